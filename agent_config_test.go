@@ -1,8 +1,11 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"netgoat.xyz/agent/internal/challenge"
 	"netgoat.xyz/agent/internal/config"
 	"netgoat.xyz/agent/internal/streaming"
 )
@@ -90,3 +93,58 @@ func TestApplyAgentConfigToConfigSkipsEmptySnapshot(t *testing.T) {
 		t.Fatalf("empty agent config should not overwrite local config: %+v", cfg.Cache)
 	}
 }
+
+func TestApplyAgentConfigChallengeKeysOnlyWhenPresent(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Challenge.Stateless = true
+	cfg.Challenge.Keys = []config.ChallengeKey{{ID: "local", Secret: "local secret 0123456789"}}
+
+	applyAgentConfigToConfig(cfg, streaming.AgentConfigData{Cache: streaming.AgentCacheConfig{Enabled: true}})
+	if !cfg.Challenge.Stateless || len(cfg.Challenge.Keys) != 1 || cfg.Challenge.Keys[0].ID != "local" {
+		t.Fatalf("agent config without keys replaced challenge config: %+v", cfg.Challenge)
+	}
+
+	applyAgentConfigToConfig(cfg, streaming.AgentConfigData{Challenge: streaming.AgentChallengeConfig{
+		Stateless: true,
+		Keys:      []streaming.AgentChallengeKey{{ID: "fleet-2", Secret: "fleet secret number two"}, {ID: "fleet-1", Secret: "fleet secret number one"}},
+	}})
+	if len(cfg.Challenge.Keys) != 2 || cfg.Challenge.Keys[0].ID != "fleet-2" {
+		t.Fatalf("challenge keys were not applied: %+v", cfg.Challenge)
+	}
+}
+
+func TestRotateChallengeKeysSharesClearanceAcrossAgents(t *testing.T) {
+	oldKey := streaming.AgentChallengeKey{ID: "v1", Secret: "first fleet secret 0123"}
+	newKey := streaming.AgentChallengeKey{ID: "v2", Secret: "second fleet secret 0123"}
+	nodeA, nodeB := challenge.NewStore(), challenge.NewStore()
+	for _, store := range []*challenge.Store{nodeA, nodeB} {
+		rotateChallengeKeys(store, streaming.AgentChallengeConfig{Keys: []streaming.AgentChallengeKey{oldKey}})
+	}
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "203.0.113.20:4000"
+		req.Header.Set("User-Agent", "curl/8.0")
+		return req
+	}
+	issued := httptest.NewRecorder()
+	setClearanceCookie(issued, newRequest(), nodeA.Clearance(), "203.0.113.20")
+	cleared := newRequest()
+	cleared.AddCookie(issued.Result().Cookies()[0])
+	if !hasClearance(cleared, nodeB.Clearance(), "203.0.113.20") {
+		t.Fatal("clearance issued by one agent rejected by another")
+	}
+
+	rotateChallengeKeys(nodeB, streaming.AgentChallengeConfig{Keys: []streaming.AgentChallengeKey{newKey, oldKey}})
+	if !hasClearance(cleared, nodeB.Clearance(), "203.0.113.20") {
+		t.Fatal("clearance rejected while the old key is still listed")
+	}
+	rotateChallengeKeys(nodeB, streaming.AgentChallengeConfig{Keys: []streaming.AgentChallengeKey{{ID: "bad", Secret: "short"}}})
+	if ids := nodeB.Clearance().Keys().IDs(); len(ids) != 2 || ids[0] != "v2" {
+		t.Fatalf("invalid keys replaced the keyring: %v", ids)
+	}
+	rotateChallengeKeys(nodeB, streaming.AgentChallengeConfig{Keys: []streaming.AgentChallengeKey{newKey}})
+	if hasClearance(cleared, nodeB.Clearance(), "203.0.113.20") {
+		t.Fatal("clearance accepted after its key was retired")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"netgoat.xyz/agent/internal/challenge"
+	"netgoat.xyz/agent/internal/config"
+	"netgoat.xyz/agent/internal/debugoverlay"
+)
+
+func TestErrorPageTemplatesOverrideAndReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	cfg := &config.Config{CustomErrorPage: write("default.html", `<html><body>default {{.Status}}</body></html>`)}
+	cfg.ErrorPages.Domain = map[string]string{"shop.example.test": write("shop.html", `<html><body>shop {{.RequestID}}</body></html>`)}
+	cfg.ErrorPages.Path = map[string]string{
+		"/admin":     write("admin.html", `<html><body>admin</body></html>`),
+		"/admin/api": write("api.html", `{{define "support"}}ticket {{.RequestID}}{{end}}`),
+	}
+	pages := buildErrorPageStore(cfg)
+	store := challenge.NewStore()
+	// A verified client is never challenged, so the error page is rendered.
+	ch := store.Create("192.0.2.1", "", 50, challenge.ChallengeText)
+	store.Verify(ch.ID, ch.Answer, "192.0.2.1")
+
+	render := func(target string) string {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "192.0.2.1:1000"
+		state := &suspicionState{analysis: &debugoverlay.AnalysisInfo{RequestID: "req-42"}}
+		rr := httptest.NewRecorder()
+		writeError(rr, pages, store, withSuspicionState(req, state), http.StatusForbidden, "Forbidden")
+		if rr.Header().Get("X-Request-Id") != "req-42" {
+			t.Fatalf("%s: X-Request-Id = %q", target, rr.Header().Get("X-Request-Id"))
+		}
+		return rr.Body.String()
+	}
+	for target, want := range map[string]string{
+		"http://other.test/":                 "default 403",
+		"http://shop.example.test/":          "shop req-42",
+		"http://shop.example.test/admin/x":   "admin",
+		"http://shop.example.test/admin/api": "ticket req-42",
+	} {
+		if got := render(target); !strings.Contains(got, want) {
+			t.Errorf("%s: page = %q, want %q", target, got, want)
+		}
+	}
+
+	write("shop.html", `<html><body>new shop page</body></html>`)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(cfg.ErrorPages.Domain["shop.example.test"], future, future); err != nil {
+		t.Fatal(err)
+	}
+	write("default.html", `{{if}}`)
+	pages.Reload()
+	if got := render("http://shop.example.test/"); !strings.Contains(got, "new shop page") {
+		t.Fatalf("shop page not reloaded: %q", got)
+	}
+	if got := render("http://other.test/"); !strings.Contains(got, "default 403") {
+		t.Fatalf("broken template should keep the previous page: %q", got)
+	}
+}
+
+func TestWriteErrorNegotiatesProblemDetails(t *testing.T) {
+	store := challenge.NewStore()
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.test/v1", nil)
+	req.RemoteAddr = "198.51.100.7:1000"
+	req.Header.Set("Accept", "application/problem+json, text/html;q=0.5")
+	req.Header.Set("User-Agent", "python-requests/2.31")
+	rr := httptest.NewRecorder()
+	writeError(rr, &errorPageStore{}, store, req, http.StatusTooManyRequests, "Too Many Requests")
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" || rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, content-type = %q", rr.Code, ct)
+	}
+	var problem challenge.Problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Status != http.StatusTooManyRequests || problem.RequestID == "" || problem.RequestID != rr.Header().Get("X-Request-Id") ||
+		problem.Challenge == nil || problem.Challenge.VerifyURL != challenge.VerifyPath {
+		t.Fatalf("problem = %+v", problem)
+	}
+}
+
+func TestNegotiateErrorFormat(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":    "text/html",
+		"*/*": "text/html",
+		"text/html,application/xhtml+xml,*/*;q=0.8":        "text/html",
+		"application/json":                                 "application/json",
+		"application/json, */*;q=0.1":                      "application/json",
+		"application/*":                                    "application/problem+json",
+		"application/problem+json;q=0.9, application/json": "application/json",
+		"text/html;q=0, application/json;q=0.1":            "application/json",
+		"image/png":                                        "text/html",
+	} {
+		if got := negotiateErrorFormat(accept); got != want {
+			t.Errorf("negotiateErrorFormat(%q) = %s, want %s", accept, got, want)
+		}
+	}
+}
+
+func TestWriteAccessibleChallengeSwapsPendingChallenge(t *testing.T) {
+	store := challenge.NewStore()
+	slider := store.Create("192.0.2.9", "agent", 85, challenge.ChallengeSlider)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com"+challenge.VerifyPath+"?alternative=accessible&challenge_id="+slider.ID, nil)
+	req.RemoteAddr = "192.0.2.9:1000"
+	req.Header.Set("Referer", "http://example.com/checkout?step=2")
+	rr := httptest.NewRecorder()
+	writeAccessibleChallenge(rr, req, &errorPageStore{}, store, slider.ID, "192.0.2.9|user:3", "192.0.2.9")
+	body := rr.Body.String()
+	if rr.Code != http.StatusForbidden || !strings.Contains(body, `<label for="answer">What is`) || !strings.Contains(body, `name="return_to" value="/checkout?step=2"`) {
+		t.Fatalf("status = %d, body = %s", rr.Code, body)
+	}
+
+	rr = httptest.NewRecorder()
+	writeAccessibleChallenge(rr, req, &errorPageStore{}, store, slider.ID, "192.0.2.9", "192.0.2.9")
+	if rr.Code != http.StatusGone {
+		t.Fatalf("reused challenge: status = %d", rr.Code)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"netgoat.xyz/agent/internal/config"
+	"netgoat.xyz/agent/internal/database"
+)
+
+func TestRouteCountryPolicies(t *testing.T) {
+	db, err := database.Init(":memory:")
+	if err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	defer db.Close()
+
+	cfg := &config.Config{}
+	cfg.Routes = map[string]config.Route{
+		"eu.example.test":  {Target: "http://127.0.0.1:9001", AllowCountries: []string{"de", "FR"}, DenyCountries: []string{"FR"}},
+		"www.example.test": {Target: "http://127.0.0.1:9002", DenyCountries: []string{"KP"}},
+		"any.example.test": {Target: "http://127.0.0.1:9003"},
+	}
+	if err := applySnapshotToDB(db, localConfigSnapshot(cfg)); err != nil {
+		t.Fatalf("applySnapshotToDB: %v", err)
+	}
+	resolver := database.NewRouteResolver()
+	if err := resolver.Reload(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		host, country string
+		want          string
+	}{
+		{"eu.example.test", "DE", ""},
+		{"eu.example.test", "FR", "FR"},
+		{"eu.example.test", "US", "US"},
+		{"eu.example.test", "", "unknown"},
+		{"www.example.test", "KP", "KP"},
+		{"www.example.test", "", ""},
+		{"www.example.test", "US", ""},
+		{"any.example.test", "KP", ""},
+	} {
+		match, err := resolver.Resolve(tc.host, "/")
+		if err != nil {
+			t.Fatalf("Resolve(%s): %v", tc.host, err)
+		}
+		country, denied := routeCountryPolicy(match, tc.country)
+		if denied != (tc.want != "") || country != tc.want {
+			t.Fatalf("%s from %q: country = %q denied = %v, want %q", tc.host, tc.country, country, denied, tc.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package challenge
+
+import (
+	"crypto/hmac"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// numberWords spell out every operand and sum of an accessible question.
+var numberWords = []string{
+	"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine",
+	"ten", "eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen",
+}
+
+// generateAccessibleQuestion asks for the sum of two numbers from one to
+// nine. The numbers are spelled out so the page, a screen reader and speech
+// synthesis all say the same thing.
+func generateAccessibleQuestion() (question, answer string) {
+	var b [2]byte
+	readRandom(b[:])
+	x, y := int(b[0])%9+1, int(b[1])%9+1
+	return "What is " + numberWords[x] + " plus " + numberWords[y] + "?", strconv.Itoa(x + y)
+}
+
+// normalizeAnswer makes text answers case- and space-insensitive, and
+// accepts accessible answers as digits or words.
+func normalizeAnswer(typ ChallengeType, answer string) string {
+	switch typ {
+	case ChallengeText:
+		return strings.ToLower(strings.TrimSpace(answer))
+	case ChallengeAccessible:
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if n := slices.Index(numberWords, answer); n >= 0 {
+			return strconv.Itoa(n)
+		}
+		return answer
+	default:
+		return answer
+	}
+}
+
+// Accessible replaces the pending challenge id, bound to binding, with an
+// accessible challenge of the same suspicion, for visitors who cannot
+// solve the original with a pointer or without JavaScript. The original is
+// dropped from the in-memory store; a stateless token just expires.
+func (s *Store) Accessible(id, binding string) (*Challenge, bool) {
+	var suspicion int
+	var userAgent string
+	if s.stateless {
+		token, ok := parseToken(s.clearance.Keys(), id)
+		if !ok || !s.now().Before(token.expiresAt) || !hmac.Equal(token.binding[:], tokenBinding(binding)) {
+			return nil, false
+		}
+		suspicion = token.suspicion
+	} else {
+		s.mu.Lock()
+		s.cleanupExpiredLocked(s.now())
+		entry, ok := s.challenges[id]
+		if !ok || entry.binding != makeBindingKey(binding) {
+			s.mu.Unlock()
+			return nil, false
+		}
+		suspicion, userAgent = entry.challenge.Suspicion, entry.challenge.UserAgent
+		s.removeChallengeLocked(entry)
+		s.mu.Unlock()
+	}
+	return s.Create(binding, userAgent, suspicion, ChallengeAccessible), true
+}
@@ -0,0 +1,86 @@
+package challenge
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessibleChallengeAcceptsDigitsAndWords(t *testing.T) {
+	store := NewStore()
+	ch := store.Create("192.0.2.7", "agent", 60, ChallengeAccessible)
+	if !strings.HasPrefix(ch.Question, "What is ") || strings.ContainsAny(ch.Question, "0123456789") {
+		t.Fatalf("question = %q; numbers should be spelled out", ch.Question)
+	}
+	sum, _ := strconv.Atoi(ch.Answer)
+	if store.Verify(ch.ID, strconv.Itoa(sum+1), "192.0.2.7") {
+		t.Fatal("wrong sum accepted")
+	}
+	if !store.Verify(ch.ID, " "+strings.ToUpper(numberWords[sum])+" ", "192.0.2.7") {
+		t.Fatal("spelled-out answer rejected")
+	}
+
+	ch = store.Create("192.0.2.8", "agent", 60, ChallengeAccessible)
+	if !store.Verify(ch.ID, ch.Answer, "192.0.2.8") {
+		t.Fatal("numeric answer rejected")
+	}
+}
+
+func TestAccessibleReplacesPendingChallenge(t *testing.T) {
+	store := NewStore()
+	slider := store.Create("198.51.100.3", "agent", 85, ChallengeSlider)
+	if _, ok := store.Accessible(slider.ID, "198.51.100.4"); ok {
+		t.Fatal("another client swapped the challenge")
+	}
+	ch, ok := store.Accessible(slider.ID, "198.51.100.3")
+	if !ok || ch.Type != ChallengeAccessible || ch.Suspicion != 85 || ch.Question == "" {
+		t.Fatalf("Accessible = %+v, %v", ch, ok)
+	}
+	if store.Verify(slider.ID, slider.Answer, "198.51.100.3") {
+		t.Fatal("the replaced challenge still verifies")
+	}
+	if !store.Verify(ch.ID, ch.Answer, "198.51.100.3") {
+		t.Fatal("accessible challenge rejected")
+	}
+
+	current := time.Unix(1_700_000_000, 0)
+	nodeA, nodeB := statelessPair(t, &current)
+	pow := nodeA.Create("203.0.113.1", "agent", 40, ChallengePoW)
+	ch, ok = nodeB.Accessible(pow.ID, "203.0.113.1")
+	if !ok || ch.Suspicion != 40 {
+		t.Fatalf("stateless Accessible = %+v, %v", ch, ok)
+	}
+	if !nodeA.Verify(ch.ID, numberWords[mustAtoi(t, ch.Answer)], "203.0.113.1") {
+		t.Fatal("stateless accessible challenge rejected")
+	}
+}
+
+func TestModesPickChallenges(t *testing.T) {
+	store := NewStore()
+	for mode, want := range map[Mode][3]ChallengeType{
+		ModeInteractive: {ChallengeText, ChallengeClick, ChallengeSlider},
+		ModePoW:         {ChallengePoW, ChallengePoW, ChallengePoW},
+		ModeManaged:     {ChallengePoW, ChallengePoW, ChallengeText},
+		ModeAccessible:  {ChallengeAccessible, ChallengeAccessible, ChallengeAccessible},
+	} {
+		store.SetMode(mode)
+		for i, suspicion := range []int{30, 60, 80} {
+			if got := store.ChallengeFor(suspicion); got != want[i] {
+				t.Errorf("%s: ChallengeFor(%d) = %s, want %s", mode, suspicion, got, want[i])
+			}
+		}
+		if got := store.ChallengeFor(10); got != ChallengeNone {
+			t.Errorf("%s: ChallengeFor(10) = %s", mode, got)
+		}
+	}
+}
+
+func mustAtoi(t *testing.T, s string) int {
+	t.Helper()
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
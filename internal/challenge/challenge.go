@@ -2,12 +2,17 @@ package challenge
 
 import (
 	"container/list"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"math/bits"
+	"slices"
 	"strings"
 	"sync"
 	"time"
+
+	"netgoat.xyz/agent/internal/tlsfp"
 )
 
 type ChallengeType string
@@ -17,6 +22,38 @@ const (
 	ChallengeText   ChallengeType = "text"
 	ChallengeClick  ChallengeType = "click"
 	ChallengeSlider ChallengeType = "slider"
+	// ChallengePoW asks the browser to find a nonce whose SHA-256 over the
+	// challenge seed starts with Difficulty zero bits. It needs no user
+	// interaction, and its answer cannot be read from the page.
+	ChallengePoW ChallengeType = "pow"
+	// ChallengeAccessible asks a spelled-out arithmetic question in plain,
+	// labelled form markup. It works with a keyboard, a screen reader and
+	// without JavaScript, and every other challenge page links to it.
+	ChallengeAccessible ChallengeType = "accessible"
+)
+
+// Mode decides which challenges the store hands out.
+type Mode string
+
+const (
+	// ModeInteractive shows the text, click and slider challenges by
+	// threshold.
+	ModeInteractive Mode = "interactive"
+	// ModePoW replaces every challenge with a proof of work.
+	ModePoW Mode = "pow"
+	// ModeManaged picks the least intrusive challenge for the score: a
+	// proof of work, which needs no interaction, below the slider
+	// threshold, and the text challenge from there on.
+	ModeManaged Mode = "managed"
+	// ModeAccessible shows the accessible challenge whenever one is due.
+	ModeAccessible Mode = "accessible"
+)
+
+// Proof-of-work difficulty bounds in leading zero bits. Each bit doubles the
+// expected work; 18 bits take around a second in a browser.
+const (
+	minPoWDifficulty = 12
+	maxPoWDifficulty = 18
 )
 
 const (
@@ -24,6 +61,7 @@ const (
 	challengeIDLength           = 22
 	defaultMaxChallenges        = 4096
 	defaultMaxVerified          = 4096
+	defaultMaxReplays           = 65536
 	defaultMaxFailedAttempts    = 5
 	defaultChallengeTTL         = 5 * time.Minute
 	defaultVerificationTTL      = time.Hour
@@ -42,6 +80,11 @@ type Challenge struct {
 	IP        string
 	UserAgent string
 	Suspicion int
+	// Question is the prompt of an accessible challenge.
+	Question string
+	// Seed and Difficulty describe a proof-of-work challenge.
+	Seed       string
+	Difficulty int
 }
 
 type bindingKey [sha256.Size]byte
@@ -59,10 +102,21 @@ type verifiedEntry struct {
 	order     *list.Element
 }
 
+// replayEntry remembers a stateless challenge token until it expires, so it
+// can be answered correctly only once and wrongly only a few times.
+type replayEntry struct {
+	nonce     [tokenNonceBytes]byte
+	expiresAt time.Time
+	failures  int
+	spent     bool
+	order     *list.Element
+}
+
 type storeConfig struct {
 	now               func() time.Time
 	maxChallenges     int
 	maxVerified       int
+	maxReplays        int
 	maxFailedAttempts int
 	challengeTTL      time.Duration
 	verificationTTL   time.Duration
@@ -77,13 +131,22 @@ type Store struct {
 	challengeOrder list.List
 	verified       map[bindingKey]*verifiedEntry
 	verifiedOrder  list.List
+	replays        map[[tokenNonceBytes]byte]*replayEntry
+	replayOrder    list.List
 
 	now               func() time.Time
 	maxChallenges     int
 	maxVerified       int
+	maxReplays        int
 	maxFailedAttempts int
 	challengeTTL      time.Duration
 	verificationTTL   time.Duration
+
+	mode       Mode
+	stateless  bool
+	clearance  *Clearance
+	pipeline   *Pipeline
+	thresholds Thresholds
 }
 
 func NewStore() *Store {
@@ -102,6 +165,9 @@ func newStore(config storeConfig) *Store {
 	if config.maxVerified <= 0 {
 		config.maxVerified = defaultMaxVerified
 	}
+	if config.maxReplays <= 0 {
+		config.maxReplays = defaultMaxReplays
+	}
 	if config.maxFailedAttempts <= 0 {
 		config.maxFailedAttempts = defaultMaxFailedAttempts
 	}
@@ -115,12 +181,113 @@ func newStore(config storeConfig) *Store {
 	return &Store{
 		challenges:        make(map[string]*challengeEntry),
 		verified:          make(map[bindingKey]*verifiedEntry),
+		replays:           make(map[[tokenNonceBytes]byte]*replayEntry),
 		now:               config.now,
 		maxChallenges:     config.maxChallenges,
 		maxVerified:       config.maxVerified,
+		maxReplays:        config.maxReplays,
 		maxFailedAttempts: config.maxFailedAttempts,
 		challengeTTL:      config.challengeTTL,
 		verificationTTL:   config.verificationTTL,
+		clearance:         NewClearance(nil, config.verificationTTL),
+		pipeline:          defaultPipeline(),
+		thresholds:        DefaultThresholds,
+		mode:              ModeInteractive,
+	}
+}
+
+// SetMode decides which challenges ChallengeFor picks; unknown modes are
+// interactive. Call it before the store is shared.
+func (s *Store) SetMode(mode Mode) {
+	switch mode {
+	case ModePoW, ModeManaged, ModeAccessible:
+		s.mode = mode
+	default:
+		s.mode = ModeInteractive
+	}
+}
+
+// SetProofOfWork switches between ModePoW and ModeInteractive.
+func (s *Store) SetProofOfWork(enabled bool) {
+	if enabled {
+		s.SetMode(ModePoW)
+	} else {
+		s.SetMode(ModeInteractive)
+	}
+}
+
+// SetClearance replaces the signer for clearance tokens. Call it before the
+// store is shared.
+func (s *Store) SetClearance(clearance *Clearance) {
+	s.clearance = clearance
+}
+
+// Clearance returns the signer for clearance tokens.
+func (s *Store) Clearance() *Clearance {
+	return s.clearance
+}
+
+// SetStateless makes challenges signed tokens that any agent holding the
+// clearance keys can verify. The store then keeps no challenges and no
+// verified clients, only replay state for tokens answered on this agent;
+// passing a challenge is proven by the clearance cookie alone. Call it
+// before the store is shared.
+func (s *Store) SetStateless(enabled bool) {
+	s.stateless = enabled
+}
+
+// Stateless reports whether challenges are signed tokens.
+func (s *Store) Stateless() bool {
+	return s.stateless
+}
+
+// SetKeyring rotates the keys that sign challenge and clearance tokens. It
+// is safe to call while the store is in use.
+func (s *Store) SetKeyring(keys *Keyring) {
+	s.clearance.SetKeys(keys)
+}
+
+// SetPipeline replaces the suspicion scoring pipeline. Call it before the
+// store is shared.
+func (s *Store) SetPipeline(pipeline *Pipeline) {
+	s.pipeline = pipeline
+}
+
+// Pipeline returns the suspicion scoring pipeline.
+func (s *Store) Pipeline() *Pipeline {
+	return s.pipeline
+}
+
+// SetThresholds replaces the agent-wide challenge thresholds; zero fields
+// keep DefaultThresholds. Call it before the store is shared.
+func (s *Store) SetThresholds(thresholds Thresholds) {
+	s.thresholds = thresholds.Or(DefaultThresholds)
+}
+
+// ChallengeFor picks the challenge for a suspicion score.
+func (s *Store) ChallengeFor(suspicion int) ChallengeType {
+	return s.ChallengeWith(suspicion, Thresholds{})
+}
+
+// ChallengeWith picks the challenge for a suspicion score, with route
+// thresholds overriding the store's where set.
+func (s *Store) ChallengeWith(suspicion int, route Thresholds) ChallengeType {
+	challengeType := route.Or(s.thresholds).Type(suspicion)
+	if challengeType == ChallengeNone {
+		return ChallengeNone
+	}
+	switch s.mode {
+	case ModePoW:
+		return ChallengePoW
+	case ModeAccessible:
+		return ChallengeAccessible
+	case ModeManaged:
+		if challengeType == ChallengeSlider {
+			return ChallengeText
+		}
+		return ChallengePoW
+	default:
+		return challengeType
 	}
 }
 
@@ -130,7 +297,19 @@ func GenerateID() string {
 	return base64.RawURLEncoding.EncodeToString(b[:])
 }
 
-func CalculateSuspicion(userAgent, ip string) int {
+// CalculateSuspicion scores a client from 0 to 100 using its User-Agent and,
+// for TLS connections, whether its ClientHello fits the browser the
+// User-Agent claims to be. fp is the zero value for plain HTTP.
+func CalculateSuspicion(userAgent, ip string, fp tlsfp.Fingerprint) int {
+	score := userAgentSuspicion(userAgent)
+	if impersonatesBrowser(strings.ToLower(userAgent), fp) {
+		score += 40
+	}
+	return min(score, 100)
+}
+
+// userAgentSuspicion scores the User-Agent on its own.
+func userAgentSuspicion(userAgent string) int {
 	score := 0
 	ua := strings.ToLower(userAgent)
 
@@ -151,22 +330,37 @@ func CalculateSuspicion(userAgent, ip string) int {
 	if strings.Count(ua, ";") > 10 || len(ua) > 300 {
 		score += 10
 	}
+	return score
+}
 
-	if score > 100 {
-		score = 100
+// impersonatesBrowser reports whether a User-Agent claiming to be a desktop
+// or mobile browser arrived with a ClientHello no current browser sends:
+// every one of them offers HTTP/2 and a dozen or more extensions, and
+// Chromium-based browsers always include GREASE values. Headless HTTP
+// libraries that copy a browser User-Agent usually fail at least one check.
+func impersonatesBrowser(ua string, fp tlsfp.Fingerprint) bool {
+	if fp.IsZero() || !strings.Contains(ua, "mozilla") {
+		return false
 	}
-	return score
+	if !strings.Contains(ua, "chrome") && !strings.Contains(ua, "firefox") && !strings.Contains(ua, "safari") {
+		return false
+	}
+	if !slices.Contains(fp.ALPN, "h2") || fp.Extensions < 10 {
+		return true
+	}
+	chromium := strings.Contains(ua, "chrome/") || strings.Contains(ua, "chromium/") || strings.Contains(ua, "edg/")
+	return chromium && !fp.GREASE
 }
 
 func DetermineChallengeType(suspicion int) ChallengeType {
-	if suspicion < 30 {
-		return ChallengeNone
-	} else if suspicion < 60 {
-		return ChallengeText
-	} else if suspicion < 80 {
-		return ChallengeClick
-	}
-	return ChallengeSlider
+	return DefaultThresholds.Type(suspicion)
+}
+
+// PoWDifficulty scales proof-of-work difficulty with suspicion, from
+// minPoWDifficulty at the challenge threshold to maxPoWDifficulty at 100.
+func PoWDifficulty(suspicion int) int {
+	suspicion = min(max(suspicion, 30), 100)
+	return minPoWDifficulty + (suspicion-30)*(maxPoWDifficulty-minPoWDifficulty)/70
 }
 
 func (s *Store) Create(ip, userAgent string, suspicion int, challengeType ChallengeType) *Challenge {
@@ -185,6 +379,18 @@ func (s *Store) Create(ip, userAgent string, suspicion int, challengeType Challe
 		challenge.Answer = generateClickAnswer()
 	case ChallengeSlider:
 		challenge.Answer = generateSliderAnswer()
+	case ChallengeAccessible:
+		challenge.Question, challenge.Answer = generateAccessibleQuestion()
+	case ChallengePoW:
+		challenge.Seed = GenerateID()
+		challenge.Difficulty = PoWDifficulty(suspicion)
+	}
+
+	if s.stateless {
+		challenge.CreatedAt = s.now()
+		challenge.ExpiresAt = challenge.CreatedAt.Add(s.challengeTTL)
+		signToken(s.clearance.Keys(), &challenge, ip)
+		return &challenge
 	}
 
 	entry := &challengeEntry{
@@ -214,6 +420,24 @@ func (s *Store) Create(ip, userAgent string, suspicion int, challengeType Challe
 }
 
 func (s *Store) Get(id string) (*Challenge, bool) {
+	if s.stateless {
+		token, ok := parseToken(s.clearance.Keys(), id)
+		if !ok || !s.now().Before(token.expiresAt) {
+			return nil, false
+		}
+		challenge := &Challenge{
+			ID:         id,
+			Type:       token.typ,
+			CreatedAt:  token.expiresAt.Add(-s.challengeTTL),
+			ExpiresAt:  token.expiresAt,
+			Suspicion:  token.suspicion,
+			Difficulty: token.difficulty,
+		}
+		if token.typ == ChallengePoW {
+			challenge.Seed = token.seed()
+		}
+		return challenge, true
+	}
 	if len(id) != challengeIDLength {
 		return nil, false
 	}
@@ -241,6 +465,9 @@ func (s *Store) Get(id string) (*Challenge, bool) {
 }
 
 func (s *Store) Verify(id, answer, ip string) bool {
+	if s.stateless {
+		return s.verifyToken(id, answer, ip)
+	}
 	binding := makeBindingKey(ip)
 
 	s.mu.Lock()
@@ -262,10 +489,12 @@ func (s *Store) Verify(id, answer, ip string) bool {
 
 	correct := false
 	switch entry.challenge.Type {
-	case ChallengeText:
-		correct = strings.EqualFold(strings.TrimSpace(answer), strings.TrimSpace(entry.challenge.Answer))
+	case ChallengeText, ChallengeAccessible:
+		correct = normalizeAnswer(entry.challenge.Type, answer) == normalizeAnswer(entry.challenge.Type, entry.challenge.Answer)
 	case ChallengeClick, ChallengeSlider:
 		correct = answer == entry.challenge.Answer
+	case ChallengePoW:
+		correct = answer != "" && leadingZeroBits(sha256.Sum256([]byte(entry.challenge.Seed+answer))) >= entry.challenge.Difficulty
 	}
 
 	if !correct {
@@ -278,6 +507,37 @@ func (s *Store) Verify(id, answer, ip string) bool {
 	return true
 }
 
+func (s *Store) verifyToken(id, answer, ip string) bool {
+	token, ok := parseToken(s.clearance.Keys(), id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.cleanupExpiredLocked(now)
+
+	if !ok || !now.Before(token.expiresAt) || !hmac.Equal(token.binding[:], tokenBinding(ip)) {
+		return false
+	}
+	entry := s.replays[token.nonce]
+	if entry != nil && (entry.spent || entry.failures >= s.maxFailedAttempts) {
+		return false
+	}
+	if entry == nil {
+		for len(s.replays) >= s.maxReplays {
+			s.removeReplayLocked(s.replayOrder.Front().Value.(*replayEntry))
+		}
+		entry = &replayEntry{nonce: token.nonce, expiresAt: token.expiresAt}
+		entry.order = s.replayOrder.PushBack(entry)
+		s.replays[token.nonce] = entry
+	}
+	if len(answer) > maxAnswerBytes || !token.accepts(answer) {
+		entry.failures++
+		return false
+	}
+	entry.spent = true
+	return true
+}
+
 func (s *Store) IsVerified(ip string) bool {
 	binding := makeBindingKey(ip)
 	s.mu.RLock()
@@ -347,6 +607,25 @@ func (s *Store) cleanupExpiredLocked(now time.Time) {
 		}
 		s.removeVerifiedLocked(entry)
 	}
+
+	// Tokens carry their own expiry, so this list is only roughly ordered;
+	// an entry behind a later one is dropped a little late.
+	for {
+		oldest := s.replayOrder.Front()
+		if oldest == nil {
+			break
+		}
+		entry := oldest.Value.(*replayEntry)
+		if now.Before(entry.expiresAt) {
+			break
+		}
+		s.removeReplayLocked(entry)
+	}
+}
+
+func (s *Store) removeReplayLocked(entry *replayEntry) {
+	delete(s.replays, entry.nonce)
+	s.replayOrder.Remove(entry.order)
 }
 
 func (s *Store) removeOldestChallengeLocked() {
@@ -385,6 +664,17 @@ func (s *Store) removeVerifiedLocked(entry *verifiedEntry) {
 	}
 }
 
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
+
 func makeBindingKey(binding string) bindingKey {
 	return sha256.Sum256([]byte(binding))
 }
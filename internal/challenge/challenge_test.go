@@ -4,6 +4,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"netgoat.xyz/agent/internal/tlsfp"
 )
 
 func TestNewStore(t *testing.T) {
@@ -113,7 +115,7 @@ func TestCalculateSuspicion(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			score := CalculateSuspicion(tt.userAgent, tt.ip)
+			score := CalculateSuspicion(tt.userAgent, tt.ip, tlsfp.Fingerprint{})
 
 			if score < tt.wantMin {
 				t.Errorf("Suspicion score = %d, want >= %d", score, tt.wantMin)
@@ -128,6 +130,35 @@ func TestCalculateSuspicion(t *testing.T) {
 	}
 }
 
+func TestCalculateSuspicionChecksTLSFingerprint(t *testing.T) {
+	const chrome = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+	browser := tlsfp.Fingerprint{JA4: "t13d1516h2_8daaf6152771_e5627efa2ab1", ALPN: []string{"h2", "http/1.1"}, GREASE: true, Extensions: 16}
+	goClient := tlsfp.Fingerprint{JA4: "t13d1312h2_f57a46bbacb6_e7c285222651", ALPN: []string{"h2", "http/1.1"}, Extensions: 12}
+	python := tlsfp.Fingerprint{JA4: "t13d4907h1_0d8feac7bc37_7395dae3b2f3", ALPN: []string{"http/1.1"}, Extensions: 7}
+
+	tests := []struct {
+		name      string
+		userAgent string
+		fp        tlsfp.Fingerprint
+		want      int
+	}{
+		{"chrome", chrome, browser, 0},
+		{"firefox without GREASE", firefox, tlsfp.Fingerprint{JA4: "t13d1715h2_5b57614c22b0_3d5424432f57", ALPN: []string{"h2"}, Extensions: 15}, 0},
+		{"plain HTTP", chrome, tlsfp.Fingerprint{}, 0},
+		{"go client claiming chrome", chrome, goClient, 40},
+		{"python claiming firefox", firefox, python, 40},
+		{"honest curl", "curl/8.5.0", python, 45},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CalculateSuspicion(tt.userAgent, "192.0.2.1", tt.fp); got != tt.want {
+				t.Fatalf("suspicion = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestDetermineChallengeType(t *testing.T) {
 	tests := []struct {
 		suspicion int
@@ -0,0 +1,96 @@
+package challenge
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ClearanceCookie is the cookie carrying a clearance token.
+const ClearanceCookie = "netgoat_clearance"
+
+// Clearance issues and checks signed tokens proving that a client solved a
+// challenge. Tokens are bound to the client IP and User-Agent, expire on
+// their own, and need no server-side state, so any agent sharing the keys
+// accepts them.
+type Clearance struct {
+	keys atomic.Pointer[Keyring]
+	ttl  time.Duration
+	now  func() time.Time
+}
+
+// NewClearance signs tokens with keys. A nil keyring selects a random key,
+// which invalidates issued tokens on restart; ttl <= 0 selects one hour.
+func NewClearance(keys *Keyring, ttl time.Duration) *Clearance {
+	if keys == nil {
+		keys = randomKeyring()
+	}
+	if ttl <= 0 {
+		ttl = defaultVerificationTTL
+	}
+	c := &Clearance{ttl: ttl, now: time.Now}
+	c.keys.Store(keys)
+	return c
+}
+
+// SetKeys swaps the keyring, for example after a rotation pushed by the
+// control plane. It is safe to call while tokens are being checked.
+func (c *Clearance) SetKeys(keys *Keyring) {
+	if keys != nil {
+		c.keys.Store(keys)
+	}
+}
+
+// Keys returns the current keyring.
+func (c *Clearance) Keys() *Keyring {
+	return c.keys.Load()
+}
+
+// TTL is how long issued tokens stay valid.
+func (c *Clearance) TTL() time.Duration {
+	return c.ttl
+}
+
+// Issue returns a token for ip and userAgent and its expiry. Tokens look
+// like "key-id.expiry.mac".
+func (c *Clearance) Issue(ip, userAgent string) (string, time.Time) {
+	key := c.Keys().signing()
+	expires := c.now().Add(c.ttl).Truncate(time.Second)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return key.ID + "." + exp + "." + base64.RawURLEncoding.EncodeToString(clearanceMAC(key.Secret, expires.Unix(), ip, userAgent)), expires
+}
+
+// Valid reports whether token was issued for ip and userAgent by a key in
+// the keyring and has not expired.
+func (c *Clearance) Valid(token, ip, userAgent string) bool {
+	if c == nil || len(token) > 160 {
+		return false
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	secret, ok := c.Keys().secret(parts[0])
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !c.now().Before(time.Unix(unix, 0)) {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, clearanceMAC(secret, unix, ip, userAgent))
+}
+
+func clearanceMAC(secret []byte, expires int64, ip, userAgent string) []byte {
+	var exp [8]byte
+	binary.BigEndian.PutUint64(exp[:], uint64(expires))
+	return tokenMAC(secret, "clearance", exp[:], []byte(ip), []byte(boundedClone(userAgent, maxStoredUserAgentBytes)))
+}
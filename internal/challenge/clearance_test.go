@@ -0,0 +1,138 @@
+package challenge
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClearanceIsBoundToClientAndExpires(t *testing.T) {
+	current := time.Unix(1_700_000_000, 0)
+	clearance := NewClearance(testKeyring(t, Key{ID: "k1", Secret: []byte("test key 0123456789")}), time.Minute)
+	clearance.now = func() time.Time { return current }
+
+	const ua = "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0"
+	token, expires := clearance.Issue("203.0.113.7", ua)
+	if !expires.Equal(current.Add(time.Minute)) {
+		t.Fatalf("expires = %v", expires)
+	}
+	if !clearance.Valid(token, "203.0.113.7", ua) {
+		t.Fatal("fresh token rejected")
+	}
+	for name, valid := range map[string]bool{
+		"other ip":    clearance.Valid(token, "203.0.113.8", ua),
+		"other agent": clearance.Valid(token, "203.0.113.7", ua+" "),
+		"tampered":    clearance.Valid(strings.Replace(token, "k1.", "k1.9", 1), "203.0.113.7", ua),
+		"garbage":     clearance.Valid("not-a-token", "203.0.113.7", ua),
+		"other key":   NewClearance(testKeyring(t, Key{ID: "k1", Secret: []byte("other key 0123456789")}), time.Minute).Valid(token, "203.0.113.7", ua),
+	} {
+		if valid {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	current = current.Add(time.Minute)
+	if clearance.Valid(token, "203.0.113.7", ua) {
+		t.Fatal("expired token accepted")
+	}
+	var none *Clearance
+	if none.Valid(token, "203.0.113.7", ua) {
+		t.Fatal("nil clearance accepted a token")
+	}
+}
+
+func TestClearanceKeyRotation(t *testing.T) {
+	oldKey := Key{ID: "2026-09", Secret: []byte("september secret value")}
+	newKey := Key{ID: "2026-10", Secret: []byte("october secret value!!")}
+	issuer := NewClearance(testKeyring(t, oldKey), time.Hour)
+	token, _ := issuer.Issue("192.0.2.1", "agent")
+
+	// Another agent already rotated: it signs with the new key but still
+	// accepts the old one.
+	rotated := NewClearance(testKeyring(t, newKey, oldKey), time.Hour)
+	if !rotated.Valid(token, "192.0.2.1", "agent") {
+		t.Fatal("token signed by the previous key rejected during rotation")
+	}
+	if fresh, _ := rotated.Issue("192.0.2.1", "agent"); !strings.HasPrefix(fresh, "2026-10.") || issuer.Valid(fresh, "192.0.2.1", "agent") {
+		t.Fatalf("rotated token %q should use the new key only", fresh)
+	}
+	issuer.SetKeys(testKeyring(t, newKey))
+	if issuer.Valid(token, "192.0.2.1", "agent") {
+		t.Fatal("token accepted after its key was retired")
+	}
+}
+
+func TestNewKeyringValidatesKeys(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	for name, keys := range map[string][]Key{
+		"empty":        nil,
+		"short secret": {{ID: "a", Secret: []byte("short")}},
+		"no id":        {{Secret: secret}},
+		"dotted id":    {{ID: "a.b", Secret: secret}},
+		"duplicate":    {{ID: "a", Secret: secret}, {ID: "a", Secret: secret}},
+	} {
+		if _, err := NewKeyring(keys...); err == nil {
+			t.Errorf("%s: keyring accepted", name)
+		}
+	}
+	ring := testKeyring(t, Key{ID: "a", Secret: secret}, Key{ID: "b_2", Secret: secret})
+	if ids := ring.IDs(); len(ids) != 2 || ids[0] != "a" {
+		t.Fatalf("IDs = %v", ids)
+	}
+}
+
+func testKeyring(t *testing.T, keys ...Key) *Keyring {
+	t.Helper()
+	ring, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestProofOfWorkChallenge(t *testing.T) {
+	store := NewStore()
+	if store.ChallengeFor(10) != ChallengeNone || store.ChallengeFor(50) != ChallengeText {
+		t.Fatal("interactive challenges should be the default")
+	}
+	store.SetProofOfWork(true)
+	if store.ChallengeFor(10) != ChallengeNone || store.ChallengeFor(90) != ChallengePoW {
+		t.Fatal("proof of work should replace interactive challenges")
+	}
+
+	ch := store.Create("198.51.100.4", "agent", 30, ChallengePoW)
+	if ch.Seed == "" || ch.Difficulty != minPoWDifficulty || ch.Answer != "" {
+		t.Fatalf("challenge = %+v", ch)
+	}
+	if page := RenderDynamicErrorPage(ch, 403, "Forbidden"); !strings.Contains(page, ch.Seed) || !strings.Contains(page, "sha256(seed + nonce)") {
+		t.Fatal("page does not carry the solver and seed")
+	}
+
+	nonce := 0
+	for leadingZeroBits(sha256.Sum256([]byte(ch.Seed+strconv.Itoa(nonce)))) < ch.Difficulty {
+		nonce++
+	}
+	wrong := nonce + 1
+	for leadingZeroBits(sha256.Sum256([]byte(ch.Seed+strconv.Itoa(wrong)))) >= ch.Difficulty {
+		wrong++
+	}
+	if store.Verify(ch.ID, strconv.Itoa(wrong), "198.51.100.4") {
+		t.Fatal("insufficient work accepted")
+	}
+	if store.Verify(ch.ID, strconv.Itoa(nonce), "198.51.100.5") {
+		t.Fatal("solution accepted from another client")
+	}
+	if !store.Verify(ch.ID, strconv.Itoa(nonce), "198.51.100.4") {
+		t.Fatal("valid solution rejected")
+	}
+}
+
+func TestPoWDifficultyScalesWithSuspicion(t *testing.T) {
+	for suspicion, want := range map[int]int{0: minPoWDifficulty, 30: minPoWDifficulty, 65: 15, 100: maxPoWDifficulty, 150: maxPoWDifficulty} {
+		if got := PoWDifficulty(suspicion); got != want {
+			t.Errorf("PoWDifficulty(%d) = %d, want %d", suspicion, got, want)
+		}
+	}
+}
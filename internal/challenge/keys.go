@@ -0,0 +1,111 @@
+package challenge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	maxKeyIDBytes  = 32
+	minSecretBytes = 16
+	localKeyID     = "local"
+)
+
+// Key is one HMAC secret for challenge and clearance tokens. Tokens name the
+// key that signed them, so agents can accept old tokens during a rotation.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring signs with its first key and verifies with any of them. To rotate,
+// put the new key first on every agent, and remove the old one once the
+// tokens it signed have expired.
+type Keyring struct {
+	keys []Key
+}
+
+// NewKeyring validates keys and returns a keyring that signs with keys[0].
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("challenge: keyring needs at least one key")
+	}
+	seen := make(map[string]bool, len(keys))
+	ring := &Keyring{keys: make([]Key, 0, len(keys))}
+	for _, key := range keys {
+		if !validKeyID(key.ID) {
+			return nil, fmt.Errorf("challenge: key id %q must be 1-%d letters, digits, '-' or '_'", key.ID, maxKeyIDBytes)
+		}
+		if len(key.Secret) < minSecretBytes {
+			return nil, fmt.Errorf("challenge: key %q secret must be at least %d bytes", key.ID, minSecretBytes)
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("challenge: duplicate key id %q", key.ID)
+		}
+		seen[key.ID] = true
+		ring.keys = append(ring.keys, Key{ID: key.ID, Secret: append([]byte(nil), key.Secret...)})
+	}
+	return ring, nil
+}
+
+// randomKeyring returns a single random key known only to this process.
+func randomKeyring() *Keyring {
+	secret := make([]byte, 32)
+	readRandom(secret)
+	return &Keyring{keys: []Key{{ID: localKeyID, Secret: secret}}}
+}
+
+// IDs lists the key ids, signing key first.
+func (k *Keyring) IDs() []string {
+	ids := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		ids[i] = key.ID
+	}
+	return ids
+}
+
+func (k *Keyring) signing() Key {
+	return k.keys[0]
+}
+
+func (k *Keyring) secret(id string) ([]byte, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key.Secret, true
+		}
+	}
+	return nil, false
+}
+
+func validKeyID(id string) bool {
+	if id == "" || len(id) > maxKeyIDBytes {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if !isAlphanumeric(c) && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// tokenMAC authenticates parts under secret. purpose keeps one kind of token
+// from ever verifying as another, and length prefixes keep ("a", "bc") and
+// ("ab", "c") apart.
+func tokenMAC(secret []byte, purpose string, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range append([][]byte{[]byte(purpose)}, parts...) {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(part)))
+		mac.Write(size[:])
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
@@ -1,30 +1,161 @@
 package challenge
 
 import (
-	"fmt"
+	"bytes"
 	"html/template"
+	"io"
+	"net/http"
+	"text/template/parse"
 )
 
-// RenderDynamicErrorPage generates HTML with embedded challenge
-func RenderDynamicErrorPage(ch *Challenge, status int, message string) string {
-	if ch == nil || ch.Type == ChallengeNone {
-		return renderSimpleError(status, message)
+// VerifyPath is where challenge pages post their answers.
+const VerifyPath = "/__netgoat/verify"
+
+// Page is the data a page template renders.
+type Page struct {
+	Status  int
+	Title   string
+	Message string
+	// RequestID identifies the request in the agent's logs, so visitors can
+	// quote it to support.
+	RequestID   string
+	ClientIP    string
+	BlockReason string
+	// Challenge is nil for a plain error page.
+	Challenge *Challenge
+	VerifyURL string
+	// ReturnTo is where the visitor goes after passing an accessible
+	// challenge, which is not served from the page they asked for.
+	ReturnTo string
+}
+
+// NewPage describes an error or challenge page; ch may be nil.
+func NewPage(ch *Challenge, status int, message string) Page {
+	if ch != nil && ch.Type == ChallengeNone {
+		ch = nil
 	}
+	return Page{Status: status, Title: http.StatusText(status), Message: message, Challenge: ch, VerifyURL: VerifyPath}
+}
 
-	switch ch.Type {
-	case ChallengeText:
-		return renderTextChallenge(ch, status, message)
-	case ChallengeClick:
-		return renderClickChallenge(ch, status, message)
-	case ChallengeSlider:
-		return renderSliderChallenge(ch, status, message)
+// template picks the template for the page: "error", or "challenge_" and
+// the challenge type.
+func (p Page) template() string {
+	if p.Challenge == nil {
+		return "error"
+	}
+	switch p.Challenge.Type {
+	case ChallengeText, ChallengeClick, ChallengeSlider, ChallengePoW, ChallengeAccessible:
+		return "challenge_" + string(p.Challenge.Type)
 	default:
-		return renderSimpleError(status, message)
+		return "error"
+	}
+}
+
+// Problem is an RFC 9457 problem details document.
+type Problem struct {
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	Status    int               `json:"status"`
+	Detail    string            `json:"detail,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Challenge *ProblemChallenge `json:"challenge,omitempty"`
+}
+
+// ProblemChallenge tells API clients how to answer a challenge. Only the
+// text and accessible prompts and the proof-of-work parameters can be
+// solved without the page.
+type ProblemChallenge struct {
+	ID         string        `json:"id"`
+	Type       ChallengeType `json:"type"`
+	VerifyURL  string        `json:"verify_url"`
+	Prompt     string        `json:"prompt,omitempty"`
+	Seed       string        `json:"seed,omitempty"`
+	Difficulty int           `json:"difficulty,omitempty"`
+}
+
+// Problem describes the page as problem details. The block reason is left
+// out; it only reaches templates, which the operator controls.
+func (p Page) Problem() Problem {
+	problem := Problem{Type: "about:blank", Title: p.Title, Status: p.Status, Detail: p.Message, RequestID: p.RequestID}
+	if ch := p.Challenge; ch != nil {
+		problem.Challenge = &ProblemChallenge{ID: ch.ID, Type: ch.Type, VerifyURL: p.VerifyURL, Seed: ch.Seed, Difficulty: ch.Difficulty}
+		switch ch.Type {
+		case ChallengeText:
+			problem.Challenge.Prompt = ch.Answer
+		case ChallengeAccessible:
+			problem.Challenge.Prompt = ch.Question
+		}
+	}
+	return problem
+}
+
+// Templates is a set of page templates. Besides the pages ("error",
+// "challenge_text", "challenge_click", "challenge_slider", "challenge_pow"
+// and "challenge_accessible"), every default page includes "theme" in its
+// head, empty by default, and "support", which shows the request ID. The
+// challenges that need a pointer or JavaScript include "accessible_link".
+type Templates struct {
+	set *template.Template
+}
+
+// basePages is never executed, so it can still be cloned.
+var (
+	basePages    = template.Must(template.New("error").Parse(builtinPages))
+	defaultPages = &Templates{set: template.Must(basePages.Clone())}
+)
+
+// DefaultTemplates returns the built-in pages.
+func DefaultTemplates() *Templates {
+	return defaultPages
+}
+
+// ParseTemplates layers text over the built-in pages. Definitions in text
+// replace the templates of the same name, and anything outside a
+// definition replaces the "error" page, so a plain HTML file still works as
+// an error page.
+func ParseTemplates(text string) (*Templates, error) {
+	set, err := basePages.Clone()
+	if err != nil {
+		return nil, err
 	}
+	override, err := set.New("override").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// A file of definitions only keeps the built-in error page.
+	if override.Tree != nil && !parse.IsEmptyTree(override.Tree.Root) {
+		if _, err := set.AddParseTree("error", override.Tree); err != nil {
+			return nil, err
+		}
+	}
+	return &Templates{set: set}, nil
+}
+
+// Render writes the page. Nothing is written if the template fails.
+func (t *Templates) Render(w io.Writer, p Page) error {
+	var buf bytes.Buffer
+	if err := t.set.ExecuteTemplate(&buf, p.template(), p); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
 }
 
-func renderSimpleError(status int, message string) string {
-	return fmt.Sprintf(`<!DOCTYPE html>
+// RenderDynamicErrorPage renders the built-in page for a challenge, or a
+// plain error page when ch is nil.
+func RenderDynamicErrorPage(ch *Challenge, status int, message string) string {
+	var buf bytes.Buffer
+	_ = DefaultTemplates().Render(&buf, NewPage(ch, status, message))
+	return buf.String()
+}
+
+const builtinPages = `{{define "theme"}}{{end}}
+
+{{define "support"}}{{if .RequestID}}<p class="support">Reference ID: <code>{{.RequestID}}</code></p>{{end}}{{end}}
+
+{{define "accessible_link"}}<p class="alternative"><a href="{{.VerifyURL}}?alternative=accessible&amp;challenge_id={{.Challenge.ID}}">Use an accessible challenge instead</a></p>{{end}}
+
+{{define "error"}}<!DOCTYPE html>
 <html lang="en">
 <head>
   <meta charset="utf-8"/>
@@ -32,25 +163,26 @@ func renderSimpleError(status int, message string) string {
   <title>Request Blocked</title>
   <style>
     :root { color-scheme: light dark; }
-    body { margin: 0; font: 16px/1.4 system-ui, sans-serif; display: grid; place-items: center; min-height: 100vh; background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%); }
+    body { margin: 0; font: 16px/1.4 system-ui, sans-serif; display: grid; place-items: center; min-height: 100vh; background: linear-gradient(135deg, #667eea 0%, #764ba2 100%); }
     .card { max-width: 500px; padding: 32px; background: white; border-radius: 16px; box-shadow: 0 20px 60px rgba(0,0,0,0.3); }
     h1 { margin: 0 0 12px; font-size: 24px; color: #333; }
     p { margin: 0 0 12px; color: #666; }
     code { background: #f5f5f5; padding: 2px 6px; border-radius: 4px; font-size: 14px; }
+    .support { font-size: 12px; color: #999; }
   </style>
+  {{template "theme" .}}
 </head>
 <body>
   <div class="card">
     <h1>🚫 Request Blocked</h1>
-    <p>%s</p>
-    <p>Status: <code>%d</code></p>
+    <p>{{.Message}}</p>
+    <p>Status: <code>{{.Status}}</code></p>
+    {{template "support" .}}
   </div>
 </body>
-</html>`, template.HTMLEscapeString(message), status)
-}
+</html>{{end}}
 
-func renderTextChallenge(ch *Challenge, status int, message string) string {
-	return fmt.Sprintf(`<!DOCTYPE html>
+{{define "challenge_text"}}<!DOCTYPE html>
 <html lang="en">
 <head>
   <meta charset="utf-8"/>
@@ -58,40 +190,41 @@ func renderTextChallenge(ch *Challenge, status int, message string) string {
   <title>Verification Required</title>
   <style>
     :root { color-scheme: light dark; }
-    body { margin: 0; font: 16px/1.4 system-ui, sans-serif; display: grid; place-items: center; min-height: 100vh; background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%); }
+    body { margin: 0; font: 16px/1.4 system-ui, sans-serif; display: grid; place-items: center; min-height: 100vh; background: linear-gradient(135deg, #667eea 0%, #764ba2 100%); }
     .card { max-width: 520px; padding: 40px; background: white; border-radius: 16px; box-shadow: 0 20px 60px rgba(0,0,0,0.3); }
     h1 { margin: 0 0 8px; font-size: 24px; color: #333; }
     .bot-id { font-size: 11px; color: #999; font-family: monospace; margin-bottom: 16px; }
     .challenge { margin: 24px 0; padding: 20px; background: #f8f9fa; border-radius: 8px; border-left: 4px solid #667eea; }
     .word { display: inline-block; padding: 8px 16px; margin: 4px; background: white; border: 2px solid #667eea; border-radius: 8px; font-size: 20px; font-weight: bold; letter-spacing: 3px; color: #667eea; }
-    input { width: 100%%; padding: 12px; font-size: 16px; border: 2px solid #ddd; border-radius: 8px; box-sizing: border-box; margin-top: 12px; }
-    button { width: 100%%; padding: 12px; background: #667eea; color: white; border: none; border-radius: 8px; font-size: 16px; font-weight: 600; cursor: pointer; margin-top: 12px; }
+    input { width: 100%; padding: 12px; font-size: 16px; border: 2px solid #ddd; border-radius: 8px; box-sizing: border-box; margin-top: 12px; }
+    button { width: 100%; padding: 12px; background: #667eea; color: white; border: none; border-radius: 8px; font-size: 16px; font-weight: 600; cursor: pointer; margin-top: 12px; }
     button:hover { background: #5568d3; }
-    .suspicion { font-size: 12px; color: #999; margin-top: 12px; }
+    .suspicion, .support { font-size: 12px; color: #999; margin-top: 12px; }
+    .alternative { font-size: 14px; margin-top: 12px; }
   </style>
+  {{template "theme" .}}
 </head>
 <body>
   <div class="card">
     <h1>🤖 Verification Required</h1>
-    <div class="bot-id">Bot ID: %s</div>
+    <div class="bot-id">Bot ID: {{.Challenge.ID}}</div>
     <p style="color: #666; margin-bottom: 8px;">Your request was flagged by our security system.</p>
     <div class="challenge">
-      <p style="margin: 0 0 12px; font-weight: 600; color: #333;">Type the word shown below:</p>
-      <div class="word">%s</div>
+      <p style="margin: 0 0 12px; font-weight: 600; color: #333;" id="prompt">Type the word shown below:</p>
+      <div class="word" id="word">{{.Challenge.Answer}}</div>
     </div>
-    <form method="POST" action="/__netgoat/verify">
-      <input type="hidden" name="challenge_id" value="%s"/>
-      <input type="text" name="answer" placeholder="Enter the word" autocomplete="off" autofocus required/>
+    <form method="POST" action="{{.VerifyURL}}">
+      <input type="hidden" name="challenge_id" value="{{.Challenge.ID}}"/>
+      <input type="text" name="answer" placeholder="Enter the word" aria-labelledby="prompt word" autocomplete="off" autofocus required/>
       <button type="submit">Verify</button>
     </form>
-    <div class="suspicion">Suspicion Score: %d/100 | Status: %d</div>
+    <div class="suspicion">Suspicion Score: {{.Challenge.Suspicion}}/100 | Status: {{.Status}}</div>
+    {{template "support" .}}
   </div>
 </body>
-</html>`, ch.ID, ch.Answer, ch.ID, ch.Suspicion, status)
-}
+</html>{{end}}
 
-func renderClickChallenge(ch *Challenge, status int, message string) string {
-	return fmt.Sprintf(`<!DOCTYPE html>
+{{define "challenge_click"}}<!DOCTYPE html>
 <html lang="en">
 <head>
   <meta charset="utf-8"/>
@@ -99,7 +232,7 @@ func renderClickChallenge(ch *Challenge, status int, message string) string {
   <title>Verification Required</title>
   <style>
     :root { color-scheme: light dark; }
-    body { margin: 0; font: 16px/1.4 system-ui, sans-serif; display: grid; place-items: center; min-height: 100vh; background: linear-gradient(135deg, #f093fb 0%%, #f5576c 100%%); }
+    body { margin: 0; font: 16px/1.4 system-ui, sans-serif; display: grid; place-items: center; min-height: 100vh; background: linear-gradient(135deg, #f093fb 0%, #f5576c 100%); }
     .card { max-width: 520px; padding: 40px; background: white; border-radius: 16px; box-shadow: 0 20px 60px rgba(0,0,0,0.3); }
     h1 { margin: 0 0 8px; font-size: 24px; color: #333; }
     .bot-id { font-size: 11px; color: #999; font-family: monospace; margin-bottom: 16px; }
@@ -108,32 +241,37 @@ func renderClickChallenge(ch *Challenge, status int, message string) string {
     .box { aspect-ratio: 1; background: #f8f9fa; border: 3px solid #ddd; border-radius: 8px; cursor: pointer; display: flex; align-items: center; justify-content: center; font-size: 32px; transition: all 0.2s; }
     .box:hover { border-color: #f5576c; transform: scale(1.05); }
     .box.selected { background: #f5576c; border-color: #f5576c; color: white; }
-    button { width: 100%%; padding: 12px; background: #f5576c; color: white; border: none; border-radius: 8px; font-size: 16px; font-weight: 600; cursor: pointer; margin-top: 16px; }
+    button { width: 100%; padding: 12px; background: #f5576c; color: white; border: none; border-radius: 8px; font-size: 16px; font-weight: 600; cursor: pointer; margin-top: 16px; }
     button:hover { background: #e04858; }
-    .suspicion { font-size: 12px; color: #999; margin-top: 12px; }
+    .suspicion, .support { font-size: 12px; color: #999; margin-top: 12px; }
+    .alternative { font-size: 14px; margin-top: 12px; }
   </style>
+  {{template "theme" .}}
 </head>
 <body>
   <div class="card">
     <h1>🎯 Click Verification</h1>
-    <div class="bot-id">Bot ID: %s</div>
+    <div class="bot-id">Bot ID: {{.Challenge.ID}}</div>
     <p style="color: #666; margin-bottom: 8px;">Select all boxes containing <strong>🚀</strong></p>
     <div class="challenge">
       <div class="grid" id="grid"></div>
     </div>
-    <form method="POST" action="/__netgoat/verify" id="verifyForm">
-      <input type="hidden" name="challenge_id" value="%s"/>
+    <form method="POST" action="{{.VerifyURL}}" id="verifyForm">
+      <input type="hidden" name="challenge_id" value="{{.Challenge.ID}}"/>
       <input type="hidden" name="answer" id="answer" value=""/>
       <button type="submit">Verify Selection</button>
     </form>
-    <div class="suspicion">Suspicion Score: %d/100 | Status: %d</div>
+    <noscript><p style="color: #c00;">This puzzle needs JavaScript.</p></noscript>
+    {{template "accessible_link" .}}
+    <div class="suspicion">Suspicion Score: {{.Challenge.Suspicion}}/100 | Status: {{.Status}}</div>
+    {{template "support" .}}
   </div>
   <script>
-    const correct = "%s".split(",").map(x => parseInt(x));
+    const correct = {{.Challenge.Answer}}.split(",").map(x => parseInt(x));
     const selected = new Set();
     const grid = document.getElementById("grid");
     const emojis = ["🌟", "🎈", "🎨", "🎭", "🎪", "🎬", "🎮", "🎯", "🎲"];
-    
+
     for (let i = 0; i < 9; i++) {
       const box = document.createElement("div");
       box.className = "box";
@@ -152,11 +290,9 @@ func renderClickChallenge(ch *Challenge, status int, message string) string {
     }
   </script>
 </body>
-</html>`, ch.ID, ch.ID, ch.Suspicion, status, ch.Answer)
-}
+</html>{{end}}
 
-func renderSliderChallenge(ch *Challenge, status int, message string) string {
-	return fmt.Sprintf(`<!DOCTYPE html>
+{{define "challenge_slider"}}<!DOCTYPE html>
 <html lang="en">
 <head>
   <meta charset="utf-8"/>
@@ -164,24 +300,26 @@ func renderSliderChallenge(ch *Challenge, status int, message string) string {
   <title>Verification Required</title>
   <style>
     :root { color-scheme: light dark; }
-    body { margin: 0; font: 16px/1.4 system-ui, sans-serif; display: grid; place-items: center; min-height: 100vh; background: linear-gradient(135deg, #fa709a 0%%, #fee140 100%%); }
+    body { margin: 0; font: 16px/1.4 system-ui, sans-serif; display: grid; place-items: center; min-height: 100vh; background: linear-gradient(135deg, #fa709a 0%, #fee140 100%); }
     .card { max-width: 520px; padding: 40px; background: white; border-radius: 16px; box-shadow: 0 20px 60px rgba(0,0,0,0.3); }
     h1 { margin: 0 0 8px; font-size: 24px; color: #333; }
     .bot-id { font-size: 11px; color: #999; font-family: monospace; margin-bottom: 16px; }
     .challenge { margin: 24px 0; }
-    .puzzle-container { position: relative; width: 100%%; height: 200px; background: linear-gradient(90deg, #fa709a 0%%, #fee140 100%%); border-radius: 12px; overflow: hidden; }
+    .puzzle-container { position: relative; width: 100%; height: 200px; background: linear-gradient(90deg, #fa709a 0%, #fee140 100%); border-radius: 12px; overflow: hidden; }
     .puzzle-piece { position: absolute; width: 60px; height: 60px; background: white; border: 3px solid #333; border-radius: 8px; cursor: grab; box-shadow: 0 4px 12px rgba(0,0,0,0.2); display: flex; align-items: center; justify-content: center; font-size: 24px; }
     .puzzle-piece:active { cursor: grabbing; }
     .target-zone { position: absolute; right: 20px; top: 70px; width: 70px; height: 70px; border: 3px dashed #333; border-radius: 8px; background: rgba(255,255,255,0.3); }
-    button { width: 100%%; padding: 12px; background: #fa709a; color: white; border: none; border-radius: 8px; font-size: 16px; font-weight: 600; cursor: pointer; margin-top: 16px; }
+    button { width: 100%; padding: 12px; background: #fa709a; color: white; border: none; border-radius: 8px; font-size: 16px; font-weight: 600; cursor: pointer; margin-top: 16px; }
     button:hover { background: #e8638a; }
-    .suspicion { font-size: 12px; color: #999; margin-top: 12px; }
+    .suspicion, .support { font-size: 12px; color: #999; margin-top: 12px; }
+    .alternative { font-size: 14px; margin-top: 12px; }
   </style>
+  {{template "theme" .}}
 </head>
 <body>
   <div class="card">
     <h1>🧩 Puzzle Verification</h1>
-    <div class="bot-id">Bot ID: %s</div>
+    <div class="bot-id">Bot ID: {{.Challenge.ID}}</div>
     <p style="color: #666; margin-bottom: 8px;">Drag the puzzle piece to the target zone</p>
     <div class="challenge">
       <div class="puzzle-container">
@@ -189,23 +327,26 @@ func renderSliderChallenge(ch *Challenge, status int, message string) string {
         <div class="puzzle-piece" id="piece" style="left: 20px; top: 70px;">🔒</div>
       </div>
     </div>
-    <form method="POST" action="/__netgoat/verify" id="verifyForm">
-      <input type="hidden" name="challenge_id" value="%s"/>
+    <form method="POST" action="{{.VerifyURL}}" id="verifyForm">
+      <input type="hidden" name="challenge_id" value="{{.Challenge.ID}}"/>
       <input type="hidden" name="answer" id="answer" value=""/>
       <button type="submit">Verify</button>
     </form>
-    <div class="suspicion">Suspicion Score: %d/100 | Status: %d</div>
+    <noscript><p style="color: #c00;">This puzzle needs JavaScript.</p></noscript>
+    {{template "accessible_link" .}}
+    <div class="suspicion">Suspicion Score: {{.Challenge.Suspicion}}/100 | Status: {{.Status}}</div>
+    {{template "support" .}}
   </div>
   <script>
     const piece = document.getElementById("piece");
-    const target = "%s";
+    const target = {{.Challenge.Answer}};
     let solved = false;
-    
+
     piece.onmousedown = (e) => {
       e.preventDefault();
       const shiftX = e.clientX - piece.getBoundingClientRect().left;
       const shiftY = e.clientY - piece.getBoundingClientRect().top;
-      
+
       const move = (e) => {
         const container = piece.parentElement.getBoundingClientRect();
         let x = e.clientX - container.left - shiftX;
@@ -214,7 +355,7 @@ func renderSliderChallenge(ch *Challenge, status int, message string) string {
         y = Math.max(0, Math.min(y, container.height - 60));
         piece.style.left = x + "px";
         piece.style.top = y + "px";
-        
+
         // Check if close to target (right side)
         if (x > container.width - 100 && y > 50 && y < 110) {
           piece.style.background = "#4ade80";
@@ -228,16 +369,155 @@ func renderSliderChallenge(ch *Challenge, status int, message string) string {
           document.getElementById("answer").value = "";
         }
       };
-      
+
       const up = () => {
         document.removeEventListener("mousemove", move);
         document.removeEventListener("mouseup", up);
       };
-      
+
       document.addEventListener("mousemove", move);
       document.addEventListener("mouseup", up);
     };
   </script>
 </body>
-</html>`, ch.ID, ch.ID, ch.Suspicion, status, ch.Answer)
-}
+</html>{{end}}
+
+{{define "challenge_accessible"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8"/>
+  <meta name="viewport" content="width=device-width, initial-scale=1"/>
+  <title>Verification Required</title>
+  <style>
+    :root { color-scheme: light dark; }
+    body { margin: 0; font: 18px/1.5 system-ui, sans-serif; display: grid; place-items: center; min-height: 100vh; background: #1f2937; }
+    main { max-width: 520px; padding: 40px; background: white; color: #111; border-radius: 16px; }
+    h1 { margin: 0 0 12px; font-size: 26px; }
+    label { display: block; margin: 24px 0 8px; font-size: 22px; font-weight: 700; }
+    .hint { margin: 0 0 8px; color: #374151; }
+    input { width: 100%; padding: 12px; font-size: 20px; border: 2px solid #111; border-radius: 8px; box-sizing: border-box; }
+    button { width: 100%; padding: 12px; background: #1d4ed8; color: white; border: none; border-radius: 8px; font-size: 18px; font-weight: 600; cursor: pointer; margin-top: 12px; }
+    button.secondary { background: white; color: #1d4ed8; border: 2px solid #1d4ed8; }
+    input:focus, button:focus, a:focus { outline: 3px solid #f59e0b; outline-offset: 2px; }
+    .support { font-size: 14px; color: #374151; margin-top: 16px; }
+  </style>
+  {{template "theme" .}}
+</head>
+<body>
+  <main aria-labelledby="title">
+    <h1 id="title">Verification Required</h1>
+    <p>Please answer one question to show you are a person.</p>
+    <form method="POST" action="{{.VerifyURL}}">
+      <input type="hidden" name="challenge_id" value="{{.Challenge.ID}}"/>
+      <input type="hidden" name="return_to" value="{{.ReturnTo}}"/>
+      <label for="answer">{{.Challenge.Question}}</label>
+      <p class="hint" id="hint">Answer with a number, such as 12 or twelve.</p>
+      <input type="text" id="answer" name="answer" inputmode="numeric" autocomplete="off" aria-describedby="hint" autofocus required/>
+      <button type="button" class="secondary" id="listen" hidden>Read the question aloud</button>
+      <button type="submit">Verify</button>
+    </form>
+    {{template "support" .}}
+  </main>
+  <script>
+    if ("speechSynthesis" in window) {
+      const listen = document.getElementById("listen");
+      listen.hidden = false;
+      listen.onclick = () => speechSynthesis.speak(new SpeechSynthesisUtterance({{.Challenge.Question}}));
+    }
+  </script>
+</body>
+</html>{{end}}
+
+{{define "challenge_pow"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8"/>
+  <meta name="viewport" content="width=device-width, initial-scale=1"/>
+  <title>Checking your browser</title>
+  <style>
+    :root { color-scheme: light dark; }
+    body { margin: 0; font: 16px/1.4 system-ui, sans-serif; display: grid; place-items: center; min-height: 100vh; background: linear-gradient(135deg, #43cea2 0%, #185a9d 100%); }
+    .card { max-width: 520px; padding: 40px; background: white; border-radius: 16px; box-shadow: 0 20px 60px rgba(0,0,0,0.3); }
+    h1 { margin: 0 0 8px; font-size: 24px; color: #333; }
+    .bot-id { font-size: 11px; color: #999; font-family: monospace; margin-bottom: 16px; }
+    .progress { height: 8px; background: #eee; border-radius: 4px; overflow: hidden; margin: 20px 0; }
+    .bar { height: 100%; width: 0; background: #185a9d; transition: width 0.2s; }
+    .suspicion, .support { font-size: 12px; color: #999; margin-top: 12px; }
+    .alternative { font-size: 14px; margin-top: 12px; }
+  </style>
+  {{template "theme" .}}
+</head>
+<body>
+  <div class="card">
+    <h1>🛡️ Checking your browser</h1>
+    <div class="bot-id">Bot ID: {{.Challenge.ID}}</div>
+    <p style="color: #666;" id="status">This takes a moment and happens automatically.</p>
+    <noscript><p style="color: #c00;">This check needs JavaScript.</p>{{template "accessible_link" .}}</noscript>
+    <div class="progress"><div class="bar" id="bar"></div></div>
+    <form method="POST" action="{{.VerifyURL}}" id="verifyForm">
+      <input type="hidden" name="challenge_id" value="{{.Challenge.ID}}"/>
+      <input type="hidden" name="answer" id="answer" value=""/>
+    </form>
+    <div class="suspicion">Suspicion Score: {{.Challenge.Suspicion}}/100 | Status: {{.Status}}</div>
+    {{template "support" .}}
+  </div>
+  <script>
+` + powSolverScript + `
+    const seed = {{.Challenge.Seed}}, difficulty = {{.Challenge.Difficulty}}, expected = Math.pow(2, difficulty);
+    let nonce = 0;
+    function work() {
+      for (const stop = nonce + 5000; nonce < stop; nonce++) {
+        if (zeroBits(sha256(seed + nonce)) >= difficulty) {
+          document.getElementById("bar").style.width = "100%";
+          document.getElementById("answer").value = String(nonce);
+          document.getElementById("verifyForm").submit();
+          return;
+        }
+      }
+      document.getElementById("bar").style.width = Math.min(95, 100 * nonce / expected) + "%";
+      setTimeout(work, 0);
+    }
+    work();
+  </script>
+</body>
+</html>{{end}}`
+
+// powSolverScript defines sha256(ascii) returning the eight state words and
+// zeroBits(words). It is plain JavaScript because crypto.subtle is missing
+// on insecure origins and too slow per call for a nonce search.
+const powSolverScript = `
+    const K = [0x428a2f98,0x71374491,0xb5c0fbcf,0xe9b5dba5,0x3956c25b,0x59f111f1,0x923f82a4,0xab1c5ed5,0xd807aa98,0x12835b01,0x243185be,0x550c7dc3,0x72be5d74,0x80deb1fe,0x9bdc06a7,0xc19bf174,0xe49b69c1,0xefbe4786,0x0fc19dc6,0x240ca1cc,0x2de92c6f,0x4a7484aa,0x5cb0a9dc,0x76f988da,0x983e5152,0xa831c66d,0xb00327c8,0xbf597fc7,0xc6e00bf3,0xd5a79147,0x06ca6351,0x14292967,0x27b70a85,0x2e1b2138,0x4d2c6dfc,0x53380d13,0x650a7354,0x766a0abb,0x81c2c92e,0x92722c85,0xa2bfe8a1,0xa81a664b,0xc24b8b70,0xc76c51a3,0xd192e819,0xd6990624,0xf40e3585,0x106aa070,0x19a4c116,0x1e376c08,0x2748774c,0x34b0bcb5,0x391c0cb3,0x4ed8aa4a,0x5b9cca4f,0x682e6ff3,0x748f82ee,0x78a5636f,0x84c87814,0x8cc70208,0x90befffa,0xa4506ceb,0xbef9a3f7,0xc67178f2];
+    const ror = (x, n) => (x >>> n) | (x << (32 - n));
+    // sha256 hashes an ASCII string and returns the eight state words.
+    function sha256(s) {
+      const n = s.length, blocks = ((n + 8) >> 6) + 1, w = new Array(blocks * 16).fill(0), m = new Array(64);
+      for (let i = 0; i < n; i++) w[i >> 2] |= s.charCodeAt(i) << (24 - (i % 4) * 8);
+      w[n >> 2] |= 0x80 << (24 - (n % 4) * 8);
+      w[blocks * 16 - 1] = n * 8;
+      const h = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+      for (let b = 0; b < blocks; b++) {
+        for (let t = 0; t < 64; t++) {
+          if (t < 16) { m[t] = w[b * 16 + t]; continue; }
+          const x = m[t - 15], y = m[t - 2];
+          m[t] = (m[t - 16] + (ror(x, 7) ^ ror(x, 18) ^ (x >>> 3)) + m[t - 7] + (ror(y, 17) ^ ror(y, 19) ^ (y >>> 10))) | 0;
+        }
+        let [a, c1, c2, c3, e, f, g, k] = h;
+        for (let t = 0; t < 64; t++) {
+          const t1 = (k + (ror(e, 6) ^ ror(e, 11) ^ ror(e, 25)) + ((e & f) ^ (~e & g)) + K[t] + m[t]) | 0;
+          const t2 = ((ror(a, 2) ^ ror(a, 13) ^ ror(a, 22)) + ((a & c1) ^ (a & c2) ^ (c1 & c2))) | 0;
+          k = g; g = f; f = e; e = (c3 + t1) | 0; c3 = c2; c2 = c1; c1 = a; a = (t1 + t2) | 0;
+        }
+        [a, c1, c2, c3, e, f, g, k].forEach((v, i) => { h[i] = (h[i] + v) | 0; });
+      }
+      return h;
+    }
+    function zeroBits(h) {
+      let bits = 0;
+      for (const word of h) {
+        const z = Math.clz32(word);
+        bits += z;
+        if (z < 32) break;
+      }
+      return bits;
+    }
+`
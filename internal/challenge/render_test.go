@@ -0,0 +1,122 @@
+package challenge
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func renderPage(t *testing.T, templates *Templates, page Page) string {
+	t.Helper()
+	var b strings.Builder
+	if err := templates.Render(&b, page); err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	return b.String()
+}
+
+func TestDefaultTemplatesRenderEveryPage(t *testing.T) {
+	store := NewStore()
+	for _, typ := range []ChallengeType{ChallengeText, ChallengeClick, ChallengeSlider, ChallengePoW, ChallengeAccessible} {
+		ch := store.Create("192.0.2.1", "agent", 50, typ)
+		page := NewPage(ch, 403, "Forbidden")
+		page.RequestID = "req-123"
+		html := renderPage(t, DefaultTemplates(), page)
+		if !strings.Contains(html, `value="`+ch.ID+`"`) || !strings.Contains(html, "Reference ID: <code>req-123</code>") {
+			t.Errorf("%s page lacks the challenge ID or reference ID", typ)
+		}
+	}
+
+	page := NewPage(nil, 502, `<script>alert(1)</script>`)
+	html := renderPage(t, DefaultTemplates(), page)
+	if strings.Contains(html, "<script>alert") || !strings.Contains(html, "&lt;script&gt;") {
+		t.Fatal("message was not escaped")
+	}
+	if strings.Contains(html, "Reference ID") {
+		t.Fatal("reference shown without a request ID")
+	}
+}
+
+func TestChallengePagesOfferAccessibleAlternative(t *testing.T) {
+	store := NewStore()
+	for typ, inNoscript := range map[ChallengeType]bool{ChallengeClick: false, ChallengeSlider: false, ChallengePoW: true} {
+		ch := store.Create("192.0.2.1", "agent", 50, typ)
+		html := renderPage(t, DefaultTemplates(), NewPage(ch, 403, "Forbidden"))
+		link := `href="/__netgoat/verify?alternative=accessible&amp;challenge_id=` + ch.ID + `"`
+		if !strings.Contains(html, link) {
+			t.Errorf("%s page has no accessible alternative", typ)
+		}
+		noscript := html[strings.Index(html, "<noscript>"):strings.Index(html, "</noscript>")]
+		if strings.Contains(noscript, link) != inNoscript {
+			t.Errorf("%s: link inside noscript = %v", typ, !inNoscript)
+		}
+	}
+
+	ch := store.Create("192.0.2.1", "agent", 50, ChallengeAccessible)
+	page := NewPage(ch, 403, "Forbidden")
+	page.ReturnTo = "/account?tab=1"
+	html := renderPage(t, DefaultTemplates(), page)
+	for _, want := range []string{`<label for="answer">` + ch.Question + `</label>`, `aria-describedby="hint"`, `name="return_to" value="/account?tab=1"`, `<html lang="en">`} {
+		if !strings.Contains(html, want) {
+			t.Errorf("accessible page lacks %s", want)
+		}
+	}
+	if strings.Contains(html, ch.Answer+"<") {
+		t.Fatal("accessible page reveals the answer")
+	}
+}
+
+func TestParseTemplatesOverridesPagesAndBlocks(t *testing.T) {
+	plain, err := ParseTemplates(`<html><body>Acme says {{.Status}}: {{.Message}} (ref {{.RequestID}}, {{.BlockReason}})</body></html>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := NewPage(nil, 403, "Forbidden")
+	page.RequestID, page.BlockReason = "abc", "rate limit exceeded"
+	if got := renderPage(t, plain, page); got != "<html><body>Acme says 403: Forbidden (ref abc, rate limit exceeded)</body></html>" {
+		t.Fatalf("plain page = %q", got)
+	}
+	ch := NewStore().Create("192.0.2.1", "agent", 50, ChallengeText)
+	if got := renderPage(t, plain, NewPage(ch, 403, "Forbidden")); !strings.Contains(got, "Verification Required") {
+		t.Fatal("a plain error page should keep the built-in challenges")
+	}
+
+	themed, err := ParseTemplates(`
+{{define "theme"}}<style>.card { background: #123456; }</style>{{end}}
+{{define "support"}}<p>Quote {{.RequestID}} to Acme support.</p>{{end}}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := renderPage(t, themed, page)
+	if !strings.Contains(got, "Request Blocked") || !strings.Contains(got, "#123456") || !strings.Contains(got, "Quote abc to Acme support.") {
+		t.Fatalf("themed page = %s", got)
+	}
+	if strings.Contains(renderPage(t, DefaultTemplates(), page), "#123456") {
+		t.Fatal("override leaked into the default templates")
+	}
+
+	if _, err := ParseTemplates(`{{if}}`); err == nil {
+		t.Fatal("broken template accepted")
+	}
+}
+
+func TestPageProblem(t *testing.T) {
+	ch := NewStore().Create("192.0.2.1", "agent", 50, ChallengeText)
+	page := NewPage(ch, 429, "Too Many Requests")
+	page.RequestID, page.BlockReason = "r1", "rate limit exceeded"
+	body, err := json.Marshal(page.Problem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	_ = json.Unmarshal(body, &got)
+	challenge, _ := got["challenge"].(map[string]any)
+	if got["type"] != "about:blank" || got["title"] != "Too Many Requests" || got["status"] != 429.0 || got["request_id"] != "r1" ||
+		challenge["id"] != ch.ID || challenge["prompt"] != ch.Answer || challenge["verify_url"] != VerifyPath {
+		t.Fatalf("problem = %s", body)
+	}
+	if strings.Contains(string(body), "rate limit exceeded") {
+		t.Fatal("problem details disclose the block reason")
+	}
+}
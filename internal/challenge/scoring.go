@@ -0,0 +1,267 @@
+package challenge
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"netgoat.xyz/agent/internal/tlsfp"
+)
+
+// Built-in suspicion signals, by the names used for their weights.
+const (
+	SignalUserAgent      = "user_agent"
+	SignalTLS            = "tls"
+	SignalHeaders        = "headers"
+	SignalAcceptLanguage = "accept_language"
+	SignalRate           = "rate"
+	SignalClassifiers    = "classifiers"
+	SignalReputation     = "reputation"
+)
+
+// DefaultWeights reproduce CalculateSuspicion for the User-Agent and TLS
+// signals. The header signals together stay below the first challenge
+// threshold, so a browser is never challenged for its headers alone.
+var DefaultWeights = map[string]float64{
+	SignalUserAgent:      1,
+	SignalTLS:            0.4,
+	SignalHeaders:        0.15,
+	SignalAcceptLanguage: 0.1,
+	SignalRate:           0.3,
+	SignalClassifiers:    0.5,
+	SignalReputation:     0.5,
+}
+
+// Signals is what the pipeline knows about a request.
+type Signals struct {
+	IP          string
+	UserAgent   string
+	Header      http.Header
+	Fingerprint tlsfp.Fingerprint
+	// RateUsage is the share of the client's rate-limit burst in use, from 0
+	// to 1, or 0 without a rate limiter.
+	RateUsage float64
+	// Classifiers holds the scores, from 0 to 1, of the classifiers that
+	// already ran on the request, by name.
+	Classifiers map[string]float64
+}
+
+// Scorer rates one aspect of a request from 0 (nothing suspicious) to 100.
+type Scorer interface {
+	Score(Signals) int
+}
+
+// ScorerFunc adapts a function to Scorer.
+type ScorerFunc func(Signals) int
+
+func (f ScorerFunc) Score(s Signals) int {
+	return f(s)
+}
+
+// Component is one signal's share of a suspicion score.
+type Component struct {
+	Signal string  `json:"signal"`
+	Score  int     `json:"score"`
+	Weight float64 `json:"weight"`
+	// Points is Score times Weight, rounded; the total adds these up.
+	Points int `json:"points"`
+}
+
+// Breakdown is a suspicion score and how it was reached.
+type Breakdown struct {
+	Total      int         `json:"total"`
+	Components []Component `json:"components"`
+}
+
+// Points maps each signal that contributed to its points.
+func (b Breakdown) Points() map[string]int {
+	points := make(map[string]int, len(b.Components))
+	for _, c := range b.Components {
+		if c.Points != 0 {
+			points[c.Signal] = c.Points
+		}
+	}
+	return points
+}
+
+type weightedScorer struct {
+	name   string
+	weight float64
+	scorer Scorer
+}
+
+// Pipeline adds up weighted scorers into a suspicion score from 0 to 100.
+type Pipeline struct {
+	scorers []weightedScorer
+}
+
+// NewPipeline builds a pipeline of the built-in signals. weights overrides
+// DefaultWeights by signal name, and a zero weight drops the signal.
+// reputation reports which reputation lists contain a client IP; nil
+// disables that signal.
+func NewPipeline(weights map[string]float64, reputation func(ip string) []string) (*Pipeline, error) {
+	builtin := map[string]Scorer{
+		SignalUserAgent:      ScorerFunc(scoreUserAgent),
+		SignalTLS:            ScorerFunc(scoreTLS),
+		SignalHeaders:        ScorerFunc(scoreHeaders),
+		SignalAcceptLanguage: ScorerFunc(scoreAcceptLanguage),
+		SignalRate:           ScorerFunc(scoreRate),
+		SignalClassifiers:    ScorerFunc(scoreClassifiers),
+		SignalReputation:     reputationScorer(reputation),
+	}
+	for name, weight := range weights {
+		if _, ok := builtin[name]; !ok {
+			return nil, fmt.Errorf("challenge: unknown suspicion signal %q", name)
+		}
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("challenge: signal %q has invalid weight %v", name, weight)
+		}
+	}
+
+	names := make([]string, 0, len(builtin))
+	for name := range builtin {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	p := &Pipeline{}
+	for _, name := range names {
+		weight, ok := weights[name]
+		if !ok {
+			weight = DefaultWeights[name]
+		}
+		p.Use(name, weight, builtin[name])
+	}
+	return p, nil
+}
+
+// Use adds a scorer, replacing any of the same name. A zero weight removes
+// it.
+func (p *Pipeline) Use(name string, weight float64, scorer Scorer) {
+	p.scorers = slices.DeleteFunc(p.scorers, func(w weightedScorer) bool { return w.name == name })
+	if weight > 0 && scorer != nil {
+		p.scorers = append(p.scorers, weightedScorer{name: name, weight: weight, scorer: scorer})
+	}
+}
+
+// Score runs every scorer and caps the sum of their points at 100.
+func (p *Pipeline) Score(s Signals) Breakdown {
+	var b Breakdown
+	for _, w := range p.scorers {
+		score := min(max(w.scorer.Score(s), 0), 100)
+		points := int(math.Round(float64(score) * w.weight))
+		b.Components = append(b.Components, Component{Signal: w.name, Score: score, Weight: w.weight, Points: points})
+		b.Total += points
+	}
+	b.Total = min(b.Total, 100)
+	return b
+}
+
+func scoreUserAgent(s Signals) int {
+	return userAgentSuspicion(s.UserAgent)
+}
+
+func scoreTLS(s Signals) int {
+	if impersonatesBrowser(strings.ToLower(s.UserAgent), s.Fingerprint) {
+		return 100
+	}
+	return 0
+}
+
+// scoreHeaders checks for headers every browser sends. net/http does not
+// keep header order, so only presence and consistency are scored.
+func scoreHeaders(s Signals) int {
+	score := 0
+	if s.Header.Get("Accept") == "" {
+		score += 40
+	}
+	if s.Header.Get("Accept-Encoding") == "" {
+		score += 30
+	}
+	// Chromium has sent fetch metadata since version 76; a Chrome
+	// User-Agent without it is another client wearing the name.
+	ua := strings.ToLower(s.UserAgent)
+	if strings.Contains(ua, "chrome/") && s.Header.Get("Sec-Fetch-Mode") == "" {
+		score += 30
+	}
+	return score
+}
+
+func scoreAcceptLanguage(s Signals) int {
+	if s.Header.Get("Accept-Language") == "" {
+		return 100
+	}
+	return 0
+}
+
+func scoreRate(s Signals) int {
+	return int(math.Round(s.RateUsage * 100))
+}
+
+// scoreClassifiers takes the most confident classifier's score.
+func scoreClassifiers(s Signals) int {
+	highest := 0.0
+	for _, score := range s.Classifiers {
+		highest = max(highest, score)
+	}
+	return int(math.Round(highest * 100))
+}
+
+func defaultPipeline() *Pipeline {
+	p, _ := NewPipeline(nil, nil)
+	return p
+}
+
+func reputationScorer(lookup func(ip string) []string) Scorer {
+	if lookup == nil {
+		return nil
+	}
+	return ScorerFunc(func(s Signals) int {
+		if len(lookup(s.IP)) > 0 {
+			return 100
+		}
+		return 0
+	})
+}
+
+// Thresholds are the suspicion scores from which each challenge is shown.
+// Zero fields fall back to another set with Or.
+type Thresholds struct {
+	Text   int
+	Click  int
+	Slider int
+}
+
+// DefaultThresholds are the thresholds used by DetermineChallengeType.
+var DefaultThresholds = Thresholds{Text: 30, Click: 60, Slider: 80}
+
+// Or fills the zero fields of t from fallback.
+func (t Thresholds) Or(fallback Thresholds) Thresholds {
+	if t.Text <= 0 {
+		t.Text = fallback.Text
+	}
+	if t.Click <= 0 {
+		t.Click = fallback.Click
+	}
+	if t.Slider <= 0 {
+		t.Slider = fallback.Slider
+	}
+	return t
+}
+
+// Type picks the challenge for a suspicion score.
+func (t Thresholds) Type(suspicion int) ChallengeType {
+	t = t.Or(DefaultThresholds)
+	switch {
+	case suspicion >= t.Slider:
+		return ChallengeSlider
+	case suspicion >= t.Click:
+		return ChallengeClick
+	case suspicion >= t.Text:
+		return ChallengeText
+	default:
+		return ChallengeNone
+	}
+}
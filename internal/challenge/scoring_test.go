@@ -0,0 +1,110 @@
+package challenge
+
+import (
+	"net/http"
+	"testing"
+
+	"netgoat.xyz/agent/internal/tlsfp"
+)
+
+func browserHeader() http.Header {
+	return http.Header{
+		"Accept":          {"text/html"},
+		"Accept-Encoding": {"gzip, br"},
+		"Accept-Language": {"en-GB"},
+		"Sec-Fetch-Mode":  {"navigate"},
+	}
+}
+
+func TestDefaultPipelineMatchesCalculateSuspicion(t *testing.T) {
+	pipeline, err := NewPipeline(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	libraryHello := tlsfp.Fingerprint{JA4: "t13i0907h1_x_y", ALPN: []string{"http/1.1"}, Extensions: 7}
+	for _, tc := range []struct {
+		ua string
+		fp tlsfp.Fingerprint
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/126.0 Safari/537.36", tlsfp.Fingerprint{}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/126.0 Safari/537.36", libraryHello},
+		{"python-requests/2.31", tlsfp.Fingerprint{}},
+		{"", tlsfp.Fingerprint{}},
+	} {
+		got := pipeline.Score(Signals{UserAgent: tc.ua, Header: browserHeader(), Fingerprint: tc.fp})
+		if want := CalculateSuspicion(tc.ua, "", tc.fp); got.Total != want {
+			t.Errorf("%q: pipeline = %d (%v), CalculateSuspicion = %d", tc.ua, got.Total, got.Points(), want)
+		}
+	}
+}
+
+func TestPipelineWeighsEachSignal(t *testing.T) {
+	reputation := func(ip string) []string {
+		if ip == "192.0.2.66" {
+			return []string{"tor-exits"}
+		}
+		return nil
+	}
+	pipeline, err := NewPipeline(map[string]float64{SignalUserAgent: 0, SignalAcceptLanguage: 0.2}, reputation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breakdown := pipeline.Score(Signals{
+		IP:          "192.0.2.66",
+		UserAgent:   "curl/8.0",
+		Header:      http.Header{"Accept": {"*/*"}},
+		RateUsage:   0.5,
+		Classifiers: map[string]float64{"koda_waf": 0.2, "koda_2": 0.6},
+	})
+	want := map[string]int{
+		SignalHeaders:        5,  // 30 for Accept-Encoding at 0.15
+		SignalAcceptLanguage: 20, // 100 at 0.2
+		SignalRate:           15, // 50 at 0.3
+		SignalClassifiers:    30, // the higher classifier, 60 at 0.5
+		SignalReputation:     50,
+	}
+	got := breakdown.Points()
+	if len(got) != len(want) {
+		t.Fatalf("points = %v, want %v", got, want)
+	}
+	for signal, points := range want {
+		if got[signal] != points {
+			t.Errorf("%s = %d, want %d", signal, got[signal], points)
+		}
+	}
+	if breakdown.Total != 100 {
+		t.Fatalf("total = %d, want the 120 points capped at 100", breakdown.Total)
+	}
+
+	pipeline.Use("custom", 1, ScorerFunc(func(Signals) int { return 250 }))
+	if b := pipeline.Score(Signals{Header: browserHeader()}); b.Points()["custom"] != 100 {
+		t.Fatalf("custom scorer points = %v; scores should be clamped to 100", b.Points())
+	}
+
+	for _, weights := range []map[string]float64{{"nope": 1}, {SignalRate: -1}} {
+		if _, err := NewPipeline(weights, nil); err == nil {
+			t.Errorf("NewPipeline(%v) accepted", weights)
+		}
+	}
+}
+
+func TestThresholdsPickChallenges(t *testing.T) {
+	route := Thresholds{Text: 50}
+	for suspicion, want := range map[int]ChallengeType{29: ChallengeNone, 49: ChallengeNone, 50: ChallengeText, 60: ChallengeClick, 80: ChallengeSlider} {
+		if got := route.Type(suspicion); got != want {
+			t.Errorf("Type(%d) = %s, want %s", suspicion, got, want)
+		}
+	}
+
+	store := NewStore()
+	store.SetThresholds(Thresholds{Text: 20, Click: 90, Slider: 95})
+	if store.ChallengeFor(25) != ChallengeText || store.ChallengeFor(85) != ChallengeText {
+		t.Fatal("store thresholds were not applied")
+	}
+	if got := store.ChallengeWith(25, route); got != ChallengeNone {
+		t.Fatalf("route threshold ignored: %s", got)
+	}
+	if got := store.ChallengeWith(92, route); got != ChallengeClick {
+		t.Fatalf("route should inherit the store's click threshold: %s", got)
+	}
+}
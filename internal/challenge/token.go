@@ -0,0 +1,127 @@
+package challenge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Stateless challenges travel as their own ID: "key-id.payload.mac", where
+// the payload carries everything Verify needs. The answer itself is only
+// present as a keyed commitment, so the token does not reveal it.
+const (
+	tokenVersion      = 1
+	tokenNonceBytes   = 16
+	tokenBindingBytes = 16
+	tokenAnswerBytes  = 16
+	tokenPayloadBytes = 1 + 8 + tokenNonceBytes + tokenBindingBytes + 3 + tokenAnswerBytes
+	maxTokenBytes     = 192
+)
+
+// tokenTypes numbers challenge types inside tokens; the code is the index
+// plus one.
+var tokenTypes = []ChallengeType{ChallengeText, ChallengeClick, ChallengeSlider, ChallengePoW, ChallengeAccessible}
+
+type challengeToken struct {
+	nonce      [tokenNonceBytes]byte
+	binding    [tokenBindingBytes]byte
+	answer     [tokenAnswerBytes]byte
+	expiresAt  time.Time
+	typ        ChallengeType
+	suspicion  int
+	difficulty int
+	secret     []byte
+}
+
+// seed is the proof-of-work seed derived from the token nonce.
+func (t challengeToken) seed() string {
+	return base64.RawURLEncoding.EncodeToString(t.nonce[:])
+}
+
+func (t challengeToken) accepts(answer string) bool {
+	if t.typ == ChallengePoW {
+		return answer != "" && leadingZeroBits(sha256.Sum256([]byte(t.seed()+answer))) >= t.difficulty
+	}
+	return hmac.Equal(answerCommitment(t.secret, t.nonce[:], t.typ, answer), t.answer[:])
+}
+
+// signToken fills in a stateless challenge's ID and seed. The expiry is
+// rounded down to whole seconds.
+func signToken(keys *Keyring, challenge *Challenge, binding string) {
+	key := keys.signing()
+	var nonce [tokenNonceBytes]byte
+	readRandom(nonce[:])
+	challenge.ExpiresAt = challenge.ExpiresAt.Truncate(time.Second)
+	if challenge.Type == ChallengePoW {
+		challenge.Seed = base64.RawURLEncoding.EncodeToString(nonce[:])
+	}
+
+	payload := make([]byte, 0, tokenPayloadBytes)
+	payload = append(payload, tokenVersion)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(challenge.ExpiresAt.Unix()))
+	payload = append(payload, nonce[:]...)
+	payload = append(payload, tokenBinding(binding)...)
+	payload = append(payload, byte(slices.Index(tokenTypes, challenge.Type)+1), byte(min(max(challenge.Suspicion, 0), 255)), byte(challenge.Difficulty))
+	if challenge.Type == ChallengePoW {
+		payload = append(payload, make([]byte, tokenAnswerBytes)...)
+	} else {
+		payload = append(payload, answerCommitment(key.Secret, nonce[:], challenge.Type, challenge.Answer)...)
+	}
+
+	challenge.ID = key.ID + "." + base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(tokenMAC(key.Secret, "challenge", payload))
+}
+
+// parseToken authenticates a stateless challenge ID. It does not check the
+// expiry, the binding or the answer.
+func parseToken(keys *Keyring, id string) (challengeToken, bool) {
+	if len(id) > maxTokenBytes {
+		return challengeToken{}, false
+	}
+	parts := strings.Split(id, ".")
+	if len(parts) != 3 {
+		return challengeToken{}, false
+	}
+	secret, ok := keys.secret(parts[0])
+	if !ok {
+		return challengeToken{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(payload) != tokenPayloadBytes || payload[0] != tokenVersion {
+		return challengeToken{}, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(mac, tokenMAC(secret, "challenge", payload)) {
+		return challengeToken{}, false
+	}
+
+	token := challengeToken{secret: secret}
+	rest := payload[1:]
+	token.expiresAt = time.Unix(int64(binary.BigEndian.Uint64(rest)), 0)
+	rest = rest[8:]
+	rest = rest[copy(token.nonce[:], rest):]
+	rest = rest[copy(token.binding[:], rest):]
+	code, suspicion, difficulty := int(rest[0]), int(rest[1]), int(rest[2])
+	if code < 1 || code > len(tokenTypes) {
+		return challengeToken{}, false
+	}
+	token.typ, token.suspicion, token.difficulty = tokenTypes[code-1], suspicion, difficulty
+	copy(token.answer[:], rest[3:])
+	return token, true
+}
+
+func tokenBinding(binding string) []byte {
+	sum := makeBindingKey(binding)
+	return sum[:tokenBindingBytes]
+}
+
+// answerCommitment binds an answer to a token so Verify can check it
+// without the answer appearing in the token. Answers are normalized as in
+// the in-memory store.
+func answerCommitment(secret, nonce []byte, typ ChallengeType, answer string) []byte {
+	return tokenMAC(secret, "answer", nonce, []byte(normalizeAnswer(typ, answer)))[:tokenAnswerBytes]
+}
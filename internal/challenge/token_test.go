@@ -0,0 +1,140 @@
+package challenge
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statelessPair returns two stateless stores sharing keys and a clock, as
+// two agents of a fleet would.
+func statelessPair(t *testing.T, current *time.Time) (*Store, *Store) {
+	t.Helper()
+	keys := testKeyring(t, Key{ID: "fleet", Secret: []byte("shared fleet secret")})
+	stores := make([]*Store, 2)
+	for i := range stores {
+		stores[i] = newStore(storeConfig{now: func() time.Time { return *current }, maxFailedAttempts: 2})
+		stores[i].SetStateless(true)
+		stores[i].SetKeyring(keys)
+	}
+	return stores[0], stores[1]
+}
+
+func TestStatelessChallengeVerifiesOnAnotherAgent(t *testing.T) {
+	current := time.Unix(1_700_000_000, 0)
+	nodeA, nodeB := statelessPair(t, &current)
+
+	ch := nodeA.Create("203.0.113.9", "agent", 50, ChallengeText)
+	if challengeCount(nodeA) != 0 {
+		t.Fatal("stateless store kept the challenge")
+	}
+	if strings.Contains(ch.ID, ch.Answer) {
+		t.Fatal("token reveals the answer")
+	}
+	got, ok := nodeB.Get(ch.ID)
+	if !ok || got.Type != ChallengeText || got.Suspicion != 50 || got.Answer != "" || !got.ExpiresAt.Equal(ch.ExpiresAt) {
+		t.Fatalf("Get = %+v, %v", got, ok)
+	}
+
+	if nodeB.Verify(ch.ID, ch.Answer, "203.0.113.10") {
+		t.Fatal("answer accepted from another client")
+	}
+	if !nodeB.Verify(ch.ID, "  "+strings.ToUpper(ch.Answer)+" ", "203.0.113.9") {
+		t.Fatal("answer rejected on another agent")
+	}
+	if nodeB.Verify(ch.ID, ch.Answer, "203.0.113.9") {
+		t.Fatal("token replayed on the agent that verified it")
+	}
+	if nodeB.IsVerified("203.0.113.9") {
+		t.Fatal("stateless store should leave verification to the clearance cookie")
+	}
+	if replayCount(nodeB) != 1 {
+		t.Fatalf("replay entries = %d, want 1", replayCount(nodeB))
+	}
+
+	current = current.Add(defaultChallengeTTL)
+	nodeB.Verify("", "", "")
+	if replayCount(nodeB) != 0 {
+		t.Fatal("replay state outlived the token")
+	}
+	if nodeA.Verify(ch.ID, ch.Answer, "203.0.113.9") {
+		t.Fatal("expired token accepted")
+	}
+}
+
+func TestStatelessChallengeLimitsGuessesAndRejectsForgeries(t *testing.T) {
+	current := time.Unix(1_700_000_000, 0)
+	store, _ := statelessPair(t, &current)
+
+	ch := store.Create("198.51.100.1", "agent", 70, ChallengeClick)
+	for i := 0; i < 2; i++ {
+		if store.Verify(ch.ID, "wrong", "198.51.100.1") {
+			t.Fatal("wrong answer accepted")
+		}
+	}
+	if store.Verify(ch.ID, ch.Answer, "198.51.100.1") {
+		t.Fatal("correct answer accepted after too many failures")
+	}
+
+	ch = store.Create("198.51.100.1", "agent", 70, ChallengeClick)
+	parts := strings.Split(ch.ID, ".")
+	payload := []byte(parts[1])
+	payload[len(payload)-1] ^= 1
+	for name, id := range map[string]string{
+		"tampered payload": parts[0] + "." + string(payload) + "." + parts[2],
+		"unknown key":      "other." + parts[1] + "." + parts[2],
+		"stateful id":      GenerateID(),
+		"oversized":        ch.ID + strings.Repeat("A", maxTokenBytes),
+	} {
+		if store.Verify(id, ch.Answer, "198.51.100.1") {
+			t.Errorf("%s: accepted", name)
+		}
+		if _, ok := store.Get(id); ok {
+			t.Errorf("%s: Get succeeded", name)
+		}
+	}
+
+	other := NewStore()
+	other.SetStateless(true)
+	if other.Verify(ch.ID, ch.Answer, "198.51.100.1") {
+		t.Fatal("token accepted by an agent without the shared key")
+	}
+}
+
+func TestStatelessProofOfWork(t *testing.T) {
+	current := time.Unix(1_700_000_000, 0)
+	nodeA, nodeB := statelessPair(t, &current)
+
+	ch := nodeA.Create("192.0.2.50", "agent", 30, ChallengePoW)
+	if got, ok := nodeB.Get(ch.ID); !ok || got.Seed != ch.Seed || got.Difficulty != minPoWDifficulty {
+		t.Fatalf("Get = %+v, %v", got, ok)
+	}
+	nonce := 0
+	for leadingZeroBits(sha256.Sum256([]byte(ch.Seed+strconv.Itoa(nonce)))) < ch.Difficulty {
+		nonce++
+	}
+	if !nodeB.Verify(ch.ID, strconv.Itoa(nonce), "192.0.2.50") {
+		t.Fatal("valid solution rejected")
+	}
+}
+
+func TestStatelessStoreBoundsReplayState(t *testing.T) {
+	current := time.Unix(1_700_000_000, 0)
+	store := newStore(storeConfig{now: func() time.Time { return current }, maxReplays: 2})
+	store.SetStateless(true)
+	for i := 0; i < 3; i++ {
+		ch := store.Create("192.0.2.1", "agent", 50, ChallengeText)
+		store.Verify(ch.ID, ch.Answer, "192.0.2.1")
+	}
+	if got := replayCount(store); got != 2 {
+		t.Fatalf("replay entries = %d, want 2", got)
+	}
+}
+
+func replayCount(store *Store) int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return len(store.replays)
+}
@@ -39,27 +39,49 @@ func New(trustedProxies []string) (*Resolver, error) {
 	return resolver, nil
 }
 
+// Result describes how a request's client address was established.
+type Result struct {
+	// ClientIP is the resolved client address, as returned by ClientIP.
+	ClientIP string
+	// PeerIP is the direct socket peer.
+	PeerIP string
+	// Chain lists the verified forwarding chain from ClientIP to the direct
+	// peer: ClientIP followed by the trusted proxies that forwarded the
+	// request. Addresses the client put before its own are never included,
+	// since it can forge them. Without a trusted peer, well-formed headers
+	// and an untrusted address in them, Chain holds just the peer.
+	Chain []string
+}
+
 // ClientIP returns the request's client IP. Forwarding headers are considered
 // only when the direct socket peer is trusted. A malformed or contradictory
 // chain fails closed to the direct peer address.
 func (r *Resolver) ClientIP(req *http.Request) string {
+	return r.Resolve(req).ClientIP
+}
+
+// Resolve returns the client address together with the direct peer and the
+// verified forwarding chain between them, using the same rules as ClientIP.
+func (r *Resolver) Resolve(req *http.Request) Result {
 	if req == nil {
-		return ""
+		return Result{}
 	}
 
 	peer, ok := parseAddress(req.RemoteAddr)
 	if !ok {
-		return strings.TrimSpace(req.RemoteAddr)
+		raw := strings.TrimSpace(req.RemoteAddr)
+		return Result{ClientIP: raw, PeerIP: raw, Chain: []string{raw}}
 	}
 	peerText := peer.String()
+	direct := Result{ClientIP: peerText, PeerIP: peerText, Chain: []string{peerText}}
 	if r == nil || !r.isTrusted(peer) {
-		return peerText
+		return direct
 	}
 
 	forwardedValues := req.Header.Values("Forwarded")
 	xffValues := req.Header.Values("X-Forwarded-For")
 	if len(forwardedValues) == 0 && len(xffValues) == 0 {
-		return peerText
+		return direct
 	}
 
 	var chain []netip.Addr
@@ -67,29 +89,35 @@ func (r *Resolver) ClientIP(req *http.Request) string {
 		var err error
 		chain, err = parseForwarded(forwardedValues)
 		if err != nil {
-			return peerText
+			return direct
 		}
 	}
 	if len(xffValues) > 0 {
 		xffChain, err := parseXForwardedFor(xffValues)
 		if err != nil {
-			return peerText
+			return direct
 		}
 		if chain != nil && !sameChain(chain, xffChain) {
-			return peerText
+			return direct
 		}
 		chain = xffChain
 	}
 
 	for i := len(chain) - 1; i >= 0; i-- {
-		if !r.isTrusted(chain[i]) {
-			return chain[i].String()
+		if r.isTrusted(chain[i]) {
+			continue
+		}
+		result := Result{ClientIP: chain[i].String(), PeerIP: peerText, Chain: make([]string, 0, len(chain)-i+1)}
+		for _, addr := range chain[i:] {
+			result.Chain = append(result.Chain, addr.String())
 		}
+		result.Chain = append(result.Chain, peerText)
+		return result
 	}
 
 	// A valid proxy chain must eventually identify an address outside the
 	// trusted proxy set. If it does not, no client address was established.
-	return peerText
+	return direct
 }
 
 func (r *Resolver) isTrusted(addr netip.Addr) bool {
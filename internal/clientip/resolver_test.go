@@ -210,3 +210,39 @@ func mustResolver(t *testing.T, trusted ...string) *Resolver {
 	}
 	return resolver
 }
+
+func TestResolveReportsPeerAndValidatedChain(t *testing.T) {
+	resolver := mustResolver(t, "10.0.0.0/8")
+
+	trusted := requestFrom("10.0.0.2:443")
+	trusted.Header.Set("X-Forwarded-For", "198.51.100.66, 203.0.113.9, 10.1.1.1")
+	got := resolver.Resolve(trusted)
+	if got.ClientIP != "203.0.113.9" || got.PeerIP != "10.0.0.2" {
+		t.Fatalf("Resolve client/peer = %q/%q", got.ClientIP, got.PeerIP)
+	}
+	// 198.51.100.66 came from the client and could be forged.
+	if want := "203.0.113.9,10.1.1.1,10.0.0.2"; strings.Join(got.Chain, ",") != want {
+		t.Fatalf("Chain = %v, want %s", got.Chain, want)
+	}
+
+	onlyTrusted := requestFrom("10.0.0.2:443")
+	onlyTrusted.Header.Set("X-Forwarded-For", "10.0.0.5, 10.1.1.1")
+	got = resolver.Resolve(onlyTrusted)
+	if got.ClientIP != "10.0.0.2" || len(got.Chain) != 1 || got.Chain[0] != "10.0.0.2" {
+		t.Fatalf("a chain of trusted addresses should not be exposed: %+v", got)
+	}
+
+	untrusted := requestFrom("203.0.113.10:4321")
+	untrusted.Header.Set("X-Forwarded-For", "198.51.100.1")
+	got = resolver.Resolve(untrusted)
+	if got.ClientIP != "203.0.113.10" || got.PeerIP != "203.0.113.10" || len(got.Chain) != 1 || got.Chain[0] != "203.0.113.10" {
+		t.Fatalf("untrusted peer should not expose forwarded addresses: %+v", got)
+	}
+
+	malformed := requestFrom("10.0.0.2:443")
+	malformed.Header.Set("X-Forwarded-For", "198.51.100.1, not-an-ip")
+	got = resolver.Resolve(malformed)
+	if got.ClientIP != "10.0.0.2" || len(got.Chain) != 1 {
+		t.Fatalf("malformed chain should fail closed to the peer: %+v", got)
+	}
+}
@@ -25,7 +25,21 @@ type Config struct {
 		KeyFile  string `yaml:"key_file"`
 		Port     string `yaml:"port"`
 	} `yaml:"ssl"`
-	// Path to a static HTML file to serve for errors (e.g., 403/404/500)
+	// WAF controls how matched rules are turned into decisions.
+	WAF struct {
+		// Mode is "block" (first BLOCK match wins) or "scoring" (BLOCK rules
+		// add to an anomaly score, like the OWASP CRS anomaly mode).
+		Mode             string `yaml:"mode"`
+		InboundThreshold int    `yaml:"inbound_threshold"`
+		// SecLangFiles are glob patterns of ModSecurity/OWASP CRS rule files
+		// converted into local WAF rules at startup.
+		SecLangFiles []string `yaml:"seclang_files"`
+		// Lists are named IP/CIDR, ASN or string lists for inList(name, value),
+		// "in list(name)" and route allow/deny lists.
+		Lists map[string][]string `yaml:"lists"`
+	} `yaml:"waf"`
+
+	// Path to the default error page template (e.g., for 403/404/500)
 	CustomErrorPage string `yaml:"custom_error_page"`
 
 	// AI-based anomaly detection (local Keras model + sklearn scaler)
@@ -58,11 +72,14 @@ type Config struct {
 		FeatureHeader string  `yaml:"feature_header"`
 	} `yaml:"koda_2"`
 
-	// Optional per-domain and per-path error pages. Values are file paths.
-	// If both domain and path match, path takes precedence by longest prefix.
+	// Optional per-domain and per-path error pages. Values are paths of
+	// html/template files layered over the built-in pages. If both domain
+	// and path match, path takes precedence by longest prefix. Files are
+	// re-read when they change.
 	ErrorPages struct {
-		Domain map[string]string `yaml:"domain"`
-		Path   map[string]string `yaml:"path"`
+		Domain                map[string]string `yaml:"domain"`
+		Path                  map[string]string `yaml:"path"`
+		ReloadIntervalSeconds int               `yaml:"reload_interval_seconds"`
 	} `yaml:"error_pages"`
 
 	Cache struct {
@@ -77,15 +94,51 @@ type Config struct {
 		RequestsPerMinute int    `yaml:"requests_per_minute"`
 		Burst             int    `yaml:"burst"`
 		Key               string `yaml:"key"`
+		// Headers sends the RateLimit-Policy and RateLimit headers on
+		// every response, not only on 429s.
+		Headers bool `yaml:"headers"`
+		// Policies are named per-route rate limit policies, applied
+		// whether or not the global limit is enabled. Policies streamed
+		// from the control plane replace them all.
+		Policies map[string]RateLimitPolicy `yaml:"policies"`
+		// Cluster shares the global limit's and the policies'
+		// consumption with the other agents in Peers.
+		Cluster struct {
+			Enabled        bool     `yaml:"enabled"`
+			Node           string   `yaml:"node"`
+			Peers          []string `yaml:"peers"`
+			Secret         string   `yaml:"secret"`
+			SyncIntervalMs int      `yaml:"sync_interval_ms"`
+		} `yaml:"cluster"`
 	} `yaml:"rate_limit"`
 
+	// RequestQueue holds requests for a slot once MaxConcurrent are being
+	// served. Waiting requests are sorted into Classes, most important
+	// first, and no client may hold more than MaxQueuedPerClient of the
+	// backlog.
 	RequestQueue struct {
-		Enabled        bool `yaml:"enabled"`
-		MaxConcurrent  int  `yaml:"max_concurrent"`
-		MaxQueued      int  `yaml:"max_queued"`
-		TimeoutSeconds int  `yaml:"timeout_seconds"`
+		Enabled            bool                `yaml:"enabled"`
+		MaxConcurrent      int                 `yaml:"max_concurrent"`
+		MaxQueued          int                 `yaml:"max_queued"`
+		MaxQueuedPerClient int                 `yaml:"max_queued_per_client"`
+		TimeoutSeconds     int                 `yaml:"timeout_seconds"`
+		Classes            []RequestQueueClass `yaml:"classes"`
 	} `yaml:"request_queue"`
 
+	// AdaptiveConcurrency limits the requests in flight to each route's
+	// upstreams, lowering the limit as their latency rises above its
+	// baseline and raising it while latency is healthy. Requests over the
+	// limit are shed with a 503.
+	AdaptiveConcurrency struct {
+		Enabled      bool    `yaml:"enabled"`
+		InitialLimit int     `yaml:"initial_limit"`
+		MinLimit     int     `yaml:"min_limit"`
+		MaxLimit     int     `yaml:"max_limit"`
+		Tolerance    float64 `yaml:"tolerance"`
+		Smoothing    float64 `yaml:"smoothing"`
+		Backoff      float64 `yaml:"backoff"`
+	} `yaml:"adaptive_concurrency"`
+
 	Bandwidth struct {
 		Enabled        bool   `yaml:"enabled"`
 		BytesPerSecond int    `yaml:"bytes_per_second"`
@@ -93,6 +146,61 @@ type Config struct {
 		Key            string `yaml:"key"`
 	} `yaml:"bandwidth"`
 
+	// Challenge selects what suspicious clients see on error pages. Mode is
+	// "interactive" (text, click or slider, the default) or "pow" for a
+	// proof-of-work check that browsers pass without user interaction.
+	// Solving either issues a clearance cookie valid for ClearanceSeconds.
+	// Keys sign challenge and clearance tokens; agents sharing them accept
+	// each other's cookies. With Stateless, challenges are signed tokens too,
+	// so a challenge served by one agent can be answered on another.
+	// Scoring weighs the suspicion signals, and Thresholds are the
+	// [text, click, slider] scores from which each challenge is shown.
+	Challenge struct {
+		Mode             string           `yaml:"mode"`
+		ClearanceSeconds int              `yaml:"clearance_seconds"`
+		Stateless        bool             `yaml:"stateless"`
+		Keys             []ChallengeKey   `yaml:"keys"`
+		Scoring          ChallengeScoring `yaml:"scoring"`
+		Thresholds       []int            `yaml:"thresholds"`
+	} `yaml:"challenge"`
+
+	// Jails ban clients that repeatedly trigger WAF blocks, honeypots, failed
+	// logins, 404s or rate limits. Without rules, built-in defaults apply.
+	Jails struct {
+		Enabled   bool       `yaml:"enabled"`
+		IgnoreIPs []string   `yaml:"ignore_ips"`
+		Rules     []JailRule `yaml:"rules"`
+	} `yaml:"jails"`
+
+	// Tarpit sizes the tarpit that TARPIT WAF rules, honeypot traps and
+	// jails with tarpit set send clients to. Over either connection cap,
+	// clients are answered at full speed.
+	Tarpit struct {
+		BytesPerSecond int `yaml:"bytes_per_second"`
+		MaxPerIP       int `yaml:"max_per_ip"`
+		MaxConnections int `yaml:"max_connections"`
+		MaxSeconds     int `yaml:"max_seconds"`
+	} `yaml:"tarpit"`
+
+	// Honeypots configure the traps served when honeypot is on. Without
+	// traps, the built-in .env, .git and .aws/credentials traps apply.
+	// Agents sharing a CanarySecret serve each client the same canaries.
+	// Served canaries are remembered for CanaryRetentionDays, so their later
+	// use can be traced to the scrape.
+	Honeypots struct {
+		CanarySecret        string         `yaml:"canary_secret"`
+		CanaryRetentionDays int            `yaml:"canary_retention_days"`
+		BodySampleBytes     int            `yaml:"body_sample_bytes"`
+		Traps               []HoneypotTrap `yaml:"traps"`
+	} `yaml:"honeypots"`
+
+	// GeoIP enriches client addresses from local MaxMind DB files such as
+	// GeoLite2-City and GeoLite2-ASN. Changed files are reloaded in place.
+	GeoIP struct {
+		Databases             []string `yaml:"databases"`
+		ReloadIntervalSeconds int      `yaml:"reload_interval_seconds"`
+	} `yaml:"geoip"`
+
 	Metrics struct {
 		Enabled bool   `yaml:"enabled"`
 		Path    string `yaml:"path"`
@@ -132,6 +240,102 @@ type Route struct {
 	CertificatePEM string        `yaml:"certificate_pem"`
 	PrivateKeyPEM  string        `yaml:"private_key_pem"`
 	Active         *bool         `yaml:"active"`
+	// WAFInboundThreshold overrides waf.inbound_threshold for this route.
+	WAFInboundThreshold int `yaml:"waf_inbound_threshold"`
+	// AllowLists restrict the route to clients in one of the named lists;
+	// DenyLists reject clients in any of them.
+	AllowLists []string `yaml:"allow_lists"`
+	DenyLists  []string `yaml:"deny_lists"`
+	// AllowCountries and DenyCountries do the same by ISO country code when
+	// geoip is configured. Clients of unknown country fail AllowCountries.
+	AllowCountries []string `yaml:"allow_countries"`
+	DenyCountries  []string `yaml:"deny_countries"`
+	// ChallengeThresholds override challenge.thresholds for this route as
+	// [text, click, slider]; zero or missing entries keep the global value.
+	ChallengeThresholds []int `yaml:"challenge_thresholds"`
+}
+
+// RateLimitPolicy applies every one of its Limits to requests matching all
+// of its non-empty Routes (route keys such as "domain:example.com"),
+// PathPrefixes and Methods.
+type RateLimitPolicy struct {
+	Routes       []string         `yaml:"routes"`
+	PathPrefixes []string         `yaml:"path_prefixes"`
+	Methods      []string         `yaml:"methods"`
+	Limits       []RateLimitLimit `yaml:"limits"`
+}
+
+// RateLimitLimit allows Requests every PeriodSeconds for each key built from
+// the Key components: ip (the default), user, api_key, route, host, global,
+// "header:<name>" and "cookie:<name>". Burst defaults to Requests.
+type RateLimitLimit struct {
+	Requests      int      `yaml:"requests"`
+	PeriodSeconds int      `yaml:"period_seconds"`
+	Burst         int      `yaml:"burst"`
+	Key           []string `yaml:"key"`
+}
+
+// JailRule bans a client after MaxHits of the listed events within
+// WindowSeconds. Events are waf, honeypot, login-failure, not-found and
+// rate-limit.
+type JailRule struct {
+	Name          string   `yaml:"name"`
+	Events        []string `yaml:"events"`
+	MaxHits       int      `yaml:"max_hits"`
+	WindowSeconds int      `yaml:"window_seconds"`
+	BanSeconds    int      `yaml:"ban_seconds"`
+	// Tarpit tarpits the jail's banned clients instead of refusing them.
+	Tarpit bool `yaml:"tarpit"`
+}
+
+// RequestQueueClass is a priority class of the request queue. A request
+// joins the first class whose non-empty conditions all match: Routes (route
+// keys), PathPrefixes, Authenticated (a signed-in user), WAFCategories (a
+// matched rule of one of these categories, known once the WAF has run; in
+// block mode only SCORE rules report one) and Headers (a header with the
+// given value, or present at all when the value is empty). A class without
+// conditions takes the requests no class matched. Weight is the class's
+// share of freed slots while several classes wait.
+type RequestQueueClass struct {
+	Name          string            `yaml:"name"`
+	Weight        int               `yaml:"weight"`
+	Routes        []string          `yaml:"routes"`
+	PathPrefixes  []string          `yaml:"path_prefixes"`
+	Authenticated bool              `yaml:"authenticated"`
+	WAFCategories []string          `yaml:"waf_categories"`
+	Headers       map[string]string `yaml:"headers"`
+}
+
+// HoneypotTrap serves a built-in Response (env, git-config,
+// aws-credentials, wp-login, phpinfo or admin-panel), or Body or the
+// template in BodyFile, on requests matching Paths. BanSeconds bans the
+// client on the first hit; Tarpit trickles the response out.
+type HoneypotTrap struct {
+	Name        string   `yaml:"name"`
+	Paths       []string `yaml:"paths"`
+	Response    string   `yaml:"response"`
+	Status      int      `yaml:"status"`
+	ContentType string   `yaml:"content_type"`
+	Body        string   `yaml:"body"`
+	BodyFile    string   `yaml:"body_file"`
+	BanSeconds  int      `yaml:"ban_seconds"`
+	Tarpit      bool     `yaml:"tarpit"`
+}
+
+// ChallengeScoring configures the suspicion pipeline. Weights override the
+// default weight of user_agent, tls, headers, accept_language, rate,
+// classifiers and reputation; zero disables a signal. Clients in any of the
+// ReputationLists count as the reputation signal.
+type ChallengeScoring struct {
+	Weights         map[string]float64 `yaml:"weights"`
+	ReputationLists []string           `yaml:"reputation_lists"`
+}
+
+// ChallengeKey is a shared HMAC secret for challenge tokens. The first key
+// signs; the others are only accepted, which allows rotation.
+type ChallengeKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
 }
 
 type RouteTarget struct {
@@ -144,6 +348,12 @@ func (r Route) IsActive() bool {
 	return r.Active == nil || *r.Active
 }
 
+// WAFScoringEnabled reports whether BLOCK rules contribute to an anomaly
+// score instead of blocking on their first match.
+func (c *Config) WAFScoringEnabled() bool {
+	return c != nil && strings.EqualFold(strings.TrimSpace(c.WAF.Mode), "scoring")
+}
+
 // HealthChecksEnabled reports whether upstream health probes should run.
 // Probes default to enabled when the config field is omitted.
 func (c *Config) HealthChecksEnabled() bool {
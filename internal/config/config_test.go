@@ -609,3 +609,32 @@ func TestLoadParsesLocalRoutes(t *testing.T) {
 		t.Fatal("explicitly inactive route should remain inactive")
 	}
 }
+
+func TestLoadWAFScoringConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	data := []byte(`waf:
+  mode: Scoring
+  inbound_threshold: 10
+routes:
+  api.example.test:
+    target: http://127.0.0.1:9001
+    waf_inbound_threshold: 20
+`)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !cfg.WAFScoringEnabled() || cfg.WAF.InboundThreshold != 10 {
+		t.Fatalf("WAF = %+v, want scoring with threshold 10", cfg.WAF)
+	}
+	if got := cfg.Routes["api.example.test"].WAFInboundThreshold; got != 20 {
+		t.Fatalf("route WAFInboundThreshold = %d, want 20", got)
+	}
+	if (&Config{}).WAFScoringEnabled() {
+		t.Fatal("scoring should be disabled by default")
+	}
+}
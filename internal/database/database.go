@@ -62,6 +62,29 @@ func Init(path string) (*sql.DB, error) {
 	return db, nil
 }
 
+// OpenReadOnly opens an existing database without creating, migrating or
+// writing to it, so offline tools can inspect a running agent's state.
+func OpenReadOnly(path string) (*sql.DB, error) {
+	filename, _, _ := strings.Cut(path, "?")
+	if _, err := os.Stat(filename); err != nil {
+		return nil, fmt.Errorf("open sqlite database: %w", err)
+	}
+	params := url.Values{}
+	params.Set("mode", "ro")
+	params.Set("_busy_timeout", strconv.FormatInt(sqliteBusyTimeout.Milliseconds(), 10))
+	db, err := sql.Open("sqlite3", "file:"+filename+"?"+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite database: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sqliteBusyTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("connect sqlite database: %w", err)
+	}
+	return db, nil
+}
+
 func sqliteDSN(path string) (string, bool, error) {
 	filename, rawQuery, hasQuery := strings.Cut(path, "?")
 	params := make(url.Values)
@@ -122,6 +145,12 @@ func createTables(db *sql.DB) error {
 		target_url TEXT NOT NULL,
 		certificate_pem TEXT,
 		private_key_pem TEXT,
+		waf_inbound_threshold INTEGER NOT NULL DEFAULT 0,
+		allow_lists TEXT NOT NULL DEFAULT '',
+		deny_lists TEXT NOT NULL DEFAULT '',
+		allow_countries TEXT NOT NULL DEFAULT '',
+		deny_countries TEXT NOT NULL DEFAULT '',
+		challenge_thresholds TEXT NOT NULL DEFAULT '',
 		active INTEGER DEFAULT 1,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
@@ -137,6 +166,10 @@ func createTables(db *sql.DB) error {
 		expression TEXT NOT NULL,
 		action TEXT NOT NULL DEFAULT 'BLOCK',
 		priority INTEGER DEFAULT 0,
+		score INTEGER NOT NULL DEFAULT 0,
+		category TEXT NOT NULL DEFAULT '',
+		shadow INTEGER NOT NULL DEFAULT 0,
+		scope TEXT NOT NULL DEFAULT '',
 		UNIQUE(name)
 	);`)
 	if err != nil {
@@ -211,6 +244,92 @@ func createTables(db *sql.DB) error {
 		return err
 	}
 
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS lists (
+		name TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT ''
+	);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS list_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		list_name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		expires_at INTEGER,
+		comment TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (list_name) REFERENCES lists(name) ON DELETE CASCADE,
+		UNIQUE(list_name, value)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS jail_bans (
+		ip TEXT PRIMARY KEY,
+		jail TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS honeypot_canaries (
+		token TEXT PRIMARY KEY,
+		label TEXT NOT NULL,
+		trap TEXT NOT NULL,
+		client_ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL DEFAULT '',
+		host TEXT NOT NULL DEFAULT '',
+		path TEXT NOT NULL DEFAULT '',
+		first_seen INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		hits INTEGER NOT NULL DEFAULT 1
+	);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS rate_limit_policies (
+		name TEXT PRIMARY KEY,
+		routes TEXT NOT NULL DEFAULT '',
+		path_prefixes TEXT NOT NULL DEFAULT '',
+		methods TEXT NOT NULL DEFAULT '',
+		limits TEXT NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+
+	if err := migrateAnomalyScoring(db); err != nil {
+		return err
+	}
+
+	if err := migrateCanonicalSeedRules(db); err != nil {
+		return err
+	}
+
+	if err := migrateShadowRules(db); err != nil {
+		return err
+	}
+
+	if err := migrateRuleScopes(db); err != nil {
+		return err
+	}
+
+	if err := migrateRouteLists(db); err != nil {
+		return err
+	}
+
+	if err := migrateRouteCountries(db); err != nil {
+		return err
+	}
+	if err := migrateRouteChallengeThresholds(db); err != nil {
+		return err
+	}
+
 	if err := seedDefaults(db); err != nil {
 		return err
 	}
@@ -234,6 +353,98 @@ func migrateRouteNulls(db *sql.DB) error {
 	return err
 }
 
+// migrateAnomalyScoring adds the scoring columns to databases created before
+// WAF anomaly scoring existed.
+func migrateAnomalyScoring(db *sql.DB) error {
+	if err := addColumnIfMissing(db, "waf_rules", "score", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "waf_rules", "category", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "routes", "waf_inbound_threshold", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// migrateShadowRules adds the monitor-only flag to databases created before
+// shadow rules existed. Existing rules stay enforced.
+func migrateShadowRules(db *sql.DB) error {
+	return addColumnIfMissing(db, "waf_rules", "shadow", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// migrateRuleScopes adds the JSON-encoded rule scope to databases created
+// before scoped rules existed. An empty scope means the rule is global.
+func migrateRuleScopes(db *sql.DB) error {
+	return addColumnIfMissing(db, "waf_rules", "scope", "TEXT NOT NULL DEFAULT ''")
+}
+
+// canonicalSeedRules replace seeded rules that matched the raw path. The WAF
+// now sees the canonical path, where case, encoding and dot-segment tricks
+// are already resolved, so these rules match on that form instead.
+var canonicalSeedRules = map[string]struct{ legacy, expression string }{
+	"Block Admin": {
+		legacy:     `Path startsWith "/admin"`,
+		expression: `lower(Path) startsWith "/admin"`,
+	},
+	"Block Path Traversal": {
+		legacy:     `Path matches "(?:\\.\\./|\\.\\.\\\\)"`,
+		expression: `"traversal" in EncodingFlags`,
+	},
+	"Block Path Traversal (Path Encoded)": {
+		legacy:     `Path matches ".*(?i)(%2e%2e%2f|%2e%2e%5c).*$"`,
+		expression: `URI matches "(?i)(%2e%2e%2f|%2e%2e%5c)"`,
+	},
+}
+
+// migrateCanonicalSeedRules upgrades seeded rules that are still unmodified.
+// Operator-edited rules are left alone.
+func migrateCanonicalSeedRules(db *sql.DB) error {
+	for name, rule := range canonicalSeedRules {
+		if _, err := db.Exec(`UPDATE waf_rules SET expression = ? WHERE name = ? AND expression = ?`,
+			rule.expression, name, rule.legacy); err != nil {
+			return fmt.Errorf("migrate seeded WAF rule %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// migrateRouteLists adds the comma-separated allow and deny list names to
+// routes created before list policies.
+func migrateRouteLists(db *sql.DB) error {
+	if err := addColumnIfMissing(db, "routes", "allow_lists", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "routes", "deny_lists", "TEXT NOT NULL DEFAULT ''")
+}
+
+// migrateRouteCountries adds the comma-separated allow and deny country codes
+// to routes created before country policies.
+func migrateRouteCountries(db *sql.DB) error {
+	if err := addColumnIfMissing(db, "routes", "allow_countries", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(db, "routes", "deny_countries", "TEXT NOT NULL DEFAULT ''")
+}
+
+// migrateRouteChallengeThresholds adds the comma-separated per-route
+// challenge thresholds to routes created before suspicion scoring.
+func migrateRouteChallengeThresholds(db *sql.DB) error {
+	return addColumnIfMissing(db, "routes", "challenge_thresholds", "TEXT NOT NULL DEFAULT ''")
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ? COLLATE NOCASE`, table, column).Scan(&count); err != nil {
+		return fmt.Errorf("inspect %s columns: %w", table, err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition); err != nil {
+		return fmt.Errorf("add %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
 func migrateRouteTargets(db *sql.DB) error {
 	_, err := db.Exec(`
 		INSERT OR IGNORE INTO route_targets (route_id, target_url, health_check, sort_order)
@@ -272,22 +483,23 @@ func seedDefaults(db *sql.DB) error {
 			Name       string
 			Expression string
 			Priority   int
+			Category   string
 		}{
-			{"Block Admin", `Path startsWith "/admin"`, 10},
-			{"Block SQL Injection (Path)", `Path matches ".*(?i)(union\\s+select|waitfor\\s+delay|1=1|--|;).*$"`, 20},
-			{"Block SQL Injection (Query)", `RawQuery matches "(?i)(union\\s+select|waitfor\\s+delay|1=1|--|;)"`, 20},
-			{"Block XSS (Path)", `Path matches "(?i)(<script>|javascript:|onerror=)"`, 20},
-			{"Block XSS (Query)", `RawQuery matches "(?i)(<script>|javascript:|onerror=)"`, 20},
-			{"Block Path Traversal", `Path matches "(?:\\.\\./|\\.\\.\\\\)"`, 20},
-			{"Block Path Traversal (Path Encoded)", `Path matches ".*(?i)(%2e%2e%2f|%2e%2e%5c).*$"`, 20},
-			{"Block Path Traversal (Query)", `RawQuery matches "(?:\\.\\./|\\.\\.\\\\)"`, 20},
-			{"Block Path Traversal (Query Encoded)", `RawQuery matches ".*(?i)(%2e%2e%2f|%2e%2e%5c).*$"`, 20},
-			{"Block SSRF Metadata & Localhost", `RawQuery matches "(?i)(169\\.254\\.169\\.254|127\\.0\\.0\\.1|localhost)"`, 20},
+			{"Block Admin", canonicalSeedRules["Block Admin"].expression, 10, "policy"},
+			{"Block SQL Injection (Path)", `Path matches ".*(?i)(union\\s+select|waitfor\\s+delay|1=1|--|;).*$"`, 20, "sqli"},
+			{"Block SQL Injection (Query)", `RawQuery matches "(?i)(union\\s+select|waitfor\\s+delay|1=1|--|;)"`, 20, "sqli"},
+			{"Block XSS (Path)", `Path matches "(?i)(<script>|javascript:|onerror=)"`, 20, "xss"},
+			{"Block XSS (Query)", `RawQuery matches "(?i)(<script>|javascript:|onerror=)"`, 20, "xss"},
+			{"Block Path Traversal", canonicalSeedRules["Block Path Traversal"].expression, 20, "lfi"},
+			{"Block Path Traversal (Path Encoded)", canonicalSeedRules["Block Path Traversal (Path Encoded)"].expression, 20, "lfi"},
+			{"Block Path Traversal (Query)", `RawQuery matches "(?:\\.\\./|\\.\\.\\\\)"`, 20, "lfi"},
+			{"Block Path Traversal (Query Encoded)", `RawQuery matches ".*(?i)(%2e%2e%2f|%2e%2e%5c).*$"`, 20, "lfi"},
+			{"Block SSRF Metadata & Localhost", `RawQuery matches "(?i)(169\\.254\\.169\\.254|127\\.0\\.0\\.1|localhost)"`, 20, "ssrf"},
 		}
 
 		for _, rule := range rules {
-			_, err = db.Exec(`INSERT INTO waf_rules (name, expression, action, priority) VALUES (?, ?, ?, ?)`,
-				rule.Name, rule.Expression, "BLOCK", rule.Priority)
+			_, err = db.Exec(`INSERT INTO waf_rules (name, expression, action, priority, category) VALUES (?, ?, ?, ?, ?)`,
+				rule.Name, rule.Expression, "BLOCK", rule.Priority, rule.Category)
 			if err != nil {
 				log.Error().Err(err).Str("rule", rule.Name).Msg("Failed to insert WAF rule")
 			} else {
@@ -352,6 +564,20 @@ type RouteMatch struct {
 	Targets        []RouteTarget
 	CertificatePEM string
 	PrivateKeyPEM  string
+	// WAFInboundThreshold overrides the global anomaly-score threshold when
+	// positive.
+	WAFInboundThreshold int
+	// AllowLists, when set, admit only clients found in one of the lists;
+	// DenyLists reject clients found in any of them.
+	AllowLists []string
+	DenyLists  []string
+	// AllowCountries and DenyCountries are upper-case ISO country codes
+	// applied the same way to the client's GeoIP country.
+	AllowCountries []string
+	DenyCountries  []string
+	// ChallengeThresholds are the route's [text, click, slider] suspicion
+	// thresholds; zero entries inherit the agent's.
+	ChallengeThresholds []int
 }
 
 func loadRouteTargets(db *sql.DB, routeID int) ([]RouteTarget, error) {
@@ -630,3 +630,91 @@ func TestReplaceFileOverwritesExisting(t *testing.T) {
 		t.Fatalf("src should be gone after rename, stat err = %v", err)
 	}
 }
+
+func TestMigrateAnomalyScoringAddsColumnsOnce(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`
+		CREATE TABLE waf_rules (id INTEGER PRIMARY KEY, name TEXT, expression TEXT, action TEXT, priority INTEGER);
+		CREATE TABLE routes (id INTEGER PRIMARY KEY, domain TEXT);
+		INSERT INTO waf_rules (name, expression, action, priority) VALUES ('legacy', 'true', 'BLOCK', 1);`); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := migrateAnomalyScoring(db); err != nil {
+			t.Fatalf("migrateAnomalyScoring run %d: %v", i+1, err)
+		}
+	}
+
+	var score int
+	var category string
+	if err := db.QueryRow(`SELECT score, category FROM waf_rules WHERE name = 'legacy'`).Scan(&score, &category); err != nil {
+		t.Fatalf("legacy rule after migration: %v", err)
+	}
+	if score != 0 || category != "" {
+		t.Fatalf("score/category = %d/%q, want defaults", score, category)
+	}
+	if _, err := db.Exec(`UPDATE routes SET waf_inbound_threshold = 12`); err != nil {
+		t.Fatalf("routes.waf_inbound_threshold missing: %v", err)
+	}
+}
+
+func TestMigrateCanonicalSeedRulesKeepsCustomizedRules(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.Exec(`UPDATE waf_rules SET expression = ? WHERE name = 'Block Admin'`, canonicalSeedRules["Block Admin"].legacy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE waf_rules SET expression = 'Path startsWith "/internal"' WHERE name = 'Block Path Traversal'`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateCanonicalSeedRules(db); err != nil {
+		t.Fatalf("migrateCanonicalSeedRules: %v", err)
+	}
+
+	var admin, traversal string
+	if err := db.QueryRow(`SELECT expression FROM waf_rules WHERE name = 'Block Admin'`).Scan(&admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT expression FROM waf_rules WHERE name = 'Block Path Traversal'`).Scan(&traversal); err != nil {
+		t.Fatal(err)
+	}
+	if admin != `lower(Path) startsWith "/admin"` {
+		t.Fatalf("Block Admin = %q, want the canonical-path expression", admin)
+	}
+	if traversal != `Path startsWith "/internal"` {
+		t.Fatalf("customized rule was overwritten: %q", traversal)
+	}
+}
+
+func TestOpenReadOnlyNeverWrites(t *testing.T) {
+	t.Setenv(bootstrapUsernameEnv, "")
+	t.Setenv(bootstrapPasswordEnv, "")
+	path := filepath.Join(t.TempDir(), "proxy.db")
+	if _, err := OpenReadOnly(path); err == nil {
+		t.Fatal("OpenReadOnly created a missing database")
+	}
+	db, err := Init(path)
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	_ = db.Close()
+
+	ro, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("OpenReadOnly: %v", err)
+	}
+	defer ro.Close()
+	var rules int
+	if err := ro.QueryRow(`SELECT COUNT(*) FROM waf_rules`).Scan(&rules); err != nil || rules == 0 {
+		t.Fatalf("read seeded rules = %d, %v", rules, err)
+	}
+	if _, err := ro.Exec(`DELETE FROM waf_rules`); err == nil {
+		t.Fatal("read-only database accepted a write")
+	}
+}
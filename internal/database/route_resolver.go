@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"unicode/utf8"
@@ -33,6 +34,12 @@ type cachedRoute struct {
 	targetURL       string
 	certificatePEM  string
 	privateKeyPEM   string
+	wafThreshold    int
+	allowLists      []string
+	denyLists       []string
+	allowCountries  []string
+	denyCountries   []string
+	thresholds      []int
 	exactRouteKey   string
 	patternRouteKey string
 	pathRouteKey    string
@@ -139,7 +146,9 @@ func loadRouteSnapshot(db *sql.DB) (*routeSnapshot, error) {
 
 	rows, err := tx.Query(`
 		SELECT id, route_type, COALESCE(domain, ''), COALESCE(path_prefix, ''),
-		       target_url, COALESCE(certificate_pem, ''), COALESCE(private_key_pem, '')
+		       target_url, COALESCE(certificate_pem, ''), COALESCE(private_key_pem, ''),
+		       COALESCE(waf_inbound_threshold, 0), COALESCE(allow_lists, ''), COALESCE(deny_lists, ''),
+		       COALESCE(allow_countries, ''), COALESCE(deny_countries, ''), COALESCE(challenge_thresholds, '')
 		FROM routes
 		WHERE active = 1 AND route_type IN ('domain', 'wildcard', 'regex', 'path')
 		ORDER BY id ASC`)
@@ -149,6 +158,7 @@ func loadRouteSnapshot(db *sql.DB) (*routeSnapshot, error) {
 
 	for rows.Next() {
 		route := &cachedRoute{}
+		var allowLists, denyLists, allowCountries, denyCountries, thresholds string
 		if err := rows.Scan(
 			&route.id,
 			&route.routeType,
@@ -157,10 +167,21 @@ func loadRouteSnapshot(db *sql.DB) (*routeSnapshot, error) {
 			&route.targetURL,
 			&route.certificatePEM,
 			&route.privateKeyPEM,
+			&route.wafThreshold,
+			&allowLists,
+			&denyLists,
+			&allowCountries,
+			&denyCountries,
+			&thresholds,
 		); err != nil {
 			_ = rows.Close()
 			return nil, fmt.Errorf("scan active route: %w", err)
 		}
+		route.allowLists = SplitListNames(allowLists)
+		route.denyLists = SplitListNames(denyLists)
+		route.allowCountries = SplitListNames(strings.ToUpper(allowCountries))
+		route.denyCountries = SplitListNames(strings.ToUpper(denyCountries))
+		route.thresholds = splitInts(thresholds)
 
 		route.routeType = strings.ToLower(strings.TrimSpace(route.routeType))
 		if route.routeType != "path" {
@@ -327,17 +348,29 @@ func (m domainMatcher) matches(domain string) bool {
 
 func (r *cachedRoute) domainMatch(routeKey string) *RouteMatch {
 	return &RouteMatch{
-		RouteKey:       routeKey,
-		Targets:        cloneRouteTargets(r.targets),
-		CertificatePEM: r.certificatePEM,
-		PrivateKeyPEM:  r.privateKeyPEM,
+		RouteKey:            routeKey,
+		Targets:             cloneRouteTargets(r.targets),
+		CertificatePEM:      r.certificatePEM,
+		PrivateKeyPEM:       r.privateKeyPEM,
+		WAFInboundThreshold: r.wafThreshold,
+		AllowLists:          r.allowLists,
+		DenyLists:           r.denyLists,
+		AllowCountries:      r.allowCountries,
+		DenyCountries:       r.denyCountries,
+		ChallengeThresholds: r.thresholds,
 	}
 }
 
 func (r *cachedRoute) pathMatch() *RouteMatch {
 	return &RouteMatch{
-		RouteKey: r.pathRouteKey,
-		Targets:  cloneRouteTargets(r.targets),
+		RouteKey:            r.pathRouteKey,
+		Targets:             cloneRouteTargets(r.targets),
+		WAFInboundThreshold: r.wafThreshold,
+		AllowLists:          r.allowLists,
+		DenyLists:           r.denyLists,
+		AllowCountries:      r.allowCountries,
+		DenyCountries:       r.denyCountries,
+		ChallengeThresholds: r.thresholds,
 	}
 }
 
@@ -346,3 +379,25 @@ func cloneRouteTargets(targets []RouteTarget) []RouteTarget {
 	copy(cloned, targets)
 	return cloned
 }
+
+// SplitListNames parses the comma-separated list names stored on a route.
+// splitInts parses a comma-separated list of integers, reading anything
+// else as zero.
+func splitInts(value string) []int {
+	var ints []int
+	for _, field := range SplitListNames(value) {
+		n, _ := strconv.Atoi(field)
+		ints = append(ints, n)
+	}
+	return ints
+}
+
+func SplitListNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
+	"sort"
 	"strings"
 	"time"
 )
@@ -17,12 +18,33 @@ type AnalysisInfo struct {
 	Path      string
 	Method    string
 
+	// GeoIP enrichment of ClientIP; empty when no database knows it.
+	Country string
+	City    string
+	ASN     uint32
+	ASOrg   string
+
+	// Challenge suspicion score, the points each signal contributed to it,
+	// and the challenge it selects ("none" when the client passes).
+	Suspicion        int
+	SuspicionSignals map[string]int
+	ChallengeType    string
+
 	// WAF Analysis
 	WAFChecked     bool
 	WAFBlocked     bool
 	WAFRuleName    string
 	WAFRuleMatched string
 
+	// WAF anomaly scoring; populated for every evaluated request so that
+	// near-miss scores are visible even when the request is allowed.
+	WAFScore             int
+	WAFScoreThreshold    int
+	WAFScoreCategories   map[string]int
+	WAFContributingRules []string
+	// WAFShadowRules are monitor-only rules that matched this request.
+	WAFShadowRules []string
+
 	// AI Analysis (GoatAI)
 	AIEnabled      bool
 	AIChecked      bool
@@ -125,6 +147,14 @@ func generateOverlayHTML(info *AnalysisInfo) string {
 					<span style="color: #fff; word-break: break-all;">{{.Path}}</span>
 					<span style="color: #888;">Target:</span>
 					<span style="color: #66d9ef; word-break: break-all;">{{.TargetURL}}</span>
+					{{if .Origin}}
+					<span style="color: #888;">Origin:</span>
+					<span style="color: #fff;">{{.Origin}}</span>
+					{{end}}
+					{{if .ChallengeType}}
+					<span style="color: #888;">Suspicion:</span>
+					<span style="color: #fff;">{{.Suspicion}} → {{.ChallengeType}}{{if .SuspicionText}} <span style="color: #888;">({{.SuspicionText}})</span>{{end}}</span>
+					{{end}}
 				</div>
 			</div>
 		</div>
@@ -146,6 +176,26 @@ func generateOverlayHTML(info *AnalysisInfo) string {
 					<span>✅</span> No threats detected
 				</div>
 				{{end}}
+				{{if .WAFScore}}
+				<div style="margin-top: 6px;">
+					<span style="color: #888;">Anomaly Score:</span> <span style="color: #fff; font-weight: bold;">{{.WAFScore}} / {{.WAFScoreThreshold}}</span>
+				</div>
+				{{range $category, $score := .WAFScoreCategories}}
+				<div><span style="color: #888;">{{$category}}:</span> <span style="color: #fff;">{{$score}}</span></div>
+				{{end}}
+				{{if .WAFContributingRules}}
+				<div style="color: #888; margin-top: 4px;">Contributing rules:</div>
+				{{range .WAFContributingRules}}
+				<div style="color: #ffe0e0;">• {{.}}</div>
+				{{end}}
+				{{end}}
+				{{end}}
+				{{if .WAFShadowRules}}
+				<div style="color: #888; margin-top: 4px;">Shadow matches (not enforced):</div>
+				{{range .WAFShadowRules}}
+				<div style="color: #ffd479;">• {{.}}</div>
+				{{end}}
+				{{end}}
 			</div>
 		</div>
 		{{end}}
@@ -386,6 +436,10 @@ func generateOverlayHTML(info *AnalysisInfo) string {
 		"TargetURL":      info.TargetURL,
 		"RequestAllowed": info.RequestAllowed,
 		"BlockReason":    info.BlockReason,
+		"Origin":         originText(info),
+		"Suspicion":      info.Suspicion,
+		"SuspicionText":  suspicionText(info.SuspicionSignals),
+		"ChallengeType":  info.ChallengeType,
 
 		// Status
 		"StatusColor":      getStatusColor(info),
@@ -398,6 +452,12 @@ func generateOverlayHTML(info *AnalysisInfo) string {
 		"WAFRuleName":   info.WAFRuleName,
 		"WAFBackground": getWAFBackground(info),
 
+		"WAFScore":             info.WAFScore,
+		"WAFScoreThreshold":    info.WAFScoreThreshold,
+		"WAFScoreCategories":   info.WAFScoreCategories,
+		"WAFContributingRules": info.WAFContributingRules,
+		"WAFShadowRules":       info.WAFShadowRules,
+
 		// AI (GoatAI)
 		"AIEnabled":          info.AIEnabled,
 		"AIChecked":          info.AIChecked,
@@ -454,6 +514,40 @@ func generateOverlayHTML(info *AnalysisInfo) string {
 	return buf.String()
 }
 
+// originText summarises the GeoIP fields, e.g. "DE · Berlin · AS3320 Deutsche Telekom AG".
+func originText(info *AnalysisInfo) string {
+	var parts []string
+	if info.Country != "" {
+		parts = append(parts, info.Country)
+	}
+	if info.City != "" {
+		parts = append(parts, info.City)
+	}
+	if info.ASN != 0 {
+		parts = append(parts, strings.TrimSpace(fmt.Sprintf("AS%d %s", info.ASN, info.ASOrg)))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// suspicionText lists signal points from largest, e.g. "user_agent 45 · rate 12".
+func suspicionText(signals map[string]int) string {
+	names := make([]string, 0, len(signals))
+	for name := range signals {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if signals[names[i]] != signals[names[j]] {
+			return signals[names[i]] > signals[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s %d", name, signals[name])
+	}
+	return strings.Join(parts, " · ")
+}
+
 func getStatusColor(info *AnalysisInfo) string {
 	if !info.RequestAllowed {
 		return "#ff4757"
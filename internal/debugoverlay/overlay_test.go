@@ -16,3 +16,52 @@ func TestInjectOverlayHandlesUppercaseBodyTag(t *testing.T) {
 		t.Fatal("original closing body tag case should be preserved")
 	}
 }
+
+func TestInjectOverlayShowsWAFAnomalyScore(t *testing.T) {
+	body := []byte("<html><body>hello</body></html>")
+	out := string(InjectOverlay(body, &AnalysisInfo{
+		RequestAllowed:       true,
+		WAFChecked:           true,
+		WAFScore:             4,
+		WAFScoreThreshold:    10,
+		WAFScoreCategories:   map[string]int{"sqli": 4},
+		WAFContributingRules: []string{"SQL Keyword"},
+	}))
+
+	for _, want := range []string{"4 / 10", "sqli", "SQL Keyword"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("overlay missing %q", want)
+		}
+	}
+}
+
+func TestInjectOverlayShowsOriginAndShadowRules(t *testing.T) {
+	body := []byte("<html><body>hello</body></html>")
+	out := string(InjectOverlay(body, &AnalysisInfo{
+		RequestAllowed: true,
+		WAFChecked:     true,
+		WAFShadowRules: []string{"Candidate SQLi"},
+		Country:        "DE",
+		City:           "Berlin",
+		ASN:            3320,
+		ASOrg:          "Deutsche Telekom AG",
+	}))
+
+	for _, want := range []string{"DE · Berlin · AS3320 Deutsche Telekom AG", "Candidate SQLi"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("overlay missing %q", want)
+		}
+	}
+}
+
+func TestInjectOverlayShowsSuspicionBreakdown(t *testing.T) {
+	out := string(InjectOverlay([]byte("<html><body>hello</body></html>"), &AnalysisInfo{
+		RequestAllowed:   true,
+		Suspicion:        57,
+		SuspicionSignals: map[string]int{"rate": 12, "user_agent": 45},
+		ChallengeType:    "text",
+	}))
+	if !strings.Contains(out, "57 → text") || !strings.Contains(out, "user_agent 45 · rate 12") {
+		t.Fatal("overlay missing the suspicion breakdown")
+	}
+}
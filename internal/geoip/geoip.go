@@ -0,0 +1,225 @@
+// Package geoip enriches client addresses with country, city and ASN data
+// from local MaxMind DB (.mmdb) files such as GeoLite2-Country, GeoLite2-City
+// and GeoLite2-ASN. Lookups never leave the process; files are re-read when
+// they change on disk.
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Info is what is known about an address. Empty fields mean unknown.
+type Info struct {
+	// Country is the ISO 3166-1 alpha-2 code, such as "DE".
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// IsZero reports whether nothing is known.
+func (i Info) IsZero() bool {
+	return i == Info{}
+}
+
+// merge fills the empty fields of i from other.
+func (i Info) merge(other Info) Info {
+	if i.Country == "" {
+		i.Country = other.Country
+	}
+	if i.City == "" {
+		i.City = other.City
+	}
+	if i.ASN == 0 {
+		i.ASN, i.ASOrg = other.ASN, other.ASOrg
+	}
+	return i
+}
+
+// Reader looks addresses up in one database file.
+type Reader struct {
+	db *mmdb
+}
+
+// Open reads a database file into memory.
+func Open(path string) (*Reader, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(file)
+}
+
+// FromBytes parses a database held in memory. The reader keeps file.
+func FromBytes(file []byte) (*Reader, error) {
+	db, err := parseMMDB(file)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{db: db}, nil
+}
+
+// Metadata describes the database.
+func (r *Reader) Metadata() Metadata {
+	return r.db.meta
+}
+
+// Lookup returns the country, city and ASN fields of the record for addr.
+// Country databases fill Country, City databases also City, and ASN
+// databases ASN and ASOrg.
+func (r *Reader) Lookup(addr netip.Addr) (Info, error) {
+	offset, found, err := r.db.lookup(addr)
+	if err != nil || !found {
+		return Info{}, err
+	}
+	d := &decoder{buf: r.db.data}
+	var info Info
+	if value, ok, err := d.find(offset, "country", "iso_code"); err != nil {
+		return Info{}, err
+	} else if ok {
+		info.Country = stringField(value)
+	}
+	if info.Country == "" {
+		if value, ok, err := d.find(offset, "registered_country", "iso_code"); err != nil {
+			return Info{}, err
+		} else if ok {
+			info.Country = stringField(value)
+		}
+	}
+	if value, ok, err := d.find(offset, "city", "names", "en"); err != nil {
+		return Info{}, err
+	} else if ok {
+		info.City = stringField(value)
+	}
+	if value, ok, err := d.find(offset, "autonomous_system_number"); err != nil {
+		return Info{}, err
+	} else if ok {
+		info.ASN = uint32(uintField(value))
+	}
+	if value, ok, err := d.find(offset, "autonomous_system_organization"); err != nil {
+		return Info{}, err
+	} else if ok {
+		info.ASOrg = stringField(value)
+	}
+	return info, nil
+}
+
+// Resolver combines several database files, for example a City and an ASN
+// database, and reloads each one when its file changes. A nil *Resolver
+// knows nothing.
+type Resolver struct {
+	files []*watchedFile
+}
+
+type watchedFile struct {
+	path    string
+	reader  atomic.Pointer[Reader]
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewResolver opens every database file. All of them must be readable at
+// startup; later reload failures keep the previous copy.
+func NewResolver(paths []string) (*Resolver, error) {
+	resolver := &Resolver{}
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		file := &watchedFile{path: path}
+		if _, err := file.reload(); err != nil {
+			return nil, fmt.Errorf("open GeoIP database %s: %w", path, err)
+		}
+		resolver.files = append(resolver.files, file)
+	}
+	return resolver, nil
+}
+
+// Lookup merges what every database knows about ip. Earlier files win when
+// two of them fill the same field.
+func (r *Resolver) Lookup(ip string) Info {
+	if r == nil || len(r.files) == 0 {
+		return Info{}
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return Info{}
+	}
+	var info Info
+	for _, file := range r.files {
+		found, err := file.reader.Load().Lookup(addr)
+		if err != nil {
+			log.Debug().Err(err).Str("database", file.path).Str("ip", ip).Msg("GeoIP lookup failed")
+			continue
+		}
+		info = info.merge(found)
+	}
+	return info
+}
+
+// Reload re-reads files whose size or modification time changed. Files that
+// fail to parse, for example while being replaced, keep serving the
+// previous copy and are retried on the next call.
+func (r *Resolver) Reload() {
+	if r == nil {
+		return
+	}
+	for _, file := range r.files {
+		reloaded, err := file.reload()
+		if err != nil {
+			log.Warn().Err(err).Str("database", file.path).Msg("Failed to reload GeoIP database; keeping the previous copy")
+			continue
+		}
+		if reloaded {
+			meta := file.reader.Load().Metadata()
+			log.Info().Str("database", file.path).Str("type", meta.DatabaseType).Uint64("build_epoch", meta.BuildEpoch).Msg("GeoIP database reloaded")
+		}
+	}
+}
+
+// Watch calls Reload every interval until ctx is done.
+func (r *Resolver) Watch(ctx context.Context, interval time.Duration) {
+	if r == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Reload()
+		}
+	}
+}
+
+func (f *watchedFile) reload() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	if f.reader.Load() != nil && stat.ModTime().Equal(f.modTime) && stat.Size() == f.size {
+		return false, nil
+	}
+	reader, err := Open(f.path)
+	if err != nil {
+		return false, err
+	}
+	f.reader.Store(reader)
+	f.modTime, f.size = stat.ModTime(), stat.Size()
+	return true, nil
+}
@@ -0,0 +1,269 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testDB writes a MaxMind DB file from prefixes and encoded data records.
+type testDB struct {
+	recordSize int
+	nodes      [][2]int64 // >= 0: node index; -1: empty; < -1: data record -(offset+2)
+	data       []byte
+}
+
+func newTestDB(recordSize int) *testDB {
+	return &testDB{recordSize: recordSize, nodes: [][2]int64{{-1, -1}}}
+}
+
+// insert maps an IPv6 prefix (IPv4 prefixes go under ::/96) to a record.
+func (db *testDB) insert(t *testing.T, prefix string, record []byte) {
+	t.Helper()
+	p := netip.MustParsePrefix(prefix)
+	bits := p.Bits()
+	addr := p.Addr().As16()
+	if p.Addr().Is4() {
+		bits += 96
+		addr = [16]byte{}
+		copy(addr[12:], p.Addr().AsSlice())
+	}
+	offset := len(db.data)
+	db.data = append(db.data, record...)
+	node := 0
+	for i := 0; i < bits; i++ {
+		bit := int(addr[i/8]>>(7-uint(i%8))) & 1
+		if i == bits-1 {
+			db.nodes[node][bit] = -int64(offset + 2)
+			return
+		}
+		if next := db.nodes[node][bit]; next > 0 {
+			node = int(next)
+			continue
+		}
+		db.nodes = append(db.nodes, [2]int64{-1, -1})
+		db.nodes[node][bit] = int64(len(db.nodes) - 1)
+		node = len(db.nodes) - 1
+	}
+}
+
+func (db *testDB) bytes() []byte {
+	count := int64(len(db.nodes))
+	resolve := func(v int64) uint32 {
+		switch {
+		case v == -1:
+			return uint32(count)
+		case v < -1:
+			return uint32(count + dataSectionSeparator + (-v - 2))
+		default:
+			return uint32(v)
+		}
+	}
+	var out []byte
+	for _, node := range db.nodes {
+		left, right := resolve(node[0]), resolve(node[1])
+		switch db.recordSize {
+		case 24:
+			out = append(out, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			out = append(out, byte(left>>16), byte(left>>8), byte(left), byte(left>>24<<4)|byte(right>>24&0x0f), byte(right>>16), byte(right>>8), byte(right))
+		default:
+			out = binary.BigEndian.AppendUint32(out, left)
+			out = binary.BigEndian.AppendUint32(out, right)
+		}
+	}
+	out = append(out, make([]byte, dataSectionSeparator)...)
+	out = append(out, db.data...)
+	out = append(out, metadataMarker...)
+	out = append(out, encMap(
+		"node_count", encUint(typeUint32, uint64(count)),
+		"record_size", encUint(typeUint16, uint64(db.recordSize)),
+		"ip_version", encUint(typeUint16, 6),
+		"database_type", encString("Test-City-ASN"),
+		"build_epoch", encUint(typeUint64, 1700000000),
+	)...)
+	return out
+}
+
+func encHeader(typ, size int) []byte {
+	var first byte
+	var ext []byte
+	if typ > 7 {
+		ext = []byte{byte(typ - 7)}
+	} else {
+		first = byte(typ << 5)
+	}
+	var tail []byte
+	switch {
+	case size < 29:
+		first |= byte(size)
+	case size < 285:
+		first |= 29
+		tail = []byte{byte(size - 29)}
+	default:
+		first |= 30
+		tail = []byte{byte((size - 285) >> 8), byte(size - 285)}
+	}
+	return append(append([]byte{first}, ext...), tail...)
+}
+
+func encString(s string) []byte {
+	return append(encHeader(typeString, len(s)), s...)
+}
+
+func encUint(typ int, n uint64) []byte {
+	var raw []byte
+	for ; n > 0; n >>= 8 {
+		raw = append([]byte{byte(n)}, raw...)
+	}
+	return append(encHeader(typ, len(raw)), raw...)
+}
+
+func encPointer(offset int) []byte {
+	return []byte{byte(typePointer<<5) | byte(offset>>8&0x7), byte(offset)}
+}
+
+// encMap encodes alternating keys and pre-encoded values.
+func encMap(pairs ...any) []byte {
+	out := encHeader(typeMap, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		out = append(out, encString(pairs[i].(string))...)
+		out = append(out, pairs[i+1].([]byte)...)
+	}
+	return out
+}
+
+func cityRecord(country, city string) []byte {
+	return encMap(
+		"city", encMap("names", encMap("de", encString(city+" (de)"), "en", encString(city))),
+		"country", encMap("iso_code", encString(country), "geoname_id", encUint(typeUint32, 2921044)),
+		"location", encMap("accuracy_radius", encUint(typeUint16, 100)),
+	)
+}
+
+func asnRecord(asn uint64, org string) []byte {
+	return encMap("autonomous_system_number", encUint(typeUint32, asn), "autonomous_system_organization", encString(org))
+}
+
+func TestReaderLookup(t *testing.T) {
+	for _, size := range []int{24, 28, 32} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			db := newTestDB(size)
+			db.insert(t, "81.2.69.0/24", cityRecord("GB", "London"))
+			db.insert(t, "2001:db8::/32", cityRecord("DE", "Berlin"))
+			// The last record points at the organisation string of the one
+			// before it, as real databases do to share values.
+			org := len(db.data) + len(asnRecord(13335, "")) - len(encString(""))
+			db.insert(t, "1.1.1.0/24", asnRecord(13335, "Cloudflare"))
+			db.insert(t, "198.51.100.0/24", encMap(
+				"registered_country", encMap("iso_code", encString("US")),
+				"autonomous_system_organization", encPointer(org),
+			))
+
+			reader, err := FromBytes(db.bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta := reader.Metadata(); meta.DatabaseType != "Test-City-ASN" || meta.RecordSize != size {
+				t.Fatalf("metadata = %+v", meta)
+			}
+			tests := []struct {
+				ip   string
+				want Info
+			}{
+				{"81.2.69.160", Info{Country: "GB", City: "London"}},
+				{"::ffff:81.2.69.1", Info{Country: "GB", City: "London"}},
+				{"2001:db8:1::1", Info{Country: "DE", City: "Berlin"}},
+				{"1.1.1.1", Info{ASN: 13335, ASOrg: "Cloudflare"}},
+				{"198.51.100.9", Info{Country: "US", ASOrg: "Cloudflare"}},
+				{"192.0.2.1", Info{}},
+				{"2001:db9::1", Info{}},
+			}
+			for _, tc := range tests {
+				got, err := reader.Lookup(netip.MustParseAddr(tc.ip))
+				if err != nil || got != tc.want {
+					t.Errorf("Lookup(%s) = %+v, %v; want %+v", tc.ip, got, err, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFromBytesRejectsOtherFiles(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); err == nil {
+		t.Fatal("FromBytes accepted a file without metadata")
+	}
+	db := newTestDB(24)
+	db.insert(t, "10.0.0.0/8", cityRecord("NL", "Amsterdam"))
+	file := db.bytes()
+	if _, err := FromBytes(file[len(file)/2:]); err == nil {
+		t.Fatal("FromBytes accepted a truncated database")
+	}
+}
+
+func TestResolverMergesAndReloads(t *testing.T) {
+	dir := t.TempDir()
+	cityPath := filepath.Join(dir, "city.mmdb")
+	asnPath := filepath.Join(dir, "asn.mmdb")
+
+	city := newTestDB(24)
+	city.insert(t, "203.0.113.0/24", cityRecord("FR", "Paris"))
+	writeDB(t, cityPath, city)
+	asn := newTestDB(24)
+	asn.insert(t, "203.0.113.0/24", asnRecord(64500, "Example Transit"))
+	writeDB(t, asnPath, asn)
+
+	resolver, err := NewResolver([]string{cityPath, asnPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Info{Country: "FR", City: "Paris", ASN: 64500, ASOrg: "Example Transit"}
+	if got := resolver.Lookup("203.0.113.7"); got != want {
+		t.Fatalf("Lookup = %+v, want %+v", got, want)
+	}
+	if got := resolver.Lookup("not-an-ip"); !got.IsZero() {
+		t.Fatalf("Lookup(invalid) = %+v", got)
+	}
+
+	// A half-written replacement keeps the previous copy in service.
+	if err := os.WriteFile(cityPath, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resolver.Reload()
+	if got := resolver.Lookup("203.0.113.7"); got.City != "Paris" {
+		t.Fatalf("after failed reload City = %q", got.City)
+	}
+
+	updated := newTestDB(24)
+	updated.insert(t, "203.0.113.0/24", cityRecord("BE", "Brussels"))
+	writeDB(t, cityPath, updated)
+	resolver.Reload()
+	if got := resolver.Lookup("203.0.113.7"); got.Country != "BE" || got.City != "Brussels" || got.ASN != 64500 {
+		t.Fatalf("after reload = %+v", got)
+	}
+
+	if _, err := NewResolver([]string{filepath.Join(dir, "missing.mmdb")}); err == nil {
+		t.Fatal("NewResolver accepted a missing file")
+	}
+	var none *Resolver
+	if got := none.Lookup("203.0.113.7"); !got.IsZero() {
+		t.Fatal("nil resolver should know nothing")
+	}
+}
+
+func writeDB(t *testing.T, path string, db *testDB) {
+	t.Helper()
+	if err := os.WriteFile(path, db.bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Make each write visible to the modification-time check even on
+	// filesystems with coarse timestamps.
+	stamp := time.Now().Add(time.Duration(len(db.data)) * time.Second)
+	if err := os.Chtimes(path, stamp, stamp); err != nil {
+		t.Fatal(err)
+	}
+}
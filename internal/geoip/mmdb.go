@@ -0,0 +1,412 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+)
+
+// metadataMarker precedes the metadata map at the end of every MaxMind DB
+// file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// maxMetadataSize bounds the search for the metadata marker, as in the spec.
+const maxMetadataSize = 128 << 10
+
+// dataSectionSeparator is the run of zero bytes between the search tree and
+// the data section.
+const dataSectionSeparator = 16
+
+// Data section field types from the MaxMind DB format specification.
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEndMarker = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+var errCorrupt = errors.New("corrupt MaxMind database")
+
+// Metadata describes a database file.
+type Metadata struct {
+	DatabaseType string
+	IPVersion    int
+	RecordSize   int
+	NodeCount    uint32
+	BuildEpoch   uint64
+}
+
+// mmdb is a parsed MaxMind DB file held in memory.
+type mmdb struct {
+	meta      Metadata
+	tree      []byte
+	data      []byte
+	nodeBytes int
+	// ipv4Start is the node where IPv4 lookups begin in an IPv6 tree, after
+	// the 96 leading zero bits of the IPv4-compatible range.
+	ipv4Start uint32
+	ipv4Depth int
+}
+
+func parseMMDB(file []byte) (*mmdb, error) {
+	start := len(file) - maxMetadataSize
+	if start < 0 {
+		start = 0
+	}
+	marker := bytes.LastIndex(file[start:], metadataMarker)
+	if marker < 0 {
+		return nil, errors.New("not a MaxMind database: metadata marker not found")
+	}
+	metaStart := start + marker + len(metadataMarker)
+	raw, _, err := (&decoder{buf: file[metaStart:]}).value(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("decode metadata: %w", err)
+	}
+	fields, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("decode metadata: %w", errCorrupt)
+	}
+	db := &mmdb{meta: Metadata{
+		DatabaseType: stringField(fields["database_type"]),
+		IPVersion:    int(uintField(fields["ip_version"])),
+		RecordSize:   int(uintField(fields["record_size"])),
+		NodeCount:    uint32(uintField(fields["node_count"])),
+		BuildEpoch:   uintField(fields["build_epoch"]),
+	}}
+	switch db.meta.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", db.meta.RecordSize)
+	}
+	if db.meta.IPVersion != 4 && db.meta.IPVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.meta.IPVersion)
+	}
+	db.nodeBytes = db.meta.RecordSize / 4
+	treeSize := int(db.meta.NodeCount) * db.nodeBytes
+	dataStart := treeSize + dataSectionSeparator
+	dataEnd := start + marker
+	if treeSize <= 0 || dataStart > dataEnd {
+		return nil, fmt.Errorf("search tree exceeds file: %w", errCorrupt)
+	}
+	db.tree = file[:treeSize]
+	db.data = file[dataStart:dataEnd]
+
+	if db.meta.IPVersion == 6 {
+		node := uint32(0)
+		for i := 0; i < 96 && node < db.meta.NodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start, db.ipv4Depth = node, 96
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (db *mmdb) record(node uint32, bit int) uint32 {
+	b := db.tree[int(node)*db.nodeBytes:]
+	switch db.meta.RecordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		return binary.BigEndian.Uint32(b[bit*4:])
+	}
+}
+
+// lookup returns the data section offset of the record for addr.
+func (db *mmdb) lookup(addr netip.Addr) (int, bool, error) {
+	addr = addr.Unmap()
+	var (
+		ip    []byte
+		node  uint32
+		depth int
+	)
+	if addr.Is4() {
+		ip = addr.AsSlice()
+		if db.meta.IPVersion == 6 {
+			node, depth = db.ipv4Start, 0
+		}
+	} else {
+		if db.meta.IPVersion == 4 {
+			return 0, false, nil
+		}
+		ip = addr.AsSlice()
+	}
+	bits := len(ip) * 8
+	for ; depth < bits && node < db.meta.NodeCount; depth++ {
+		bit := int(ip[depth/8]>>(7-uint(depth%8))) & 1
+		node = db.record(node, bit)
+	}
+	switch {
+	case node == db.meta.NodeCount:
+		return 0, false, nil
+	case node < db.meta.NodeCount:
+		return 0, false, fmt.Errorf("search tree too deep: %w", errCorrupt)
+	}
+	offset := int(node-db.meta.NodeCount) - dataSectionSeparator
+	if offset < 0 || offset >= len(db.data) {
+		return 0, false, fmt.Errorf("record points outside data section: %w", errCorrupt)
+	}
+	return offset, true, nil
+}
+
+// decoder reads values from a data section. Offsets are relative to buf.
+type decoder struct {
+	buf []byte
+}
+
+// header decodes a control byte and returns the field type, its size (or
+// pointer target) and the offset of the payload.
+func (d *decoder) header(offset int) (typ int, size int, next int, err error) {
+	if offset >= len(d.buf) {
+		return 0, 0, 0, errCorrupt
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ = int(ctrl >> 5)
+	if typ == typePointer {
+		return d.pointer(ctrl, offset)
+	}
+	if typ == typeExtended {
+		if offset >= len(d.buf) {
+			return 0, 0, 0, errCorrupt
+		}
+		typ = 7 + int(d.buf[offset])
+		offset++
+	}
+	size = int(ctrl & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > len(d.buf) {
+			return 0, 0, 0, errCorrupt
+		}
+		n := 0
+		for _, b := range d.buf[offset : offset+extra] {
+			n = n<<8 | int(b)
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + n
+		case 2:
+			size = 285 + n
+		default:
+			size = 65821 + n
+		}
+	}
+	return typ, size, offset, nil
+}
+
+func (d *decoder) pointer(ctrl byte, offset int) (int, int, int, error) {
+	length := int(ctrl>>3&0x3) + 1
+	if offset+length > len(d.buf) {
+		return 0, 0, 0, errCorrupt
+	}
+	n := 0
+	if length != 4 {
+		n = int(ctrl & 0x7)
+	}
+	for _, b := range d.buf[offset : offset+length] {
+		n = n<<8 | int(b)
+	}
+	switch length {
+	case 2:
+		n += 2048
+	case 3:
+		n += 526336
+	}
+	return typePointer, n, offset + length, nil
+}
+
+// resolve follows a pointer, returning the type, size and payload offset of
+// the value at offset together with the offset after it in the original
+// stream.
+func (d *decoder) resolve(offset int) (typ, size, payload, next int, err error) {
+	typ, size, payload, err = d.header(offset)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if typ != typePointer {
+		next, err = d.end(typ, size, payload)
+		return typ, size, payload, next, err
+	}
+	next = payload
+	typ, size, payload, err = d.header(size)
+	if err != nil || typ == typePointer {
+		return 0, 0, 0, 0, errCorrupt
+	}
+	return typ, size, payload, next, nil
+}
+
+// end returns the offset just past a value whose payload starts at payload.
+func (d *decoder) end(typ, size, payload int) (int, error) {
+	switch typ {
+	case typeMap, typeArray:
+		count := size
+		if typ == typeMap {
+			count *= 2
+		}
+		offset := payload
+		for i := 0; i < count; i++ {
+			_, _, _, next, err := d.resolve(offset)
+			if err != nil {
+				return 0, err
+			}
+			offset = next
+		}
+		return offset, nil
+	case typeBool, typeEndMarker, typeContainer:
+		return payload, nil
+	default:
+		if payload+size > len(d.buf) {
+			return 0, errCorrupt
+		}
+		return payload + size, nil
+	}
+}
+
+// value decodes the value at offset into Go types: map[string]any, []any,
+// string, []byte, uint64, int64, float64 or bool. Unsigned 128-bit integers
+// are returned as []byte.
+func (d *decoder) value(offset, depth int) (any, int, error) {
+	if depth > 32 {
+		return nil, 0, errCorrupt
+	}
+	typ, size, payload, next, err := d.resolve(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ != typeMap && typ != typeArray && typ != typeBool && payload+size > len(d.buf) {
+		return nil, 0, errCorrupt
+	}
+	raw := d.buf[payload:min(payload+size, len(d.buf))]
+	switch typ {
+	case typeString:
+		return string(raw), next, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), raw...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		var n uint64
+		for _, b := range raw {
+			n = n<<8 | uint64(b)
+		}
+		return n, next, nil
+	case typeInt32:
+		var n uint32
+		for _, b := range raw {
+			n = n<<8 | uint32(b)
+		}
+		return int64(int32(n)), next, nil
+	case typeBool:
+		return size != 0, next, nil
+	case typeArray:
+		values := make([]any, 0, size)
+		offset := payload
+		for i := 0; i < size; i++ {
+			item, after, err := d.value(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, item)
+			offset = after
+		}
+		return values, next, nil
+	case typeMap:
+		values := make(map[string]any, size)
+		offset := payload
+		for i := 0; i < size; i++ {
+			key, after, err := d.value(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errCorrupt
+			}
+			item, after, err := d.value(after, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values[name] = item
+			offset = after
+		}
+		return values, next, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d: %w", typ, errCorrupt)
+	}
+}
+
+// find walks nested maps along path without decoding unrelated fields and
+// returns the value at the end of it.
+func (d *decoder) find(offset int, path ...string) (any, bool, error) {
+	for _, key := range path {
+		typ, size, payload, _, err := d.resolve(offset)
+		if err != nil {
+			return nil, false, err
+		}
+		if typ != typeMap {
+			return nil, false, nil
+		}
+		found := false
+		cursor := payload
+		for i := 0; i < size; i++ {
+			name, after, err := d.value(cursor, 0)
+			if err != nil {
+				return nil, false, err
+			}
+			if name == key {
+				offset, found = after, true
+				break
+			}
+			_, _, _, cursor, err = d.resolve(after)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		if !found {
+			return nil, false, nil
+		}
+	}
+	value, _, err := d.value(offset, 0)
+	return value, err == nil, err
+}
+
+func stringField(value any) string {
+	s, _ := value.(string)
+	return s
+}
+
+func uintField(value any) uint64 {
+	n, _ := value.(uint64)
+	return n
+}
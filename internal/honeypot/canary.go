@@ -0,0 +1,271 @@
+package honeypot
+
+import (
+	"bytes"
+	"container/list"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxCanaries = 100000
+	// maxInspectBytes bounds how much of a request body is searched for
+	// canaries, as the WAF bounds its own inspection.
+	maxInspectBytes = 64 << 10
+	// minCanaryLength keeps short words out of the lookups; every canary
+	// format is longer.
+	minCanaryLength = 16
+)
+
+// Scrape records who was served a canary.
+type Scrape struct {
+	Token     string    `json:"token"`
+	Label     string    `json:"label"`
+	Trap      string    `json:"trap"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Hits      int       `json:"hits"`
+}
+
+// Sighting is a request presenting a canary, and where in the request it
+// was found: "header:<name>", "basic-auth", "query" or "body".
+type Sighting struct {
+	Where  string
+	Scrape Scrape
+}
+
+// Ledger remembers the canaries the honeypot served and finds them in later
+// requests, so a leaked credential can be traced back to the scrape it came
+// from whichever address uses it. Entries older than the retention are
+// pruned; past the size limit the least recently served are dropped. A nil
+// *Ledger records and finds nothing.
+type Ledger struct {
+	db        *sql.DB
+	retention time.Duration
+	max       int
+	now       func() time.Time
+
+	mu      sync.RWMutex
+	tokens  map[string]*list.Element
+	recency list.List
+}
+
+// NewLedger returns a ledger keeping canaries for retention. When db is
+// non-nil, unexpired canaries are loaded from it and every change is
+// written back.
+func NewLedger(db *sql.DB, retention time.Duration) (*Ledger, error) {
+	l := &Ledger{
+		db:        db,
+		retention: retention,
+		max:       defaultMaxCanaries,
+		now:       time.Now,
+		tokens:    make(map[string]*list.Element),
+	}
+	if db != nil {
+		if err := l.load(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *Ledger) load() error {
+	rows, err := l.db.Query(`SELECT token, label, trap, client_ip, user_agent, host, path, first_seen, last_seen, hits
+		FROM honeypot_canaries WHERE last_seen > ? ORDER BY last_seen`, l.now().Add(-l.retention).Unix())
+	if err != nil {
+		return fmt.Errorf("load canaries: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			s                   Scrape
+			firstSeen, lastSeen int64
+		)
+		if err := rows.Scan(&s.Token, &s.Label, &s.Trap, &s.ClientIP, &s.UserAgent, &s.Host, &s.Path, &firstSeen, &lastSeen, &s.Hits); err != nil {
+			return fmt.Errorf("scan canary: %w", err)
+		}
+		s.FirstSeen, s.LastSeen = time.Unix(firstSeen, 0), time.Unix(lastSeen, 0)
+		l.putLocked(s)
+	}
+	return rows.Err()
+}
+
+// Record remembers the canaries served in a trap hit. Per-client canaries
+// are stable, so a repeated scrape updates the existing entries.
+func (l *Ledger) Record(event Event) error {
+	if l == nil || len(event.Canaries) == 0 {
+		return nil
+	}
+	scrapes := make([]Scrape, 0, len(event.Canaries))
+	l.mu.Lock()
+	for label, token := range event.Canaries {
+		s := Scrape{
+			Token:     token,
+			Label:     label,
+			Trap:      event.Trap,
+			ClientIP:  event.ClientIP,
+			UserAgent: event.Headers.Get("User-Agent"),
+			Host:      event.Host,
+			Path:      event.Path,
+			FirstSeen: event.Time,
+			LastSeen:  event.Time,
+			Hits:      1,
+		}
+		if element, ok := l.tokens[token]; ok {
+			previous := element.Value.(Scrape)
+			s.FirstSeen, s.Hits = previous.FirstSeen, previous.Hits+1
+		}
+		l.putLocked(s)
+		scrapes = append(scrapes, s)
+	}
+	l.mu.Unlock()
+
+	if l.db == nil {
+		return nil
+	}
+	for _, s := range scrapes {
+		_, err := l.db.Exec(`INSERT INTO honeypot_canaries (token, label, trap, client_ip, user_agent, host, path, first_seen, last_seen, hits)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(token) DO UPDATE SET label=excluded.label, trap=excluded.trap, client_ip=excluded.client_ip,
+				user_agent=excluded.user_agent, host=excluded.host, path=excluded.path, last_seen=excluded.last_seen, hits=excluded.hits`,
+			s.Token, s.Label, s.Trap, s.ClientIP, s.UserAgent, s.Host, s.Path, s.FirstSeen.Unix(), s.LastSeen.Unix(), s.Hits)
+		if err != nil {
+			return fmt.Errorf("persist canary: %w", err)
+		}
+	}
+	return nil
+}
+
+// putLocked stores s as the most recently served canary, dropping the least
+// recently served one past the size limit.
+func (l *Ledger) putLocked(s Scrape) {
+	if element, ok := l.tokens[s.Token]; ok {
+		element.Value = s
+		l.recency.MoveToFront(element)
+		return
+	}
+	l.tokens[s.Token] = l.recency.PushFront(s)
+	if l.recency.Len() > l.max {
+		oldest := l.recency.Back()
+		l.recency.Remove(oldest)
+		delete(l.tokens, oldest.Value.(Scrape).Token)
+	}
+}
+
+// Find searches r's headers, credentials, query and the first 64 KiB of its
+// body for recorded canaries. The body is restored for the upstream.
+func (l *Ledger) Find(r *http.Request) []Sighting {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	empty := len(l.tokens) == 0
+	l.mu.RUnlock()
+	if empty {
+		return nil
+	}
+
+	var sightings []Sighting
+	seen := make(map[string]bool)
+	search := func(where, text string) {
+		for _, token := range l.lookup(text) {
+			if !seen[token.Token] {
+				seen[token.Token] = true
+				sightings = append(sightings, Sighting{Where: where, Scrape: token})
+			}
+		}
+	}
+	for name, values := range r.Header {
+		for _, value := range values {
+			search("header:"+name, value)
+		}
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		search("basic-auth", user+":"+password)
+	}
+	search("query", r.URL.RawQuery)
+	if query, err := url.QueryUnescape(r.URL.RawQuery); err == nil {
+		search("query", query)
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		prefix, _ := io.ReadAll(io.LimitReader(r.Body, maxInspectBytes))
+		r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(prefix), r.Body), Closer: r.Body}
+		body := string(prefix)
+		search("body", body)
+		if decoded, err := url.QueryUnescape(body); err == nil {
+			search("body", decoded)
+		}
+	}
+	return sightings
+}
+
+// lookup returns the recorded canaries among the words of text. Words are
+// split twice: keeping '+' and '/' for base64 secrets, and on them for
+// tokens inside paths.
+func (l *Ledger) lookup(text string) []Scrape {
+	if len(text) < minCanaryLength {
+		return nil
+	}
+	var found []Scrape
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, split := range []func(rune) bool{notBase64, notAlphanumeric} {
+		for _, word := range strings.FieldsFunc(text, split) {
+			if len(word) < minCanaryLength {
+				continue
+			}
+			if element, ok := l.tokens[word]; ok {
+				found = append(found, element.Value.(Scrape))
+			}
+		}
+	}
+	return found
+}
+
+func notAlphanumeric(r rune) bool {
+	return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+}
+
+func notBase64(r rune) bool {
+	return notAlphanumeric(r) && r != '+' && r != '/'
+}
+
+// Prune drops canaries last served before the retention period.
+func (l *Ledger) Prune() error {
+	if l == nil {
+		return nil
+	}
+	cutoff := l.now().Add(-l.retention)
+	l.mu.Lock()
+	for element := l.recency.Back(); element != nil; element = l.recency.Back() {
+		s := element.Value.(Scrape)
+		if s.LastSeen.After(cutoff) {
+			break
+		}
+		l.recency.Remove(element)
+		delete(l.tokens, s.Token)
+	}
+	l.mu.Unlock()
+	if l.db == nil {
+		return nil
+	}
+	if _, err := l.db.Exec(`DELETE FROM honeypot_canaries WHERE last_seen <= ?`, cutoff.Unix()); err != nil {
+		return fmt.Errorf("prune canaries: %w", err)
+	}
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
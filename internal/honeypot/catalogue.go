@@ -0,0 +1,77 @@
+package honeypot
+
+// Responses are the built-in trap responses by name.
+var Responses = map[string]Response{
+	"env": {ContentType: "text/plain", Body: `APP_ENV=production
+APP_KEY=base64:{{.AWSSecretKey "app_key"}}
+DB_HOST=10.0.3.12
+DB_USERNAME=app
+DB_PASSWORD={{.Password "db_password"}}
+AWS_ACCESS_KEY_ID={{.AWSAccessKeyID "aws_access_key_id"}}
+AWS_SECRET_ACCESS_KEY={{.AWSSecretKey "aws_secret_access_key"}}
+STRIPE_SECRET=sk_live_{{.Canary "stripe_secret"}}
+`},
+	"git-config": {ContentType: "text/plain", Body: `[core]
+	repositoryformatversion = 0
+	filemode = true
+	bare = false
+	logallrefupdates = true
+[remote "origin"]
+	url = https://deploy:{{.Canary "git_token"}}@git.internal/app.git
+	fetch = +refs/heads/*:refs/remotes/origin/*
+`},
+	"aws-credentials": {ContentType: "text/plain", Body: `[default]
+aws_access_key_id = {{.AWSAccessKeyID "aws_access_key_id"}}
+aws_secret_access_key = {{.AWSSecretKey "aws_secret_access_key"}}
+region = us-east-1
+`},
+	"wp-login": {ContentType: "text/html; charset=utf-8", Body: `<!DOCTYPE html>
+<html lang="en-US">
+<head><meta charset="UTF-8"><title>Log In &lsaquo; {{.Host}} &#8212; WordPress</title>
+<meta name="robots" content="noindex, nofollow"></head>
+<body class="login no-js login-action-login wp-core-ui">
+<div id="login"><h1><a href="https://wordpress.org/">Powered by WordPress</a></h1>
+<form name="loginform" id="loginform" action="/wp-login.php" method="post">
+<p><label for="user_login">Username or Email Address</label><input type="text" name="log" id="user_login" size="20"></p>
+<p><label for="user_pass">Password</label><input type="password" name="pwd" id="user_pass" size="20"></p>
+<p class="submit"><input type="submit" name="wp-submit" id="wp-submit" value="Log In">
+<input type="hidden" name="redirect_to" value="/wp-admin/"><input type="hidden" name="testcookie" value="1"></p>
+<input type="hidden" name="_wpnonce" value="{{.Canary "wp_nonce"}}">
+</form></div></body></html>
+`},
+	"phpinfo": {ContentType: "text/html; charset=utf-8", Body: `<!DOCTYPE html>
+<html><head><title>PHP 8.1.2-1ubuntu2.14 - phpinfo()</title></head>
+<body><div class="center"><table><tr class="h"><td><h1 class="p">PHP Version 8.1.2-1ubuntu2.14</h1></td></tr></table>
+<table>
+<tr><td class="e">System </td><td class="v">Linux web-01 5.15.0-91-generic #101-Ubuntu SMP x86_64 </td></tr>
+<tr><td class="e">Server API </td><td class="v">FPM/FastCGI </td></tr>
+<tr><td class="e">Loaded Configuration File </td><td class="v">/etc/php/8.1/fpm/php.ini </td></tr>
+<tr><td class="e">$_SERVER['HTTP_HOST']</td><td class="v">{{.Host}}</td></tr>
+<tr><td class="e">$_SERVER['DB_PASSWORD']</td><td class="v">{{.Password "db_password"}}</td></tr>
+<tr><td class="e">$_SERVER['AWS_ACCESS_KEY_ID']</td><td class="v">{{.AWSAccessKeyID "aws_access_key_id"}}</td></tr>
+<tr><td class="e">$_SERVER['AWS_SECRET_ACCESS_KEY']</td><td class="v">{{.AWSSecretKey "aws_secret_access_key"}}</td></tr>
+</table></div></body></html>
+`},
+	"admin-panel": {ContentType: "text/html; charset=utf-8", Body: `<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><title>Administration - Sign in</title></head>
+<body><main><h1>Administration</h1>
+<form method="post" action="{{.Path}}">
+<label>User <input name="username" autocomplete="username"></label>
+<label>Password <input name="password" type="password" autocomplete="current-password"></label>
+<input type="hidden" name="csrf_token" value="{{.Canary "csrf_token"}}">
+<button type="submit">Sign in</button>
+</form></main></body></html>
+`},
+}
+
+// DefaultTraps is the catalogue used when none is configured. It only
+// covers paths no real site serves; the WordPress, phpinfo and admin-panel
+// responses are left for configured traps, since those paths may be real
+// behind the proxy.
+func DefaultTraps() []Trap {
+	return []Trap{
+		{Name: "env", Paths: []string{"/.env", "/.env.*"}, Response: Responses["env"]},
+		{Name: "git", Paths: []string{"**/.git", "**/.git/**"}, Response: Responses["git-config"]},
+		{Name: "aws-credentials", Paths: []string{"**/.aws/credentials"}, Response: Responses["aws-credentials"]},
+	}
+}
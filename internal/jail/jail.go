@@ -0,0 +1,435 @@
+// Package jail bans clients that keep tripping the agent's defences, in the
+// style of fail2ban. The proxy reports events it already produces (WAF
+// blocks, honeypot hits, failed logins, 404 responses and rate-limit
+// rejections); a jail bans a client once it reports MaxHits matching events
+// within Window. Bans expire on their own and are persisted so they survive
+// restarts.
+package jail
+
+import (
+	"container/list"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Events reported by the proxy.
+const (
+	EventWAF          = "waf"
+	EventHoneypot     = "honeypot"
+	EventLoginFailure = "login-failure"
+	EventNotFound     = "not-found"
+	EventRateLimit    = "rate-limit"
+)
+
+// ManualJail names bans created through the admin API.
+const ManualJail = "manual"
+
+var ErrInvalidIP = errors.New("invalid IP address")
+
+// Rule is one jail.
+type Rule struct {
+	Name    string
+	Events  []string
+	MaxHits int
+	Window  time.Duration
+	BanTime time.Duration
+	// Tarpit asks for the jail's banned clients to be tarpitted rather than
+	// refused at once.
+	Tarpit bool
+}
+
+// DefaultRules are used when jails are enabled without explicit rules.
+func DefaultRules() []Rule {
+	return []Rule{
+		{Name: "waf", Events: []string{EventWAF}, MaxHits: 5, Window: time.Minute, BanTime: time.Hour},
+		{Name: "honeypot", Events: []string{EventHoneypot}, MaxHits: 1, Window: time.Minute, BanTime: 24 * time.Hour},
+		{Name: "login", Events: []string{EventLoginFailure}, MaxHits: 5, Window: 5 * time.Minute, BanTime: 15 * time.Minute},
+		{Name: "not-found", Events: []string{EventNotFound}, MaxHits: 50, Window: time.Minute, BanTime: 10 * time.Minute},
+		{Name: "rate-limit", Events: []string{EventRateLimit}, MaxHits: 20, Window: time.Minute, BanTime: 10 * time.Minute},
+	}
+}
+
+// Ban is an active ban.
+type Ban struct {
+	IP        string    `json:"ip"`
+	Jail      string    `json:"jail"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Manager tracks offenders and bans. A nil *Manager bans nobody.
+type Manager struct {
+	rules  []Rule
+	ignore []netip.Prefix
+	db     *sql.DB
+	now    func() time.Time
+
+	mu           sync.Mutex
+	offenders    map[offenderKey]*offender
+	recency      list.List
+	maxOffenders int
+	lastPrune    time.Time
+
+	bansMu sync.RWMutex
+	bans   map[string]Ban
+}
+
+type offenderKey struct {
+	jail, ip string
+}
+
+type offender struct {
+	hits    []time.Time
+	element *list.Element
+}
+
+const defaultMaxOffenders = 100000
+
+// New returns a manager for the given jails. Clients inside an ignore prefix
+// are never banned. When db is non-nil, unexpired bans are loaded from it and
+// every ban change is written back.
+func New(db *sql.DB, rules []Rule, ignore []string) (*Manager, error) {
+	m := &Manager{
+		db:           db,
+		now:          time.Now,
+		offenders:    make(map[offenderKey]*offender),
+		maxOffenders: defaultMaxOffenders,
+		bans:         make(map[string]Ban),
+	}
+	for _, rule := range rules {
+		rule.Name = strings.TrimSpace(rule.Name)
+		if rule.Name == "" || len(rule.Events) == 0 {
+			return nil, fmt.Errorf("jail %q needs a name and at least one event", rule.Name)
+		}
+		if rule.MaxHits <= 0 || rule.Window <= 0 || rule.BanTime <= 0 {
+			return nil, fmt.Errorf("jail %q needs positive max hits, window and ban time", rule.Name)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	for _, entry := range ignore {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("jail ignore entry %q: %w", entry, err)
+		}
+		m.ignore = append(m.ignore, prefix)
+	}
+	if db != nil {
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Manager) load() error {
+	rows, err := m.db.Query(`SELECT ip, jail, reason, created_at, expires_at FROM jail_bans WHERE expires_at > ?`, m.now().Unix())
+	if err != nil {
+		return fmt.Errorf("load bans: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			ban              Ban
+			created, expires int64
+		)
+		if err := rows.Scan(&ban.IP, &ban.Jail, &ban.Reason, &created, &expires); err != nil {
+			return fmt.Errorf("scan ban: %w", err)
+		}
+		ban.CreatedAt, ban.ExpiresAt = time.Unix(created, 0), time.Unix(expires, 0)
+		m.bans[ban.IP] = ban
+	}
+	return rows.Err()
+}
+
+// Banned returns the active ban for ip, if any.
+func (m *Manager) Banned(ip string) (Ban, bool) {
+	if m == nil {
+		return Ban{}, false
+	}
+	m.bansMu.RLock()
+	ban, ok := m.bans[canonicalIP(ip)]
+	m.bansMu.RUnlock()
+	if !ok || !m.now().Before(ban.ExpiresAt) {
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+// Record reports an event for ip. It returns the ban when this event pushed
+// the client over a jail's threshold.
+func (m *Manager) Record(ip, event string) (Ban, bool) {
+	if m == nil {
+		return Ban{}, false
+	}
+	ip = canonicalIP(ip)
+	if ip == "" || m.ignored(ip) {
+		return Ban{}, false
+	}
+	if _, banned := m.Banned(ip); banned {
+		return Ban{}, false
+	}
+
+	now := m.now()
+	var trip *Rule
+	m.mu.Lock()
+	m.pruneLocked(now)
+	for i := range m.rules {
+		rule := &m.rules[i]
+		if !slices.Contains(rule.Events, event) {
+			continue
+		}
+		key := offenderKey{jail: rule.Name, ip: ip}
+		o := m.offenders[key]
+		if o == nil {
+			m.ensureCapacityLocked()
+			o = &offender{element: m.recency.PushFront(key)}
+			m.offenders[key] = o
+		} else {
+			m.recency.MoveToFront(o.element)
+		}
+		o.hits = append(dropBefore(o.hits, now.Add(-rule.Window)), now)
+		if len(o.hits) >= rule.MaxHits && trip == nil {
+			trip = rule
+			m.removeLocked(key, o)
+		}
+	}
+	m.mu.Unlock()
+
+	if trip == nil {
+		return Ban{}, false
+	}
+	ban := Ban{
+		IP:        ip,
+		Jail:      trip.Name,
+		Reason:    fmt.Sprintf("%d %s events within %s", trip.MaxHits, event, trip.Window),
+		CreatedAt: now,
+		ExpiresAt: now.Add(trip.BanTime),
+	}
+	if err := m.store(ban); err != nil {
+		log.Error().Err(err).Str("ip", ip).Str("jail", ban.Jail).Msg("Ban is enforced but was not persisted")
+	}
+	return ban, true
+}
+
+// Ban bans ip by hand for the given duration.
+func (m *Manager) Ban(ip, jail, reason string, duration time.Duration) (Ban, error) {
+	if m == nil {
+		return Ban{}, errors.New("jails are disabled")
+	}
+	ip = canonicalIP(ip)
+	if ip == "" {
+		return Ban{}, ErrInvalidIP
+	}
+	if duration <= 0 {
+		return Ban{}, errors.New("ban duration must be positive")
+	}
+	now := m.now()
+	ban := Ban{IP: ip, Jail: ifEmpty(jail, ManualJail), Reason: reason, CreatedAt: now, ExpiresAt: now.Add(duration)}
+	return ban, m.store(ban)
+}
+
+// Unban lifts the ban on ip and reports whether one was active.
+func (m *Manager) Unban(ip string) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+	ip = canonicalIP(ip)
+	if ip == "" {
+		return false, ErrInvalidIP
+	}
+	_, active := m.Banned(ip)
+	m.bansMu.Lock()
+	delete(m.bans, ip)
+	m.bansMu.Unlock()
+	m.mu.Lock()
+	for key, o := range m.offenders {
+		if key.ip == ip {
+			m.removeLocked(key, o)
+		}
+	}
+	m.mu.Unlock()
+	if m.db != nil {
+		if _, err := m.db.Exec(`DELETE FROM jail_bans WHERE ip = ?`, ip); err != nil {
+			return active, fmt.Errorf("delete ban: %w", err)
+		}
+	}
+	return active, nil
+}
+
+// Bans lists the active bans, soonest expiry first.
+func (m *Manager) Bans() []Ban {
+	if m == nil {
+		return nil
+	}
+	now := m.now()
+	m.bansMu.RLock()
+	bans := make([]Ban, 0, len(m.bans))
+	for _, ban := range m.bans {
+		if now.Before(ban.ExpiresAt) {
+			bans = append(bans, ban)
+		}
+	}
+	m.bansMu.RUnlock()
+	sort.Slice(bans, func(i, j int) bool {
+		if !bans[i].ExpiresAt.Equal(bans[j].ExpiresAt) {
+			return bans[i].ExpiresAt.Before(bans[j].ExpiresAt)
+		}
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// Prune forgets expired bans, in memory and in the database.
+func (m *Manager) Prune() error {
+	if m == nil {
+		return nil
+	}
+	now := m.now()
+	m.bansMu.Lock()
+	for ip, ban := range m.bans {
+		if !now.Before(ban.ExpiresAt) {
+			delete(m.bans, ip)
+		}
+	}
+	m.bansMu.Unlock()
+	if m.db == nil {
+		return nil
+	}
+	if _, err := m.db.Exec(`DELETE FROM jail_bans WHERE expires_at <= ?`, now.Unix()); err != nil {
+		return fmt.Errorf("prune bans: %w", err)
+	}
+	return nil
+}
+
+// store publishes a ban before persisting it, so it is enforced even if the
+// database write fails.
+func (m *Manager) store(ban Ban) error {
+	m.bansMu.Lock()
+	m.bans[ban.IP] = ban
+	m.bansMu.Unlock()
+	if m.db == nil {
+		return nil
+	}
+	_, err := m.db.Exec(`INSERT INTO jail_bans (ip, jail, reason, created_at, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(ip) DO UPDATE SET jail=excluded.jail, reason=excluded.reason, created_at=excluded.created_at, expires_at=excluded.expires_at`,
+		ban.IP, ban.Jail, ban.Reason, ban.CreatedAt.Unix(), ban.ExpiresAt.Unix())
+	if err != nil {
+		return fmt.Errorf("persist ban: %w", err)
+	}
+	return nil
+}
+
+// Tarpits reports whether ban's jail asks for its clients to be tarpitted.
+func (m *Manager) Tarpits(ban Ban) bool {
+	if m == nil {
+		return false
+	}
+	for _, rule := range m.rules {
+		if rule.Name == ban.Jail {
+			return rule.Tarpit
+		}
+	}
+	return false
+}
+
+// Ignores reports whether ip is on the ignore list and never jailed.
+func (m *Manager) Ignores(ip string) bool {
+	return m != nil && m.ignored(canonicalIP(ip))
+}
+
+func (m *Manager) ignored(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range m.ignore {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneLocked drops offenders whose newest hit is older than every window.
+func (m *Manager) pruneLocked(now time.Time) {
+	if now.Sub(m.lastPrune) < time.Minute {
+		return
+	}
+	var longest time.Duration
+	for _, rule := range m.rules {
+		longest = max(longest, rule.Window)
+	}
+	for key, o := range m.offenders {
+		if len(o.hits) == 0 || now.Sub(o.hits[len(o.hits)-1]) > longest {
+			m.removeLocked(key, o)
+		}
+	}
+	m.lastPrune = now
+}
+
+func (m *Manager) ensureCapacityLocked() {
+	if m.maxOffenders <= 0 || len(m.offenders) < m.maxOffenders {
+		return
+	}
+	if oldest := m.recency.Back(); oldest != nil {
+		key := oldest.Value.(offenderKey)
+		m.removeLocked(key, m.offenders[key])
+	}
+}
+
+func (m *Manager) removeLocked(key offenderKey, o *offender) {
+	delete(m.offenders, key)
+	if o != nil && o.element != nil {
+		m.recency.Remove(o.element)
+		o.element = nil
+	}
+}
+
+func dropBefore(hits []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(hits) && !hits[i].After(cutoff) {
+		i++
+	}
+	return hits[i:]
+}
+
+// canonicalIP returns ip in netip's canonical form, unmapping IPv4-in-IPv6,
+// or "" if it is not an address.
+func canonicalIP(ip string) string {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return ""
+	}
+	return addr.Unmap().WithZone("").String()
+}
+
+func parsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func ifEmpty(value, fallback string) string {
+	if strings.TrimSpace(value) == "" {
+		return fallback
+	}
+	return value
+}
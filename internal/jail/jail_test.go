@@ -0,0 +1,162 @@
+package jail
+
+import (
+	"testing"
+	"time"
+
+	"netgoat.xyz/agent/internal/database"
+)
+
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time { return c.now }
+
+func newTestManager(t *testing.T, rules []Rule, ignore ...string) (*Manager, *clock) {
+	t.Helper()
+	m, err := New(nil, rules, ignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &clock{now: time.Unix(1700000000, 0)}
+	m.now = c.Now
+	return m, c
+}
+
+func TestBanAfterThresholdWithinWindow(t *testing.T) {
+	m, c := newTestManager(t, []Rule{{Name: "waf", Events: []string{EventWAF}, MaxHits: 3, Window: time.Minute, BanTime: time.Hour}})
+
+	m.Record("192.0.2.1", EventWAF)
+	c.now = c.now.Add(45 * time.Second)
+	m.Record("192.0.2.1", EventWAF)
+	c.now = c.now.Add(30 * time.Second)
+	// The first hit has left the window, so this is only the second.
+	if _, banned := m.Record("192.0.2.1", EventWAF); banned {
+		t.Fatal("hits outside the window should not count")
+	}
+	if _, banned := m.Record("192.0.2.1", EventNotFound); banned {
+		t.Fatal("events the jail does not watch should not count")
+	}
+	ban, banned := m.Record("192.0.2.1", EventWAF)
+	if !banned || ban.Jail != "waf" || !ban.ExpiresAt.Equal(c.now.Add(time.Hour)) {
+		t.Fatalf("ban = %+v, %v", ban, banned)
+	}
+	if _, banned := m.Banned("::ffff:192.0.2.1"); !banned {
+		t.Fatal("mapped form of a banned address should be banned")
+	}
+	if _, banned := m.Banned("192.0.2.2"); banned {
+		t.Fatal("other clients should not be banned")
+	}
+
+	c.now = c.now.Add(time.Hour)
+	if _, banned := m.Banned("192.0.2.1"); banned {
+		t.Fatal("ban should expire")
+	}
+	if len(m.Bans()) != 0 {
+		t.Fatal("expired bans should not be listed")
+	}
+}
+
+func TestIgnoredClientsAreNeverBanned(t *testing.T) {
+	m, _ := newTestManager(t, []Rule{{Name: "honeypot", Events: []string{EventHoneypot}, MaxHits: 1, Window: time.Minute, BanTime: time.Hour}}, "10.0.0.0/8")
+	if _, banned := m.Record("10.1.2.3", EventHoneypot); banned {
+		t.Fatal("ignored client was banned")
+	}
+	if _, banned := m.Record("not-an-ip", EventHoneypot); banned {
+		t.Fatal("invalid address was banned")
+	}
+}
+
+func TestTarpitsFollowsTheBanningJail(t *testing.T) {
+	m, _ := newTestManager(t, []Rule{
+		{Name: "scanners", Events: []string{EventNotFound}, MaxHits: 1, Window: time.Minute, BanTime: time.Hour, Tarpit: true},
+		{Name: "login", Events: []string{EventLoginFailure}, MaxHits: 1, Window: time.Minute, BanTime: time.Hour},
+	})
+	scanner, _ := m.Record("192.0.2.1", EventNotFound)
+	login, _ := m.Record("192.0.2.2", EventLoginFailure)
+	manual, _ := m.Ban("192.0.2.3", "", "", time.Hour)
+	if !m.Tarpits(scanner) || m.Tarpits(login) || m.Tarpits(manual) {
+		t.Fatal("only the scanners jail tarpits")
+	}
+	var nilManager *Manager
+	if nilManager.Tarpits(scanner) || nilManager.Ignores("192.0.2.1") {
+		t.Fatal("nil manager tarpits or ignores")
+	}
+}
+
+func TestUnbanClearsBanAndCounters(t *testing.T) {
+	m, _ := newTestManager(t, []Rule{{Name: "login", Events: []string{EventLoginFailure}, MaxHits: 2, Window: time.Minute, BanTime: time.Hour}})
+	m.Record("2001:db8::1", EventLoginFailure)
+	if _, banned := m.Record("2001:db8::1", EventLoginFailure); !banned {
+		t.Fatal("expected a ban")
+	}
+	if lifted, err := m.Unban("2001:db8::1"); err != nil || !lifted {
+		t.Fatalf("Unban = %v, %v", lifted, err)
+	}
+	if _, banned := m.Record("2001:db8::1", EventLoginFailure); banned {
+		t.Fatal("counters should restart after an unban")
+	}
+	if lifted, _ := m.Unban("2001:db8::2"); lifted {
+		t.Fatal("unbanning a client without a ban should report false")
+	}
+	if _, err := m.Unban("bogus"); err != ErrInvalidIP {
+		t.Fatalf("Unban(bogus) error = %v", err)
+	}
+}
+
+func TestBansPersistAcrossRestarts(t *testing.T) {
+	db, err := database.Init(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	first, err := New(db, DefaultRules(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, banned := first.Record("198.51.100.4", EventHoneypot); !banned {
+		t.Fatal("default honeypot jail should ban on the first hit")
+	}
+	if _, err := first.Ban("198.51.100.5", "", "abuse report", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Ban("198.51.100.6", "", "", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Unban("198.51.100.6"); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := New(db, DefaultRules(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans := second.Bans()
+	if len(bans) != 2 || bans[0].IP != "198.51.100.5" || bans[0].Jail != ManualJail || bans[1].Jail != "honeypot" {
+		t.Fatalf("reloaded bans = %+v", bans)
+	}
+
+	second.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if err := second.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM jail_bans`).Scan(&stored); err != nil || stored != 1 {
+		t.Fatalf("stored bans after prune = %d, %v", stored, err)
+	}
+}
+
+func TestNewRejectsInvalidRules(t *testing.T) {
+	for _, rule := range []Rule{
+		{Events: []string{EventWAF}, MaxHits: 1, Window: time.Second, BanTime: time.Second},
+		{Name: "x", MaxHits: 1, Window: time.Second, BanTime: time.Second},
+		{Name: "x", Events: []string{EventWAF}, Window: time.Second, BanTime: time.Second},
+	} {
+		if _, err := New(nil, []Rule{rule}, nil); err == nil {
+			t.Fatalf("New accepted %+v", rule)
+		}
+	}
+	if _, err := New(nil, nil, []string{"not-a-cidr"}); err == nil {
+		t.Fatal("New accepted an invalid ignore entry")
+	}
+}
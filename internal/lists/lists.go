@@ -0,0 +1,298 @@
+// Package lists compiles named lists of IP addresses and CIDR prefixes, ASNs
+// and plain strings into immutable sets for fast membership checks.
+//
+// Addresses are held in a path-compressed radix trie per address family, so
+// a lookup visits at most one node per distinct prefix length on the path to
+// the address regardless of how many entries a list holds. ASNs ("AS13335")
+// and strings are matched exactly. Entries may expire; expired entries are
+// dropped when a set is compiled and ignored by lookups afterwards.
+package lists
+
+import (
+	"database/sql"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is one list member.
+type Entry struct {
+	Value string
+	// ExpiresAt is when the entry stops matching; zero never expires.
+	ExpiresAt time.Time
+}
+
+// Set is an immutable compiled collection of named lists.
+type Set struct {
+	lists map[string]*compiledList
+}
+
+type compiledList struct {
+	v4, v6  *node
+	asns    map[uint32]time.Time
+	strings map[string]time.Time
+	size    int
+}
+
+// Compile builds a set from lists of entries. Entries that parse as an IP
+// address or CIDR prefix match addresses, "AS<number>" entries match ASNs and
+// anything else matches the exact string. Entries already expired at now are
+// skipped.
+func Compile(lists map[string][]Entry, now time.Time) *Set {
+	set := &Set{lists: make(map[string]*compiledList, len(lists))}
+	for name, entries := range lists {
+		list := &compiledList{}
+		for _, entry := range entries {
+			if !entry.ExpiresAt.IsZero() && !now.Before(entry.ExpiresAt) {
+				continue
+			}
+			list.add(strings.TrimSpace(entry.Value), entry.ExpiresAt)
+		}
+		set.lists[name] = list
+	}
+	return set
+}
+
+// FromStrings converts lists of non-expiring values, as written in the agent
+// configuration, into entries.
+func FromStrings(lists map[string][]string) map[string][]Entry {
+	converted := make(map[string][]Entry, len(lists))
+	for name, values := range lists {
+		entries := make([]Entry, 0, len(values))
+		for _, value := range values {
+			entries = append(entries, Entry{Value: value})
+		}
+		converted[name] = entries
+	}
+	return converted
+}
+
+func (l *compiledList) add(value string, expires time.Time) {
+	if value == "" {
+		return
+	}
+	l.size++
+	if prefix, ok := ParsePrefix(value); ok {
+		if prefix.Addr().Is4() {
+			insert(&l.v4, prefix, expires)
+		} else {
+			insert(&l.v6, prefix, expires)
+		}
+		return
+	}
+	if asn, ok := ParseASN(value); ok {
+		if l.asns == nil {
+			l.asns = make(map[uint32]time.Time)
+		}
+		addExpiry(l.asns, asn, expires)
+		return
+	}
+	if l.strings == nil {
+		l.strings = make(map[string]time.Time)
+	}
+	addExpiry(l.strings, value, expires)
+}
+
+// Has reports whether a list with the given name exists, even if empty.
+func (s *Set) Has(name string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.lists[name]
+	return ok
+}
+
+// Len returns the number of live entries compiled into a list.
+func (s *Set) Len(name string) int {
+	if s == nil || s.lists[name] == nil {
+		return 0
+	}
+	return s.lists[name].size
+}
+
+// Contains reports whether value is in the named list. IP values match any
+// containing prefix, "AS<number>" values match ASN entries and other values
+// match exactly. Unknown lists contain nothing.
+func (s *Set) Contains(name, value string) bool {
+	if s == nil {
+		return false
+	}
+	list := s.lists[name]
+	if list == nil {
+		return false
+	}
+	value = strings.TrimSpace(value)
+	if expires, ok := list.strings[value]; ok && live(expires) {
+		return true
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return list.containsAddr(addr)
+	}
+	if asn, ok := ParseASN(value); ok {
+		expires, found := list.asns[asn]
+		return found && live(expires)
+	}
+	return false
+}
+
+// ContainsAddr reports whether addr is inside any prefix of the named list.
+func (s *Set) ContainsAddr(name string, addr netip.Addr) bool {
+	if s == nil || s.lists[name] == nil {
+		return false
+	}
+	return s.lists[name].containsAddr(addr)
+}
+
+// ContainsASN reports whether the named list holds the ASN.
+func (s *Set) ContainsASN(name string, asn uint32) bool {
+	if s == nil || s.lists[name] == nil {
+		return false
+	}
+	expires, found := s.lists[name].asns[asn]
+	return found && live(expires)
+}
+
+func (l *compiledList) containsAddr(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return lookup(l.v4, addr)
+	}
+	return lookup(l.v6, addr.WithZone(""))
+}
+
+// ParsePrefix parses an address or CIDR prefix. Single addresses become
+// full-length prefixes and IPv4-mapped IPv6 forms are unmapped.
+func ParsePrefix(value string) (netip.Prefix, bool) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		if prefix.Addr().Is4In6() {
+			bits := prefix.Bits() - 96
+			if bits < 0 {
+				return netip.Prefix{}, false
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+		}
+		return prefix.Masked(), true
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil || addr.Zone() != "" {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+// ParseASN parses "AS13335" (case-insensitive).
+func ParseASN(value string) (uint32, bool) {
+	if len(value) < 3 || !strings.EqualFold(value[:2], "AS") {
+		return 0, false
+	}
+	asn, err := strconv.ParseUint(value[2:], 10, 32)
+	return uint32(asn), err == nil
+}
+
+func live(expires time.Time) bool {
+	return expires.IsZero() || time.Now().Before(expires)
+}
+
+// longerExpiry keeps the longest-lived of two duplicate entries; a
+// non-expiring entry wins.
+func longerExpiry(a, b time.Time) time.Time {
+	if a.IsZero() || b.IsZero() {
+		return time.Time{}
+	}
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+func addExpiry[K comparable](m map[K]time.Time, key K, expires time.Time) {
+	if existing, ok := m[key]; ok {
+		expires = longerExpiry(existing, expires)
+	}
+	m[key] = expires
+}
+
+// Store publishes compiled sets atomically so readers never see a partial
+// update.
+type Store struct {
+	current atomic.Pointer[Set]
+}
+
+// NewStore returns a store holding an empty set.
+func NewStore() *Store {
+	store := &Store{}
+	store.current.Store(Compile(nil, time.Now()))
+	return store
+}
+
+// Set returns the currently published set.
+func (s *Store) Set() *Set {
+	if s == nil {
+		return nil
+	}
+	return s.current.Load()
+}
+
+// Contains checks the currently published set.
+func (s *Store) Contains(name, value string) bool {
+	return s.Set().Contains(name, value)
+}
+
+// Load compiles lists and publishes them.
+func (s *Store) Load(lists map[string][]Entry) {
+	s.current.Store(Compile(lists, time.Now()))
+}
+
+// Reload reads every list from the database and publishes it. The previous
+// set stays active if reading fails.
+func (s *Store) Reload(db *sql.DB) error {
+	now := time.Now()
+	rows, err := db.Query(`SELECT l.name, e.value, e.expires_at
+		FROM lists AS l
+		LEFT JOIN list_entries AS e ON e.list_name = l.name AND (e.expires_at IS NULL OR e.expires_at > ?)
+		ORDER BY l.name, e.id`, now.Unix())
+	if err != nil {
+		return fmt.Errorf("load lists: %w", err)
+	}
+	defer rows.Close()
+
+	lists := make(map[string][]Entry)
+	for rows.Next() {
+		var (
+			name    string
+			value   sql.NullString
+			expires sql.NullInt64
+		)
+		if err := rows.Scan(&name, &value, &expires); err != nil {
+			return fmt.Errorf("scan list entry: %w", err)
+		}
+		if !value.Valid {
+			if _, ok := lists[name]; !ok {
+				lists[name] = nil
+			}
+			continue
+		}
+		entry := Entry{Value: value.String}
+		if expires.Valid {
+			entry.ExpiresAt = time.Unix(expires.Int64, 0)
+		}
+		lists[name] = append(lists[name], entry)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate list entries: %w", err)
+	}
+	s.current.Store(Compile(lists, now))
+	return nil
+}
@@ -0,0 +1,113 @@
+package lists
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSetContains(t *testing.T) {
+	now := time.Now()
+	set := Compile(map[string][]Entry{
+		"corp": {
+			{Value: "10.0.0.0/8"},
+			{Value: "10.1.0.0/16"},
+			{Value: "192.0.2.7"},
+			{Value: "2001:db8::/32"},
+			{Value: "::ffff:198.51.100.0/120"},
+			{Value: "AS13335"},
+			{Value: "scanner"},
+		},
+		"temp": {
+			{Value: "203.0.113.0/24", ExpiresAt: now.Add(time.Hour)},
+			{Value: "203.0.113.9", ExpiresAt: now.Add(-time.Second)},
+			{Value: "expired", ExpiresAt: now.Add(-time.Second)},
+		},
+		"empty": nil,
+	}, now)
+
+	tests := []struct {
+		list, value string
+		want        bool
+	}{
+		{"corp", "10.200.3.4", true},
+		{"corp", "10.1.2.3", true},
+		{"corp", "11.0.0.1", false},
+		{"corp", "192.0.2.7", true},
+		{"corp", "192.0.2.8", false},
+		{"corp", "::ffff:10.0.0.1", true},
+		{"corp", "198.51.100.77", true},
+		{"corp", "2001:db8:1::1", true},
+		{"corp", "2001:db9::1", false},
+		{"corp", "as13335", true},
+		{"corp", "AS15169", false},
+		{"corp", "scanner", true},
+		{"corp", "Scanner", false},
+		{"temp", "203.0.113.9", true},
+		{"temp", "expired", false},
+		{"empty", "10.0.0.1", false},
+		{"missing", "10.0.0.1", false},
+	}
+	for _, tc := range tests {
+		if got := set.Contains(tc.list, tc.value); got != tc.want {
+			t.Errorf("Contains(%q, %q) = %v, want %v", tc.list, tc.value, got, tc.want)
+		}
+	}
+	if !set.Has("empty") || set.Has("missing") {
+		t.Fatal("Has should report configured lists, including empty ones")
+	}
+	if got := set.Len("temp"); got != 1 {
+		t.Fatalf("Len(temp) = %d, want 1 live entry", got)
+	}
+}
+
+func TestEntriesExpireAfterCompile(t *testing.T) {
+	set := Compile(map[string][]Entry{
+		"ban": {{Value: "192.0.2.1", ExpiresAt: time.Now().Add(20 * time.Millisecond)}},
+	}, time.Now())
+	if !set.Contains("ban", "192.0.2.1") {
+		t.Fatal("entry should match before it expires")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if set.Contains("ban", "192.0.2.1") {
+		t.Fatal("entry should stop matching once expired")
+	}
+}
+
+func TestTrieMatchesLinearScan(t *testing.T) {
+	var entries []Entry
+	var prefixes []netip.Prefix
+	for i := 0; i < 2000; i++ {
+		prefix := netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(i * 7), byte(i * 13), byte(i), 0}), 8+i%25).Masked()
+		entries = append(entries, Entry{Value: prefix.String()})
+		prefixes = append(prefixes, prefix)
+	}
+	set := Compile(map[string][]Entry{"big": entries}, time.Now())
+	for i := 0; i < 5000; i++ {
+		addr := netip.AddrFrom4([4]byte{byte(i * 31), byte(i * 17), byte(i * 3), byte(i)})
+		want := false
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr) {
+				want = true
+				break
+			}
+		}
+		if got := set.ContainsAddr("big", addr); got != want {
+			t.Fatalf("ContainsAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func BenchmarkContainsLargeList(b *testing.B) {
+	entries := make([]Entry, 0, 50000)
+	for i := 0; i < 50000; i++ {
+		entries = append(entries, Entry{Value: fmt.Sprintf("%d.%d.%d.0/24", 1+i%200, i/200%256, i%256)})
+	}
+	set := Compile(map[string][]Entry{"block": entries}, time.Now())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Contains("block", "203.0.113.50")
+	}
+}
@@ -0,0 +1,85 @@
+package lists
+
+import (
+	"net/netip"
+	"time"
+)
+
+// node is a path-compressed radix trie node. Each node owns a masked prefix;
+// children extend it by at least one bit, keyed by the first bit after it.
+type node struct {
+	prefix   netip.Prefix
+	children [2]*node
+	// entry marks prefixes that were listed, as opposed to branch points.
+	entry   bool
+	expires time.Time
+}
+
+func insert(root **node, prefix netip.Prefix, expires time.Time) {
+	for {
+		current := *root
+		if current == nil {
+			*root = &node{prefix: prefix, entry: true, expires: expires}
+			return
+		}
+		common := commonBits(current.prefix, prefix)
+		switch {
+		case common == current.prefix.Bits() && common == prefix.Bits():
+			if current.entry {
+				expires = longerExpiry(current.expires, expires)
+			}
+			current.entry, current.expires = true, expires
+			return
+		case common == current.prefix.Bits():
+			root = &current.children[bitAt(prefix.Addr(), common)]
+		default:
+			branch := &node{prefix: netip.PrefixFrom(prefix.Addr(), common).Masked()}
+			branch.children[bitAt(current.prefix.Addr(), common)] = current
+			if common == prefix.Bits() {
+				branch.entry, branch.expires = true, expires
+			} else {
+				branch.children[bitAt(prefix.Addr(), common)] = &node{prefix: prefix, entry: true, expires: expires}
+			}
+			*root = branch
+			return
+		}
+	}
+}
+
+func lookup(current *node, addr netip.Addr) bool {
+	for current != nil && current.prefix.Contains(addr) {
+		if current.entry && live(current.expires) {
+			return true
+		}
+		if current.prefix.Bits() == addr.BitLen() {
+			return false
+		}
+		current = current.children[bitAt(addr, current.prefix.Bits())]
+	}
+	return false
+}
+
+// commonBits returns the length of the shared leading bits of two prefixes
+// of the same family, capped at the shorter prefix length.
+func commonBits(a, b netip.Prefix) int {
+	limit := min(a.Bits(), b.Bits())
+	left, right := a.Addr().AsSlice(), b.Addr().AsSlice()
+	bits := 0
+	for i := range left {
+		if diff := left[i] ^ right[i]; diff != 0 {
+			for diff&0x80 == 0 {
+				diff <<= 1
+				bits++
+			}
+			return min(bits, limit)
+		}
+		bits += 8
+	}
+	return min(bits, limit)
+}
+
+// bitAt returns bit i of addr, counting from the most significant bit.
+func bitAt(addr netip.Addr, i int) int {
+	bytes := addr.AsSlice()
+	return int(bytes[i/8]>>(7-uint(i%8))) & 1
+}
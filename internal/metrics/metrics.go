@@ -26,11 +26,53 @@ type Recorder struct {
 	proxyErrors  atomic.Uint64
 	bytesWritten atomic.Uint64
 	latencyNanos atomic.Uint64
+	wafScored    atomic.Uint64
+	wafScoreSum  atomic.Uint64
+
+	mu         sync.Mutex
+	statuses   map[int]uint64
+	blocks     map[string]uint64
+	wafRules   map[string]uint64
+	canaryUses map[string]uint64
+	errors     map[string]*ErrorInfo
+
+	wafRuleStats atomic.Pointer[func() []WAFRuleStats]
+	tarpitStats  atomic.Pointer[func() TarpitStats]
+	concurrency  atomic.Pointer[func() []ConcurrencyStats]
+}
+
+// WAFRuleStats are the cumulative counters of one loaded WAF rule. The WAF
+// engine keeps them; the recorder only reads them when a snapshot is taken.
+type WAFRuleStats struct {
+	Rule                  string  `json:"rule"`
+	Action                string  `json:"action"`
+	Shadow                bool    `json:"shadow"`
+	Evaluations           uint64  `json:"evaluations"`
+	Matches               uint64  `json:"matches"`
+	Errors                uint64  `json:"errors"`
+	EvaluationTimeSeconds float64 `json:"evaluation_time_seconds"`
+}
+
+// TarpitStats are the tarpit's counters. Active connections are a gauge;
+// the rest are cumulative.
+type TarpitStats struct {
+	Active       int     `json:"active"`
+	Held         uint64  `json:"held"`
+	Rejected     uint64  `json:"rejected"`
+	BytesWritten uint64  `json:"bytes_written"`
+	HeldSeconds  float64 `json:"held_seconds"`
+}
 
-	mu       sync.Mutex
-	statuses map[int]uint64
-	blocks   map[string]uint64
-	errors   map[string]*ErrorInfo
+// ConcurrencyStats describe one route's adaptive concurrency limiter. Limit
+// and InFlight are gauges; Shed and Dropped are cumulative.
+type ConcurrencyStats struct {
+	Route              string  `json:"route"`
+	Limit              int     `json:"limit"`
+	InFlight           int     `json:"in_flight"`
+	Shed               uint64  `json:"shed"`
+	Dropped            uint64  `json:"dropped"`
+	RTTSeconds         float64 `json:"rtt_seconds"`
+	BaselineRTTSeconds float64 `json:"baseline_rtt_seconds"`
 }
 
 type ErrorInfo struct {
@@ -41,27 +83,36 @@ type ErrorInfo struct {
 }
 
 type Snapshot struct {
-	StartedAt        time.Time         `json:"started_at"`
-	UptimeSeconds    int64             `json:"uptime_seconds"`
-	Requests         uint64            `json:"requests"`
-	Responses        uint64            `json:"responses"`
-	Blocked          uint64            `json:"blocked"`
-	CacheHits        uint64            `json:"cache_hits"`
-	ProxyErrors      uint64            `json:"proxy_errors"`
-	BytesWritten     uint64            `json:"bytes_written"`
-	AverageLatencyMs float64           `json:"average_latency_ms"`
-	StatusCodes      map[string]uint64 `json:"status_codes"`
-	BlockReasons     map[string]uint64 `json:"block_reasons"`
-	ErrorStatusCodes map[string]uint64 `json:"error_status_codes"`
-	RecentErrors     []ErrorInfo       `json:"recent_errors"`
+	StartedAt        time.Time          `json:"started_at"`
+	UptimeSeconds    int64              `json:"uptime_seconds"`
+	Requests         uint64             `json:"requests"`
+	Responses        uint64             `json:"responses"`
+	Blocked          uint64             `json:"blocked"`
+	CacheHits        uint64             `json:"cache_hits"`
+	ProxyErrors      uint64             `json:"proxy_errors"`
+	BytesWritten     uint64             `json:"bytes_written"`
+	AverageLatencyMs float64            `json:"average_latency_ms"`
+	StatusCodes      map[string]uint64  `json:"status_codes"`
+	BlockReasons     map[string]uint64  `json:"block_reasons"`
+	ErrorStatusCodes map[string]uint64  `json:"error_status_codes"`
+	RecentErrors     []ErrorInfo        `json:"recent_errors"`
+	WAFScored        uint64             `json:"waf_scored_requests"`
+	WAFScoreSum      uint64             `json:"waf_score_sum"`
+	WAFScoreRules    map[string]uint64  `json:"waf_score_rules"`
+	WAFRules         []WAFRuleStats     `json:"waf_rules"`
+	Tarpit           *TarpitStats       `json:"tarpit,omitempty"`
+	Concurrency      []ConcurrencyStats `json:"concurrency,omitempty"`
+	CanaryUses       map[string]uint64  `json:"canary_uses"`
 }
 
 func NewRecorder() *Recorder {
 	return &Recorder{
-		started:  time.Now().Unix(),
-		statuses: make(map[int]uint64),
-		blocks:   make(map[string]uint64),
-		errors:   make(map[string]*ErrorInfo),
+		started:    time.Now().Unix(),
+		statuses:   make(map[int]uint64),
+		blocks:     make(map[string]uint64),
+		wafRules:   make(map[string]uint64),
+		canaryUses: make(map[string]uint64),
+		errors:     make(map[string]*ErrorInfo),
 	}
 }
 
@@ -100,6 +151,44 @@ func (r *Recorder) RecordBlocked(reason string) {
 	r.mu.Unlock()
 }
 
+// RecordWAFScore records the anomaly score a request accumulated and the
+// rules that contributed to it, whether or not the request was blocked.
+func (r *Recorder) RecordWAFScore(score int, rules []string) {
+	if score <= 0 {
+		return
+	}
+	r.wafScored.Add(1)
+	r.wafScoreSum.Add(uint64(score))
+
+	r.mu.Lock()
+	for _, rule := range rules {
+		r.wafRules[rule]++
+	}
+	r.mu.Unlock()
+}
+
+// RecordCanaryUse counts a request presenting a canary served by trap.
+func (r *Recorder) RecordCanaryUse(trap string) {
+	r.mu.Lock()
+	r.canaryUses[trap]++
+	r.mu.Unlock()
+}
+
+// SetWAFRuleStats registers the source of per-rule WAF statistics.
+func (r *Recorder) SetWAFRuleStats(source func() []WAFRuleStats) {
+	r.wafRuleStats.Store(&source)
+}
+
+// SetTarpitStats registers the source of tarpit statistics.
+func (r *Recorder) SetTarpitStats(source func() TarpitStats) {
+	r.tarpitStats.Store(&source)
+}
+
+// SetConcurrencyStats registers the source of adaptive concurrency limits.
+func (r *Recorder) SetConcurrencyStats(source func() []ConcurrencyStats) {
+	r.concurrency.Store(&source)
+}
+
 func (r *Recorder) RecordCacheHit() {
 	r.cacheHits.Add(1)
 }
@@ -132,6 +221,14 @@ func (r *Recorder) Snapshot() Snapshot {
 	for reason, count := range r.blocks {
 		blocks[reason] = count
 	}
+	wafRules := make(map[string]uint64, len(r.wafRules))
+	for rule, count := range r.wafRules {
+		wafRules[rule] = count
+	}
+	canaryUses := make(map[string]uint64, len(r.canaryUses))
+	for trap, count := range r.canaryUses {
+		canaryUses[trap] = count
+	}
 	errorStatuses := make(map[string]uint64)
 	errors := make([]ErrorInfo, 0, len(r.errors))
 	for _, info := range r.errors {
@@ -149,6 +246,19 @@ func (r *Recorder) Snapshot() Snapshot {
 	if len(errors) > 8 {
 		errors = errors[:8]
 	}
+	var ruleStats []WAFRuleStats
+	if source := r.wafRuleStats.Load(); source != nil {
+		ruleStats = (*source)()
+	}
+	var tarpit *TarpitStats
+	if source := r.tarpitStats.Load(); source != nil {
+		stats := (*source)()
+		tarpit = &stats
+	}
+	var concurrency []ConcurrencyStats
+	if source := r.concurrency.Load(); source != nil {
+		concurrency = (*source)()
+	}
 
 	return Snapshot{
 		StartedAt:        started,
@@ -164,6 +274,13 @@ func (r *Recorder) Snapshot() Snapshot {
 		BlockReasons:     blocks,
 		ErrorStatusCodes: errorStatuses,
 		RecentErrors:     errors,
+		WAFScored:        r.wafScored.Load(),
+		WAFScoreSum:      r.wafScoreSum.Load(),
+		WAFScoreRules:    wafRules,
+		WAFRules:         ruleStats,
+		Tarpit:           tarpit,
+		Concurrency:      concurrency,
+		CanaryUses:       canaryUses,
 	}
 }
 
@@ -192,6 +309,36 @@ func (r *Recorder) ServePrometheus(w http.ResponseWriter, _ *http.Request) {
 	for _, reason := range reasons {
 		fmt.Fprintf(w, "netgoat_blocks_by_reason_total{reason=%q} %d\n", reason, snap.BlockReasons[reason])
 	}
+	fmt.Fprintf(w, "netgoat_waf_scored_requests_total %d\n", snap.WAFScored)
+	fmt.Fprintf(w, "netgoat_waf_score_sum %d\n", snap.WAFScoreSum)
+	for _, rule := range sortedKeys(snap.WAFScoreRules) {
+		fmt.Fprintf(w, "netgoat_waf_score_contributions_total{rule=%q} %d\n", rule, snap.WAFScoreRules[rule])
+	}
+	for _, rule := range snap.WAFRules {
+		labels := fmt.Sprintf("rule=%q,action=%q,shadow=%q", rule.Rule, rule.Action, strconv.FormatBool(rule.Shadow))
+		fmt.Fprintf(w, "netgoat_waf_rule_evaluations_total{%s} %d\n", labels, rule.Evaluations)
+		fmt.Fprintf(w, "netgoat_waf_rule_matches_total{%s} %d\n", labels, rule.Matches)
+		fmt.Fprintf(w, "netgoat_waf_rule_errors_total{%s} %d\n", labels, rule.Errors)
+		fmt.Fprintf(w, "netgoat_waf_rule_evaluation_seconds_total{%s} %.6f\n", labels, rule.EvaluationTimeSeconds)
+	}
+	for _, trap := range sortedKeys(snap.CanaryUses) {
+		fmt.Fprintf(w, "netgoat_honeypot_canary_uses_total{trap=%q} %d\n", trap, snap.CanaryUses[trap])
+	}
+	if tarpit := snap.Tarpit; tarpit != nil {
+		fmt.Fprintf(w, "netgoat_tarpit_active_connections %d\n", tarpit.Active)
+		fmt.Fprintf(w, "netgoat_tarpit_connections_total %d\n", tarpit.Held)
+		fmt.Fprintf(w, "netgoat_tarpit_rejected_total %d\n", tarpit.Rejected)
+		fmt.Fprintf(w, "netgoat_tarpit_bytes_written_total %d\n", tarpit.BytesWritten)
+		fmt.Fprintf(w, "netgoat_tarpit_held_seconds_total %.3f\n", tarpit.HeldSeconds)
+	}
+	for _, limit := range snap.Concurrency {
+		fmt.Fprintf(w, "netgoat_concurrency_limit{route=%q} %d\n", limit.Route, limit.Limit)
+		fmt.Fprintf(w, "netgoat_concurrency_in_flight{route=%q} %d\n", limit.Route, limit.InFlight)
+		fmt.Fprintf(w, "netgoat_concurrency_shed_total{route=%q} %d\n", limit.Route, limit.Shed)
+		fmt.Fprintf(w, "netgoat_concurrency_dropped_total{route=%q} %d\n", limit.Route, limit.Dropped)
+		fmt.Fprintf(w, "netgoat_concurrency_rtt_seconds{route=%q} %.6f\n", limit.Route, limit.RTTSeconds)
+		fmt.Fprintf(w, "netgoat_concurrency_baseline_rtt_seconds{route=%q} %.6f\n", limit.Route, limit.BaselineRTTSeconds)
+	}
 }
 
 func sortedKeys(m map[string]uint64) []string {
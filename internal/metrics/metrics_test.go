@@ -43,6 +43,118 @@ func TestRecorderSnapshot(t *testing.T) {
 	}
 }
 
+func TestRecorderWAFScores(t *testing.T) {
+	rec := NewRecorder()
+	rec.RecordWAFScore(0, []string{"ignored"})
+	rec.RecordWAFScore(5, []string{"SQL Keyword"})
+	rec.RecordWAFScore(8, []string{"SQL Keyword", "XSS Script"})
+
+	snap := rec.Snapshot()
+	if snap.WAFScored != 2 || snap.WAFScoreSum != 13 {
+		t.Fatalf("WAFScored/WAFScoreSum = %d/%d, want 2/13", snap.WAFScored, snap.WAFScoreSum)
+	}
+	if snap.WAFScoreRules["SQL Keyword"] != 2 || snap.WAFScoreRules["XSS Script"] != 1 {
+		t.Fatalf("unexpected WAFScoreRules: %+v", snap.WAFScoreRules)
+	}
+	if _, ok := snap.WAFScoreRules["ignored"]; ok {
+		t.Fatal("zero scores should not be recorded")
+	}
+}
+
+func TestRecorderExportsWAFRuleStats(t *testing.T) {
+	rec := NewRecorder()
+	if snap := rec.Snapshot(); snap.WAFRules != nil {
+		t.Fatalf("WAFRules without a source = %+v", snap.WAFRules)
+	}
+	rec.SetWAFRuleStats(func() []WAFRuleStats {
+		return []WAFRuleStats{{Rule: "Block SQLi", Action: "BLOCK", Shadow: true, Evaluations: 10, Matches: 3, Errors: 1, EvaluationTimeSeconds: 0.0025}}
+	})
+
+	if snap := rec.Snapshot(); len(snap.WAFRules) != 1 || snap.WAFRules[0].Matches != 3 {
+		t.Fatalf("WAFRules = %+v", snap.WAFRules)
+	}
+	res := httptest.NewRecorder()
+	rec.ServePrometheus(res, httptest.NewRequest(http.MethodGet, "/metrics.prom", nil))
+	body := res.Body.String()
+	for _, want := range []string{
+		`netgoat_waf_rule_evaluations_total{rule="Block SQLi",action="BLOCK",shadow="true"} 10`,
+		`netgoat_waf_rule_matches_total{rule="Block SQLi",action="BLOCK",shadow="true"} 3`,
+		`netgoat_waf_rule_errors_total{rule="Block SQLi",action="BLOCK",shadow="true"} 1`,
+		`netgoat_waf_rule_evaluation_seconds_total{rule="Block SQLi",action="BLOCK",shadow="true"} 0.002500`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("missing %q in %q", want, body)
+		}
+	}
+}
+
+func TestRecorderExportsTarpitStats(t *testing.T) {
+	rec := NewRecorder()
+	if snap := rec.Snapshot(); snap.Tarpit != nil {
+		t.Fatalf("Tarpit without a source = %+v", snap.Tarpit)
+	}
+	rec.SetTarpitStats(func() TarpitStats {
+		return TarpitStats{Active: 2, Held: 9, Rejected: 1, BytesWritten: 400, HeldSeconds: 95.5}
+	})
+	if snap := rec.Snapshot(); snap.Tarpit == nil || snap.Tarpit.Held != 9 {
+		t.Fatalf("Tarpit = %+v", snap.Tarpit)
+	}
+	res := httptest.NewRecorder()
+	rec.ServePrometheus(res, httptest.NewRequest(http.MethodGet, "/metrics.prom", nil))
+	body := res.Body.String()
+	for _, want := range []string{
+		"netgoat_tarpit_active_connections 2\n",
+		"netgoat_tarpit_connections_total 9\n",
+		"netgoat_tarpit_rejected_total 1\n",
+		"netgoat_tarpit_bytes_written_total 400\n",
+		"netgoat_tarpit_held_seconds_total 95.500\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("missing %q in %q", want, body)
+		}
+	}
+}
+
+func TestRecorderExportsConcurrencyLimits(t *testing.T) {
+	rec := NewRecorder()
+	rec.SetConcurrencyStats(func() []ConcurrencyStats {
+		return []ConcurrencyStats{{Route: "api", Limit: 12, InFlight: 3, Shed: 7, Dropped: 1, RTTSeconds: 0.025, BaselineRTTSeconds: 0.02}}
+	})
+	if snap := rec.Snapshot(); len(snap.Concurrency) != 1 || snap.Concurrency[0].Limit != 12 {
+		t.Fatalf("Concurrency = %+v", snap.Concurrency)
+	}
+	res := httptest.NewRecorder()
+	rec.ServePrometheus(res, httptest.NewRequest(http.MethodGet, "/metrics.prom", nil))
+	body := res.Body.String()
+	for _, want := range []string{
+		`netgoat_concurrency_limit{route="api"} 12`,
+		`netgoat_concurrency_in_flight{route="api"} 3`,
+		`netgoat_concurrency_shed_total{route="api"} 7`,
+		`netgoat_concurrency_dropped_total{route="api"} 1`,
+		`netgoat_concurrency_rtt_seconds{route="api"} 0.025000`,
+		`netgoat_concurrency_baseline_rtt_seconds{route="api"} 0.020000`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("missing %q in %q", want, body)
+		}
+	}
+}
+
+func TestRecorderCountsCanaryUsesByTrap(t *testing.T) {
+	rec := NewRecorder()
+	rec.RecordCanaryUse("env")
+	rec.RecordCanaryUse("env")
+	rec.RecordCanaryUse("git")
+	if snap := rec.Snapshot(); snap.CanaryUses["env"] != 2 || snap.CanaryUses["git"] != 1 {
+		t.Fatalf("CanaryUses = %v", snap.CanaryUses)
+	}
+	res := httptest.NewRecorder()
+	rec.ServePrometheus(res, httptest.NewRequest(http.MethodGet, "/metrics.prom", nil))
+	if want := `netgoat_honeypot_canary_uses_total{trap="env"} 2`; !strings.Contains(res.Body.String(), want) {
+		t.Fatalf("missing %q in %q", want, res.Body)
+	}
+}
+
 func TestRecorderBoundsDistinctProxyErrors(t *testing.T) {
 	rec := NewRecorder()
 	for i := 0; i < maxTrackedErrors*2; i++ {
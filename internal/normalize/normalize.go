@@ -0,0 +1,247 @@
+// Package normalize computes the canonical form of a request URL so that
+// routing and security evaluation all act on the same path. Upstreams still
+// receive the path exactly as the client escaped it.
+//
+// Paths are percent-decoded repeatedly (up to MaxDecodeRounds), backslashes
+// are treated as separators, repeated slashes are collapsed and dot-segments
+// are resolved. Encodings that different components could interpret
+// differently either fail with an *Error (NUL bytes, invalid or overlong
+// UTF-8, encoding nested deeper than the limit) or are reported as flags.
+package normalize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxDecodeRounds is the deepest nesting of percent-encoding that is decoded.
+// Anything still encoded afterwards is rejected.
+const MaxDecodeRounds = 3
+
+// Flags describe ambiguities that were resolved rather than rejected.
+const (
+	// FlagMultipleEncoding marks input that was percent-encoded more than once.
+	FlagMultipleEncoding = "multiple-encoding"
+	// FlagUnicodeEscape marks IIS-style %uXXXX escapes.
+	FlagUnicodeEscape = "unicode-escape"
+	// FlagBackslash marks a backslash used as a path separator.
+	FlagBackslash = "backslash"
+	// FlagDuplicateSlash marks repeated path separators.
+	FlagDuplicateSlash = "duplicate-slash"
+	// FlagTraversal marks ".." segments, including ones above the root.
+	FlagTraversal = "traversal"
+	// FlagNullByte marks a NUL byte in the query string.
+	FlagNullByte = "null-byte"
+	// FlagInvalidUTF8 marks invalid or overlong UTF-8 in the query string.
+	FlagInvalidUTF8 = "invalid-utf8"
+)
+
+var (
+	ErrNullByte          = errors.New("encoded NUL byte")
+	ErrInvalidUTF8       = errors.New("invalid or overlong UTF-8")
+	ErrExcessiveEncoding = errors.New("percent-encoding nested too deeply")
+)
+
+// Error reports why a path could not be canonicalized.
+type Error struct {
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ambiguous request path %q: %v", e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Result is the canonical form of a request URL.
+type Result struct {
+	// Path is the decoded, cleaned path. It always starts with "/".
+	Path string
+	// Query is the raw query decoded for matching; it is not re-parsed.
+	Query string
+	// Flags lists resolved ambiguities in the order they were found.
+	Flags []string
+}
+
+type contextKey struct{}
+
+// Request canonicalizes r's URL and returns r with the result attached to
+// its context, where FromRequest and CanonicalPath find it. r.URL is left
+// as received: writing the decoded path back would turn %2F into a
+// separator and %2525 into %25 on the way upstream.
+func Request(r *http.Request) (*http.Request, Result, error) {
+	result, err := URL(r.URL.EscapedPath(), r.URL.RawQuery)
+	if err != nil {
+		return r, result, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, result)), result, nil
+}
+
+// FromRequest returns the Result Request attached to r.
+func FromRequest(r *http.Request) (Result, bool) {
+	result, ok := r.Context().Value(contextKey{}).(Result)
+	return result, ok
+}
+
+// CanonicalPath is the path to route and match r on: the one Request
+// attached, or r.URL.Path for a request that did not go through Request.
+func CanonicalPath(r *http.Request) string {
+	if result, ok := FromRequest(r); ok {
+		return result.Path
+	}
+	return r.URL.Path
+}
+
+// URL canonicalizes an escaped path and raw query.
+func URL(escapedPath, rawQuery string) (Result, error) {
+	var flags []string
+	canonical, err := Path(escapedPath, &flags)
+	if err != nil {
+		return Result{Flags: flags}, err
+	}
+	query := Query(rawQuery, &flags)
+	return Result{Path: canonical, Query: query, Flags: flags}, nil
+}
+
+// Path returns the canonical form of an escaped path, appending any resolved
+// ambiguities to flags when it is non-nil.
+func Path(escaped string, flags *[]string) (string, error) {
+	decoded, err := decodeAll(escaped, false, flags)
+	if err != nil {
+		return "", &Error{Path: escaped, Err: err}
+	}
+	if strings.IndexByte(decoded, 0) >= 0 {
+		return "", &Error{Path: escaped, Err: ErrNullByte}
+	}
+	if !utf8.ValidString(decoded) {
+		return "", &Error{Path: escaped, Err: ErrInvalidUTF8}
+	}
+
+	if strings.Contains(decoded, `\`) {
+		addFlag(flags, FlagBackslash)
+		decoded = strings.ReplaceAll(decoded, `\`, "/")
+	}
+	if strings.Contains(decoded, "//") {
+		addFlag(flags, FlagDuplicateSlash)
+	}
+	for _, segment := range strings.Split(decoded, "/") {
+		if segment == ".." {
+			addFlag(flags, FlagTraversal)
+			break
+		}
+	}
+
+	cleaned := path.Clean("/" + decoded)
+	if strings.HasSuffix(decoded, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
+
+// Query decodes a raw query for matching. Query strings carry arbitrary
+// application data, so ambiguities are flagged but never rejected.
+func Query(raw string, flags *[]string) string {
+	decoded, err := decodeAll(raw, true, flags)
+	if err != nil {
+		// The deepest decoding reached is still the most useful form.
+		addFlag(flags, FlagMultipleEncoding)
+	}
+	if strings.IndexByte(decoded, 0) >= 0 {
+		addFlag(flags, FlagNullByte)
+	}
+	if !utf8.ValidString(decoded) {
+		addFlag(flags, FlagInvalidUTF8)
+	}
+	return decoded
+}
+
+// decodeAll percent-decodes until the value is stable. Form decoding turns
+// "+" into a space, but only in the first round: a decoded "+" is literal.
+func decodeAll(value string, form bool, flags *[]string) (string, error) {
+	for round := 0; ; round++ {
+		decoded, unicode := decodeOnce(value, form && round == 0)
+		if decoded == value {
+			return value, nil
+		}
+		if unicode {
+			addFlag(flags, FlagUnicodeEscape)
+		}
+		if round == 1 {
+			addFlag(flags, FlagMultipleEncoding)
+		}
+		value = decoded
+		if round+1 == MaxDecodeRounds {
+			if next, _ := decodeOnce(value, false); next != value {
+				return value, ErrExcessiveEncoding
+			}
+			return value, nil
+		}
+	}
+}
+
+// decodeOnce decodes %XX and %uXXXX escapes. Malformed escapes are kept
+// literally, as most servers do.
+func decodeOnce(value string, form bool) (string, bool) {
+	if !strings.ContainsRune(value, '%') && !(form && strings.ContainsRune(value, '+')) {
+		return value, false
+	}
+	var (
+		b       strings.Builder
+		unicode bool
+	)
+	b.Grow(len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '+' && form:
+			b.WriteByte(' ')
+		case c == '%' && i+2 < len(value) && isHex(value[i+1]) && isHex(value[i+2]):
+			b.WriteByte(unhex(value[i+1])<<4 | unhex(value[i+2]))
+			i += 2
+		case c == '%' && i+5 < len(value) && (value[i+1] == 'u' || value[i+1] == 'U') &&
+			isHex(value[i+2]) && isHex(value[i+3]) && isHex(value[i+4]) && isHex(value[i+5]):
+			r := rune(unhex(value[i+2]))<<12 | rune(unhex(value[i+3]))<<8 | rune(unhex(value[i+4]))<<4 | rune(unhex(value[i+5]))
+			b.WriteRune(r)
+			unicode = true
+			i += 5
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), unicode
+}
+
+func addFlag(flags *[]string, flag string) {
+	if flags == nil {
+		return
+	}
+	for _, existing := range *flags {
+		if existing == flag {
+			return
+		}
+	}
+	*flags = append(*flags, flag)
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
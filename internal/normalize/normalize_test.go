@@ -0,0 +1,119 @@
+package normalize
+
+import (
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestPathCanonicalForms(t *testing.T) {
+	tests := []struct {
+		escaped string
+		want    string
+		flags   []string
+	}{
+		{"/", "/", nil},
+		{"/products/42", "/products/42", nil},
+		{"/ADMIN", "/ADMIN", nil},
+		{"/%61dmin", "/admin", nil},
+		{"/%2561dmin", "/admin", []string{FlagMultipleEncoding}},
+		{"/%252561dmin", "/admin", []string{FlagMultipleEncoding}},
+		{"/public/../admin/", "/admin/", []string{FlagTraversal}},
+		{"/../../etc/passwd", "/etc/passwd", []string{FlagTraversal}},
+		{"/%2e%2e/%2e%2e/etc/passwd", "/etc/passwd", []string{FlagTraversal}},
+		{"//admin///panel", "/admin/panel", []string{FlagDuplicateSlash}},
+		{`/static\..\admin`, "/admin", []string{FlagBackslash, FlagTraversal}},
+		{"/%5c..%5cadmin", "/admin", []string{FlagBackslash, FlagDuplicateSlash, FlagTraversal}},
+		{"/%u0061dmin", "/admin", []string{FlagUnicodeEscape}},
+		{"/./a/./b", "/a/b", nil},
+		{"/caf%C3%A9", "/café", nil},
+		{"/50%25off", "/50%off", nil},
+		{"/a+b", "/a+b", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.escaped, func(t *testing.T) {
+			var flags []string
+			got, err := Path(tc.escaped, &flags)
+			if err != nil {
+				t.Fatalf("Path: %v", err)
+			}
+			if got != tc.want || !slices.Equal(flags, tc.flags) {
+				t.Fatalf("Path(%q) = %q %v, want %q %v", tc.escaped, got, flags, tc.want, tc.flags)
+			}
+			again, err := Path(got, nil)
+			if err != nil || again != got {
+				t.Fatalf("canonical form is not stable: %q -> %q, %v", got, again, err)
+			}
+		})
+	}
+}
+
+func TestPathRejectsAmbiguousEncodings(t *testing.T) {
+	for escaped, want := range map[string]error{
+		"/admin%00.html":      ErrNullByte,
+		"/%2500":              ErrNullByte,
+		"/%c0%afetc/passwd":   ErrInvalidUTF8,
+		"/%e0%80%af":          ErrInvalidUTF8,
+		"/%ff":                ErrInvalidUTF8,
+		"/%25252561dmin":      ErrExcessiveEncoding,
+		"/%2525252e%2525252e": ErrExcessiveEncoding,
+	} {
+		t.Run(escaped, func(t *testing.T) {
+			_, err := Path(escaped, nil)
+			var normErr *Error
+			if !errors.As(err, &normErr) || !errors.Is(err, want) {
+				t.Fatalf("Path(%q) error = %v, want %v", escaped, err, want)
+			}
+		})
+	}
+}
+
+func TestQueryFlagsButNeverRejects(t *testing.T) {
+	var flags []string
+	got := Query("q=1%2527+OR+1%3D1&x=%00&y=a%2Bb", &flags)
+	if got != "q=1' OR 1=1&x=\x00&y=a+b" {
+		t.Fatalf("Query = %q", got)
+	}
+	if !slices.Equal(flags, []string{FlagMultipleEncoding, FlagNullByte}) {
+		t.Fatalf("flags = %v", flags)
+	}
+}
+
+func TestRequestAttachesCanonicalFormAndKeepsURL(t *testing.T) {
+	req := httptest.NewRequest("GET", "/x/..//%2561dmin?id=1", nil)
+	canonical, result, err := Request(req)
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	if got := CanonicalPath(canonical); got != "/admin" || result.Path != "/admin" {
+		t.Fatalf("CanonicalPath = %q, result %q", got, result.Path)
+	}
+	if !slices.Equal(result.Flags, []string{FlagMultipleEncoding, FlagDuplicateSlash, FlagTraversal}) {
+		t.Fatalf("flags = %v", result.Flags)
+	}
+	if canonical.URL.EscapedPath() != "/x/..//%2561dmin" || canonical.URL.RawQuery != "id=1" {
+		t.Fatalf("URL was rewritten: %q query %q", canonical.URL.EscapedPath(), canonical.URL.RawQuery)
+	}
+
+	for _, path := range []string{"/a%2Fb", "/files/100%2525off", "/docs/50%25"} {
+		req, _, err := Request(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatalf("Request(%s): %v", path, err)
+		}
+		if req.URL.EscapedPath() != path {
+			t.Fatalf("%s became %q", path, req.URL.EscapedPath())
+		}
+	}
+
+	bad := httptest.NewRequest("GET", "/a%2500b", nil)
+	if _, _, err := Request(bad); err == nil {
+		t.Fatal("NUL byte should be rejected")
+	}
+	if _, ok := FromRequest(bad); ok {
+		t.Fatal("a rejected request should carry no canonical form")
+	}
+	if got := CanonicalPath(httptest.NewRequest("GET", "/a/b%2F..", nil)); got != "/a/b/.." {
+		t.Fatalf("CanonicalPath without Request = %q", got)
+	}
+}
@@ -0,0 +1,517 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"netgoat.xyz/agent/internal/traffic"
+)
+
+const (
+	// GossipPath receives consumption batches from peer agents.
+	GossipPath = "/__netgoat/ratelimit/gossip"
+	// SignatureHeader carries the hex HMAC-SHA256 of a gossiped batch
+	// under the shared cluster secret.
+	SignatureHeader = "X-Netgoat-Signature"
+
+	defaultSyncInterval = time.Second
+	// maxBatchAge bounds how late a batch may be applied, and so how long
+	// batches are remembered to drop duplicates. Agents' clocks must agree
+	// to within it.
+	maxBatchAge = time.Minute
+	// maxPendingKeys bounds the keys in one batch; maxBatchBytes leaves
+	// about 100 bytes for each of them.
+	maxPendingKeys   = 20000
+	maxBatchBytes    = 2 << 20
+	minClusterSecret = 16
+)
+
+// Batch is the consumption one agent recorded during one sync interval.
+// Epoch tells a restarted agent's batches from those it sent before.
+type Batch struct {
+	Node  string    `json:"node"`
+	Epoch int64     `json:"epoch"`
+	Seq   uint64    `json:"seq"`
+	Sent  time.Time `json:"sent"`
+	// Tokens maps limiter names to the tokens taken under each key.
+	Tokens map[string]map[string]float64 `json:"tokens"`
+}
+
+// SyncStore is a shared log that agents exchange batches through when they
+// cannot reach each other directly. Implementations must be safe for
+// concurrent use.
+type SyncStore interface {
+	// Push appends a batch.
+	Push(ctx context.Context, batch Batch) error
+	// Pull returns the batches pushed after cursor, oldest first, and the
+	// cursor to pass next time. Zero starts from the oldest batch kept.
+	Pull(ctx context.Context, cursor uint64) ([]Batch, uint64, error)
+}
+
+// ClusterConfig configures a Cluster. Peers are the base URLs of the other
+// agents, which may include this one. Secret is shared by every agent and
+// must be at least 16 bytes. Node defaults to the host name.
+type ClusterConfig struct {
+	Node     string
+	Peers    []string
+	Secret   string
+	Interval time.Duration
+	// Store, when set, is the fallback for an agent that reaches no peer:
+	// such an agent pushes its batches there instead, and every agent pulls
+	// what the others pushed each interval.
+	Store  SyncStore
+	Client *http.Client
+}
+
+// ClusterStats are a Cluster's counters. Reachable is the number of peers
+// the last sync reached; the rest are cumulative.
+type ClusterStats struct {
+	Peers     int
+	Reachable int
+	Sent      uint64
+	Received  uint64
+	Failures  uint64
+	Dropped   uint64
+}
+
+// Cluster shares rate limiter consumption between agents, so N agents
+// allow roughly the configured rate between them rather than N times it.
+// Every interval it sends the tokens its tracked limiters took to every
+// peer, or through the store if there is one and no peer was reachable, and
+// takes the tokens other agents report from its own buckets. Each bucket thereby counts the whole
+// cluster's requests, a sync interval late: limits can be overshot by what
+// the other agents allow within one interval. Agents that cannot be reached
+// simply stop contributing, and an agent that reaches nobody limits on its
+// own traffic alone. A nil *Cluster tracks nothing.
+type Cluster struct {
+	node     string
+	epoch    int64
+	secret   []byte
+	peers    []string
+	interval time.Duration
+	store    SyncStore
+	client   *http.Client
+	now      func() time.Time
+
+	mu          sync.Mutex
+	limiters    map[string]*traffic.RateLimiter
+	pending     map[string]map[string]float64
+	pendingKeys int
+	seq         uint64
+	cursor      uint64
+	seen        map[string]map[uint64]time.Time
+	down        map[string]bool
+	storeDown   bool
+	reachable   int
+
+	sent     atomic.Uint64
+	received atomic.Uint64
+	failures atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+func NewCluster(cfg ClusterConfig) (*Cluster, error) {
+	if len(cfg.Secret) < minClusterSecret {
+		return nil, fmt.Errorf("rate limit cluster secret must be at least %d bytes", minClusterSecret)
+	}
+	if len(cfg.Peers) == 0 && cfg.Store == nil {
+		return nil, errors.New("rate limit cluster needs peers or a store")
+	}
+	node := strings.TrimSpace(cfg.Node)
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultSyncInterval
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: cfg.Interval}
+	}
+	peers := make([]string, 0, len(cfg.Peers))
+	for _, peer := range cfg.Peers {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return &Cluster{
+		node:     node,
+		epoch:    time.Now().UnixNano(),
+		secret:   []byte(cfg.Secret),
+		peers:    peers,
+		interval: cfg.Interval,
+		store:    cfg.Store,
+		client:   cfg.Client,
+		now:      time.Now,
+		limiters: make(map[string]*traffic.RateLimiter),
+		pending:  make(map[string]map[string]float64),
+		seen:     make(map[string]map[uint64]time.Time),
+		down:     make(map[string]bool),
+	}, nil
+}
+
+// Track shares limiter's consumption under name, which must be the same on
+// every agent. A nil limiter stops tracking name.
+func (c *Cluster) Track(name string, limiter *traffic.RateLimiter) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	previous := c.limiters[name]
+	if limiter == nil {
+		delete(c.limiters, name)
+	} else {
+		c.limiters[name] = limiter
+	}
+	c.mu.Unlock()
+	if previous != nil && previous != limiter {
+		previous.Observe(nil)
+	}
+	if limiter != nil {
+		limiter.Observe(func(key string, tokens float64) { c.record(name, key, tokens) })
+	}
+}
+
+func (c *Cluster) record(name, key string, tokens float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := c.pending[name]
+	if keys == nil {
+		keys = make(map[string]float64)
+		c.pending[name] = keys
+	}
+	if _, ok := keys[key]; !ok {
+		if c.pendingKeys >= maxPendingKeys {
+			c.dropped.Add(1)
+			return
+		}
+		c.pendingKeys++
+	}
+	keys[key] += tokens
+}
+
+// Run syncs every interval until ctx is done.
+func (c *Cluster) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Sync(ctx)
+		}
+	}
+}
+
+// Sync sends the consumption recorded since the last sync to the peers,
+// pushes it to the store when none of them could be reached, and applies the
+// batches the store holds from other agents.
+func (c *Cluster) Sync(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	if batch, ok := c.takeBatch(); ok {
+		c.gossip(ctx, batch)
+		c.mu.Lock()
+		unreachable := c.reachable == 0
+		c.mu.Unlock()
+		if c.store != nil && unreachable {
+			c.storeResult(c.store.Push(ctx, batch))
+		}
+	}
+	if c.store != nil {
+		c.mu.Lock()
+		cursor := c.cursor
+		c.mu.Unlock()
+		batches, next, err := c.store.Pull(ctx, cursor)
+		c.storeResult(err)
+		if err == nil {
+			c.mu.Lock()
+			c.cursor = next
+			c.mu.Unlock()
+			for _, batch := range batches {
+				c.Apply(batch)
+			}
+		}
+	}
+	c.pruneSeen()
+}
+
+func (c *Cluster) takeBatch() (Batch, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tokens := make(map[string]map[string]float64, len(c.pending))
+	for name, keys := range c.pending {
+		for key, n := range keys {
+			if n == 0 {
+				continue
+			}
+			if tokens[name] == nil {
+				tokens[name] = make(map[string]float64)
+			}
+			tokens[name][key] = n
+		}
+	}
+	c.pending = make(map[string]map[string]float64)
+	c.pendingKeys = 0
+	if len(tokens) == 0 {
+		return Batch{}, false
+	}
+	c.seq++
+	return Batch{Node: c.node, Epoch: c.epoch, Seq: c.seq, Sent: c.now(), Tokens: tokens}, true
+}
+
+func (c *Cluster) gossip(ctx context.Context, batch Batch) {
+	if len(c.peers) == 0 {
+		return
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return
+	}
+	signature := c.sign(body)
+	ctx, cancel := context.WithTimeout(ctx, c.interval)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		reachable atomic.Int64
+	)
+	for _, peer := range c.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.send(ctx, peer, body, signature)
+			c.mu.Lock()
+			wasDown := c.down[peer]
+			c.down[peer] = err != nil
+			c.mu.Unlock()
+			if err != nil {
+				c.failures.Add(1)
+				if !wasDown {
+					log.Warn().Err(err).Str("peer", peer).Msg("Rate limit peer unreachable; limiting without its traffic")
+				}
+				return
+			}
+			reachable.Add(1)
+			c.sent.Add(1)
+			if wasDown {
+				log.Info().Str("peer", peer).Msg("Rate limit peer reachable again")
+			}
+		}()
+	}
+	wg.Wait()
+	c.mu.Lock()
+	c.reachable = int(reachable.Load())
+	c.mu.Unlock()
+}
+
+func (c *Cluster) send(ctx context.Context, peer string, body []byte, signature string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+GossipPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<10))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("peer answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *Cluster) storeResult(err error) {
+	c.mu.Lock()
+	wasDown := c.storeDown
+	c.storeDown = err != nil
+	c.mu.Unlock()
+	switch {
+	case err != nil:
+		c.failures.Add(1)
+		if !wasDown {
+			log.Warn().Err(err).Msg("Rate limit sync store unavailable; limiting without it")
+		}
+	case wasDown:
+		log.Info().Msg("Rate limit sync store available again")
+	}
+}
+
+func (c *Cluster) sign(body []byte) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeHTTP receives batches gossiped by peers. Batches must be signed with
+// the cluster secret; requests without a well-formed signature are refused
+// before their body is read.
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil || len(signature) != sha256.Size {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if r.ContentLength > maxBatchBytes {
+		http.Error(w, "batch too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBatchBytes+1))
+	if err != nil || len(body) > maxBatchBytes {
+		http.Error(w, "batch too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var batch Batch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		http.Error(w, "invalid batch", http.StatusBadRequest)
+		return
+	}
+	c.Apply(batch)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Apply takes the tokens another agent reported from the tracked limiters.
+// It reports false for this agent's own batches, duplicates, batches older
+// than a minute and batches for unknown limiters only.
+func (c *Cluster) Apply(batch Batch) bool {
+	if c == nil || (batch.Node == c.node && batch.Epoch == c.epoch) {
+		return false
+	}
+	if age := c.now().Sub(batch.Sent); age > maxBatchAge || age < -maxBatchAge {
+		return false
+	}
+	origin := fmt.Sprintf("%s/%d", batch.Node, batch.Epoch)
+	c.mu.Lock()
+	seqs := c.seen[origin]
+	if seqs == nil {
+		seqs = make(map[uint64]time.Time)
+		c.seen[origin] = seqs
+	}
+	if _, duplicate := seqs[batch.Seq]; duplicate {
+		c.mu.Unlock()
+		return false
+	}
+	seqs[batch.Seq] = batch.Sent
+	limiters := make(map[string]*traffic.RateLimiter, len(batch.Tokens))
+	for name := range batch.Tokens {
+		if limiter := c.limiters[name]; limiter != nil {
+			limiters[name] = limiter
+		}
+	}
+	c.mu.Unlock()
+
+	for name, limiter := range limiters {
+		for key, tokens := range batch.Tokens[name] {
+			limiter.Consume(key, tokens)
+		}
+	}
+	c.received.Add(1)
+	return len(limiters) > 0
+}
+
+func (c *Cluster) pruneSeen() {
+	cutoff := c.now().Add(-maxBatchAge)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for origin, seqs := range c.seen {
+		for seq, sent := range seqs {
+			if sent.Before(cutoff) {
+				delete(seqs, seq)
+			}
+		}
+		if len(seqs) == 0 {
+			delete(c.seen, origin)
+		}
+	}
+}
+
+// Stats returns the cluster's counters.
+func (c *Cluster) Stats() ClusterStats {
+	if c == nil {
+		return ClusterStats{}
+	}
+	c.mu.Lock()
+	reachable := c.reachable
+	c.mu.Unlock()
+	return ClusterStats{
+		Peers:     len(c.peers),
+		Reachable: reachable,
+		Sent:      c.sent.Load(),
+		Received:  c.received.Load(),
+		Failures:  c.failures.Load(),
+		Dropped:   c.dropped.Load(),
+	}
+}
+
+// MemoryStore is an in-process SyncStore keeping the most recent batches.
+// It stands in for a shared store in tests and single-host setups.
+type MemoryStore struct {
+	mu      sync.Mutex
+	batches []Batch
+	first   uint64
+	max     int
+}
+
+// NewMemoryStore returns a store keeping up to max batches (1024 when
+// max is not positive).
+func NewMemoryStore(max int) *MemoryStore {
+	if max <= 0 {
+		max = 1024
+	}
+	return &MemoryStore{first: 1, max: max}
+}
+
+func (s *MemoryStore) Push(_ context.Context, batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, batch)
+	if over := len(s.batches) - s.max; over > 0 {
+		s.batches = append([]Batch(nil), s.batches[over:]...)
+		s.first += uint64(over)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Pull(_ context.Context, cursor uint64) ([]Batch, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := s.first + uint64(len(s.batches)) - 1
+	if cursor >= last {
+		return nil, last, nil
+	}
+	start := 0
+	if cursor >= s.first {
+		start = int(cursor - s.first + 1)
+	}
+	return append([]Batch(nil), s.batches[start:]...), last, nil
+}
@@ -0,0 +1,222 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"netgoat.xyz/agent/internal/traffic"
+)
+
+const testSecret = "0123456789abcdef"
+
+// unreadable is a request body that fails the test when it is read.
+type unreadable struct{ t *testing.T }
+
+func (u unreadable) Read([]byte) (int, error) {
+	u.t.Error("request body read")
+	return 0, io.EOF
+}
+
+func newTestCluster(t *testing.T, node string, peers []string, store SyncStore) (*Cluster, *traffic.RateLimiter) {
+	t.Helper()
+	cluster, err := NewCluster(ClusterConfig{Node: node, Peers: peers, Secret: testSecret, Store: store, Interval: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := traffic.NewRateLimiterEvery(2, time.Hour, 0)
+	cluster.Track("global", limiter)
+	return cluster, limiter
+}
+
+func TestClusterGossipSharesConsumption(t *testing.T) {
+	b, limiterB := newTestCluster(t, "b", []string{"http://127.0.0.1:1"}, nil)
+	server := httptest.NewServer(b)
+	defer server.Close()
+	a, limiterA := newTestCluster(t, "a", []string{server.URL + "/", "http://127.0.0.1:1"}, nil)
+
+	limiterA.Take("192.0.2.1")
+	limiterA.Take("192.0.2.1")
+	limiterA.Take("192.0.2.2")
+	limiterA.Refund("192.0.2.2")
+	a.Sync(context.Background())
+
+	if limiterB.Allow("192.0.2.1") {
+		t.Fatal("b allowed a client that spent its quota on a")
+	}
+	if !limiterB.Allow("192.0.2.2") || !limiterB.Allow("192.0.2.2") {
+		t.Fatal("a refunded token was still counted")
+	}
+	if stats := a.Stats(); stats.Peers != 2 || stats.Reachable != 1 || stats.Sent != 1 || stats.Failures != 1 {
+		t.Fatalf("a stats = %+v", stats)
+	}
+	if stats := b.Stats(); stats.Received != 1 {
+		t.Fatalf("b stats = %+v", stats)
+	}
+
+	// Nothing new to send: no batch, so no requests to the dead peer.
+	a.Sync(context.Background())
+	if stats := a.Stats(); stats.Sent != 1 || stats.Failures != 1 {
+		t.Fatalf("empty sync sent a batch: %+v", stats)
+	}
+	// b's own consumption still reaches nobody, and b keeps limiting locally.
+	if !limiterB.Allow("192.0.2.3") {
+		t.Fatal("b stopped limiting locally without peers")
+	}
+	b.Sync(context.Background())
+}
+
+func TestClusterRejectsForgedStaleAndRepeatedBatches(t *testing.T) {
+	cluster, limiter := newTestCluster(t, "b", []string{"http://127.0.0.1:1"}, nil)
+	fresh := Batch{Node: "a", Epoch: 1, Seq: 1, Sent: time.Now(), Tokens: map[string]map[string]float64{"global": {"192.0.2.1": 1}}}
+
+	if !cluster.Apply(fresh) || cluster.Apply(fresh) {
+		t.Fatal("a batch should apply exactly once")
+	}
+	if !limiter.Allow("192.0.2.1") || limiter.Allow("192.0.2.1") {
+		t.Fatal("the applied batch should have taken one token")
+	}
+	stale := fresh
+	stale.Seq, stale.Sent = 2, time.Now().Add(-2*time.Minute)
+	own := fresh
+	own.Node, own.Epoch = cluster.node, cluster.epoch
+	unknown := fresh
+	unknown.Seq, unknown.Tokens = 3, map[string]map[string]float64{"other": {"192.0.2.1": 1}}
+	for name, batch := range map[string]Batch{"stale": stale, "own": own, "unknown limiter": unknown} {
+		if cluster.Apply(batch) {
+			t.Errorf("%s batch applied", name)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	body := []byte(`{"node":"a","epoch":1,"seq":9,"sent":"2030-01-01T00:00:00Z","tokens":{}}`)
+	req := httptest.NewRequest(http.MethodPost, GossipPath, bytes.NewReader(body))
+	req.Header.Set(SignatureHeader, cluster.sign([]byte("something else")))
+	cluster.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("forged batch answered %d", rec.Code)
+	}
+	// Without a well-formed signature the body is never read.
+	for _, signature := range []string{"", "zz", "abcd"} {
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodPost, GossipPath, unreadable{t})
+		req.Header.Set(SignatureHeader, signature)
+		cluster.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("signature %q answered %d", signature, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, GossipPath, unreadable{t})
+	req.Header.Set(SignatureHeader, cluster.sign(body))
+	req.ContentLength = maxBatchBytes + 1
+	cluster.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized batch answered %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	cluster.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, GossipPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET answered %d", rec.Code)
+	}
+
+	if _, err := NewCluster(ClusterConfig{Peers: []string{"http://127.0.0.1:1"}, Secret: "short"}); err == nil {
+		t.Fatal("short secret accepted")
+	}
+	if _, err := NewCluster(ClusterConfig{Secret: testSecret}); err == nil {
+		t.Fatal("cluster without peers or store accepted")
+	}
+}
+
+func TestClusterSyncsThroughStore(t *testing.T) {
+	store := NewMemoryStore(0)
+	a, limiterA := newTestCluster(t, "a", nil, store)
+	b, limiterB := newTestCluster(t, "b", nil, store)
+
+	limiterA.Take("192.0.2.1")
+	limiterA.Take("192.0.2.1")
+	a.Sync(context.Background())
+	b.Sync(context.Background())
+	if limiterB.Allow("192.0.2.1") {
+		t.Fatal("b allowed a client that spent its quota on a")
+	}
+	// Pulling again applies nothing twice, and a's own batch is skipped.
+	b.Sync(context.Background())
+	a.Sync(context.Background())
+	if stats := b.Stats(); stats.Received != 1 {
+		t.Fatalf("b stats = %+v", stats)
+	}
+	if !limiterA.Allow("192.0.2.9") {
+		t.Fatal("a applied its own batch")
+	}
+}
+
+func TestClusterFallsBackToStoreWithoutPeers(t *testing.T) {
+	store := NewMemoryStore(0)
+	b, limiterB := newTestCluster(t, "b", nil, store)
+	server := httptest.NewServer(b)
+	defer server.Close()
+	a, limiterA := newTestCluster(t, "a", []string{server.URL}, store)
+
+	limiterA.Take("192.0.2.1")
+	a.Sync(context.Background())
+	if len(store.batches) != 0 {
+		t.Fatalf("a pushed to the store while its peer was reachable: %d batches", len(store.batches))
+	}
+
+	server.Close()
+	limiterA.Take("192.0.2.1")
+	a.Sync(context.Background())
+	if len(store.batches) != 1 {
+		t.Fatalf("store holds %d batches after a lost its peer, want 1", len(store.batches))
+	}
+	b.Sync(context.Background())
+	if limiterB.Allow("192.0.2.1") {
+		t.Fatal("b did not apply the batches a gossiped and pushed")
+	}
+}
+
+func TestMemoryStoreKeepsRecentBatches(t *testing.T) {
+	store := NewMemoryStore(2)
+	ctx := context.Background()
+	if batches, cursor, _ := store.Pull(ctx, 0); len(batches) != 0 || cursor != 0 {
+		t.Fatalf("empty store: %v, %d", batches, cursor)
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		store.Push(ctx, Batch{Seq: seq})
+	}
+	batches, cursor, _ := store.Pull(ctx, 0)
+	if len(batches) != 2 || batches[0].Seq != 2 || cursor != 3 {
+		t.Fatalf("pull from 0: %v, %d", batches, cursor)
+	}
+	store.Push(ctx, Batch{Seq: 4})
+	if batches, cursor, _ = store.Pull(ctx, cursor); len(batches) != 1 || batches[0].Seq != 4 || cursor != 4 {
+		t.Fatalf("pull from 3: %v, %d", batches, cursor)
+	}
+}
+
+func TestStoreTracksPolicyLimitersAcrossReloads(t *testing.T) {
+	cluster, _ := newTestCluster(t, "a", nil, NewMemoryStore(0))
+	store := NewStore()
+	login := Policy{Name: "login", Limits: []Limit{{Requests: 1, PeriodSeconds: 60}}}
+	if err := store.Load([]Policy{login}); err != nil {
+		t.Fatal(err)
+	}
+	store.UseCluster(cluster)
+	name := "policy:" + limiterID("login", login.Limits[0])
+	if cluster.limiters[name] == nil {
+		t.Fatalf("tracked limiters: %v", cluster.limiters)
+	}
+
+	login.Limits[0].Requests = 2
+	if err := store.Load([]Policy{login}); err != nil {
+		t.Fatal(err)
+	}
+	if cluster.limiters[name] != nil || cluster.limiters["policy:"+limiterID("login", login.Limits[0])] == nil {
+		t.Fatalf("tracked limiters after reload: %v", cluster.limiters)
+	}
+}
@@ -0,0 +1,455 @@
+// Package ratelimit applies rate limit policies. A policy selects requests
+// by route key, path prefix and method, and holds several limits that must
+// all allow a request, such as 10 a second and 1000 an hour per client
+// address alongside 5000 a second for the whole route. Each limit counts
+// requests under a key composed from the client address, a header, a
+// cookie, the authenticated user or the API key.
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"netgoat.xyz/agent/internal/normalize"
+	"netgoat.xyz/agent/internal/traffic"
+)
+
+// Key components. Header and cookie components name the header or cookie
+// after a colon: "header:X-Tenant", "cookie:session".
+const (
+	KeyIP     = "ip"
+	KeyUser   = "user"
+	KeyAPIKey = "api_key"
+	KeyRoute  = "route"
+	KeyHost   = "host"
+	KeyGlobal = "global"
+
+	keyHeaderPrefix = "header:"
+	keyCookiePrefix = "cookie:"
+)
+
+// Limit allows Requests every PeriodSeconds, in bursts of up to Burst
+// (Requests when zero), for each distinct key. Key lists the components the
+// key is built from and defaults to the client address. A user, API key,
+// header or cookie component that is absent from a request counts the
+// request against the client address instead, so anonymous clients do not
+// share one bucket.
+type Limit struct {
+	Requests      int      `json:"requests"`
+	PeriodSeconds int      `json:"period_seconds"`
+	Burst         int      `json:"burst,omitempty"`
+	Key           []string `json:"key,omitempty"`
+}
+
+// Period returns the limit's period.
+func (l Limit) Period() time.Duration {
+	return time.Duration(l.PeriodSeconds) * time.Second
+}
+
+// String describes the limit as, for example, "10/1s by ip".
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s by %s", l.Requests, l.Period(), strings.Join(l.keyComponents(), "+"))
+}
+
+func (l Limit) keyComponents() []string {
+	if len(l.Key) == 0 {
+		return []string{KeyIP}
+	}
+	return l.Key
+}
+
+// Policy applies its limits to requests matching every non-empty selector:
+// one of the resolved route keys, one of the path prefixes of the canonical
+// path, and one of the methods. A policy without selectors applies to every
+// request.
+type Policy struct {
+	Name         string   `json:"-"`
+	Routes       []string `json:"routes,omitempty"`
+	PathPrefixes []string `json:"path_prefixes,omitempty"`
+	Methods      []string `json:"methods,omitempty"`
+	Limits       []Limit  `json:"limits"`
+}
+
+// Validate reports the first problem that would stop the policy compiling.
+func (p Policy) Validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return errors.New("rate limit policy name cannot be empty")
+	}
+	if len(p.Limits) == 0 {
+		return fmt.Errorf("rate limit policy %q has no limits", p.Name)
+	}
+	for i, limit := range p.Limits {
+		if limit.Requests <= 0 || limit.PeriodSeconds <= 0 || limit.Burst < 0 {
+			return fmt.Errorf("rate limit policy %q: limit %d needs positive requests and period_seconds", p.Name, i+1)
+		}
+		for _, component := range limit.Key {
+			if !validComponent(component) {
+				return fmt.Errorf("rate limit policy %q: limit %d: unknown key component %q", p.Name, i+1, component)
+			}
+		}
+	}
+	return nil
+}
+
+func validComponent(component string) bool {
+	switch component {
+	case KeyIP, KeyUser, KeyAPIKey, KeyRoute, KeyHost, KeyGlobal:
+		return true
+	}
+	if name, ok := strings.CutPrefix(component, keyHeaderPrefix); ok {
+		return strings.TrimSpace(name) != ""
+	}
+	if name, ok := strings.CutPrefix(component, keyCookiePrefix); ok {
+		return strings.TrimSpace(name) != ""
+	}
+	return false
+}
+
+// Identity carries what the proxy knows about a request beyond the request
+// itself.
+type Identity struct {
+	ClientIP string
+	RouteKey string
+	User     string
+}
+
+// Decision is the outcome of checking a request against every policy.
+type Decision struct {
+	Allowed bool
+	// Policy and Limit name the limit that refused the request.
+	Policy string
+	Limit  Limit
+	// Usage is the largest share of any matching limit's burst now spent,
+	// from 0 to 1.
+	Usage float64
+	// Quotas report the state of each limit checked, named
+	// "<policy>/<limit number>", for the RateLimit response headers.
+	Quotas []traffic.RateLimitQuota
+}
+
+// Set is an immutable compiled collection of policies. Its limiters are
+// shared with the set it was compiled from, so counts survive reloads.
+type Set struct {
+	policies []*compiledPolicy
+}
+
+type compiledPolicy struct {
+	Policy
+	limiters []*traffic.RateLimiter
+}
+
+// Compile validates and compiles policies, in name order. Limiters of
+// limits that are unchanged from previous, which may be nil, are kept.
+func Compile(policies []Policy, previous *Set) (*Set, error) {
+	reuse := make(map[string]*traffic.RateLimiter)
+	if previous != nil {
+		for _, policy := range previous.policies {
+			for i, limit := range policy.Limits {
+				reuse[limiterID(policy.Name, limit)] = policy.limiters[i]
+			}
+		}
+	}
+
+	set := &Set{policies: make([]*compiledPolicy, 0, len(policies))}
+	for _, policy := range policies {
+		policy = policy.normalized()
+		if err := policy.Validate(); err != nil {
+			return nil, err
+		}
+		compiled := &compiledPolicy{Policy: policy, limiters: make([]*traffic.RateLimiter, len(policy.Limits))}
+		for i, limit := range policy.Limits {
+			limiter := reuse[limiterID(policy.Name, limit)]
+			if limiter == nil {
+				limiter = traffic.NewRateLimiterEvery(limit.Requests, limit.Period(), limit.Burst)
+			}
+			compiled.limiters[i] = limiter
+		}
+		set.policies = append(set.policies, compiled)
+	}
+	slices.SortFunc(set.policies, func(a, b *compiledPolicy) int { return strings.Compare(a.Name, b.Name) })
+	return set, nil
+}
+
+func (p Policy) normalized() Policy {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Routes = cleanEntries(p.Routes, nil)
+	p.PathPrefixes = cleanEntries(p.PathPrefixes, nil)
+	p.Methods = cleanEntries(p.Methods, strings.ToUpper)
+	limits := make([]Limit, len(p.Limits))
+	for i, limit := range p.Limits {
+		limit.Key = cleanEntries(limit.Key, func(component string) string {
+			if name, ok := strings.CutPrefix(component, keyHeaderPrefix); ok {
+				return keyHeaderPrefix + http.CanonicalHeaderKey(strings.TrimSpace(name))
+			}
+			if name, ok := strings.CutPrefix(component, keyCookiePrefix); ok {
+				return keyCookiePrefix + strings.TrimSpace(name)
+			}
+			return strings.ToLower(component)
+		})
+		limits[i] = limit
+	}
+	p.Limits = limits
+	return p
+}
+
+// limiterID identifies a limit across reloads: a limit whose rate, burst
+// or key changes starts counting afresh.
+func limiterID(policy string, limit Limit) string {
+	return fmt.Sprintf("%s|%d|%d|%d|%s", policy, limit.Requests, limit.PeriodSeconds, limit.Burst, strings.Join(limit.Key, ","))
+}
+
+func cleanEntries(entries []string, transform func(string) string) []string {
+	var cleaned []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if transform != nil && entry != "" {
+			entry = transform(entry)
+		}
+		if entry != "" && !slices.Contains(cleaned, entry) {
+			cleaned = append(cleaned, entry)
+		}
+	}
+	return cleaned
+}
+
+// Len returns the number of policies in the set.
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.policies)
+}
+
+// Allow checks r against every matching policy and takes a token from each
+// of their limits. When any limit refuses the request, the tokens already
+// taken are returned, so a refused request does not count against the
+// others. A nil *Set allows everything.
+func (s *Set) Allow(r *http.Request, id Identity) Decision {
+	decision := Decision{Allowed: true}
+	if s == nil {
+		return decision
+	}
+	type token struct {
+		limiter *traffic.RateLimiter
+		key     string
+	}
+	var taken []token
+	for _, policy := range s.policies {
+		if !policy.matches(id.RouteKey, r.Method, normalize.CanonicalPath(r)) {
+			continue
+		}
+		for i, limit := range policy.Limits {
+			limiter, key := policy.limiters[i], requestKey(limit, r, id)
+			status := limiter.Take(key)
+			decision.Quotas = append(decision.Quotas, traffic.RateLimitQuota{Name: fmt.Sprintf("%s/%d", policy.Name, i+1), RateLimitStatus: status})
+			if !status.Allowed {
+				for j, t := range taken {
+					decision.Quotas[j].RateLimitStatus = t.limiter.Refund(t.key)
+				}
+				decision.Allowed, decision.Policy, decision.Limit, decision.Usage = false, policy.Name, limit, 1
+				return decision
+			}
+			taken = append(taken, token{limiter, key})
+			decision.Usage = max(decision.Usage, limiter.Usage(key))
+		}
+	}
+	return decision
+}
+
+func (p *compiledPolicy) matches(routeKey, method, path string) bool {
+	if len(p.Routes) > 0 && !slices.Contains(p.Routes, routeKey) {
+		return false
+	}
+	if len(p.PathPrefixes) > 0 && !slices.ContainsFunc(p.PathPrefixes, func(prefix string) bool { return strings.HasPrefix(path, prefix) }) {
+		return false
+	}
+	if len(p.Methods) > 0 && !slices.Contains(p.Methods, strings.ToUpper(method)) {
+		return false
+	}
+	return true
+}
+
+// requestKey builds the limiter key for r from the limit's components.
+func requestKey(limit Limit, r *http.Request, id Identity) string {
+	components := limit.keyComponents()
+	parts := make([]string, 0, len(components))
+	for _, component := range components {
+		parts = append(parts, keyPart(component, r, id))
+	}
+	return strings.Join(parts, "|")
+}
+
+func keyPart(component string, r *http.Request, id Identity) string {
+	var value string
+	switch component {
+	case KeyIP:
+		return "ip=" + id.ClientIP
+	case KeyRoute:
+		return "route=" + id.RouteKey
+	case KeyHost:
+		host := r.Host
+		if i := strings.LastIndex(host, ":"); i > 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		return "host=" + strings.ToLower(host)
+	case KeyGlobal:
+		return "global"
+	case KeyUser:
+		value = id.User
+	case KeyAPIKey:
+		value = apiKey(r)
+	default:
+		if name, ok := strings.CutPrefix(component, keyHeaderPrefix); ok {
+			value = r.Header.Get(name)
+		} else if name, ok := strings.CutPrefix(component, keyCookiePrefix); ok {
+			if cookie, err := r.Cookie(name); err == nil {
+				value = cookie.Value
+			}
+		}
+	}
+	if value == "" {
+		return "ip=" + id.ClientIP
+	}
+	return component + "=" + value
+}
+
+// apiKey returns a digest of the request's X-API-Key header or bearer
+// token, so credentials are not kept as limiter keys.
+func apiKey(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			key = strings.TrimSpace(token)
+		}
+	}
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:12])
+}
+
+// Store publishes compiled sets atomically so readers never see a partial
+// update.
+type Store struct {
+	mu      sync.Mutex
+	current atomic.Pointer[Set]
+	cluster *Cluster
+}
+
+// NewStore returns a store holding no policies.
+func NewStore() *Store {
+	store := &Store{}
+	store.current.Store(&Set{})
+	return store
+}
+
+// Set returns the currently published set.
+func (s *Store) Set() *Set {
+	if s == nil {
+		return nil
+	}
+	return s.current.Load()
+}
+
+// Allow checks r against the currently published set.
+func (s *Store) Allow(r *http.Request, id Identity) Decision {
+	return s.Set().Allow(r, id)
+}
+
+// Load compiles policies and publishes them. Nothing changes if any policy
+// is invalid.
+func (s *Store) Load(policies []Policy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.current.Load()
+	set, err := Compile(policies, previous)
+	if err != nil {
+		return err
+	}
+	s.track(previous, set)
+	s.current.Store(set)
+	return nil
+}
+
+// UseCluster shares the consumption of every policy limit, now and after
+// reloads, through cluster.
+func (s *Store) UseCluster(cluster *Cluster) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cluster = cluster
+	s.track(nil, s.current.Load())
+}
+
+// track registers next's limiters with the cluster and drops those of
+// previous that next no longer has.
+func (s *Store) track(previous, next *Set) {
+	if s.cluster == nil {
+		return
+	}
+	names := make(map[string]bool)
+	for _, policy := range next.policies {
+		for i, limit := range policy.Limits {
+			name := "policy:" + limiterID(policy.Name, limit)
+			names[name] = true
+			s.cluster.Track(name, policy.limiters[i])
+		}
+	}
+	if previous == nil {
+		return
+	}
+	for _, policy := range previous.policies {
+		for _, limit := range policy.Limits {
+			if name := "policy:" + limiterID(policy.Name, limit); !names[name] {
+				s.cluster.Track(name, nil)
+			}
+		}
+	}
+}
+
+// Reload reads every policy from the database and publishes them. The
+// previous set stays active if reading or compiling fails.
+func (s *Store) Reload(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name, routes, path_prefixes, methods, limits FROM rate_limit_policies ORDER BY name`)
+	if err != nil {
+		return fmt.Errorf("load rate limit policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []Policy
+	for rows.Next() {
+		var (
+			policy                         Policy
+			routes, prefixes, methods, raw string
+		)
+		if err := rows.Scan(&policy.Name, &routes, &prefixes, &methods, &raw); err != nil {
+			return fmt.Errorf("scan rate limit policy: %w", err)
+		}
+		policy.Routes, policy.PathPrefixes, policy.Methods = splitList(routes), splitList(prefixes), splitList(methods)
+		if err := json.Unmarshal([]byte(raw), &policy.Limits); err != nil {
+			return fmt.Errorf("decode limits of rate limit policy %q: %w", policy.Name, err)
+		}
+		policies = append(policies, policy)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate rate limit policies: %w", err)
+	}
+	return s.Load(policies)
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
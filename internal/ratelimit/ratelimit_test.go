@@ -0,0 +1,167 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"netgoat.xyz/agent/internal/database"
+)
+
+func mustCompile(t *testing.T, policies ...Policy) *Set {
+	t.Helper()
+	set, err := Compile(policies, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestEveryMatchingLimitMustAllow(t *testing.T) {
+	set := mustCompile(t,
+		Policy{Name: "api", Routes: []string{"domain:api.example.com"}, Limits: []Limit{
+			{Requests: 2, PeriodSeconds: 1},
+			{Requests: 3, PeriodSeconds: 3600, Key: []string{"route"}},
+		}},
+		Policy{Name: "login", PathPrefixes: []string{"/login"}, Methods: []string{"post"}, Limits: []Limit{
+			{Requests: 1, PeriodSeconds: 60},
+		}},
+	)
+	api := Identity{ClientIP: "192.0.2.1", RouteKey: "domain:api.example.com"}
+	other := Identity{ClientIP: "192.0.2.2", RouteKey: "domain:api.example.com"}
+	req := httptest.NewRequest(http.MethodGet, "/v1/items", nil)
+
+	if d := set.Allow(req, api); !d.Allowed || d.Usage < 0.49 || d.Usage > 0.5 {
+		t.Fatalf("first request: %+v", d)
+	}
+	set.Allow(req, api)
+	if d := set.Allow(req, api); d.Allowed || d.Policy != "api" || d.Limit.PeriodSeconds != 1 {
+		t.Fatalf("per-IP limit: %+v", d)
+	}
+	// The refused request was not counted against the route: one of its
+	// three hourly requests is still left.
+	if d := set.Allow(req, other); !d.Allowed {
+		t.Fatalf("route limit counted a refused request: %+v", d)
+	}
+	d := set.Allow(req, other)
+	if d.Allowed || d.Limit.Key[0] != KeyRoute {
+		t.Fatalf("route limit: %+v", d)
+	}
+	if len(d.Quotas) != 2 || d.Quotas[0].Name != "api/1" || d.Quotas[0].Remaining != 1 || d.Quotas[1].Name != "api/2" || d.Quotas[1].Allowed || d.Quotas[1].RetryAfter < 19*time.Minute {
+		t.Fatalf("quotas of a refused request: %+v", d.Quotas)
+	}
+
+	if d := set.Allow(req, Identity{ClientIP: "192.0.2.1", RouteKey: "path:/"}); !d.Allowed || d.Usage != 0 {
+		t.Fatalf("unmatched route: %+v", d)
+	}
+	login := httptest.NewRequest(http.MethodPost, "/login", nil)
+	visitor := Identity{ClientIP: "198.51.100.4"}
+	set.Allow(login, visitor)
+	if d := set.Allow(login, visitor); d.Allowed || d.Policy != "login" {
+		t.Fatalf("login: %+v", d)
+	}
+	if d := set.Allow(httptest.NewRequest(http.MethodGet, "/login", nil), visitor); !d.Allowed {
+		t.Fatalf("login policy applied to GET: %+v", d)
+	}
+}
+
+func TestComposedKeys(t *testing.T) {
+	limit := Limit{Requests: 1, PeriodSeconds: 60, Key: []string{"user", "header:x-tenant"}}
+	set := mustCompile(t, Policy{Name: "tenants", Limits: []Limit{limit}})
+	request := func(tenant string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Tenant", tenant)
+		return req
+	}
+
+	if !set.Allow(request("a"), Identity{ClientIP: "192.0.2.1", User: "alice"}).Allowed {
+		t.Fatal("first request refused")
+	}
+	if !set.Allow(request("b"), Identity{ClientIP: "192.0.2.1", User: "alice"}).Allowed {
+		t.Fatal("another tenant shares alice's bucket")
+	}
+	if !set.Allow(request("a"), Identity{ClientIP: "192.0.2.1", User: "bob"}).Allowed {
+		t.Fatal("bob shares alice's bucket")
+	}
+	if set.Allow(request("a"), Identity{ClientIP: "192.0.2.9", User: "alice"}).Allowed {
+		t.Fatal("alice's bucket should follow her across addresses")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		key    []string
+		build  func(*http.Request)
+		id     Identity
+		expect string
+	}{
+		{"anonymous user", []string{"user"}, nil, Identity{ClientIP: "192.0.2.1"}, "ip=192.0.2.1"},
+		{"bearer token", []string{"api_key"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, Identity{}, "api_key=2bb80d537b1da3e38bd30361"},
+		{"cookie", []string{"cookie:session"}, func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "s1"}) }, Identity{}, "cookie:session=s1"},
+		{"host and route", []string{"host", "route"}, nil, Identity{RouteKey: "domain:example.com"}, "host=example.com|route=domain:example.com"},
+		{"global", []string{"global"}, nil, Identity{ClientIP: "192.0.2.1"}, "global"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://Example.com:8080/", nil)
+		if tc.build != nil {
+			tc.build(req)
+		}
+		if got := requestKey(Limit{Key: tc.key}, req, tc.id); got != tc.expect {
+			t.Errorf("%s: key = %q, want %q", tc.name, got, tc.expect)
+		}
+	}
+}
+
+func TestCompileRejectsInvalidPolicies(t *testing.T) {
+	for name, policy := range map[string]Policy{
+		"no name":        {Limits: []Limit{{Requests: 1, PeriodSeconds: 1}}},
+		"no limits":      {Name: "p"},
+		"zero period":    {Name: "p", Limits: []Limit{{Requests: 1}}},
+		"unknown key":    {Name: "p", Limits: []Limit{{Requests: 1, PeriodSeconds: 1, Key: []string{"country"}}}},
+		"unnamed cookie": {Name: "p", Limits: []Limit{{Requests: 1, PeriodSeconds: 1, Key: []string{"cookie:"}}}},
+	} {
+		if _, err := Compile([]Policy{policy}, nil); err == nil {
+			t.Errorf("%s: compiled", name)
+		}
+	}
+}
+
+func TestStoreReloadKeepsCounts(t *testing.T) {
+	db, err := database.Init(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`INSERT INTO rate_limit_policies (name, routes, path_prefixes, methods, limits)
+		VALUES ('login', '', '/login', 'POST', '[{"requests":1,"period_seconds":60}]')`); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewStore()
+	if err := store.Reload(db); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	id := Identity{ClientIP: "192.0.2.1"}
+	if !store.Allow(req, id).Allowed {
+		t.Fatal("first login refused")
+	}
+	if err := store.Reload(db); err != nil {
+		t.Fatal(err)
+	}
+	if store.Allow(req, id).Allowed {
+		t.Fatal("reload reset an unchanged limit")
+	}
+
+	if _, err := db.Exec(`UPDATE rate_limit_policies SET limits = '[{"requests":1,"period_seconds":0}]'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(db); err == nil || store.Set().Len() != 1 {
+		t.Fatalf("invalid reload: %v, %d policies", err, store.Set().Len())
+	}
+	if _, err := db.Exec(`UPDATE rate_limit_policies SET limits = '[{"requests":2,"period_seconds":60}]'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(db); err != nil || !store.Allow(req, id).Allowed {
+		t.Fatalf("changed limit should count afresh: %v", err)
+	}
+}
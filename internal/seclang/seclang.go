@@ -0,0 +1,729 @@
+// Package seclang converts a practical subset of ModSecurity SecLang rules,
+// such as those shipped with the OWASP Core Rule Set, into expressions for the
+// WAF engine.
+//
+// Supported:
+//   - SecRule with REQUEST_URI, REQUEST_FILENAME, REQUEST_METHOD, ARGS,
+//     ARGS_NAMES, REQUEST_HEADERS, REQUEST_HEADERS_NAMES and REQUEST_BODY,
+//     including ":name" selectors and "!" exclusions of literal names
+//   - the @rx, @pm, @contains, @streq, @beginsWith, @endsWith, @within and
+//     @detectSQLi operators, optionally negated
+//   - the t:none, t:lowercase and t:urlDecode transformations
+//   - chained rules, severity, anomaly-score setvar and attack-* tags
+//
+// Scoring rules that add no anomaly score, of INFO or DEBUG severity or a
+// pass without setvar, are reported as well.
+//
+// Anything else makes the whole rule untranslatable. Such rules are returned
+// as Issues so callers can report them; a partially translated rule could
+// block more or less than the original, so none is ever emitted.
+package seclang
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"netgoat.xyz/agent/internal/waf"
+)
+
+// Rule is one translated SecRule (including any rules chained to it).
+type Rule struct {
+	ID         int
+	Name       string
+	Expression string
+	// Action is one of the waf Action* constants.
+	Action   string
+	Score    int
+	Category string
+	Source   string
+	Line     int
+}
+
+// Issue reports a directive that could not be translated.
+type Issue struct {
+	Source string
+	Line   int
+	RuleID int
+	Reason string
+}
+
+func (i Issue) String() string {
+	location := i.Source
+	if i.Line > 0 {
+		location = fmt.Sprintf("%s:%d", i.Source, i.Line)
+	}
+	if i.RuleID > 0 {
+		return fmt.Sprintf("%s: rule %d: %s", location, i.RuleID, i.Reason)
+	}
+	return fmt.Sprintf("%s: %s", location, i.Reason)
+}
+
+// Result collects the translated rules and the issues found while converting.
+type Result struct {
+	Rules  []Rule
+	Issues []Issue
+}
+
+// LoadFiles converts every file matched by the glob patterns, in sorted order
+// per pattern. Patterns that match nothing are reported as issues.
+func LoadFiles(patterns []string) (*Result, error) {
+	result := &Result{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("seclang pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			result.Issues = append(result.Issues, Issue{Source: pattern, Reason: "pattern matched no files"})
+			continue
+		}
+		sort.Strings(matches)
+		for _, path := range matches {
+			file, err := os.Open(path)
+			if err != nil {
+				return nil, fmt.Errorf("open seclang file: %w", err)
+			}
+			parsed, err := Parse(file, path)
+			_ = file.Close()
+			if err != nil {
+				return nil, err
+			}
+			result.Rules = append(result.Rules, parsed.Rules...)
+			result.Issues = append(result.Issues, parsed.Issues...)
+		}
+	}
+	return result, nil
+}
+
+// Parse converts the SecLang directives read from r. The source name is only
+// used in rule provenance and issue messages. The returned error is reserved
+// for read failures; untranslatable input is reported through Result.Issues.
+func Parse(r io.Reader, source string) (*Result, error) {
+	directives, err := readDirectives(r)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", source, err)
+	}
+
+	result := &Result{}
+	var (
+		chain    []*secRule
+		chainErr error
+	)
+	flush := func() {
+		if len(chain) == 0 {
+			return
+		}
+		head := chain[0]
+		err := chainErr
+		if err == nil {
+			var rule Rule
+			if rule, err = translate(chain, source); err == nil {
+				result.Rules = append(result.Rules, rule)
+			}
+		}
+		if err != nil {
+			result.Issues = append(result.Issues, Issue{Source: source, Line: head.line, RuleID: head.id, Reason: err.Error()})
+		}
+		chain = nil
+		chainErr = nil
+	}
+
+	for _, d := range directives {
+		args, err := splitArgs(d.text)
+		if err != nil {
+			flush()
+			result.Issues = append(result.Issues, Issue{Source: source, Line: d.line, Reason: err.Error()})
+			continue
+		}
+		name := args[0]
+		switch strings.ToLower(name) {
+		case "secrule":
+			// A rule that cannot be translated still consumes the rest of
+			// its chain, so the links are reported with it rather than being
+			// mistaken for standalone rules.
+			rule, err := parseSecRule(args[1:], d.line)
+			if err != nil && chainErr == nil {
+				if len(chain) > 0 {
+					err = fmt.Errorf("chained rule at line %d: %w", d.line, err)
+				}
+				chainErr = err
+			}
+			chain = append(chain, rule)
+			if !rule.chained {
+				flush()
+			}
+		case "secmarker", "seccomponentsignature":
+			// Markers and signatures have no runtime effect on their own.
+			flush()
+		default:
+			flush()
+			result.Issues = append(result.Issues, Issue{Source: source, Line: d.line, Reason: "unsupported directive " + name})
+		}
+	}
+	if len(chain) > 0 && chainErr == nil {
+		chainErr = fmt.Errorf("chain is not terminated")
+	}
+	flush()
+	return result, nil
+}
+
+type directive struct {
+	text string
+	line int
+}
+
+// readDirectives joins backslash-continued lines and drops comments.
+func readDirectives(r io.Reader) ([]directive, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 4<<20)
+	var (
+		directives []directive
+		current    strings.Builder
+		start      int
+		lineNo     int
+	)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if current.Len() == 0 {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			start = lineNo
+		}
+		if strings.HasSuffix(line, `\`) {
+			current.WriteString(strings.TrimSuffix(line, `\`))
+			current.WriteByte(' ')
+			continue
+		}
+		current.WriteString(line)
+		directives = append(directives, directive{text: strings.TrimSpace(current.String()), line: start})
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() > 0 {
+		directives = append(directives, directive{text: strings.TrimSpace(current.String()), line: start})
+	}
+	return directives, nil
+}
+
+// splitArgs splits a directive into whitespace-separated arguments, honouring
+// double quotes and backslash-escaped quotes inside them.
+func splitArgs(text string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inQuote bool
+		started bool
+	)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case inQuote && c == '\\' && i+1 < len(text) && text[i+1] == '"':
+			current.WriteByte('"')
+			i++
+		case c == '"':
+			inQuote = !inQuote
+			started = true
+		case !inQuote && (c == ' ' || c == '\t'):
+			if started {
+				args = append(args, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteByte(c)
+			started = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quoted argument")
+	}
+	if started {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty directive")
+	}
+	return args, nil
+}
+
+type secRule struct {
+	line       int
+	id         int
+	variables  []variable
+	operator   string
+	operand    string
+	negated    bool
+	transforms []string
+	chained    bool
+	action     string
+	// pass is set when the rule only passes, so it scores by severity or
+	// setvar alone.
+	pass     bool
+	msg      string
+	tags     []string
+	severity string
+	score    int
+}
+
+type variable struct {
+	collection string
+	selector   string
+	exclusions []string
+}
+
+func parseSecRule(args []string, line int) (*secRule, error) {
+	rule := &secRule{line: line}
+	if len(args) < 2 || len(args) > 3 {
+		return rule, fmt.Errorf("SecRule needs variables, operator and optional actions")
+	}
+	// Actions are parsed first so issues can name the rule id and so a
+	// chain start is recognised even when the rest is untranslatable.
+	if len(args) == 3 {
+		if err := rule.parseActions(args[2]); err != nil {
+			return rule, err
+		}
+	}
+	variables, err := parseVariables(args[0])
+	if err != nil {
+		return rule, err
+	}
+	rule.variables = variables
+	if err := rule.parseOperator(args[1]); err != nil {
+		return rule, err
+	}
+	return rule, nil
+}
+
+func parseVariables(text string) ([]variable, error) {
+	var variables []variable
+	for _, part := range strings.Split(text, "|") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, "&") {
+			return nil, fmt.Errorf("unsupported variable count %s", part)
+		}
+		exclude := strings.HasPrefix(part, "!")
+		part = strings.TrimPrefix(part, "!")
+		collection, selector, _ := strings.Cut(part, ":")
+		collection = strings.ToUpper(collection)
+		if _, ok := collections[collection]; !ok {
+			return nil, fmt.Errorf("unsupported variable %s", collection)
+		}
+		if strings.HasPrefix(selector, "/") || strings.HasPrefix(selector, "'/") {
+			return nil, fmt.Errorf("unsupported regular expression selector %s:%s", collection, selector)
+		}
+		selector = strings.Trim(selector, "'")
+		if exclude {
+			if selector == "" {
+				return nil, fmt.Errorf("exclusion of %s needs a name", collection)
+			}
+			found := false
+			for i := range variables {
+				if variables[i].collection == collection && variables[i].selector == "" {
+					variables[i].exclusions = append(variables[i].exclusions, selector)
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("exclusion %s:%s does not follow its collection", collection, selector)
+			}
+			continue
+		}
+		if selector != "" && !collections[collection].keyed {
+			return nil, fmt.Errorf("variable %s does not take a selector", collection)
+		}
+		variables = append(variables, variable{collection: collection, selector: selector})
+	}
+	if len(variables) == 0 {
+		return nil, fmt.Errorf("rule has no variables")
+	}
+	return variables, nil
+}
+
+var supportedOperators = map[string]bool{
+	"rx": true, "pm": true, "contains": true, "streq": true,
+	"beginswith": true, "endswith": true, "within": true, "detectsqli": true,
+}
+
+func (r *secRule) parseOperator(text string) error {
+	if strings.HasPrefix(text, "!") {
+		r.negated = true
+		text = text[1:]
+	}
+	if !strings.HasPrefix(text, "@") {
+		// An operator without "@" is an implicit @rx.
+		r.operator = "rx"
+		r.operand = text
+	} else {
+		name, operand, _ := strings.Cut(text[1:], " ")
+		r.operator = strings.ToLower(name)
+		r.operand = operand
+	}
+	if !supportedOperators[r.operator] {
+		return fmt.Errorf("unsupported operator @%s", r.operator)
+	}
+	if strings.Contains(r.operand, "%{") {
+		return fmt.Errorf("unsupported macro expansion in @%s operand", r.operator)
+	}
+	if r.operator == "rx" {
+		if _, err := regexp.Compile(r.operand); err != nil {
+			return fmt.Errorf("regular expression is not RE2 compatible: %v", err)
+		}
+	}
+	if r.operator == "pm" && len(strings.Fields(r.operand)) == 0 {
+		return fmt.Errorf("@pm needs at least one phrase")
+	}
+	return nil
+}
+
+// ignoredActions only affect logging or metadata.
+var ignoredActions = map[string]bool{
+	"log": true, "nolog": true, "auditlog": true, "noauditlog": true,
+	"capture": true, "ver": true, "rev": true, "maturity": true,
+	"accuracy": true, "logdata": true, "status": true,
+}
+
+// severityScores mirror the CRS default anomaly score per severity. Info
+// and debug rules add nothing to it.
+var severityScores = map[string]int{
+	"emergency": 5, "alert": 5, "critical": 5, "error": 4, "warning": 3, "notice": 2,
+	"info": 0, "debug": 0,
+	"0": 5, "1": 5, "2": 5, "3": 4, "4": 3, "5": 2, "6": 0, "7": 0,
+}
+
+// scoreMacros resolve the CRS severity score variables used in setvar.
+var scoreMacros = map[string]int{
+	"tx.critical_anomaly_score": 5,
+	"tx.error_anomaly_score":    4,
+	"tx.warning_anomaly_score":  3,
+	"tx.notice_anomaly_score":   2,
+}
+
+// parseActions reads every action even after an error so the id and chain
+// flag are known for reporting; the first error is returned.
+func (r *secRule) parseActions(text string) error {
+	var first error
+	fail := func(err error) {
+		if first == nil {
+			first = err
+		}
+	}
+	for _, action := range splitActions(text) {
+		name, value, _ := strings.Cut(action, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), "'")
+		switch name {
+		case "id":
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				fail(fmt.Errorf("invalid id %q", value))
+			}
+			r.id = id
+		case "phase":
+			if value != "1" && value != "2" && value != "request" {
+				fail(fmt.Errorf("unsupported phase %s", value))
+			}
+		case "chain":
+			r.chained = true
+		case "deny", "drop":
+			r.action = waf.ActionBlock
+		case "block", "pass":
+			r.action = waf.ActionScore
+			r.pass = name == "pass"
+		case "allow":
+			r.action = waf.ActionAllow
+		case "msg":
+			r.msg = value
+		case "tag":
+			r.tags = append(r.tags, value)
+		case "severity":
+			r.severity = strings.ToLower(value)
+		case "t":
+			transform := strings.ToLower(value)
+			switch transform {
+			case "none":
+				r.transforms = nil
+			case "lowercase", "urldecode":
+				r.transforms = append(r.transforms, transform)
+			default:
+				fail(fmt.Errorf("unsupported transformation t:%s", value))
+			}
+		case "setvar":
+			score, err := anomalyScore(value)
+			if err != nil {
+				fail(err)
+			}
+			r.score += score
+		default:
+			if !ignoredActions[name] {
+				fail(fmt.Errorf("unsupported action %s", name))
+			}
+		}
+	}
+	return first
+}
+
+// splitActions splits on commas outside single quotes.
+func splitActions(text string) []string {
+	var (
+		actions []string
+		current strings.Builder
+		quoted  bool
+	)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && text[i+1] == '\'':
+			current.WriteByte('\'')
+			i++
+		case c == '\'':
+			quoted = !quoted
+			current.WriteByte(c)
+		case c == ',' && !quoted:
+			actions = append(actions, strings.TrimSpace(current.String()))
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if tail := strings.TrimSpace(current.String()); tail != "" {
+		actions = append(actions, tail)
+	}
+	return actions
+}
+
+// anomalyScore returns the increment a setvar adds to the inbound anomaly
+// score. Other variables only feed CRS bookkeeping and are ignored.
+func anomalyScore(expression string) (int, error) {
+	target, value, ok := strings.Cut(expression, "=")
+	target = strings.ToLower(strings.TrimSpace(target))
+	if !ok || !strings.HasPrefix(target, "tx.") || !strings.Contains(target, "anomaly_score") {
+		return 0, nil
+	}
+	if strings.HasPrefix(target, "tx.outbound") {
+		return 0, nil
+	}
+	if !strings.HasPrefix(value, "+") {
+		return 0, fmt.Errorf("unsupported anomaly score assignment %s", expression)
+	}
+	value = strings.TrimPrefix(value, "+")
+	if macro, found := strings.CutPrefix(value, "%{"); found {
+		score, ok := scoreMacros[strings.ToLower(strings.TrimSuffix(macro, "}"))]
+		if !ok {
+			return 0, fmt.Errorf("unsupported anomaly score macro %s", value)
+		}
+		return score, nil
+	}
+	score, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported anomaly score increment %s", value)
+	}
+	return score, nil
+}
+
+func translate(chain []*secRule, source string) (Rule, error) {
+	head := chain[0]
+	for _, link := range chain[1:] {
+		if link.action != "" || link.id != 0 {
+			return Rule{}, fmt.Errorf("chained rule at line %d sets a disruptive action or id", link.line)
+		}
+	}
+	if head.id == 0 {
+		return Rule{}, fmt.Errorf("rule has no id")
+	}
+
+	parts := make([]string, 0, len(chain))
+	for _, link := range chain {
+		parts = append(parts, link.expression())
+	}
+	expression := parts[0]
+	if len(parts) > 1 {
+		expression = "(" + strings.Join(parts, ") && (") + ")"
+	}
+	if err := waf.ValidateExpression(expression); err != nil {
+		return Rule{}, fmt.Errorf("translated expression does not compile: %v", err)
+	}
+
+	action := head.action
+	if action == "" {
+		action = waf.ActionScore
+	}
+	score := head.score
+	severityScore, rated := severityScores[head.severity]
+	if score == 0 {
+		score = severityScore
+	}
+	// The engine weighs a rule without a score as a critical one, so a
+	// scoring rule that adds nothing, an informational or a bare pass rule,
+	// is reported rather than loaded.
+	if action == waf.ActionScore && score == 0 && (rated || head.pass) {
+		return Rule{}, fmt.Errorf("rule adds no anomaly score")
+	}
+	name := fmt.Sprintf("SecRule %d", head.id)
+	if head.msg != "" {
+		name += ": " + head.msg
+	}
+	return Rule{
+		ID:         head.id,
+		Name:       name,
+		Expression: expression,
+		Action:     action,
+		Score:      score,
+		Category:   category(head.tags),
+		Source:     source,
+		Line:       head.line,
+	}, nil
+}
+
+// category derives the scoring category from CRS "attack-*" tags.
+func category(tags []string) string {
+	for _, tag := range tags {
+		if name, ok := strings.CutPrefix(strings.ToLower(tag), "attack-"); ok && name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+type collectionSpec struct {
+	// field is the WAFContext field holding the collection.
+	field string
+	// kind is "string", "list" ([]string), "values" (map values) or "keys".
+	kind  string
+	keyed bool
+	// canonical normalizes selector names for case-insensitive collections.
+	canonical func(string) string
+}
+
+var collections = map[string]collectionSpec{
+	"REQUEST_URI":           {field: "URI", kind: "string"},
+	"REQUEST_FILENAME":      {field: "Path", kind: "string"},
+	"REQUEST_METHOD":        {field: "Method", kind: "string"},
+	"REQUEST_BODY":          {field: "Body", kind: "string"},
+	"ARGS":                  {field: "Args", kind: "values", keyed: true},
+	"ARGS_NAMES":            {field: "Args", kind: "keys"},
+	"REQUEST_HEADERS":       {field: "Headers", kind: "values", keyed: true, canonical: textproto.CanonicalMIMEHeaderKey},
+	"REQUEST_HEADERS_NAMES": {field: "Headers", kind: "keys"},
+}
+
+// expression renders one SecRule as an expr boolean. Each variable is
+// matched independently and the rule fires if any of them matches.
+func (r *secRule) expression() string {
+	parts := make([]string, 0, len(r.variables))
+	for _, v := range r.variables {
+		parts = append(parts, r.variableExpression(v))
+	}
+	return strings.Join(parts, " || ")
+}
+
+func (r *secRule) variableExpression(v variable) string {
+	spec := collections[v.collection]
+	switch {
+	case spec.kind == "string":
+		return r.predicate(spec.field)
+	case spec.kind == "keys":
+		return fmt.Sprintf("any(keys(%s), {%s})", spec.field, r.predicate("#"))
+	case v.selector != "":
+		name := v.selector
+		if spec.canonical != nil {
+			name = spec.canonical(name)
+		}
+		return fmt.Sprintf("any(%s[%s], {%s})", spec.field, quote(name), r.predicate("#"))
+	case len(v.exclusions) > 0:
+		excluded := make([]string, 0, len(v.exclusions))
+		for _, name := range v.exclusions {
+			if spec.canonical != nil {
+				name = spec.canonical(name)
+			}
+			excluded = append(excluded, quote(name))
+		}
+		// The inner predicate rebinds "#", so the value list is taken from
+		// the outer key before it is shadowed.
+		return fmt.Sprintf("any(keys(%s), {!(# in [%s]) && any(%s[#], {%s})})",
+			spec.field, strings.Join(excluded, ", "), spec.field, r.predicate("#"))
+	default:
+		return fmt.Sprintf("any(values(%s), {any(#, {%s})})", spec.field, r.predicate("#"))
+	}
+}
+
+// predicate applies the transformations and operator to a value expression.
+func (r *secRule) predicate(value string) string {
+	for _, transform := range r.transforms {
+		switch transform {
+		case "lowercase":
+			value = "lower(" + value + ")"
+		case "urldecode":
+			value = "urlDecode(" + value + ")"
+		}
+	}
+
+	var match string
+	switch r.operator {
+	case "rx":
+		match = value + " matches " + quote(r.operand)
+	case "pm":
+		phrases := strings.Fields(r.operand)
+		quoted := make([]string, len(phrases))
+		for i, phrase := range phrases {
+			quoted[i] = quote(phrase)
+		}
+		match = "phraseMatch(" + value + ", [" + strings.Join(quoted, ", ") + "])"
+	case "contains":
+		match = value + " contains " + quote(r.operand)
+	case "streq":
+		match = value + " == " + quote(r.operand)
+	case "beginswith":
+		match = value + " startsWith " + quote(r.operand)
+	case "endswith":
+		match = value + " endsWith " + quote(r.operand)
+	case "within":
+		match = quote(r.operand) + " contains " + value
+	case "detectsqli":
+		match = "detectSQLi(" + value + ")"
+	}
+	if r.negated {
+		return "!(" + match + ")"
+	}
+	return match
+}
+
+// quote renders s as an expr string literal. Non-printable bytes use \x
+// escapes so regular expressions survive byte-for-byte.
+func quote(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,235 @@
+package seclang
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"netgoat.xyz/agent/internal/waf"
+)
+
+const crsSample = `# Excerpt in the style of the OWASP Core Rule Set.
+SecComponentSignature "OWASP_CRS/4.0.0"
+SecMarker "BEGIN-REQUEST-942"
+
+SecRule ARGS|REQUEST_HEADERS:User-Agent|!ARGS:comment "@rx (?i)union\s+select" \
+    "id:942100,\
+    phase:2,\
+    block,\
+    t:none,t:urlDecode,t:lowercase,\
+    msg:'SQL Injection Attack Detected',\
+    tag:'attack-sqli',\
+    severity:'CRITICAL',\
+    setvar:'tx.inbound_anomaly_score_pl1=+%{tx.critical_anomaly_score}'"
+
+SecRule REQUEST_URI "@pm <script javascript:" \
+    "id:941100,phase:1,block,t:none,t:urlDecode,msg:'XSS',tag:'attack-xss',severity:'WARNING'"
+
+SecRule REQUEST_METHOD "@streq POST" "id:920100,phase:1,deny,chain,msg:'Form without content type'"
+    SecRule &REQUEST_HEADERS:Content-Type "@eq 0" ""
+
+SecRule REQUEST_BODY "@contains <!ENTITY" "id:944100,phase:2,deny,tag:'attack-xxe'"
+
+SecRule REQUEST_HEADERS_NAMES "@rx ^x-debug" "id:920200,phase:1,pass,t:lowercase,setvar:'tx.inbound_anomaly_score_pl1=+2'"
+
+SecRule ARGS "@detectXSS" "id:941101,phase:2,block"
+
+SecRule REQUEST_HEADERS:Referer "@detectSQLi" "id:942102,phase:1,block,tag:'attack-sqli'"
+
+SecRule REQUEST_FILENAME "@beginsWith /health" "id:900100,phase:1,allow"
+
+SecRule ARGS "@rx (?<=a)b" "id:942200,phase:2,block"
+
+SecRule ARGS "@rx x" "id:942300,phase:2,block,t:htmlEntityDecode"
+
+SecAction "id:900000,phase:1,pass,setvar:tx.paranoia_level=1"
+`
+
+func parseSample(t *testing.T) *Result {
+	t.Helper()
+	result, err := Parse(strings.NewReader(crsSample), "sample.conf")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return result
+}
+
+func TestParseTranslatesSupportedRules(t *testing.T) {
+	result := parseSample(t)
+
+	byID := make(map[int]Rule)
+	for _, rule := range result.Rules {
+		byID[rule.ID] = rule
+	}
+	for _, id := range []int{942100, 941100, 944100, 920200, 942102, 900100} {
+		if _, ok := byID[id]; !ok {
+			t.Fatalf("rule %d was not translated; issues: %v", id, result.Issues)
+		}
+	}
+
+	sqli := byID[942100]
+	if sqli.Action != waf.ActionScore || sqli.Score != 5 || sqli.Category != "sqli" || sqli.Line != 5 {
+		t.Fatalf("942100 = %+v", sqli)
+	}
+	if sqli.Name != "SecRule 942100: SQL Injection Attack Detected" {
+		t.Fatalf("942100 name = %q", sqli.Name)
+	}
+	if xss := byID[941100]; xss.Score != 3 || xss.Category != "xss" {
+		t.Fatalf("941100 score/category = %d/%q, want severity WARNING weight", xss.Score, xss.Category)
+	}
+	if xxe := byID[944100]; xxe.Action != waf.ActionBlock {
+		t.Fatalf("944100 action = %q, want BLOCK", xxe.Action)
+	}
+	if debug := byID[920200]; debug.Score != 2 || debug.Action != waf.ActionScore {
+		t.Fatalf("920200 = %+v", debug)
+	}
+	if allow := byID[900100]; allow.Action != waf.ActionAllow {
+		t.Fatalf("900100 action = %q, want ALLOW", allow.Action)
+	}
+}
+
+func TestParseReportsUntranslatableRules(t *testing.T) {
+	result := parseSample(t)
+
+	want := map[int]string{
+		920100: "chained rule at line 19: unsupported variable count &REQUEST_HEADERS:Content-Type",
+		941101: "unsupported operator @detectxss",
+		942200: "regular expression is not RE2 compatible",
+		942300: "unsupported transformation t:htmlEntityDecode",
+	}
+	reported := make(map[int]string)
+	var directiveIssue bool
+	for _, issue := range result.Issues {
+		if issue.RuleID != 0 {
+			reported[issue.RuleID] = issue.Reason
+		}
+		if issue.Reason == "unsupported directive SecAction" {
+			directiveIssue = true
+		}
+	}
+	for id, reason := range want {
+		if !strings.Contains(reported[id], reason) {
+			t.Errorf("rule %d issue = %q, want %q", id, reported[id], reason)
+		}
+	}
+	if !directiveIssue {
+		t.Errorf("SecAction was not reported: %v", result.Issues)
+	}
+	if len(result.Issues) != len(want)+1 {
+		t.Errorf("issues = %v", result.Issues)
+	}
+	for _, rule := range result.Rules {
+		if _, bad := want[rule.ID]; bad {
+			t.Errorf("untranslatable rule %d was emitted", rule.ID)
+		}
+	}
+}
+
+func TestParseReportsRulesWithoutAnomalyScore(t *testing.T) {
+	rules := `SecRule REQUEST_URI "@contains /info" "id:100,phase:1,block,severity:'INFO'"
+SecRule REQUEST_URI "@contains /debug" "id:101,phase:1,block,severity:7"
+SecRule REQUEST_URI "@contains /pass" "id:102,phase:1,pass,t:none"
+SecRule REQUEST_URI "@contains /scored" "id:103,phase:1,pass,setvar:'tx.inbound_anomaly_score_pl1=+3'"
+SecRule REQUEST_URI "@contains /denied" "id:104,phase:1,deny,severity:'INFO'"
+`
+	result, err := Parse(strings.NewReader(rules), "info.conf")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	reported := make(map[int]string)
+	for _, issue := range result.Issues {
+		reported[issue.RuleID] = issue.Reason
+	}
+	for _, id := range []int{100, 101, 102} {
+		if reported[id] != "rule adds no anomaly score" {
+			t.Errorf("rule %d issue = %q", id, reported[id])
+		}
+	}
+	if len(result.Rules) != 2 || result.Rules[0].ID != 103 || result.Rules[0].Score != 3 || result.Rules[1].Action != waf.ActionBlock {
+		t.Fatalf("rules = %+v", result.Rules)
+	}
+}
+
+func TestTranslatedRulesEvaluate(t *testing.T) {
+	result := parseSample(t)
+	rules := make([]waf.Rule, 0, len(result.Rules))
+	for _, rule := range result.Rules {
+		rules = append(rules, waf.Rule{
+			Name:       rule.Name,
+			Expression: rule.Expression,
+			Action:     rule.Action,
+			Score:      rule.Score,
+			Category:   rule.Category,
+		})
+	}
+	engine := waf.NewEngine()
+	if err := engine.Load(rules); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	scoring := waf.Options{Scoring: true, InboundThreshold: 5}
+
+	tests := []struct {
+		name    string
+		target  string
+		body    string
+		header  [2]string
+		blocked bool
+		rule    string
+	}{
+		{name: "clean", target: "/products?id=1"},
+		{name: "encoded sqli in args", target: "/?id=1%2520UNION%2520SELECT%2520pw", blocked: true, rule: waf.AnomalyRuleName},
+		{name: "excluded arg", target: "/?comment=union+select"},
+		{name: "sqli in user agent", target: "/", header: [2]string{"User-Agent", "x UNION  SELECT y"}, blocked: true, rule: waf.AnomalyRuleName},
+		{name: "form body arg", target: "/login", body: "user=a&pw=1+union+select+2", blocked: true, rule: waf.AnomalyRuleName},
+		{name: "below threshold", target: "/?q=%3Cscript%3E"},
+		{name: "xxe body", target: "/upload", body: `<!DOCTYPE x [<!ENTITY e SYSTEM "file:///etc/passwd">]>`, blocked: true, rule: waf.AnomalyRuleName},
+		{name: "sqli heuristic in referer", target: "/", header: [2]string{"Referer", "x' OR '1'='1"}, blocked: true, rule: waf.AnomalyRuleName},
+		{name: "allow wins", target: "/health?id=union+select"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			method := "GET"
+			if tc.body != "" {
+				method = "POST"
+			}
+			req := httptest.NewRequest(method, tc.target, strings.NewReader(tc.body))
+			if tc.body != "" && strings.Contains(tc.body, "=") {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tc.header[0] != "" {
+				req.Header.Set(tc.header[0], tc.header[1])
+			}
+			decision := engine.Evaluate(req, scoring)
+			if decision.Blocked != tc.blocked || !strings.HasPrefix(decision.Rule, tc.rule) {
+				t.Fatalf("decision = %+v, want blocked=%v rule=%q", decision, tc.blocked, tc.rule)
+			}
+		})
+	}
+}
+
+func TestLoadFilesReportsEmptyPatterns(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "REQUEST-900.conf")
+	if err := os.WriteFile(path, []byte(`SecRule REQUEST_URI "@contains /etc/passwd" "id:930120,phase:1,deny"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := LoadFiles([]string{filepath.Join(dir, "*.conf"), filepath.Join(dir, "missing-*.conf")})
+	if err != nil {
+		t.Fatalf("LoadFiles: %v", err)
+	}
+	if len(result.Rules) != 1 || result.Rules[0].Source != path {
+		t.Fatalf("rules = %+v", result.Rules)
+	}
+	if len(result.Issues) != 1 || result.Issues[0].Reason != "pattern matched no files" {
+		t.Fatalf("issues = %v", result.Issues)
+	}
+}
+
+func TestQuoteEscapesForExpr(t *testing.T) {
+	if got := quote("a\"b\\c\x00"); got != `"a\"b\\c\x00"` {
+		t.Fatalf("quote = %s", got)
+	}
+}
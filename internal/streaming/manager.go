@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"reflect"
 	"sync"
 	"time"
 
@@ -18,9 +19,16 @@ type ConfigSnapshot struct {
 	RoutesConfigured   bool                   `json:"routes_configured,omitempty"`
 	WAFRules           map[string]WAFRuleData `json:"waf_rules"`
 	WAFRulesConfigured bool                   `json:"waf_rules_configured,omitempty"`
-	Users              []UserData             `json:"users"`
-	UserDomains        []UserDomainData       `json:"user_domains"`
-	ZeroTrustEnabled   bool                   `json:"zero_trust_enabled"`
+	// Lists are named IP/CIDR, ASN or string lists referenced by WAF rules
+	// and route policies.
+	Lists           map[string]ListData `json:"lists,omitempty"`
+	ListsConfigured bool                `json:"lists_configured,omitempty"`
+	// RateLimitPolicies are named per-route rate limit policies.
+	RateLimitPolicies           map[string]RateLimitPolicyData `json:"rate_limit_policies,omitempty"`
+	RateLimitPoliciesConfigured bool                           `json:"rate_limit_policies_configured,omitempty"`
+	Users                       []UserData                     `json:"users"`
+	UserDomains                 []UserDomainData               `json:"user_domains"`
+	ZeroTrustEnabled            bool                           `json:"zero_trust_enabled"`
 	// ZeroTrustConfigured distinguishes an explicit false from a field omitted
 	// by older control planes or an empty local snapshot.
 	ZeroTrustConfigured bool            `json:"zero_trust_configured,omitempty"`
@@ -38,6 +46,18 @@ type RouteData struct {
 	Targets        []RouteTarget `json:"targets,omitempty"`
 	CertificatePEM string        `json:"certificate_pem,omitempty"`
 	PrivateKeyPEM  string        `json:"private_key_pem,omitempty"`
+	// WAFInboundThreshold overrides the agent's anomaly-score threshold.
+	WAFInboundThreshold int `json:"waf_inbound_threshold,omitempty"`
+	// AllowLists admit only clients in one of the named lists; DenyLists
+	// reject clients in any of them.
+	AllowLists []string `json:"allow_lists,omitempty"`
+	DenyLists  []string `json:"deny_lists,omitempty"`
+	// AllowCountries and DenyCountries do the same by ISO country code.
+	AllowCountries []string `json:"allow_countries,omitempty"`
+	DenyCountries  []string `json:"deny_countries,omitempty"`
+	// ChallengeThresholds are the route's [text, click, slider] suspicion
+	// thresholds; zero entries inherit the agent's.
+	ChallengeThresholds []int `json:"challenge_thresholds,omitempty"`
 }
 
 // AllTargets returns configured upstreams, falling back to the legacy Target field.
@@ -56,6 +76,53 @@ type WAFRuleData struct {
 	Expression string `json:"expression"`
 	Action     string `json:"action"`
 	Priority   int    `json:"priority"`
+	Score      int    `json:"score,omitempty"`
+	Category   string `json:"category,omitempty"`
+	// Shadow rules are evaluated and counted but never enforced.
+	Shadow bool `json:"shadow,omitempty"`
+	// Scope limits the rule to some hosts, route keys or path prefixes.
+	Scope *WAFRuleScope `json:"scope,omitempty"`
+}
+
+// ListData is a named list. Entries are IPs, CIDR prefixes, "AS<number>"
+// ASNs or plain strings.
+type ListData struct {
+	Description string          `json:"description,omitempty"`
+	Entries     []ListEntryData `json:"entries"`
+}
+
+type ListEntryData struct {
+	Value string `json:"value"`
+	// ExpiresAt is optional; expired entries never match.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+}
+
+// RateLimitPolicyData mirrors ratelimit.Policy: every limit applies to
+// requests matching all of the non-empty route, path prefix and method
+// selectors.
+type RateLimitPolicyData struct {
+	Routes       []string        `json:"routes,omitempty"`
+	PathPrefixes []string        `json:"path_prefixes,omitempty"`
+	Methods      []string        `json:"methods,omitempty"`
+	Limits       []RateLimitData `json:"limits"`
+}
+
+// RateLimitData allows Requests every PeriodSeconds per key. Key components
+// are ip, user, api_key, route, host, global, "header:<name>" and
+// "cookie:<name>"; the default is ip.
+type RateLimitData struct {
+	Requests      int      `json:"requests"`
+	PeriodSeconds int      `json:"period_seconds"`
+	Burst         int      `json:"burst,omitempty"`
+	Key           []string `json:"key,omitempty"`
+}
+
+// WAFRuleScope mirrors waf.Scope; every non-empty field must match.
+type WAFRuleScope struct {
+	Hosts        []string `json:"hosts,omitempty"`
+	Routes       []string `json:"routes,omitempty"`
+	PathPrefixes []string `json:"path_prefixes,omitempty"`
 }
 
 type UserData struct {
@@ -126,6 +193,19 @@ type AgentModelConfig struct {
 	FeatureHeader string  `json:"feature_header"`
 }
 
+// AgentChallengeConfig shares challenge signing keys across a fleet. Keys
+// are only applied when present, so control planes that do not manage them
+// leave the local configuration alone.
+type AgentChallengeConfig struct {
+	Stateless bool                `json:"stateless"`
+	Keys      []AgentChallengeKey `json:"keys,omitempty"`
+}
+
+type AgentChallengeKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
 type AgentConfigData struct {
 	Cache        AgentCacheConfig        `json:"cache"`
 	RateLimit    AgentRateLimitConfig    `json:"rate_limit"`
@@ -134,11 +214,12 @@ type AgentConfigData struct {
 	Metrics      AgentMetricsConfig      `json:"metrics"`
 	KodaWaf      AgentModelConfig        `json:"koda_waf"`
 	Koda2        AgentModelConfig        `json:"koda_2"`
+	Challenge    AgentChallengeConfig    `json:"challenge"`
 	present      bool
 }
 
 func (c AgentConfigData) IsZero() bool {
-	return !c.present && c == AgentConfigData{}
+	return !c.present && reflect.ValueOf(c).IsZero()
 }
 
 func (c *AgentConfigData) UnmarshalJSON(data []byte) error {
@@ -279,34 +360,70 @@ func (s *ConfigSnapshot) copy() *ConfigSnapshot {
 		targets := make([]RouteTarget, len(v.Targets))
 		copy(targets, v.Targets)
 		routes[k] = RouteData{
-			Type:           v.Type,
-			Target:         v.Target,
-			Targets:        targets,
-			CertificatePEM: v.CertificatePEM,
-			PrivateKeyPEM:  v.PrivateKeyPEM,
+			Type:                v.Type,
+			Target:              v.Target,
+			Targets:             targets,
+			CertificatePEM:      v.CertificatePEM,
+			PrivateKeyPEM:       v.PrivateKeyPEM,
+			WAFInboundThreshold: v.WAFInboundThreshold,
+			AllowLists:          append([]string(nil), v.AllowLists...),
+			DenyLists:           append([]string(nil), v.DenyLists...),
+			AllowCountries:      append([]string(nil), v.AllowCountries...),
+			DenyCountries:       append([]string(nil), v.DenyCountries...),
+			ChallengeThresholds: append([]int(nil), v.ChallengeThresholds...),
 		}
 	}
 	rules := make(map[string]WAFRuleData, len(s.WAFRules))
 	for k, v := range s.WAFRules {
 		rules[k] = v
 	}
+	var lists map[string]ListData
+	if s.Lists != nil {
+		lists = make(map[string]ListData, len(s.Lists))
+		for k, v := range s.Lists {
+			v.Entries = append([]ListEntryData(nil), v.Entries...)
+			lists[k] = v
+		}
+	}
+	var policies map[string]RateLimitPolicyData
+	if s.RateLimitPolicies != nil {
+		policies = make(map[string]RateLimitPolicyData, len(s.RateLimitPolicies))
+		for k, v := range s.RateLimitPolicies {
+			v.Routes = append([]string(nil), v.Routes...)
+			v.PathPrefixes = append([]string(nil), v.PathPrefixes...)
+			v.Methods = append([]string(nil), v.Methods...)
+			limits := make([]RateLimitData, len(v.Limits))
+			for i, limit := range v.Limits {
+				limit.Key = append([]string(nil), limit.Key...)
+				limits[i] = limit
+			}
+			v.Limits = limits
+			policies[k] = v
+		}
+	}
 	users := make([]UserData, len(s.Users))
 	copy(users, s.Users)
 	userDomains := make([]UserDomainData, len(s.UserDomains))
 	copy(userDomains, s.UserDomains)
+	agentConfig := s.AgentConfig
+	agentConfig.Challenge.Keys = append([]AgentChallengeKey(nil), s.AgentConfig.Challenge.Keys...)
 
 	return &ConfigSnapshot{
-		Version:             s.Version,
-		Timestamp:           s.Timestamp,
-		Routes:              routes,
-		RoutesConfigured:    s.RoutesConfigured,
-		WAFRules:            rules,
-		WAFRulesConfigured:  s.WAFRulesConfigured,
-		Users:               users,
-		UserDomains:         userDomains,
-		ZeroTrustEnabled:    s.ZeroTrustEnabled,
-		ZeroTrustConfigured: s.ZeroTrustConfigured,
-		AgentConfig:         s.AgentConfig,
+		Version:                     s.Version,
+		Timestamp:                   s.Timestamp,
+		Routes:                      routes,
+		RoutesConfigured:            s.RoutesConfigured,
+		WAFRules:                    rules,
+		WAFRulesConfigured:          s.WAFRulesConfigured,
+		Lists:                       lists,
+		ListsConfigured:             s.ListsConfigured,
+		RateLimitPolicies:           policies,
+		RateLimitPoliciesConfigured: s.RateLimitPoliciesConfigured,
+		Users:                       users,
+		UserDomains:                 userDomains,
+		ZeroTrustEnabled:            s.ZeroTrustEnabled,
+		ZeroTrustConfigured:         s.ZeroTrustConfigured,
+		AgentConfig:                 agentConfig,
 	}
 }
 
@@ -0,0 +1,317 @@
+package tlsfp
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxHelloBytes bounds how much of a connection is buffered while waiting
+// for the ClientHello. Real hellos, including post-quantum key shares, stay
+// well below it.
+const maxHelloBytes = 16 << 10
+
+const (
+	recordTypeHandshake  = 22
+	handshakeClientHello = 1
+	recordHeaderLen      = 5
+)
+
+// Extension numbers read while fingerprinting.
+const (
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+// clientHello holds the ClientHello fields used by JA3 and JA4, in the order
+// the client sent them. GREASE values are kept; the fingerprints drop them.
+type clientHello struct {
+	version             uint16
+	ciphers             []uint16
+	extensions          []uint16
+	curves              []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	supportedVersions   []uint16
+	alpn                []string
+	serverName          bool
+}
+
+// readClientHello reassembles the ClientHello handshake message from the
+// TLS records in buf. It reports complete=false while more bytes are needed.
+func readClientHello(buf []byte) (body []byte, complete bool, err error) {
+	var msg []byte
+	for len(buf) >= recordHeaderLen {
+		if buf[0] != recordTypeHandshake {
+			return nil, false, errNotClientHello
+		}
+		length := int(buf[3])<<8 | int(buf[4])
+		if len(buf) < recordHeaderLen+length {
+			break
+		}
+		msg = append(msg, buf[recordHeaderLen:recordHeaderLen+length]...)
+		buf = buf[recordHeaderLen+length:]
+		if len(msg) >= 4 {
+			if msg[0] != handshakeClientHello {
+				return nil, false, errNotClientHello
+			}
+			size := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+			if size > maxHelloBytes {
+				return nil, false, errNotClientHello
+			}
+			if len(msg) >= 4+size {
+				return msg[4 : 4+size], true, nil
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+// reader consumes big-endian fields and remembers the first short read.
+type reader struct {
+	buf []byte
+	bad bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.bad || n > len(r.buf) {
+		r.bad = true
+		return nil
+	}
+	out := r.buf[:n]
+	r.buf = r.buf[n:]
+	return out
+}
+
+func (r *reader) u8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *reader) u16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<8 | int(b[1])
+}
+
+// vector returns a length-prefixed field using an n-byte length.
+func (r *reader) vector(n int) *reader {
+	length := r.u8()
+	if n == 2 {
+		length = length<<8 | r.u8()
+	}
+	return &reader{buf: r.bytes(length), bad: r.bad}
+}
+
+func (r *reader) u16s() []uint16 {
+	var out []uint16
+	for len(r.buf) >= 2 {
+		out = append(out, uint16(r.u16()))
+	}
+	return out
+}
+
+func parseClientHello(body []byte) (clientHello, error) {
+	r := &reader{buf: body}
+	var hello clientHello
+	hello.version = uint16(r.u16())
+	r.bytes(32) // random
+	r.vector(1) // session id
+	hello.ciphers = r.vector(2).u16s()
+	r.vector(1) // compression methods
+	if r.bad {
+		return clientHello{}, errNotClientHello
+	}
+	if len(r.buf) == 0 {
+		return hello, nil
+	}
+	extensions := r.vector(2)
+	for len(extensions.buf) > 0 && !extensions.bad {
+		typ := uint16(extensions.u16())
+		data := extensions.vector(2)
+		hello.extensions = append(hello.extensions, typ)
+		switch typ {
+		case extServerName:
+			hello.serverName = true
+		case extSupportedGroups:
+			hello.curves = data.vector(2).u16s()
+		case extECPointFormats:
+			hello.pointFormats = append([]uint8(nil), data.vector(1).buf...)
+		case extSignatureAlgorithms:
+			hello.signatureAlgorithms = data.vector(2).u16s()
+		case extSupportedVersions:
+			hello.supportedVersions = data.vector(1).u16s()
+		case extALPN:
+			protocols := data.vector(2)
+			for len(protocols.buf) > 0 && !protocols.bad {
+				if proto := protocols.vector(1); !proto.bad {
+					hello.alpn = append(hello.alpn, string(proto.buf))
+				}
+			}
+		}
+	}
+	if r.bad || extensions.bad {
+		return clientHello{}, errNotClientHello
+	}
+	return hello, nil
+}
+
+// isGREASE reports whether v is one of the reserved 0x?A?A values clients
+// send to keep servers tolerant of unknown values (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (h clientHello) fingerprint() Fingerprint {
+	fp := Fingerprint{
+		JA3Raw:     h.ja3(),
+		JA4Raw:     h.ja4(false),
+		JA4:        h.ja4(true),
+		ALPN:       h.alpn,
+		Extensions: len(withoutGREASE(h.extensions)),
+	}
+	sum := md5.Sum([]byte(fp.JA3Raw))
+	fp.JA3 = hex.EncodeToString(sum[:])
+	for _, values := range [][]uint16{h.ciphers, h.extensions, h.curves} {
+		if slices.ContainsFunc(values, isGREASE) {
+			fp.GREASE = true
+		}
+	}
+	return fp
+}
+
+// ja3 builds "version,ciphers,extensions,curves,point formats" with decimal
+// values joined by "-", as defined by the original JA3.
+func (h clientHello) ja3() string {
+	decimals := func(values []uint16) string {
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = strconv.Itoa(int(v))
+		}
+		return strings.Join(parts, "-")
+	}
+	points := make([]uint16, len(h.pointFormats))
+	for i, p := range h.pointFormats {
+		points[i] = uint16(p)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		decimals(withoutGREASE(h.ciphers)),
+		decimals(withoutGREASE(h.extensions)),
+		decimals(withoutGREASE(h.curves)),
+		decimals(points),
+	}, ",")
+}
+
+// ja4 builds the JA4 fingerprint of a TLS-over-TCP ClientHello. With hashed
+// false it returns the raw form (ja4_r) that lists the sorted values.
+func (h clientHello) ja4(hashed bool) string {
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+
+	sni := "i"
+	if h.serverName {
+		sni = "d"
+	}
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(h), sni, min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(h.alpn))
+
+	slices.Sort(ciphers)
+	sortedExtensions := make([]uint16, 0, len(extensions))
+	for _, ext := range extensions {
+		if ext != extServerName && ext != extALPN {
+			sortedExtensions = append(sortedExtensions, ext)
+		}
+	}
+	slices.Sort(sortedExtensions)
+
+	cipherPart := hexList(ciphers)
+	extensionPart := hexList(sortedExtensions)
+	if algorithms := withoutGREASE(h.signatureAlgorithms); len(algorithms) > 0 {
+		extensionPart += "_" + hexList(algorithms)
+	}
+	if !hashed {
+		return prefix + "_" + cipherPart + "_" + extensionPart
+	}
+	return prefix + "_" + truncatedHash(cipherPart, len(ciphers)) + "_" + truncatedHash(extensionPart, len(sortedExtensions))
+}
+
+func ja4Version(h clientHello) string {
+	version := h.version
+	if supported := withoutGREASE(h.supportedVersions); len(supported) > 0 {
+		version = slices.Max(supported)
+	}
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN value,
+// falling back to hex digits for non-alphanumeric values.
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	first, last := alpn[0][0], alpn[0][len(alpn[0])-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		encoded := hex.EncodeToString([]byte{first, last})
+		return encoded[:1] + encoded[3:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+func hexList(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func truncatedHash(s string, count int) string {
+	if count == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
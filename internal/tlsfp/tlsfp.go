@@ -0,0 +1,135 @@
+// Package tlsfp fingerprints TLS clients from their ClientHello using JA3 and
+// JA4. A Listener records the first handshake message of every connection;
+// the fingerprint is attached to requests through http.Server.ConnContext.
+package tlsfp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Fingerprint describes the ClientHello a connection opened with. The zero
+// value means no TLS handshake was seen.
+type Fingerprint struct {
+	// JA3 is the MD5 of JA3Raw, "version,ciphers,extensions,curves,formats".
+	JA3    string `json:"ja3,omitempty"`
+	JA3Raw string `json:"ja3_raw,omitempty"`
+	// JA4 is the JA4 fingerprint, such as "t13d1516h2_8daaf6152771_e5627efa2ab1";
+	// JA4Raw lists the sorted values instead of their hashes.
+	JA4    string `json:"ja4,omitempty"`
+	JA4Raw string `json:"ja4_raw,omitempty"`
+	// ALPN lists the offered application protocols in order.
+	ALPN []string `json:"alpn,omitempty"`
+	// GREASE reports whether the client sent RFC 8701 GREASE values, as
+	// Chromium-based browsers and Safari do and most HTTP libraries do not.
+	GREASE bool `json:"grease,omitempty"`
+	// Extensions counts the offered extensions, excluding GREASE.
+	Extensions int `json:"extensions,omitempty"`
+}
+
+// IsZero reports whether no ClientHello was fingerprinted.
+func (f Fingerprint) IsZero() bool {
+	return f.JA3 == "" && f.JA4 == ""
+}
+
+// Listener wraps accepted connections in *Conn.
+type Listener struct {
+	net.Listener
+}
+
+// NewListener returns a listener whose connections record their ClientHello.
+// Wrap it with tls.NewListener (or pass it to http.Server.ServeTLS).
+func NewListener(inner net.Listener) *Listener {
+	return &Listener{Listener: inner}
+}
+
+// Accept wraps the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn}, nil
+}
+
+// Conn buffers the bytes read from the peer until a complete ClientHello has
+// been seen, then stops recording.
+type Conn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	buf  []byte
+	done bool
+	fp   Fingerprint
+}
+
+// Read reads from the connection, recording the handshake on the way.
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.record(p[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) record(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return
+	}
+	c.buf = append(c.buf, data...)
+	body, complete, err := readClientHello(c.buf)
+	switch {
+	case err != nil || (!complete && len(c.buf) > maxHelloBytes):
+		c.done, c.buf = true, nil
+	case complete:
+		if hello, err := parseClientHello(body); err == nil {
+			c.fp = hello.fingerprint()
+		}
+		c.done, c.buf = true, nil
+	}
+}
+
+// Fingerprint returns the connection's fingerprint once its ClientHello has
+// been read, and the zero value before that or for non-TLS traffic.
+func (c *Conn) Fingerprint() Fingerprint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fp
+}
+
+type contextKey struct{}
+
+// ConnContext is an http.Server.ConnContext hook that makes the connection's
+// fingerprint available to FromRequest.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if fpConn, ok := conn.(*Conn); ok {
+		return context.WithValue(ctx, contextKey{}, fpConn)
+	}
+	return ctx
+}
+
+// WithFingerprint returns a context carrying a fixed fingerprint, for
+// requests that did not arrive on a fingerprinting listener.
+func WithFingerprint(ctx context.Context, fp Fingerprint) context.Context {
+	return context.WithValue(ctx, contextKey{}, fp)
+}
+
+// FromRequest returns the fingerprint of the connection r arrived on.
+func FromRequest(r *http.Request) Fingerprint {
+	switch value := r.Context().Value(contextKey{}).(type) {
+	case *Conn:
+		return value.Fingerprint()
+	case Fingerprint:
+		return value
+	default:
+		return Fingerprint{}
+	}
+}
@@ -0,0 +1,217 @@
+package tlsfp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helloBuilder assembles a ClientHello handshake message.
+type helloBuilder struct {
+	ciphers    []uint16
+	extensions [][]byte
+}
+
+func u16(v int) []byte { return []byte{byte(v >> 8), byte(v)} }
+
+func list16(values ...uint16) []byte {
+	out := u16(len(values) * 2)
+	for _, v := range values {
+		out = append(out, u16(int(v))...)
+	}
+	return out
+}
+
+func (b *helloBuilder) extension(typ uint16, data []byte) {
+	ext := append(u16(int(typ)), u16(len(data))...)
+	b.extensions = append(b.extensions, append(ext, data...))
+}
+
+// records returns the ClientHello split into TLS records of at most split
+// bytes, so callers can exercise reassembly.
+func (b *helloBuilder) records(split int) []byte {
+	body := append(u16(0x0303), make([]byte, 32)...)
+	body = append(body, 0) // empty session id
+	body = append(body, list16(b.ciphers...)...)
+	body = append(body, 1, 0) // null compression
+	var extensions []byte
+	for _, ext := range b.extensions {
+		extensions = append(extensions, ext...)
+	}
+	body = append(body, u16(len(extensions))...)
+	body = append(body, extensions...)
+
+	msg := append([]byte{handshakeClientHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	var out []byte
+	for len(msg) > 0 {
+		n := min(split, len(msg))
+		out = append(out, recordTypeHandshake, 3, 1)
+		out = append(out, u16(n)...)
+		out = append(out, msg[:n]...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+// chromeLikeHello reproduces the example from the JA4 specification, with
+// GREASE values added where Chrome sends them.
+func chromeLikeHello() *helloBuilder {
+	b := &helloBuilder{ciphers: []uint16{
+		0x1a1a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9,
+		0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+	}}
+	b.extension(0x2a2a, nil)
+	b.extension(extServerName, append(u16(14), append([]byte{0}, append(u16(11), "example.com"...)...)...))
+	b.extension(0x0017, nil)
+	b.extension(0xff01, []byte{0})
+	b.extension(extSupportedGroups, list16(0x3a3a, 0x001d, 0x0017, 0x0018))
+	b.extension(extECPointFormats, []byte{1, 0})
+	b.extension(0x0023, nil)
+	b.extension(extALPN, append(u16(12), append([]byte{2}, append([]byte("h2"), append([]byte{8}, "http/1.1"...)...)...)...))
+	b.extension(0x0005, []byte{1, 0, 0, 0, 0})
+	b.extension(extSignatureAlgorithms, list16(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601))
+	b.extension(0x0012, nil)
+	b.extension(0x0033, u16(0))
+	b.extension(0x002d, []byte{1, 1})
+	b.extension(extSupportedVersions, []byte{6, 0x4a, 0x4a, 0x03, 0x04, 0x03, 0x03})
+	b.extension(0x001b, []byte{2, 0, 2})
+	b.extension(0x4469, u16(0))
+	b.extension(0x0015, make([]byte, 8))
+	b.extension(0x3a3a, []byte{0})
+	return b
+}
+
+func TestFingerprintMatchesJA4Specification(t *testing.T) {
+	for _, split := range []int{1 << 14, 100} {
+		body, complete, err := readClientHello(chromeLikeHello().records(split))
+		if err != nil || !complete {
+			t.Fatalf("split %d: complete = %v, err = %v", split, complete, err)
+		}
+		hello, err := parseClientHello(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp := hello.fingerprint()
+
+		if fp.JA4 != "t13d1516h2_8daaf6152771_e5627efa2ab1" {
+			t.Fatalf("JA4 = %s", fp.JA4)
+		}
+		wantRaw := "t13d1516h2_002f,0035,009c,009d,1301,1302,1303,c013,c014,c02b,c02c,c02f,c030,cca8,cca9_" +
+			"0005,000a,000b,000d,0012,0015,0017,001b,0023,002b,002d,0033,4469,ff01_0403,0804,0401,0503,0805,0501,0806,0601"
+		if fp.JA4Raw != wantRaw {
+			t.Fatalf("JA4Raw = %s", fp.JA4Raw)
+		}
+		wantJA3 := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+			"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+		if fp.JA3Raw != wantJA3 {
+			t.Fatalf("JA3Raw = %s", fp.JA3Raw)
+		}
+		if sum := md5.Sum([]byte(wantJA3)); fp.JA3 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("JA3 = %s", fp.JA3)
+		}
+		if !fp.GREASE || fp.Extensions != 16 || strings.Join(fp.ALPN, ",") != "h2,http/1.1" {
+			t.Fatalf("fingerprint = %+v", fp)
+		}
+	}
+}
+
+func TestReadClientHelloRejectsOtherTraffic(t *testing.T) {
+	if _, _, err := readClientHello([]byte("GET / HTTP/1.1\r\nHost: example\r\n\r\n")); err == nil {
+		t.Fatal("plain HTTP accepted as a ClientHello")
+	}
+	records := chromeLikeHello().records(1 << 14)
+	if _, complete, err := readClientHello(records[:len(records)-1]); complete || err != nil {
+		t.Fatalf("truncated hello: complete = %v, err = %v", complete, err)
+	}
+	if _, err := parseClientHello([]byte{3, 3, 1}); err == nil {
+		t.Fatal("truncated body accepted")
+	}
+}
+
+func TestJA4ALPNFallsBackToHex(t *testing.T) {
+	for alpn, want := range map[string]string{"h2": "h2", "http/1.1": "h1", "\xab\x01": "a1", "x": "xx"} {
+		if got := ja4ALPN([]string{alpn}); got != want {
+			t.Fatalf("ja4ALPN(%q) = %q, want %q", alpn, got, want)
+		}
+	}
+	if got := ja4ALPN(nil); got != "00" {
+		t.Fatalf("ja4ALPN(nil) = %q", got)
+	}
+}
+
+func TestListenerAttachesFingerprintToRequests(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(chan Fingerprint, 1)
+	server := &http.Server{
+		ConnContext: ConnContext,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen <- FromRequest(r)
+		}),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}},
+	}
+	go server.Serve(tls.NewListener(NewListener(inner), server.TLSConfig))
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}},
+	}}
+	resp, err := client.Get("https://" + inner.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	fp := <-seen
+	// Go sends no SNI for IP addresses and no GREASE.
+	if prefix, _, _ := strings.Cut(fp.JA4, "_"); !strings.HasPrefix(prefix, "t13i") || !strings.HasSuffix(prefix, "h1") {
+		t.Fatalf("JA4 = %q", fp.JA4)
+	}
+	if fp.JA3 == "" || fp.GREASE {
+		t.Fatalf("fingerprint = %+v", fp)
+	}
+
+	plain := httptest.NewRequest("GET", "/", nil)
+	if !FromRequest(plain).IsZero() {
+		t.Fatal("requests without a fingerprinting connection should have none")
+	}
+	if got := FromRequest(plain.WithContext(WithFingerprint(plain.Context(), fp))); got.JA4 != fp.JA4 {
+		t.Fatal("WithFingerprint was not honoured")
+	}
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
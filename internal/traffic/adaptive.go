@@ -0,0 +1,241 @@
+package traffic
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAdaptiveInitialLimit = 20
+	defaultAdaptiveMinLimit     = 1
+	defaultAdaptiveMaxLimit     = 1000
+	defaultAdaptiveTolerance    = 1.5
+	defaultAdaptiveSmoothing    = 0.2
+	defaultAdaptiveBackoff      = 0.9
+
+	// The recent RTT averages roughly the last 10 samples, the baseline the
+	// last 500, so a latency rise shows up in the recent RTT long before the
+	// baseline follows it.
+	adaptiveShortWindow = 10
+	adaptiveLongWindow  = 500
+)
+
+// AdaptiveConfig tunes an AdaptiveLimiter. Zero fields take the defaults:
+// a limit of 20 between 1 and 1000, a tolerance of 1.5, smoothing of 0.2
+// and a backoff of 0.9.
+type AdaptiveConfig struct {
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// Tolerance is how many times the baseline RTT the recent RTT may
+	// reach before the limit shrinks.
+	Tolerance float64
+	// Smoothing is the weight of each new limit estimate, in (0, 1].
+	Smoothing float64
+	// Backoff multiplies the limit whenever the upstream fails.
+	Backoff float64
+}
+
+// Outcome is how a request admitted by an AdaptiveLimiter ended.
+type Outcome int
+
+const (
+	// OutcomeSuccess feeds the request's RTT to the limit.
+	OutcomeSuccess Outcome = iota
+	// OutcomeDropped backs the limit off: the upstream failed, timed out
+	// or said it was overloaded.
+	OutcomeDropped
+	// OutcomeIgnored only frees the slot, for example when the client
+	// went away and the RTT says nothing about the upstream.
+	OutcomeIgnored
+)
+
+// AdaptiveStats describe an AdaptiveLimiter. Limit and InFlight are gauges;
+// Shed and Dropped are cumulative.
+type AdaptiveStats struct {
+	Key      string
+	Limit    int
+	InFlight int
+	Shed     uint64
+	Dropped  uint64
+	RTT      time.Duration
+	Baseline time.Duration
+}
+
+// AdaptiveLimiter caps the requests in flight to an upstream and moves the
+// cap with the latency it measures, after the gradient algorithm of
+// Netflix's concurrency-limits: while the recent RTT stays within
+// Tolerance of the long-run baseline the limit grows by about its square
+// root per sample, and as the recent RTT rises above it the limit shrinks
+// in proportion, down to half per sample. Requests over the limit are shed
+// at once rather than queued behind a struggling upstream.
+type AdaptiveLimiter struct {
+	cfg AdaptiveConfig
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	rtt      float64
+	baseline float64
+
+	shed    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+func NewAdaptiveLimiter(cfg AdaptiveConfig) *AdaptiveLimiter {
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = defaultAdaptiveMinLimit
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = defaultAdaptiveMaxLimit
+	}
+	cfg.MaxLimit = max(cfg.MaxLimit, cfg.MinLimit)
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = defaultAdaptiveInitialLimit
+	}
+	cfg.InitialLimit = min(max(cfg.InitialLimit, cfg.MinLimit), cfg.MaxLimit)
+	if cfg.Tolerance < 1 {
+		cfg.Tolerance = defaultAdaptiveTolerance
+	}
+	if cfg.Smoothing <= 0 || cfg.Smoothing > 1 {
+		cfg.Smoothing = defaultAdaptiveSmoothing
+	}
+	if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+		cfg.Backoff = defaultAdaptiveBackoff
+	}
+	return &AdaptiveLimiter{cfg: cfg, limit: float64(cfg.InitialLimit)}
+}
+
+// Acquire admits a request when fewer than the limit are in flight. The
+// caller must call release once the upstream has answered, with the time
+// it took and how it ended; ok is false, and release nil, when the request
+// is shed.
+func (l *AdaptiveLimiter) Acquire() (release func(rtt time.Duration, outcome Outcome), ok bool) {
+	l.mu.Lock()
+	if l.inFlight >= int(l.limit) {
+		l.mu.Unlock()
+		l.shed.Add(1)
+		return nil, false
+	}
+	l.inFlight++
+	l.mu.Unlock()
+
+	var once sync.Once
+	return func(rtt time.Duration, outcome Outcome) {
+		once.Do(func() { l.release(rtt, outcome) })
+	}, true
+}
+
+func (l *AdaptiveLimiter) release(rtt time.Duration, outcome Outcome) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inFlight := l.inFlight
+	l.inFlight--
+	switch outcome {
+	case OutcomeDropped:
+		l.dropped.Add(1)
+		l.setLimitLocked(l.limit * l.cfg.Backoff)
+	case OutcomeSuccess:
+		if rtt > 0 {
+			l.sampleLocked(float64(rtt), inFlight)
+		}
+	}
+}
+
+func (l *AdaptiveLimiter) sampleLocked(rtt float64, inFlight int) {
+	if l.baseline == 0 {
+		l.rtt, l.baseline = rtt, rtt
+		return
+	}
+	l.rtt += (rtt - l.rtt) / adaptiveShortWindow
+	l.baseline += (rtt - l.baseline) / adaptiveLongWindow
+	// After a long stretch of high latency the baseline has drifted up with
+	// it; let it fall back quickly once the upstream recovers.
+	if l.baseline > 2*l.rtt {
+		l.baseline *= 0.95
+	}
+
+	gradient := max(0.5, min(1, l.cfg.Tolerance*l.baseline/l.rtt))
+	estimate := l.limit*gradient + math.Sqrt(l.limit)
+	// A limit that is not being used says nothing about whether the
+	// upstream could take more.
+	if estimate > l.limit && float64(inFlight) < l.limit/2 {
+		return
+	}
+	l.setLimitLocked(l.limit*(1-l.cfg.Smoothing) + estimate*l.cfg.Smoothing)
+}
+
+func (l *AdaptiveLimiter) setLimitLocked(limit float64) {
+	l.limit = min(max(limit, float64(l.cfg.MinLimit)), float64(l.cfg.MaxLimit))
+}
+
+// Limit is the number of requests the limiter admits at once.
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+func (l *AdaptiveLimiter) Stats() AdaptiveStats {
+	l.mu.Lock()
+	stats := AdaptiveStats{
+		Limit:    int(l.limit),
+		InFlight: l.inFlight,
+		RTT:      time.Duration(l.rtt),
+		Baseline: time.Duration(l.baseline),
+	}
+	l.mu.Unlock()
+	stats.Shed = l.shed.Load()
+	stats.Dropped = l.dropped.Load()
+	return stats
+}
+
+// AdaptiveLimiters keeps one AdaptiveLimiter per key, such as a route or an
+// upstream pool, so one slow upstream does not shed requests for the
+// others. A nil *AdaptiveLimiters limits nothing.
+type AdaptiveLimiters struct {
+	cfg AdaptiveConfig
+
+	mu       sync.Mutex
+	limiters map[string]*AdaptiveLimiter
+}
+
+func NewAdaptiveLimiters(cfg AdaptiveConfig) *AdaptiveLimiters {
+	return &AdaptiveLimiters{cfg: cfg, limiters: make(map[string]*AdaptiveLimiter)}
+}
+
+// Get returns key's limiter, creating it on first use. It returns nil on a
+// nil *AdaptiveLimiters.
+func (a *AdaptiveLimiters) Get(key string) *AdaptiveLimiter {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	limiter, ok := a.limiters[key]
+	if !ok {
+		limiter = NewAdaptiveLimiter(a.cfg)
+		a.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// Stats returns every limiter's stats, sorted by key.
+func (a *AdaptiveLimiters) Stats() []AdaptiveStats {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	out := make([]AdaptiveStats, 0, len(a.limiters))
+	for key, limiter := range a.limiters {
+		stats := limiter.Stats()
+		stats.Key = key
+		out = append(out, stats)
+	}
+	a.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
@@ -0,0 +1,120 @@
+package traffic
+
+import (
+	"testing"
+	"time"
+)
+
+// fill acquires n slots and returns their release funcs.
+func fill(t *testing.T, l *AdaptiveLimiter, n int) []func(time.Duration, Outcome) {
+	t.Helper()
+	releases := make([]func(time.Duration, Outcome), 0, n)
+	for range n {
+		release, ok := l.Acquire()
+		if !ok {
+			t.Fatalf("slot %d of %d shed at limit %d", len(releases)+1, n, l.Limit())
+		}
+		releases = append(releases, release)
+	}
+	return releases
+}
+
+func TestAdaptiveLimiterShedsOverTheLimit(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveConfig{InitialLimit: 2})
+	releases := fill(t, l, 2)
+	if _, ok := l.Acquire(); ok {
+		t.Fatal("third request admitted at a limit of 2")
+	}
+	releases[0](0, OutcomeIgnored)
+	releases[0](0, OutcomeIgnored)
+	if stats := l.Stats(); stats.InFlight != 1 || stats.Shed != 1 || stats.Limit != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if _, ok := l.Acquire(); !ok {
+		t.Fatal("a released slot was not reusable")
+	}
+}
+
+func TestAdaptiveLimiterGrowsWhileLatencyIsHealthy(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveConfig{InitialLimit: 10, MaxLimit: 40})
+	for range 200 {
+		for _, release := range fill(t, l, l.Limit()) {
+			release(10*time.Millisecond, OutcomeSuccess)
+		}
+	}
+	if limit := l.Limit(); limit != 40 {
+		t.Fatalf("limit = %d, want the maximum of 40", limit)
+	}
+}
+
+func TestAdaptiveLimiterDoesNotGrowWhileIdle(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveConfig{InitialLimit: 10})
+	for range 200 {
+		release, _ := l.Acquire()
+		release(10*time.Millisecond, OutcomeSuccess)
+	}
+	if limit := l.Limit(); limit != 10 {
+		t.Fatalf("limit = %d after one request at a time", limit)
+	}
+}
+
+func TestAdaptiveLimiterShrinksWhenLatencyRises(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveConfig{InitialLimit: 50, MinLimit: 5, MaxLimit: 100})
+	for range 20 {
+		for _, release := range fill(t, l, l.Limit()) {
+			release(10*time.Millisecond, OutcomeSuccess)
+		}
+	}
+	healthy := l.Limit()
+	for _, release := range fill(t, l, l.Limit()) {
+		release(200*time.Millisecond, OutcomeSuccess)
+	}
+	stats := l.Stats()
+	if stats.Limit >= healthy/2 || stats.Limit < 5 {
+		t.Fatalf("limit went from %d to %d as latency rose", healthy, stats.Limit)
+	}
+	if stats.RTT <= stats.Baseline {
+		t.Fatalf("RTT %s should be above the baseline %s", stats.RTT, stats.Baseline)
+	}
+
+	// Once the upstream recovers the limit climbs back.
+	for range 200 {
+		for _, release := range fill(t, l, l.Limit()) {
+			release(10*time.Millisecond, OutcomeSuccess)
+		}
+	}
+	if limit := l.Limit(); limit != healthy {
+		t.Fatalf("limit = %d after recovery, was %d", limit, healthy)
+	}
+}
+
+func TestAdaptiveLimiterBacksOffOnDrops(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveConfig{InitialLimit: 100, MinLimit: 3, Backoff: 0.5})
+	for _, release := range fill(t, l, 10) {
+		release(0, OutcomeDropped)
+	}
+	if stats := l.Stats(); stats.Limit != 3 || stats.Dropped != 10 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestAdaptiveLimitersArePerKey(t *testing.T) {
+	var none *AdaptiveLimiters
+	if none.Get("api") != nil || none.Stats() != nil {
+		t.Fatal("a nil set should limit nothing")
+	}
+	set := NewAdaptiveLimiters(AdaptiveConfig{InitialLimit: 1})
+	if _, ok := set.Get("slow").Acquire(); !ok {
+		t.Fatal("first request shed")
+	}
+	if _, ok := set.Get("slow").Acquire(); ok {
+		t.Fatal("slow admitted a second request")
+	}
+	if _, ok := set.Get("api").Acquire(); !ok {
+		t.Fatal("a busy route shed requests for another")
+	}
+	stats := set.Stats()
+	if len(stats) != 2 || stats[0].Key != "api" || stats[1].Key != "slow" || stats[1].Shed != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
@@ -0,0 +1,69 @@
+package traffic
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimitQuota is a named RateLimitStatus to report to the client.
+type RateLimitQuota struct {
+	Name string
+	RateLimitStatus
+}
+
+// SetRateLimitHeaders describes quotas in the RateLimit-Policy and RateLimit
+// fields of draft-ietf-httpapi-ratelimit-headers, for example
+//
+//	RateLimit-Policy: "login";q=5;w=60
+//	RateLimit: "login";r=0;t=48
+//
+// and sets Retry-After to the longest wait of any quota that refused the
+// request. Nothing is set without quotas.
+func SetRateLimitHeaders(h http.Header, quotas []RateLimitQuota) {
+	if len(quotas) == 0 {
+		return
+	}
+	policies := make([]string, 0, len(quotas))
+	limits := make([]string, 0, len(quotas))
+	var retryAfter time.Duration
+	for _, quota := range quotas {
+		name := quotaName(quota.Name)
+		policies = append(policies, fmt.Sprintf("%s;q=%d;w=%d", name, quota.Quota, ceilSeconds(quota.Window)))
+		limits = append(limits, fmt.Sprintf("%s;r=%d;t=%d", name, max(quota.Remaining, 0), ceilSeconds(quota.Reset)))
+		if !quota.Allowed {
+			retryAfter = max(retryAfter, quota.RetryAfter, time.Second)
+		}
+	}
+	h.Set("RateLimit-Policy", strings.Join(policies, ", "))
+	h.Set("RateLimit", strings.Join(limits, ", "))
+	if retryAfter > 0 {
+		h.Set("Retry-After", strconv.FormatInt(ceilSeconds(retryAfter), 10))
+	}
+}
+
+// quotaName renders name as a structured field string, replacing the
+// characters a string cannot hold.
+func quotaName(name string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
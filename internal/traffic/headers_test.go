@@ -0,0 +1,35 @@
+package traffic
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	h := http.Header{}
+	SetRateLimitHeaders(h, []RateLimitQuota{
+		{Name: "global", RateLimitStatus: RateLimitStatus{Allowed: true, Quota: 120, Window: time.Minute, Remaining: 59, Reset: 30500 * time.Millisecond}},
+		{Name: `lo"gin`, RateLimitStatus: RateLimitStatus{Quota: 5, Window: time.Minute, RetryAfter: 11200 * time.Millisecond, Reset: time.Minute}},
+		{Name: "api/1", RateLimitStatus: RateLimitStatus{Quota: 10, Window: time.Second, RetryAfter: 100 * time.Millisecond}},
+	})
+	for field, want := range map[string]string{
+		"RateLimit-Policy": `"global";q=120;w=60, "lo\"gin";q=5;w=60, "api/1";q=10;w=1`,
+		"RateLimit":        `"global";r=59;t=31, "lo\"gin";r=0;t=60, "api/1";r=0;t=0`,
+		"Retry-After":      "12",
+	} {
+		if got := h.Get(field); got != want {
+			t.Errorf("%s = %s, want %s", field, got, want)
+		}
+	}
+
+	h = http.Header{}
+	SetRateLimitHeaders(h, []RateLimitQuota{{Name: "global", RateLimitStatus: RateLimitStatus{Allowed: true, Quota: 1, Window: time.Second}}})
+	if h.Get("Retry-After") != "" {
+		t.Fatal("Retry-After set on an allowed request")
+	}
+	SetRateLimitHeaders(h, nil)
+	if h.Get("RateLimit") == "" {
+		t.Fatal("empty quotas cleared the headers")
+	}
+}
@@ -2,9 +2,10 @@ package traffic
 
 import (
 	"container/list"
-	"context"
 	"errors"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,10 +13,13 @@ var (
 	ErrRateLimited = errors.New("rate limit exceeded")
 	ErrQueueFull   = errors.New("request queue full")
 	ErrQueueWait   = errors.New("request queue wait timed out")
+	ErrQueueShed   = errors.New("request shed for a higher priority class")
 )
 
 type RateLimiter struct {
 	mu         sync.Mutex
+	requests   int
+	period     time.Duration
 	rate       float64
 	burst      float64
 	buckets    map[string]*rateBucket
@@ -23,6 +27,7 @@ type RateLimiter struct {
 	maxBuckets int
 	ttl        time.Duration
 	lastPrune  time.Time
+	observer   atomic.Pointer[func(key string, tokens float64)]
 }
 
 type rateBucket struct {
@@ -42,26 +47,121 @@ const (
 )
 
 func NewRateLimiter(requestsPerMinute, burst int) *RateLimiter {
-	if requestsPerMinute <= 0 {
-		requestsPerMinute = 60
+	return NewRateLimiterEvery(requestsPerMinute, time.Minute, burst)
+}
+
+// NewRateLimiterEvery returns a limiter allowing requests per period, such
+// as 1000 an hour, with bursts of up to burst requests. Idle buckets are
+// kept until they would have refilled, so long periods are not reset early.
+func NewRateLimiterEvery(requests int, period time.Duration, burst int) *RateLimiter {
+	if requests <= 0 {
+		requests = 60
+	}
+	if period <= 0 {
+		period = time.Minute
 	}
 	if burst <= 0 {
-		burst = requestsPerMinute
+		burst = requests
 	}
+	rate := float64(requests) / period.Seconds()
+	refill := time.Duration(float64(burst) / rate * float64(time.Second))
 	return &RateLimiter{
-		rate:       float64(requestsPerMinute) / 60,
+		requests:   requests,
+		period:     period,
+		rate:       rate,
 		burst:      float64(burst),
 		buckets:    make(map[string]*rateBucket),
 		maxBuckets: defaultLimiterMaxBuckets,
-		ttl:        defaultLimiterBucketTTL,
+		ttl:        max(defaultLimiterBucketTTL, refill),
 	}
 }
 
+// RateLimitStatus is a key's bucket after Take: whether the request was
+// allowed, the quota of Quota requests per Window it is counted against, how
+// many more requests may be made now, how long until a refused request
+// would be allowed, and how long until the bucket is full again.
+type RateLimitStatus struct {
+	Allowed    bool
+	Quota      int
+	Window     time.Duration
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
 func (l *RateLimiter) Allow(key string) bool {
-	return l.allowAt(key, time.Now())
+	return l.Take(key).Allowed
+}
+
+// Take takes a token for key when one is available and reports the state
+// of its bucket.
+func (l *RateLimiter) Take(key string) RateLimitStatus {
+	status := l.takeAt(key, time.Now())
+	if status.Allowed {
+		l.notify(key, 1)
+	}
+	return status
+}
+
+// Observe calls fn, outside the limiter's lock, with the tokens taken (or,
+// when negative, refunded) for a key by Allow, Take and Refund, so they can
+// be shared with other agents. Tokens applied through Consume are not
+// reported. A nil fn stops observing.
+func (l *RateLimiter) Observe(fn func(key string, tokens float64)) {
+	if fn == nil {
+		l.observer.Store(nil)
+		return
+	}
+	l.observer.Store(&fn)
+}
+
+func (l *RateLimiter) notify(key string, tokens float64) {
+	if fn := l.observer.Load(); fn != nil {
+		if key == "" {
+			key = "global"
+		}
+		(*fn)(key, tokens)
+	}
+}
+
+// Consume takes tokens spent elsewhere, such as on another agent, from
+// key's bucket. Negative tokens return them. The bucket may go into debt
+// of up to one burst, which it must refill before allowing requests again.
+func (l *RateLimiter) Consume(key string, tokens float64) {
+	l.consumeAt(key, tokens, time.Now())
+}
+
+func (l *RateLimiter) consumeAt(key string, tokens float64, now time.Time) {
+	if key == "" {
+		key = "global"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if tokens <= 0 {
+			return
+		}
+		l.ensureCapacityLocked(now)
+		b = &rateBucket{tokens: l.burst, last: now}
+		b.rateElement = l.recency.PushFront(key)
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.tokens+elapsed*l.rate, l.burst)
+		b.last = now
+	}
+	b.tokens = min(max(b.tokens-tokens, -l.burst), l.burst)
 }
 
 func (l *RateLimiter) allowAt(key string, now time.Time) bool {
+	return l.takeAt(key, now).Allowed
+}
+
+func (l *RateLimiter) takeAt(key string, now time.Time) RateLimitStatus {
 	if key == "" {
 		key = "global"
 	}
@@ -76,7 +176,7 @@ func (l *RateLimiter) allowAt(key string, now time.Time) bool {
 		b = &rateBucket{tokens: l.burst - 1, last: now}
 		b.rateElement = l.recency.PushFront(key)
 		l.buckets[key] = b
-		return true
+		return l.statusLocked(b, true)
 	}
 	l.recency.MoveToFront(b.rateElement)
 
@@ -89,10 +189,84 @@ func (l *RateLimiter) allowAt(key string, now time.Time) bool {
 		b.last = now
 	}
 	if b.tokens < 1 {
-		return false
+		return l.statusLocked(b, false)
 	}
 	b.tokens--
-	return true
+	return l.statusLocked(b, true)
+}
+
+func (l *RateLimiter) statusLocked(b *rateBucket, allowed bool) RateLimitStatus {
+	status := RateLimitStatus{
+		Allowed:   allowed,
+		Quota:     l.requests,
+		Window:    l.period,
+		Remaining: max(int(b.tokens), 0),
+		Reset:     l.refillTime(l.burst - b.tokens),
+	}
+	if !allowed {
+		status.RetryAfter = l.refillTime(1 - b.tokens)
+	}
+	return status
+}
+
+// refillTime returns how long tokens take to refill, rounded up to whole
+// milliseconds.
+func (l *RateLimiter) refillTime(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(tokens/l.rate*1000)) * time.Millisecond
+}
+
+// Refund returns a token taken by Allow or Take, for callers checking
+// several limiters that must all allow a request, and reports the bucket's
+// state afterwards.
+func (l *RateLimiter) Refund(key string) RateLimitStatus {
+	status, ok := l.refund(key)
+	if ok {
+		l.notify(key, -1)
+	}
+	return status
+}
+
+func (l *RateLimiter) refund(key string) (RateLimitStatus, bool) {
+	if key == "" {
+		key = "global"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		return RateLimitStatus{Allowed: true, Quota: l.requests, Window: l.period, Remaining: int(l.burst)}, false
+	}
+	b.tokens = min(b.tokens+1, l.burst)
+	return l.statusLocked(b, true), true
+}
+
+// Usage reports how much of key's burst is spent, from 0 for an idle or
+// unknown client to 1 when its next request would be limited. It does not
+// take a token.
+func (l *RateLimiter) Usage(key string) float64 {
+	return l.usageAt(key, time.Now())
+}
+
+func (l *RateLimiter) usageAt(key string, now time.Time) float64 {
+	if key == "" {
+		key = "global"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		return 0
+	}
+	tokens := b.tokens
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		tokens = min(tokens+elapsed*l.rate, l.burst)
+	}
+	return min(max(1-tokens/l.burst, 0), 1)
 }
 
 func (l *RateLimiter) pruneLocked(now time.Time) {
@@ -126,70 +300,3 @@ func (l *RateLimiter) removeBucketLocked(key string, b *rateBucket) {
 		b.rateElement = nil
 	}
 }
-
-type Queue struct {
-	sem       chan struct{}
-	maxQueued int
-	timeout   time.Duration
-
-	mu      sync.Mutex
-	waiting int
-}
-
-func NewQueue(maxConcurrent, maxQueued int, timeout time.Duration) *Queue {
-	if maxConcurrent <= 0 {
-		maxConcurrent = 1
-	}
-	if maxQueued < 0 {
-		maxQueued = 0
-	}
-	if timeout <= 0 {
-		timeout = 5 * time.Second
-	}
-	return &Queue{
-		sem:       make(chan struct{}, maxConcurrent),
-		maxQueued: maxQueued,
-		timeout:   timeout,
-	}
-}
-
-func (q *Queue) Acquire(ctx context.Context) (func(), error) {
-	select {
-	case q.sem <- struct{}{}:
-		return q.release, nil
-	default:
-	}
-
-	q.mu.Lock()
-	if q.waiting >= q.maxQueued {
-		q.mu.Unlock()
-		return nil, ErrQueueFull
-	}
-	q.waiting++
-	q.mu.Unlock()
-
-	defer func() {
-		q.mu.Lock()
-		q.waiting--
-		q.mu.Unlock()
-	}()
-
-	timer := time.NewTimer(q.timeout)
-	defer timer.Stop()
-
-	select {
-	case q.sem <- struct{}{}:
-		return q.release, nil
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-timer.C:
-		return nil, ErrQueueWait
-	}
-}
-
-func (q *Queue) release() {
-	select {
-	case <-q.sem:
-	default:
-	}
-}
@@ -39,6 +39,114 @@ func TestRateLimiterSeparatesKeys(t *testing.T) {
 	}
 }
 
+func TestRateLimiterUsageTracksSpentBurst(t *testing.T) {
+	limiter := NewRateLimiter(60, 4)
+	now := time.Unix(100, 0)
+
+	if got := limiter.usageAt("client", now); got != 0 {
+		t.Fatalf("unknown client usage = %v", got)
+	}
+	limiter.allowAt("client", now)
+	limiter.allowAt("client", now)
+	if got := limiter.usageAt("client", now); got != 0.5 {
+		t.Fatalf("usage after two of four = %v", got)
+	}
+	if got := limiter.usageAt("client", now); got != 0.5 {
+		t.Fatal("Usage should not take tokens")
+	}
+	if got := limiter.usageAt("client", now.Add(time.Second)); got != 0.25 {
+		t.Fatalf("usage after refill = %v", got)
+	}
+}
+
+func TestRateLimiterEveryHonoursLongPeriods(t *testing.T) {
+	limiter := NewRateLimiterEvery(2, time.Hour, 0)
+	now := time.Unix(100, 0)
+
+	if !limiter.allowAt("client", now) || !limiter.allowAt("client", now) {
+		t.Fatal("burst defaults to the request count")
+	}
+	if limiter.allowAt("client", now.Add(20*time.Minute)) {
+		t.Fatal("a token should take half an hour to refill")
+	}
+	if !limiter.allowAt("client", now.Add(31*time.Minute)) {
+		t.Fatal("request should pass after half an hour")
+	}
+	if limiter.ttl != time.Hour {
+		t.Fatalf("idle buckets kept for %s; want the full refill time", limiter.ttl)
+	}
+}
+
+func TestRateLimiterRefundReturnsToken(t *testing.T) {
+	limiter := NewRateLimiter(60, 1)
+	now := time.Unix(100, 0)
+
+	limiter.allowAt("client", now)
+	limiter.Refund("client")
+	limiter.Refund("client")
+	if !limiter.allowAt("client", now) {
+		t.Fatal("refunded token should be spendable")
+	}
+	if limiter.allowAt("client", now) {
+		t.Fatal("refunds must not exceed the burst")
+	}
+	limiter.Refund("unknown")
+	assertRateLimiterIndexConsistent(t, limiter, 1)
+}
+
+func TestRateLimiterTakeReportsBucketState(t *testing.T) {
+	limiter := NewRateLimiterEvery(10, 10*time.Second, 2)
+	now := time.Unix(100, 0)
+
+	status := limiter.takeAt("client", now)
+	if want := (RateLimitStatus{Allowed: true, Quota: 10, Window: 10 * time.Second, Remaining: 1, Reset: time.Second}); status != want {
+		t.Fatalf("first take = %+v, want %+v", status, want)
+	}
+	limiter.takeAt("client", now)
+	status = limiter.takeAt("client", now.Add(250*time.Millisecond))
+	if status.Allowed || status.Remaining != 0 || status.RetryAfter != 750*time.Millisecond || status.Reset != 1750*time.Millisecond {
+		t.Fatalf("refused take = %+v", status)
+	}
+}
+
+func TestRateLimiterConsumeAndObserve(t *testing.T) {
+	limiter := NewRateLimiter(60, 2)
+	now := time.Unix(100, 0)
+	var observed []float64
+	limiter.Observe(func(key string, tokens float64) {
+		if key != "client" {
+			t.Errorf("observed key %q", key)
+		}
+		observed = append(observed, tokens)
+	})
+
+	limiter.consumeAt("client", 5, now)
+	if limiter.allowAt("client", now.Add(2*time.Second)) {
+		t.Fatal("a bucket in debt should refuse requests")
+	}
+	if !limiter.allowAt("client", now.Add(3*time.Second)) {
+		t.Fatal("debt is capped at one burst")
+	}
+	limiter.consumeAt("client", -1, now.Add(3*time.Second))
+	if !limiter.allowAt("client", now.Add(3*time.Second)) {
+		t.Fatal("returned tokens should be spendable")
+	}
+	limiter.consumeAt("idle", -1, now)
+	if _, ok := limiter.buckets["idle"]; ok {
+		t.Fatal("returning tokens to an unknown bucket created it")
+	}
+	if len(observed) != 0 {
+		t.Fatalf("Consume and unexported takes were observed: %v", observed)
+	}
+
+	limiter.Take("client")
+	limiter.Refund("client")
+	limiter.Refund("unknown")
+	if len(observed) != 2 || observed[0] != 1 || observed[1] != -1 {
+		t.Fatalf("observed %v", observed)
+	}
+}
+
 func TestRateLimiterPrunesIdleBuckets(t *testing.T) {
 	limiter := NewRateLimiter(60, 1)
 	limiter.ttl = time.Second
@@ -0,0 +1,317 @@
+package traffic
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultQueueClass is the class of requests queued without one.
+const DefaultQueueClass = "default"
+
+// QueueClass is a priority class of a Queue.
+type QueueClass struct {
+	Name string
+	// Weight is the class's share of the slots freed while several
+	// classes are waiting; zero counts as 1.
+	Weight int
+}
+
+// QueueConfig sizes a Queue. Zero fields take the defaults: one slot, no
+// backlog, a 5 second wait, a tenth of MaxQueued per client (at least 1)
+// and the single class "default".
+type QueueConfig struct {
+	MaxConcurrent      int
+	MaxQueued          int
+	MaxQueuedPerClient int
+	Timeout            time.Duration
+	// Classes are listed most important first. Requests of an unknown
+	// class join the one named "default", or the last one without it.
+	Classes []QueueClass
+}
+
+// Queue caps the requests served at once and lets up to MaxQueued more
+// wait for a slot. Every waiting request belongs to a class and a client.
+// A freed slot goes to a class by weighted fair queuing, so while both
+// wait a class of weight 4 gets four slots for each one of a class of
+// weight 1, and within the class to its clients in turn, so a client with
+// many requests waiting only delays itself. No client may hold more than
+// MaxQueuedPerClient of the backlog. When the backlog is full a request
+// sheds the newest waiter of the busiest client in the least important
+// class below its own, so lower classes are always shed first.
+type Queue struct {
+	maxConcurrent int
+	maxQueued     int
+	maxPerClient  int
+	timeout       time.Duration
+	classes       []*queueClass
+	byName        map[string]int
+	defaultClass  int
+
+	mu        sync.Mutex
+	active    int
+	queued    int
+	perClient map[string]int
+	// vtime is the pass of the class served last; a class that starts
+	// waiting starts from it rather than from credit saved while idle.
+	vtime float64
+}
+
+type queueClass struct {
+	name   string
+	stride float64
+	pass   float64
+	queued int
+	// waiting holds each client's waiters in arrival order, and ring the
+	// clients with waiters in the order they are served.
+	waiting map[string][]*queueWaiter
+	ring    []string
+	next    int
+}
+
+type queueWaiter struct {
+	class  int
+	client string
+	// ready is closed once the waiter is granted a slot, or shed with err.
+	ready chan struct{}
+	err   error
+}
+
+// NewQueue returns a FIFO Queue with a single class.
+func NewQueue(maxConcurrent, maxQueued int, timeout time.Duration) *Queue {
+	return NewPriorityQueue(QueueConfig{MaxConcurrent: maxConcurrent, MaxQueued: maxQueued, MaxQueuedPerClient: maxQueued, Timeout: timeout})
+}
+
+func NewPriorityQueue(cfg QueueConfig) *Queue {
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = 1
+	}
+	if cfg.MaxQueued < 0 {
+		cfg.MaxQueued = 0
+	}
+	if cfg.MaxQueuedPerClient <= 0 {
+		cfg.MaxQueuedPerClient = max(cfg.MaxQueued/10, 1)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if len(cfg.Classes) == 0 {
+		cfg.Classes = []QueueClass{{Name: DefaultQueueClass}}
+	}
+	q := &Queue{
+		maxConcurrent: cfg.MaxConcurrent,
+		maxQueued:     cfg.MaxQueued,
+		maxPerClient:  cfg.MaxQueuedPerClient,
+		timeout:       cfg.Timeout,
+		byName:        make(map[string]int, len(cfg.Classes)),
+		perClient:     make(map[string]int),
+	}
+	for _, class := range cfg.Classes {
+		if _, ok := q.byName[class.Name]; ok {
+			continue
+		}
+		q.byName[class.Name] = len(q.classes)
+		q.classes = append(q.classes, &queueClass{
+			name:    class.Name,
+			stride:  1 / float64(max(class.Weight, 1)),
+			waiting: make(map[string][]*queueWaiter),
+		})
+	}
+	q.defaultClass = len(q.classes) - 1
+	if i, ok := q.byName[DefaultQueueClass]; ok {
+		q.defaultClass = i
+	}
+	return q
+}
+
+// Acquire queues an unclassified request. See AcquireClass.
+func (q *Queue) Acquire(ctx context.Context) (func(), error) {
+	return q.AcquireClass(ctx, "", "")
+}
+
+// AcquireClass waits for a slot for a request of class from client and
+// returns the func that frees it. It fails with ErrQueueFull when the
+// backlog or the client's share of it is full, ErrQueueShed when a more
+// important request took its place, ErrQueueWait when no slot came up in
+// time, or the context's error.
+func (q *Queue) AcquireClass(ctx context.Context, class, client string) (func(), error) {
+	q.mu.Lock()
+	if q.active < q.maxConcurrent && q.queued == 0 {
+		q.active++
+		q.mu.Unlock()
+		return q.releaser(), nil
+	}
+	index, ok := q.byName[class]
+	if !ok {
+		index = q.defaultClass
+	}
+	if q.perClient[client] >= q.maxPerClient || (q.queued >= q.maxQueued && !q.shedBelowLocked(index)) {
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &queueWaiter{class: index, client: client, ready: make(chan struct{})}
+	q.pushLocked(w)
+	q.mu.Unlock()
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		if w.err != nil {
+			return nil, w.err
+		}
+		return q.releaser(), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = ErrQueueWait
+	}
+
+	q.mu.Lock()
+	select {
+	case <-w.ready:
+		// Granted a slot, or shed, while giving up; pass a slot on.
+		q.mu.Unlock()
+		if w.err == nil {
+			q.releaser()()
+		}
+	default:
+		q.removeLocked(w)
+		q.mu.Unlock()
+	}
+	return nil, err
+}
+
+// Reclassify charges a request already holding a slot of class from to the
+// less important class to instead, as if to had been granted the slot, so
+// the requests waiting in to give way for it. The request keeps its slot.
+// Moves to a class that is not less important are ignored.
+func (q *Queue) Reclassify(from, to string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fromIndex, ok := q.byName[from]
+	if !ok {
+		fromIndex = q.defaultClass
+	}
+	toIndex, ok := q.byName[to]
+	if !ok {
+		toIndex = q.defaultClass
+	}
+	if toIndex <= fromIndex {
+		return
+	}
+	c := q.classes[toIndex]
+	c.pass = max(c.pass, q.vtime) + c.stride
+}
+
+func (q *Queue) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			q.active--
+			q.dispatchLocked()
+			q.mu.Unlock()
+		})
+	}
+}
+
+func (q *Queue) pushLocked(w *queueWaiter) {
+	c := q.classes[w.class]
+	if c.queued == 0 {
+		c.pass = max(c.pass, q.vtime)
+	}
+	if len(c.waiting[w.client]) == 0 {
+		c.ring = append(c.ring, w.client)
+	}
+	c.waiting[w.client] = append(c.waiting[w.client], w)
+	c.queued++
+	q.queued++
+	q.perClient[w.client]++
+}
+
+// dispatchLocked hands free slots to waiters: to the waiting class with the
+// lowest pass, the more important one on a tie, and in it to the next
+// client in turn.
+func (q *Queue) dispatchLocked() {
+	for q.active < q.maxConcurrent && q.queued > 0 {
+		var c *queueClass
+		for _, class := range q.classes {
+			if class.queued > 0 && (c == nil || class.pass < c.pass) {
+				c = class
+			}
+		}
+		client := c.ring[c.next]
+		waiters := c.waiting[client]
+		w := waiters[0]
+		if len(waiters) > 1 {
+			// Keep the client in the ring and move on to the next one.
+			c.next = (c.next + 1) % len(c.ring)
+		}
+		q.dequeueLocked(c, client, waiters[1:])
+
+		q.vtime = c.pass
+		c.pass += c.stride
+		q.active++
+		close(w.ready)
+	}
+}
+
+// shedBelowLocked sheds the newest waiter of the busiest client in the
+// least important waiting class below index, reporting whether there was
+// one.
+func (q *Queue) shedBelowLocked(index int) bool {
+	for i := len(q.classes) - 1; i > index; i-- {
+		c := q.classes[i]
+		if c.queued == 0 {
+			continue
+		}
+		busiest := c.ring[0]
+		for _, client := range c.ring[1:] {
+			if len(c.waiting[client]) > len(c.waiting[busiest]) {
+				busiest = client
+			}
+		}
+		waiters := c.waiting[busiest]
+		w := waiters[len(waiters)-1]
+		q.dequeueLocked(c, busiest, waiters[:len(waiters)-1])
+		w.err = ErrQueueShed
+		close(w.ready)
+		return true
+	}
+	return false
+}
+
+func (q *Queue) removeLocked(w *queueWaiter) {
+	c := q.classes[w.class]
+	waiters := c.waiting[w.client]
+	if i := slices.Index(waiters, w); i >= 0 {
+		q.dequeueLocked(c, w.client, slices.Delete(waiters, i, i+1))
+	}
+}
+
+// dequeueLocked accounts for one waiter of client leaving class c, with
+// remaining still waiting.
+func (q *Queue) dequeueLocked(c *queueClass, client string, remaining []*queueWaiter) {
+	if len(remaining) > 0 {
+		c.waiting[client] = remaining
+	} else {
+		delete(c.waiting, client)
+		i := slices.Index(c.ring, client)
+		c.ring = slices.Delete(c.ring, i, i+1)
+		if i < c.next {
+			c.next--
+		}
+		if c.next >= len(c.ring) {
+			c.next = 0
+		}
+	}
+	c.queued--
+	q.queued--
+	if q.perClient[client]--; q.perClient[client] == 0 {
+		delete(q.perClient, client)
+	}
+}
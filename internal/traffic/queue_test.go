@@ -0,0 +1,188 @@
+package traffic
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+type queueGrant struct {
+	label   string
+	release func()
+	err     error
+}
+
+// enqueue starts a request of class from client and returns once it waits
+// in the queue.
+func enqueue(t *testing.T, q *Queue, class, client, label string, grants chan<- queueGrant) {
+	t.Helper()
+	waiting := func() int {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		index, ok := q.byName[class]
+		if !ok {
+			index = q.defaultClass
+		}
+		return len(q.classes[index].waiting[client])
+	}
+	before := waiting()
+	go func() {
+		release, err := q.AcquireClass(context.Background(), class, client)
+		grants <- queueGrant{label, release, err}
+	}()
+	for deadline := time.Now().Add(time.Second); waiting() == before; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never queued", label)
+		}
+	}
+}
+
+// drain releases the held slot and then every granted request in turn,
+// returning the order they were granted in.
+func drain(t *testing.T, held func(), grants <-chan queueGrant, n int) []string {
+	t.Helper()
+	held()
+	order := make([]string, 0, n)
+	for range n {
+		grant := <-grants
+		if grant.err != nil {
+			t.Fatalf("%s: %v", grant.label, grant.err)
+		}
+		order = append(order, grant.label)
+		grant.release()
+	}
+	return order
+}
+
+func TestQueueSharesSlotsBetweenClassesByWeight(t *testing.T) {
+	q := NewPriorityQueue(QueueConfig{MaxQueued: 16, MaxQueuedPerClient: 16, Classes: []QueueClass{
+		{Name: "checkout", Weight: 3},
+		{Name: "search", Weight: 1},
+	}})
+	held, _ := q.Acquire(context.Background())
+	grants := make(chan queueGrant, 16)
+	for range 8 {
+		enqueue(t, q, "search", "bot", "search", grants)
+	}
+	for range 8 {
+		enqueue(t, q, "checkout", "shopper", "checkout", grants)
+	}
+
+	order := drain(t, held, grants, 16)
+	checkout := 0
+	for _, label := range order[:8] {
+		if label == "checkout" {
+			checkout++
+		}
+	}
+	if checkout != 6 {
+		t.Fatalf("checkout got %d of the first 8 slots, want 6: %v", checkout, order)
+	}
+}
+
+func TestQueueTakesClientsInTurn(t *testing.T) {
+	q := NewPriorityQueue(QueueConfig{MaxQueued: 16, MaxQueuedPerClient: 16})
+	held, _ := q.Acquire(context.Background())
+	grants := make(chan queueGrant, 16)
+	for range 4 {
+		enqueue(t, q, "", "192.0.2.1", "a", grants)
+	}
+	enqueue(t, q, "", "192.0.2.2", "b", grants)
+	enqueue(t, q, "", "192.0.2.2", "b", grants)
+
+	order := drain(t, held, grants, 6)
+	if got, want := order, []string{"a", "b", "a", "b", "a", "a"}; !slices.Equal(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+}
+
+func TestQueueCapsEachClientsBacklog(t *testing.T) {
+	q := NewPriorityQueue(QueueConfig{MaxQueued: 20})
+	held, _ := q.Acquire(context.Background())
+	defer held()
+	grants := make(chan queueGrant, 4)
+	enqueue(t, q, "", "192.0.2.1", "a", grants)
+	enqueue(t, q, "", "192.0.2.1", "a", grants)
+	if _, err := q.AcquireClass(context.Background(), "", "192.0.2.1"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("third request from one client: %v, want ErrQueueFull", err)
+	}
+	enqueue(t, q, "", "192.0.2.2", "b", grants)
+}
+
+func TestQueueShedsLowerClassesFirst(t *testing.T) {
+	q := NewPriorityQueue(QueueConfig{MaxQueued: 2, MaxQueuedPerClient: 2, Classes: []QueueClass{
+		{Name: "login"}, {Name: DefaultQueueClass}, {Name: "search"},
+	}})
+	held, _ := q.Acquire(context.Background())
+	grants := make(chan queueGrant, 8)
+	enqueue(t, q, "search", "bot", "search", grants)
+	enqueue(t, q, "unknown", "visitor", "default", grants)
+	if _, err := q.AcquireClass(context.Background(), "search", "bot"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("search into a full queue: %v, want ErrQueueFull", err)
+	}
+
+	enqueue(t, q, "login", "user", "login", grants)
+	if grant := <-grants; grant.label != "search" || !errors.Is(grant.err, ErrQueueShed) {
+		t.Fatalf("first shed = %s %v, want search", grant.label, grant.err)
+	}
+	enqueue(t, q, "login", "user", "login", grants)
+	if grant := <-grants; grant.label != "default" || !errors.Is(grant.err, ErrQueueShed) {
+		t.Fatalf("second shed = %s %v, want default", grant.label, grant.err)
+	}
+	if _, err := q.AcquireClass(context.Background(), "login", "other"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("login with only logins waiting: %v, want ErrQueueFull", err)
+	}
+	if order := drain(t, held, grants, 2); !slices.Equal(order, []string{"login", "login"}) {
+		t.Fatalf("order = %v", order)
+	}
+}
+
+func TestQueueReclassifyKeepsTheSlot(t *testing.T) {
+	q := NewPriorityQueue(QueueConfig{MaxQueued: 1, MaxQueuedPerClient: 1, Classes: []QueueClass{
+		{Name: "members"}, {Name: DefaultQueueClass}, {Name: "suspicious"},
+	}})
+	held, err := q.AcquireClass(context.Background(), "members", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grants := make(chan queueGrant, 1)
+	enqueue(t, q, "suspicious", "192.0.2.2", "suspicious", grants)
+
+	// The backlog is full, yet reclassifying the held request refuses
+	// nothing and only charges the lower class.
+	q.Reclassify("members", "suspicious")
+	q.Reclassify("suspicious", "members")
+	if q.active != 1 || q.queued != 1 {
+		t.Fatalf("active %d, queued %d after reclassifying", q.active, q.queued)
+	}
+	if pass := q.classes[2].pass; pass != 1 {
+		t.Fatalf("suspicious pass = %v, want one slot charged", pass)
+	}
+	if pass := q.classes[0].pass; pass != 0 {
+		t.Fatalf("members pass = %v, a move up should be ignored", pass)
+	}
+	if order := drain(t, held, grants, 1); !slices.Equal(order, []string{"suspicious"}) {
+		t.Fatalf("order = %v", order)
+	}
+}
+
+func TestQueueForgetsWaitersThatGiveUp(t *testing.T) {
+	q := NewPriorityQueue(QueueConfig{MaxQueued: 2, MaxQueuedPerClient: 2})
+	held, _ := q.Acquire(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.AcquireClass(ctx, "", "gone"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Acquire error = %v, want context.Canceled", err)
+	}
+	held()
+	release, err := q.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("a canceled waiter kept its place: %v", err)
+	}
+	release()
+	if q.active != 0 || q.queued != 0 || len(q.perClient) != 0 {
+		t.Fatalf("queue not empty: active %d, queued %d, clients %v", q.active, q.queued, q.perClient)
+	}
+}
@@ -0,0 +1,176 @@
+package traffic
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTarpitBytesPerSecond = 4
+	defaultTarpitMaxPerIP       = 4
+	defaultTarpitMaxConnections = 256
+	defaultTarpitMaxDuration    = 10 * time.Minute
+)
+
+// TarpitConfig sizes a Tarpit. Zero fields take the defaults: 4 bytes per
+// second, 4 connections per IP, 256 connections in all, 10 minutes each.
+type TarpitConfig struct {
+	BytesPerSecond int
+	MaxPerIP       int
+	MaxConnections int
+	MaxDuration    time.Duration
+}
+
+// TarpitStats are a Tarpit's counters. Active is the number of connections
+// held now; the rest are cumulative.
+type TarpitStats struct {
+	Active   int
+	Held     uint64
+	Rejected uint64
+	Bytes    uint64
+	Duration time.Duration
+}
+
+// Tarpit holds abusive clients' connections open and trickles their
+// responses out through a BandwidthLimiter, so scanners waste their time
+// rather than ours. MaxConnections is a hard ceiling on held sockets; a
+// client over either cap is answered at full speed instead. A nil *Tarpit
+// holds nothing.
+type Tarpit struct {
+	limiter     *BandwidthLimiter
+	chunk       int
+	maxPerIP    int
+	maxTotal    int
+	maxDuration time.Duration
+
+	mu     sync.Mutex
+	active map[string]int
+	total  int
+
+	held     atomic.Uint64
+	rejected atomic.Uint64
+	bytes    atomic.Uint64
+	nanos    atomic.Uint64
+}
+
+func NewTarpit(cfg TarpitConfig) *Tarpit {
+	if cfg.BytesPerSecond <= 0 {
+		cfg.BytesPerSecond = defaultTarpitBytesPerSecond
+	}
+	if cfg.MaxPerIP <= 0 {
+		cfg.MaxPerIP = defaultTarpitMaxPerIP
+	}
+	if cfg.MaxConnections <= 0 {
+		cfg.MaxConnections = defaultTarpitMaxConnections
+	}
+	if cfg.MaxDuration <= 0 {
+		cfg.MaxDuration = defaultTarpitMaxDuration
+	}
+	return &Tarpit{
+		// One chunk a second: the burst is the per-second rate.
+		limiter:     NewBandwidthLimiter(cfg.BytesPerSecond, cfg.BytesPerSecond),
+		chunk:       cfg.BytesPerSecond,
+		maxPerIP:    cfg.MaxPerIP,
+		maxTotal:    cfg.MaxConnections,
+		maxDuration: cfg.MaxDuration,
+		active:      make(map[string]int),
+	}
+}
+
+// Hold takes a tarpit slot for ip. On success it returns a writer that
+// trickles everything written to it, and a release func the caller must
+// call once the response is written. Release keeps trickling spaces after
+// the response, which HTML, JSON and text all ignore, until the client
+// disconnects or MaxDuration passes, and then frees the slot. When the
+// tarpit is full Hold returns w unchanged and false.
+func (t *Tarpit) Hold(w http.ResponseWriter, r *http.Request, ip string) (http.ResponseWriter, func(), bool) {
+	if t == nil {
+		return w, func() {}, false
+	}
+	t.mu.Lock()
+	if t.total >= t.maxTotal || t.active[ip] >= t.maxPerIP {
+		t.mu.Unlock()
+		t.rejected.Add(1)
+		return w, func() {}, false
+	}
+	t.total++
+	t.active[ip]++
+	t.mu.Unlock()
+	t.held.Add(1)
+
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(r.Context(), t.maxDuration)
+	tw := &tarpitWriter{
+		BandwidthResponseWriter: BandwidthResponseWriter{ResponseWriter: w, limiter: t.limiter, key: "tarpit:" + ip, ctx: ctx},
+		tarpit:                  t,
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			tw.pad()
+			cancel()
+			t.nanos.Add(uint64(time.Since(started)))
+			t.mu.Lock()
+			t.total--
+			if t.active[ip]--; t.active[ip] <= 0 {
+				delete(t.active, ip)
+			}
+			t.mu.Unlock()
+		})
+	}
+	return tw, release, true
+}
+
+// Stats returns the tarpit's counters.
+func (t *Tarpit) Stats() TarpitStats {
+	if t == nil {
+		return TarpitStats{}
+	}
+	t.mu.Lock()
+	active := t.total
+	t.mu.Unlock()
+	return TarpitStats{
+		Active:   active,
+		Held:     t.held.Load(),
+		Rejected: t.rejected.Load(),
+		Bytes:    t.bytes.Load(),
+		Duration: time.Duration(t.nanos.Load()),
+	}
+}
+
+// tarpitWriter splits writes into per-second chunks and flushes each one,
+// so the client sees the bytes arrive one chunk at a time.
+type tarpitWriter struct {
+	BandwidthResponseWriter
+	tarpit *Tarpit
+}
+
+func (w *tarpitWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(w.tarpit.chunk, len(b))
+		n, err := w.BandwidthResponseWriter.Write(b[:n])
+		written += n
+		w.tarpit.bytes.Add(uint64(n))
+		if err != nil {
+			return written, err
+		}
+		w.Flush()
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// pad trickles spaces until the writer's context ends.
+func (w *tarpitWriter) pad() {
+	spaces := bytes.Repeat([]byte{' '}, w.tarpit.chunk)
+	for {
+		if _, err := w.Write(spaces); err != nil {
+			return
+		}
+	}
+}
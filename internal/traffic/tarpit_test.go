@@ -0,0 +1,99 @@
+package traffic
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTarpitTricklesInChunksAndPads(t *testing.T) {
+	tarpit := NewTarpit(TarpitConfig{BytesPerSecond: 100, MaxDuration: 1700 * time.Millisecond})
+	rec := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	w, release, ok := tarpit.Hold(rec, httptest.NewRequest(http.MethodGet, "/", nil), "192.0.2.1")
+	if !ok {
+		t.Fatal("Hold refused an empty tarpit")
+	}
+
+	start := time.Now()
+	if _, err := w.Write([]byte(strings.Repeat("x", 150))); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("150 bytes at 100 B/s took %s", elapsed)
+	}
+	// Padding goes out at 1.5s; the next chunk would pass MaxDuration.
+	release()
+	if want := strings.Repeat("x", 150) + strings.Repeat(" ", 100); rec.Body.String() != want || rec.flushes != 3 {
+		t.Fatalf("wrote %q in %d flushes", rec.Body, rec.flushes)
+	}
+	stats := tarpit.Stats()
+	if stats.Active != 0 || stats.Held != 1 || stats.Bytes != 250 || stats.Duration < 1700*time.Millisecond {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestTarpitCaps(t *testing.T) {
+	tarpit := NewTarpit(TarpitConfig{MaxPerIP: 2, MaxConnections: 3, MaxDuration: time.Millisecond})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	hold := func(ip string) (func(), bool) {
+		_, release, ok := tarpit.Hold(httptest.NewRecorder(), req, ip)
+		return release, ok
+	}
+
+	releaseA1, _ := hold("192.0.2.1")
+	hold("192.0.2.1")
+	if _, ok := hold("192.0.2.1"); ok {
+		t.Fatal("per-IP cap not enforced")
+	}
+	hold("192.0.2.2")
+	if _, ok := hold("192.0.2.3"); ok {
+		t.Fatal("global cap not enforced")
+	}
+	releaseA1()
+	releaseA1()
+	if _, ok := hold("192.0.2.3"); !ok {
+		t.Fatal("released slot was not reused")
+	}
+	if stats := tarpit.Stats(); stats.Active != 3 || stats.Held != 4 || stats.Rejected != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	var nilTarpit *Tarpit
+	rec := httptest.NewRecorder()
+	if w, release, ok := nilTarpit.Hold(rec, req, "192.0.2.1"); ok || w != rec {
+		t.Fatal("nil tarpit held a connection")
+	} else {
+		release()
+	}
+}
+
+func TestTarpitGivesUpWhenClientLeaves(t *testing.T) {
+	tarpit := NewTarpit(TarpitConfig{BytesPerSecond: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	w, release, _ := tarpit.Hold(httptest.NewRecorder(), req, "192.0.2.1")
+	defer release()
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	n, err := w.Write([]byte("abcdef"))
+	if err == nil || n != 1 {
+		t.Fatalf("Write = %d, %v; want 1 byte and an error", n, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Write kept going after the client left")
+	}
+}
+
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (w *flushCounter) Flush() {
+	w.flushes++
+	w.ResponseRecorder.Flush()
+}
@@ -0,0 +1,252 @@
+package waf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/expr-lang/expr"
+
+	"netgoat.xyz/agent/internal/geoip"
+	"netgoat.xyz/agent/internal/tlsfp"
+)
+
+// DefaultSampleLimit is how many matching requests a dry run keeps per rule
+// and how many changed decisions it lists.
+const DefaultSampleLimit = 5
+
+// MaxSampleLineBytes bounds one line of a JSONL corpus.
+const MaxSampleLineBytes = 1 << 20
+
+// Sample is one recorded request in a JSONL corpus. Only URL is required;
+// unrecognised fields are ignored, so request logs with extra metadata can be
+// replayed as they are.
+type Sample struct {
+	// ID labels the sample in reports. It defaults to "line N".
+	ID     string `json:"request_id"`
+	Method string `json:"method"`
+	// URL is the request target as sent by the client, either origin-form
+	// ("/path?query") or absolute ("https://host/path").
+	URL        string            `json:"url"`
+	Host       string            `json:"host"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	RemoteAddr string            `json:"remote_addr"`
+	RouteKey   string            `json:"route_key"`
+	Username   string            `json:"username"`
+	// Geo stands in for the GeoIP lookup of the client address.
+	Geo geoip.Info `json:"geo"`
+	// JA3 and JA4 stand in for the TLS fingerprint of the connection.
+	JA3 string `json:"ja3"`
+	JA4 string `json:"ja4"`
+}
+
+// ReadSamples parses a JSONL corpus. Blank lines and lines starting with "#"
+// are skipped.
+func ReadSamples(r io.Reader) ([]Sample, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), MaxSampleLineBytes)
+	var samples []Sample
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var sample Sample
+		if err := json.Unmarshal([]byte(text), &sample); err != nil {
+			return nil, fmt.Errorf("corpus line %d: %w", line, err)
+		}
+		if strings.TrimSpace(sample.URL) == "" {
+			return nil, fmt.Errorf("corpus line %d: url is required", line)
+		}
+		if sample.ID == "" {
+			sample.ID = fmt.Sprintf("line %d", line)
+		}
+		samples = append(samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read corpus: %w", err)
+	}
+	return samples, nil
+}
+
+// Request builds the HTTP request the sample describes, as the server would
+// have received it.
+func (s Sample) Request() (*http.Request, error) {
+	method := strings.ToUpper(strings.TrimSpace(s.Method))
+	if method == "" {
+		method = http.MethodGet
+	}
+	target := strings.TrimSpace(s.URL)
+	parsed, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, fmt.Errorf("sample %s: %w", s.ID, err)
+	}
+	req := &http.Request{
+		Method:     method,
+		URL:        parsed,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header, len(s.Headers)),
+		Host:       parsed.Host,
+		RemoteAddr: s.RemoteAddr,
+		RequestURI: target,
+		Body:       http.NoBody,
+	}
+	for name, value := range s.Headers {
+		req.Header.Set(name, value)
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	if s.Host != "" {
+		req.Host = s.Host
+	}
+	if req.RemoteAddr == "" {
+		req.RemoteAddr = "192.0.2.1:1234"
+	}
+	if s.Body != "" {
+		req.Body = io.NopCloser(strings.NewReader(s.Body))
+		req.ContentLength = int64(len(s.Body))
+	}
+	if s.JA3 != "" || s.JA4 != "" {
+		req = req.WithContext(tlsfp.WithFingerprint(context.Background(), tlsfp.Fingerprint{JA3: s.JA3, JA4: s.JA4}))
+	}
+	return req, nil
+}
+
+// DryRunReport summarises a candidate rule set evaluated against a corpus.
+type DryRunReport struct {
+	Requests int `json:"requests"`
+	// Blocked counts requests the candidate rules block; ActiveBlocked counts
+	// those the active rules block and is zero when there is no active set.
+	Blocked       int          `json:"blocked"`
+	ActiveBlocked int          `json:"active_blocked"`
+	Rules         []RuleReport `json:"rules"`
+	// NewlyBlocked and NewlyAllowed count decisions that flip between the
+	// active and candidate rules. Changes lists the first of them, along with
+	// requests that stay blocked but by a different rule.
+	NewlyBlocked int              `json:"newly_blocked"`
+	NewlyAllowed int              `json:"newly_allowed"`
+	Changes      []DecisionChange `json:"changes,omitempty"`
+	// Errors lists samples that could not be turned into requests.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// RuleReport counts how many requests a candidate rule matched, independent
+// of which rule decided each request.
+type RuleReport struct {
+	Name    string   `json:"name"`
+	Action  string   `json:"action"`
+	Matches int      `json:"matches"`
+	Samples []string `json:"samples,omitempty"`
+}
+
+// DecisionChange is a request whose decision differs between rule sets.
+type DecisionChange struct {
+	RequestID string  `json:"request_id"`
+	Active    Verdict `json:"active"`
+	Candidate Verdict `json:"candidate"`
+}
+
+// Verdict is the part of a Decision that a dry run compares.
+type Verdict struct {
+	Blocked bool   `json:"blocked"`
+	Rule    string `json:"rule,omitempty"`
+	Score   int    `json:"score,omitempty"`
+}
+
+// DryRun evaluates candidate against every sample without affecting live
+// traffic or rule statistics. When active is non-nil, each decision is
+// compared with the active rule set. opts applies to every sample, with the
+// sample's RouteKey, Username and Geo overriding the corresponding fields;
+// sampleLimit <= 0 selects DefaultSampleLimit.
+func DryRun(candidate, active *Engine, samples []Sample, opts Options, sampleLimit int) DryRunReport {
+	if sampleLimit <= 0 {
+		sampleLimit = DefaultSampleLimit
+	}
+	rules := candidate.rules.Load()
+	report := DryRunReport{Rules: make([]RuleReport, len(rules.items))}
+	for i, rule := range rules.items {
+		report.Rules[i] = RuleReport{Name: rule.name, Action: ifEmpty(rule.action, ActionBlock)}
+	}
+
+	for _, sample := range samples {
+		sampleOpts := opts
+		if sample.RouteKey != "" {
+			sampleOpts.RouteKey = sample.RouteKey
+		}
+		if sample.Username != "" {
+			sampleOpts.Username = sample.Username
+		}
+		if !sample.Geo.IsZero() {
+			sampleOpts.Geo = sample.Geo
+		}
+		req, err := sample.Request()
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		report.Requests++
+
+		for _, i := range candidate.matchingRules(req, sampleOpts) {
+			rule := &report.Rules[i]
+			rule.Matches++
+			if len(rule.Samples) < sampleLimit {
+				rule.Samples = append(rule.Samples, sample.ID)
+			}
+		}
+		next := verdictOf(candidate.evaluate(req, sampleOpts, false))
+		if next.Blocked {
+			report.Blocked++
+		}
+		if active == nil {
+			continue
+		}
+		current := verdictOf(active.evaluate(req, sampleOpts, false))
+		if current.Blocked {
+			report.ActiveBlocked++
+		}
+		switch {
+		case current.Blocked == next.Blocked && (!next.Blocked || current.Rule == next.Rule):
+			continue
+		case next.Blocked && !current.Blocked:
+			report.NewlyBlocked++
+		case current.Blocked && !next.Blocked:
+			report.NewlyAllowed++
+		}
+		if len(report.Changes) < sampleLimit {
+			report.Changes = append(report.Changes, DecisionChange{RequestID: sample.ID, Active: current, Candidate: next})
+		}
+	}
+	return report
+}
+
+// matchingRules returns the indexes of every in-scope rule whose expression
+// matches r, ignoring actions and short-circuiting.
+func (e *Engine) matchingRules(r *http.Request, opts Options) []int {
+	rules := e.rules.Load()
+	env, rejected := requestContext(r, opts, rules.needsBody)
+	if rejected != "" {
+		return nil
+	}
+	var matched []int
+	for _, i := range rules.index.lookup(rules.items, env.Host, env.RouteKey, env.Path) {
+		output, err := expr.Run(rules.items[i].program, env)
+		if ok, _ := output.(bool); err == nil && ok {
+			matched = append(matched, i)
+		}
+	}
+	return matched
+}
+
+func verdictOf(decision Decision) Verdict {
+	return Verdict{Blocked: decision.Blocked, Rule: decision.Rule, Score: decision.Score}
+}
@@ -0,0 +1,100 @@
+package waf
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const sampleCorpus = `{"request_id": "home", "url": "/"}
+{"request_id": "admin", "url": "/admin/users", "headers": {"Host": "shop.test"}}
+
+# comments and blank lines are skipped
+{"request_id": "admin-encoded", "url": "/%61dmin"}
+{"request_id": "login", "method": "post", "url": "/login", "headers": {"Content-Type": "application/x-www-form-urlencoded"}, "body": "user=admin'--"}
+{"url": "/api/items?id=1%20UNION%20SELECT%20password%20FROM%20users", "remote_addr": "203.0.113.9:5555"}
+`
+
+func TestReadSamples(t *testing.T) {
+	samples, err := ReadSamples(strings.NewReader(sampleCorpus))
+	if err != nil {
+		t.Fatalf("ReadSamples: %v", err)
+	}
+	if len(samples) != 5 {
+		t.Fatalf("len(samples) = %d, want 5", len(samples))
+	}
+	if samples[4].ID != "line 7" {
+		t.Fatalf("unlabelled sample ID = %q", samples[4].ID)
+	}
+
+	req, err := samples[3].Request()
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if req.Method != "POST" || string(body) != "user=admin'--" || req.RemoteAddr != "192.0.2.1:1234" {
+		t.Fatalf("request = %s %q from %s", req.Method, body, req.RemoteAddr)
+	}
+	req, _ = samples[1].Request()
+	if req.Host != "shop.test" || req.Header.Get("Host") != "" {
+		t.Fatalf("Host = %q, header %q", req.Host, req.Header.Get("Host"))
+	}
+
+	if _, err := ReadSamples(strings.NewReader("{\"url\": \"/\"}\n{\"method\": \"GET\"}\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("missing url error = %v", err)
+	}
+}
+
+func TestDryRunReportsMatchesAndDiff(t *testing.T) {
+	samples, err := ReadSamples(strings.NewReader(sampleCorpus))
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := NewEngine()
+	if err := active.Load([]Rule{{Name: "Block Admin", Expression: `Path startsWith "/admin"`, Action: ActionBlock}}); err != nil {
+		t.Fatal(err)
+	}
+	candidate := NewEngine()
+	if err := candidate.Load([]Rule{
+		{Name: "Allow Login", Expression: `Path == "/login"`, Action: ActionAllow},
+		{Name: "Block SQLi", Expression: `detectSQLi(RawQuery) || detectSQLi(Body)`, Action: ActionBlock},
+		{Name: "Block Everything", Expression: `Path startsWith "/"`, Action: ActionBlock},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	report := DryRun(candidate, active, samples, Options{}, 2)
+	if report.Requests != 5 || report.Blocked != 4 || report.ActiveBlocked != 2 {
+		t.Fatalf("requests/blocked/active = %d/%d/%d", report.Requests, report.Blocked, report.ActiveBlocked)
+	}
+	want := []RuleReport{
+		{Name: "Allow Login", Action: ActionAllow, Matches: 1, Samples: []string{"login"}},
+		{Name: "Block SQLi", Action: ActionBlock, Matches: 2, Samples: []string{"login", "line 7"}},
+		{Name: "Block Everything", Action: ActionBlock, Matches: 5, Samples: []string{"home", "admin"}},
+	}
+	for i, rule := range report.Rules {
+		if rule.Name != want[i].Name || rule.Action != want[i].Action || rule.Matches != want[i].Matches || !slices.Equal(rule.Samples, want[i].Samples) {
+			t.Fatalf("rule %d = %+v, want %+v", i, rule, want[i])
+		}
+	}
+	if report.NewlyBlocked != 2 || report.NewlyAllowed != 0 {
+		t.Fatalf("newly blocked/allowed = %d/%d", report.NewlyBlocked, report.NewlyAllowed)
+	}
+	// Both admin requests stay blocked but by a different rule; only the
+	// first two changes are listed.
+	if len(report.Changes) != 2 || report.Changes[0].RequestID != "home" || report.Changes[1].Active.Rule != "Block Admin" || report.Changes[1].Candidate.Rule != "Block Everything" {
+		t.Fatalf("changes = %+v", report.Changes)
+	}
+}
+
+func TestDryRunWithoutActiveRulesSkipsDiff(t *testing.T) {
+	candidate := NewEngine()
+	if err := candidate.Load([]Rule{{Name: "Block POST", Expression: `Method == "POST"`}}); err != nil {
+		t.Fatal(err)
+	}
+	report := DryRun(candidate, nil, []Sample{{ID: "a", URL: "/"}, {ID: "b", URL: "::bad"}, {ID: "c", Method: "POST", URL: "/"}}, Options{}, 0)
+	if report.Requests != 2 || report.Blocked != 1 || report.Changes != nil || len(report.Errors) != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+}
@@ -0,0 +1,248 @@
+package waf
+
+import (
+	"encoding/base64"
+	"html"
+	"math"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+
+	"netgoat.xyz/agent/internal/lists"
+)
+
+// maxDecodeRounds bounds urlDecodeAll so hostile input cannot loop forever.
+const maxDecodeRounds = 5
+
+// functionOptions returns the helpers available to every rule expression in
+// addition to expr's builtins. Lists are read at evaluation time, so list
+// updates never require recompiling rules; a nil pointer matches nothing.
+func functionOptions(store *atomic.Pointer[lists.Store]) []expr.Option {
+	return []expr.Option{
+		expr.Patch(headerPatcher{}),
+		expr.Patch(listPatcher{}),
+		expr.Function("urlDecode", func(params ...any) (any, error) {
+			return urlDecode(params[0].(string)), nil
+		}, urlDecode),
+		expr.Function("urlDecodeAll", func(params ...any) (any, error) {
+			return urlDecodeAll(params[0].(string)), nil
+		}, urlDecodeAll),
+		expr.Function("htmlEntityDecode", func(params ...any) (any, error) {
+			return html.UnescapeString(params[0].(string)), nil
+		}, html.UnescapeString),
+		expr.Function("normalizePath", func(params ...any) (any, error) {
+			return normalizePath(params[0].(string)), nil
+		}, normalizePath),
+		expr.Function("base64Decode", func(params ...any) (any, error) {
+			return base64Decode(params[0].(string)), nil
+		}, base64Decode),
+		expr.Function("detectSQLi", func(params ...any) (any, error) {
+			return detectSQLi(params[0].(string)), nil
+		}, detectSQLi),
+		expr.Function("phraseMatch", func(params ...any) (any, error) {
+			return phraseMatch(params[0].(string), params[1].([]any)), nil
+		}, new(func(string, []any) bool)),
+		expr.Function("cidr", func(params ...any) (any, error) {
+			ranges := make([]string, 0, len(params)-1)
+			for _, param := range params[1:] {
+				ranges = append(ranges, param.(string))
+			}
+			return cidrMatch(params[0].(string), ranges...), nil
+		}, new(func(string, ...string) bool)),
+		expr.Function("inList", func(params ...any) (any, error) {
+			if store == nil {
+				return false, nil
+			}
+			if asn, ok := params[1].(int); ok {
+				return asn > 0 && asn <= math.MaxUint32 && store.Load().Set().ContainsASN(params[0].(string), uint32(asn)), nil
+			}
+			return store.Load().Contains(params[0].(string), params[1].(string)), nil
+		}, new(func(string, string) bool), new(func(string, int) bool)),
+		expr.Function("headerValue", func(params ...any) (any, error) {
+			return headerValue(params[0].(map[string][]string), params[1].(string)), nil
+		}, headerValue),
+	}
+}
+
+// headerPatcher rewrites header("name") into headerValue(Headers, "name"):
+// expr functions cannot read the environment, but rules should not have to
+// pass the header map themselves.
+type headerPatcher struct{}
+
+func (headerPatcher) Visit(node *ast.Node) {
+	call, ok := (*node).(*ast.CallNode)
+	if !ok || len(call.Arguments) != 1 {
+		return
+	}
+	if callee, ok := call.Callee.(*ast.IdentifierNode); !ok || callee.Value != "header" {
+		return
+	}
+	ast.Patch(node, &ast.CallNode{
+		Callee:    &ast.IdentifierNode{Value: "headerValue"},
+		Arguments: []ast.Node{&ast.IdentifierNode{Value: "Headers"}, call.Arguments[0]},
+	})
+}
+
+// listPatcher rewrites X in list("name") into inList("name", X), so large
+// managed lists read like any other membership test. "not in" wraps the
+// same node in a negation and needs no special case.
+type listPatcher struct{}
+
+func (listPatcher) Visit(node *ast.Node) {
+	binary, ok := (*node).(*ast.BinaryNode)
+	if !ok || binary.Operator != "in" {
+		return
+	}
+	call, ok := binary.Right.(*ast.CallNode)
+	if !ok || len(call.Arguments) != 1 {
+		return
+	}
+	if callee, ok := call.Callee.(*ast.IdentifierNode); !ok || callee.Value != "list" {
+		return
+	}
+	ast.Patch(node, &ast.CallNode{
+		Callee:    &ast.IdentifierNode{Value: "inList"},
+		Arguments: []ast.Node{call.Arguments[0], binary.Left},
+	})
+}
+
+// headerValue returns all values of a header joined by ", ", looking the name
+// up case-insensitively.
+func headerValue(headers map[string][]string, name string) string {
+	values := headers[textproto.CanonicalMIMEHeaderKey(name)]
+	if values == nil {
+		values = headers[name]
+	}
+	return strings.Join(values, ", ")
+}
+
+// urlDecode percent-decodes a value, treating "+" as a space. Invalid escapes
+// are left in place rather than failing the rule, matching ModSecurity's
+// t:urlDecode.
+func urlDecode(value string) string {
+	if !strings.ContainsAny(value, "%+") {
+		return value
+	}
+	if decoded, err := url.QueryUnescape(value); err == nil {
+		return decoded
+	}
+	var b strings.Builder
+	b.Grow(len(value))
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%' && i+2 < len(value) && isHex(value[i+1]) && isHex(value[i+2]):
+			b.WriteByte(unhex(value[i+1])<<4 | unhex(value[i+2]))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// urlDecodeAll decodes until the value stops changing, defeating multiple
+// encoding such as %2561 for "a".
+func urlDecodeAll(value string) string {
+	for i := 0; i < maxDecodeRounds; i++ {
+		decoded := urlDecode(value)
+		if decoded == value {
+			break
+		}
+		value = decoded
+	}
+	return value
+}
+
+// normalizePath treats backslashes as separators, collapses repeated slashes
+// and resolves dot-segments. The result always starts with "/".
+func normalizePath(value string) string {
+	value = strings.ReplaceAll(value, `\`, "/")
+	cleaned := path.Clean("/" + value)
+	if strings.HasSuffix(value, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// base64Decode accepts standard and URL-safe alphabets with or without
+// padding. Undecodable input yields "".
+func base64Decode(value string) string {
+	value = strings.TrimSpace(value)
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(value); err == nil {
+			return string(decoded)
+		}
+	}
+	return ""
+}
+
+// cidrMatch reports whether ip is inside any of the ranges. Ranges may be
+// CIDR prefixes or single addresses; malformed entries never match.
+func cidrMatch(ip string, ranges ...string) bool {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, entry := range ranges {
+		if prefix, ok := parseRange(entry); ok && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRange(entry string) (netip.Prefix, bool) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), prefix.IsValid()
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+// phraseMatch reports whether value contains any of the phrases,
+// case-insensitively, like ModSecurity's @pm operator.
+func phraseMatch(value string, phrases []any) bool {
+	value = strings.ToLower(value)
+	for _, phrase := range phrases {
+		if p, ok := phrase.(string); ok && p != "" && strings.Contains(value, strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,177 @@
+package waf
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"netgoat.xyz/agent/internal/geoip"
+)
+
+func TestHelperFunctionsInRules(t *testing.T) {
+	engine := NewEngine()
+	engine.SetLists(map[string][]string{
+		"badips":  {"203.0.113.7", "198.51.100.0/24"},
+		"badbots": {"sqlmap", "nikto"},
+	})
+
+	tests := []struct {
+		name       string
+		expression string
+		request    func() *http.Request
+		want       bool
+	}{
+		{"cidr match", `cidr(IP, "10.0.0.0/8", "192.0.2.1")`, remote("10.1.2.3"), true},
+		{"cidr single address", `cidr(IP, "10.0.0.0/8", "192.0.2.1")`, remote("192.0.2.1"), true},
+		{"cidr miss", `cidr(IP, "10.0.0.0/8")`, remote("192.0.2.1"), false},
+		{"cidr mapped ipv4", `cidr(IP, "10.0.0.0/8")`, remote("::ffff:10.0.0.1"), true},
+		{"list prefix", `inList("badips", IP)`, remote("198.51.100.20"), true},
+		{"list address", `inList("badips", IP)`, remote("203.0.113.7"), true},
+		{"list string", `inList("badbots", lower(UserAgent))`, withHeader("User-Agent", "SQLMap"), true},
+		{"unknown list", `inList("missing", IP)`, remote("203.0.113.7"), false},
+		{"in list", `IP in list("badips")`, remote("198.51.100.20"), true},
+		{"not in list", `IP not in list("badips")`, remote("198.51.100.20"), false},
+		{"in list combined", `Method == "GET" && lower(UserAgent) in list("badbots")`, withHeader("User-Agent", "Nikto"), true},
+		{"in array still works", `Method in ["GET", "HEAD"]`, target("/"), true},
+		{"header", `header("x-forwarded-host") == "evil.test"`, withHeader("X-Forwarded-Host", "evil.test"), true},
+		{"urlDecodeAll", `normalizePath(urlDecodeAll(URI)) startsWith "/admin"`, target("/%252561dmin/x"), true},
+		{"normalizePath", `normalizePath(Path) == "/admin/"`, target(`/public/..//admin/`), true},
+		{"htmlEntityDecode", `htmlEntityDecode(Query["q"][0]) contains "<script"`, target("/?q=%26lt%3Bscript%26gt%3B"), true},
+		{"base64Decode", `base64Decode(Query["t"][0]) contains "../"`, target("/?t=Li4vZXRjL3Bhc3N3ZA"), true},
+		{"detectSQLi", `detectSQLi(RawQuery)`, target("/?id=1%27%20OR%20%271%27=%271"), true},
+		{"cookies", `Cookies["session"] == "abc"`, withHeader("Cookie", "session=abc; theme=dark"), true},
+		{"content length and protocol", `ContentLength == 0 && Protocol == "HTTP/1.1" && Scheme == "http"`, target("/"), true},
+		{"scheme https", `Scheme == "https"`, func() *http.Request {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.TLS = &tls.ConnectionState{}
+			return req
+		}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := engine.Load([]Rule{{Name: tc.name, Expression: tc.expression, Action: ActionBlock}}); err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if got := engine.Evaluate(tc.request(), Options{}).Blocked; got != tc.want {
+				t.Fatalf("%s = %v, want %v", tc.expression, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRouteKeyAndUsernameComeFromOptions(t *testing.T) {
+	engine := NewEngine()
+	if err := engine.Load([]Rule{{Name: "admin route", Expression: `RouteKey == "domain:admin.test" && Username != "root"`, Action: ActionBlock}}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	if !engine.Evaluate(req, Options{RouteKey: "domain:admin.test", Username: "alice"}).Blocked {
+		t.Fatal("rule should see the route key and username")
+	}
+	if engine.Evaluate(req, Options{RouteKey: "domain:admin.test", Username: "root"}).Blocked {
+		t.Fatal("root should be allowed")
+	}
+}
+
+func TestGeoFieldsComeFromOptions(t *testing.T) {
+	engine := NewEngine()
+	engine.SetLists(map[string][]string{"hosting": {"AS16509"}})
+	if err := engine.Load([]Rule{{Name: "geo", Expression: `Country in ["KP", "IR"] || ASN in list("hosting") || (ASN == 64500 && City == "Berlin")`, Action: ActionBlock}}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, tc := range []struct {
+		geo  geoip.Info
+		want bool
+	}{
+		{geoip.Info{Country: "KP"}, true},
+		{geoip.Info{Country: "DE", ASN: 16509, ASOrg: "AMAZON-02"}, true},
+		{geoip.Info{Country: "DE", City: "Berlin", ASN: 64500}, true},
+		{geoip.Info{Country: "DE", City: "Munich", ASN: 64500}, false},
+		{geoip.Info{}, false},
+	} {
+		if got := engine.Evaluate(req, Options{Geo: tc.geo}).Blocked; got != tc.want {
+			t.Fatalf("Geo %+v: blocked = %v, want %v", tc.geo, got, tc.want)
+		}
+	}
+}
+
+func TestDetectSQLi(t *testing.T) {
+	for _, input := range []string{
+		"1 UNION SELECT password FROM users",
+		"1/**/UnIoN/**/SeLeCt/**/1",
+		"1 /*!50000union*/ select 1",
+		"x' or 'a'='a",
+		"1 or 1=1",
+		"admin'--",
+		"1; DROP TABLE users",
+		"1 AND SLEEP(5)",
+		"1' AND extractvalue(1, concat(0x7e, @@version))#",
+		"%2527%2520or%25201%253D1",
+	} {
+		if !detectSQLi(input) {
+			t.Errorf("detectSQLi(%q) = false, want true", input)
+		}
+	}
+	for _, input := range []string{
+		"",
+		"the union of two sets",
+		"select your plan from the list below",
+		"it's a nice day -- really",
+		"order #42 for O'Brien",
+		"--verbose",
+		"a=b&c=d",
+	} {
+		if detectSQLi(input) {
+			t.Errorf("detectSQLi(%q) = true, want false", input)
+		}
+	}
+}
+
+func remote(ip string) func() *http.Request {
+	return func() *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "[" + ip + "]:1234"
+		return req
+	}
+}
+
+func withHeader(name, value string) func() *http.Request {
+	return func() *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(name, value)
+		return req
+	}
+}
+
+func target(uri string) func() *http.Request {
+	return func() *http.Request {
+		return httptest.NewRequest("GET", uri, nil)
+	}
+}
+
+func TestTLSFingerprintFieldsComeFromConnection(t *testing.T) {
+	engine := NewEngine()
+	engine.SetLists(map[string][]string{"tools": {"t13i1310h1_ba3ad6a0b2a1_b8f1b3e1c8d4"}})
+	if err := engine.Load([]Rule{{Name: "tool", Expression: `JA4 in list("tools") || JA3 == "e7d705a3286e19ea42f587b344ee6865"`, Action: ActionBlock}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		sample Sample
+		want   bool
+	}{
+		{Sample{URL: "/", JA4: "t13i1310h1_ba3ad6a0b2a1_b8f1b3e1c8d4"}, true},
+		{Sample{URL: "/", JA3: "e7d705a3286e19ea42f587b344ee6865"}, true},
+		{Sample{URL: "/", JA4: "t13d1516h2_8daaf6152771_e5627efa2ab1"}, false},
+		{Sample{URL: "/"}, false},
+	} {
+		req, err := tc.sample.Request()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := engine.Evaluate(req, Options{}).Blocked; got != tc.want {
+			t.Fatalf("%+v: blocked = %v, want %v", tc.sample, got, tc.want)
+		}
+	}
+}
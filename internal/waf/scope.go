@@ -0,0 +1,181 @@
+package waf
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Scope limits a rule to part of the traffic. Each non-empty field must
+// match: the request host (exactly, or "*.example.com" for any subdomain),
+// the resolved route key, or a path prefix of the canonical path. A rule
+// with an empty scope applies to every request.
+type Scope struct {
+	Hosts        []string `json:"hosts,omitempty"`
+	Routes       []string `json:"routes,omitempty"`
+	PathPrefixes []string `json:"path_prefixes,omitempty"`
+}
+
+// IsGlobal reports whether the scope places no restriction on requests.
+func (s Scope) IsGlobal() bool {
+	return len(s.Hosts) == 0 && len(s.Routes) == 0 && len(s.PathPrefixes) == 0
+}
+
+// Validate rejects a scope with a field whose entries are all blank, which
+// would otherwise leave the rule global.
+func (s Scope) Validate() error {
+	_, err := s.normalized()
+	return err
+}
+
+// normalized lowercases hosts, drops blanks and duplicates, and trims
+// whitespace from every entry. A field that had entries but is left empty
+// is an error rather than no restriction.
+func (s Scope) normalized() (Scope, error) {
+	normalized := Scope{
+		Hosts: cleanEntries(s.Hosts, func(host string) string {
+			return strings.ToLower(strings.TrimSuffix(host, "."))
+		}),
+		Routes:       cleanEntries(s.Routes, nil),
+		PathPrefixes: cleanEntries(s.PathPrefixes, nil),
+	}
+	for _, field := range []struct {
+		name          string
+		before, after []string
+	}{
+		{"hosts", s.Hosts, normalized.Hosts},
+		{"routes", s.Routes, normalized.Routes},
+		{"path_prefixes", s.PathPrefixes, normalized.PathPrefixes},
+	} {
+		if len(field.before) > 0 && len(field.after) == 0 {
+			return Scope{}, fmt.Errorf("scope %s are all blank", field.name)
+		}
+	}
+	return normalized, nil
+}
+
+func (s Scope) matches(host, routeKey, path string) bool {
+	if len(s.Hosts) > 0 && !slices.ContainsFunc(s.Hosts, func(pattern string) bool { return hostMatches(pattern, host) }) {
+		return false
+	}
+	if len(s.Routes) > 0 && !slices.Contains(s.Routes, routeKey) {
+		return false
+	}
+	if len(s.PathPrefixes) > 0 && !slices.ContainsFunc(s.PathPrefixes, func(prefix string) bool { return strings.HasPrefix(path, prefix) }) {
+		return false
+	}
+	return true
+}
+
+func hostMatches(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return pattern == host
+}
+
+func cleanEntries(entries []string, transform func(string) string) []string {
+	var cleaned []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if transform != nil {
+			entry = transform(entry)
+		}
+		if entry != "" && !slices.Contains(cleaned, entry) {
+			cleaned = append(cleaned, entry)
+		}
+	}
+	return cleaned
+}
+
+// scopeIndex finds the rules that can apply to a request without visiting
+// every scoped rule. Each scoped rule is indexed under one dimension, hosts
+// first, then routes, then path prefixes; its full scope is checked on
+// lookup.
+type scopeIndex struct {
+	global []int
+	all    []int
+	scoped bool
+
+	hosts     map[string][]int
+	wildcards map[string][]int
+	routes    map[string][]int
+	paths     map[string][]int
+	// pathLengths are the distinct prefix lengths, so a lookup probes one
+	// map key per length instead of comparing every prefix.
+	pathLengths []int
+}
+
+func (x *scopeIndex) add(index int, scope Scope) {
+	x.all = append(x.all, index)
+	switch {
+	case scope.IsGlobal():
+		x.global = append(x.global, index)
+		return
+	case len(scope.Hosts) > 0:
+		for _, host := range scope.Hosts {
+			if suffix, ok := strings.CutPrefix(host, "*."); ok {
+				x.wildcards = appendIndex(x.wildcards, suffix, index)
+			} else {
+				x.hosts = appendIndex(x.hosts, host, index)
+			}
+		}
+	case len(scope.Routes) > 0:
+		for _, route := range scope.Routes {
+			x.routes = appendIndex(x.routes, route, index)
+		}
+	default:
+		for _, prefix := range scope.PathPrefixes {
+			x.paths = appendIndex(x.paths, prefix, index)
+			if !slices.Contains(x.pathLengths, len(prefix)) {
+				x.pathLengths = append(x.pathLengths, len(prefix))
+			}
+		}
+	}
+	x.scoped = true
+}
+
+// lookup returns the rule indexes to evaluate, in evaluation order. Scoped
+// candidates are filtered by their full scope.
+func (x *scopeIndex) lookup(items []compiledRule, host, routeKey, path string) []int {
+	if !x.scoped {
+		return x.all
+	}
+	candidates := append([]int(nil), x.global...)
+	candidates = append(candidates, x.hosts[host]...)
+	for parent := host; ; {
+		_, rest, ok := strings.Cut(parent, ".")
+		if !ok || rest == "" {
+			break
+		}
+		candidates = append(candidates, x.wildcards[rest]...)
+		parent = rest
+	}
+	candidates = append(candidates, x.routes[routeKey]...)
+	for _, length := range x.pathLengths {
+		if length <= len(path) {
+			candidates = append(candidates, x.paths[path[:length]]...)
+		}
+	}
+	if len(candidates) == len(x.global) {
+		return x.global
+	}
+
+	slices.Sort(candidates)
+	candidates = slices.Compact(candidates)
+	applicable := candidates[:0]
+	for _, index := range candidates {
+		if items[index].scope.matches(host, routeKey, path) {
+			applicable = append(applicable, index)
+		}
+	}
+	return applicable
+}
+
+func appendIndex(index map[string][]int, key string, rule int) map[string][]int {
+	if index == nil {
+		index = make(map[string][]int)
+	}
+	index[key] = append(index[key], rule)
+	return index
+}
@@ -0,0 +1,124 @@
+package waf
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScopedRulesOnlyApplyToTheirTraffic(t *testing.T) {
+	engine := NewEngine()
+	if err := engine.Load([]Rule{
+		{Name: "Allow Health", Expression: `Path == "/health"`, Action: ActionAllow},
+		{Name: "Shop Admin", Expression: `Path startsWith "/admin"`, Scope: Scope{Hosts: []string{"Shop.Example.Test."}}},
+		{Name: "Tenant Wildcard", Expression: `Method == "PUT"`, Scope: Scope{Hosts: []string{"*.tenants.test"}}},
+		{Name: "API Route", Expression: `Method == "DELETE"`, Scope: Scope{Routes: []string{"path:/api/"}}},
+		{Name: "Uploads", Expression: `ContentLength > 10`, Scope: Scope{PathPrefixes: []string{"/upload"}}},
+		{Name: "Shop Checkout", Expression: `Method == "POST"`, Scope: Scope{Hosts: []string{"shop.example.test"}, PathPrefixes: []string{"/checkout"}}},
+		{Name: "Global", Expression: `Path == "/wp-login.php"`},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, method, host, target, routeKey string
+		want                                 string
+	}{
+		{"host scope", "GET", "shop.example.test", "/admin", "", "Shop Admin"},
+		{"other host", "GET", "blog.example.test", "/admin", "", ""},
+		{"wildcard", "PUT", "a.b.tenants.test", "/", "", "Tenant Wildcard"},
+		{"wildcard apex excluded", "PUT", "tenants.test", "/", "", ""},
+		{"route scope", "DELETE", "api.test", "/api/items", "path:/api/", "API Route"},
+		{"other route", "DELETE", "api.test", "/api/items", "domain:api.test", ""},
+		{"path scope", "POST", "x.test", "/uploads/big", "", "Uploads"},
+		{"all dimensions", "POST", "shop.example.test", "/checkout/pay", "", "Shop Checkout"},
+		{"partial dimensions", "POST", "shop.example.test", "/cart", "", ""},
+		{"global", "GET", "x.test", "/wp-login.php", "", "Global"},
+		{"global allow first", "GET", "shop.example.test", "/health", "", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, nil)
+			req.Host = tc.host
+			if tc.name == "path scope" {
+				req.ContentLength = 100
+			}
+			decision := engine.Evaluate(req, Options{RouteKey: tc.routeKey})
+			if decision.Blocked != (tc.want != "") || (tc.want != "" && decision.Rule != tc.want) {
+				t.Fatalf("decision = %+v, want rule %q", decision, tc.want)
+			}
+		})
+	}
+
+	// Rules outside the request's scope are not evaluated at all: of the
+	// shop.example.test requests only /checkout reached Shop Checkout.
+	for _, stats := range engine.RuleStats() {
+		if stats.Rule == "Shop Checkout" && stats.Evaluations != 1 {
+			t.Fatalf("Shop Checkout evaluated %d times, want 1", stats.Evaluations)
+		}
+	}
+}
+
+func TestBlankScopesAreRejected(t *testing.T) {
+	for _, scope := range []Scope{
+		{Hosts: []string{" ", "."}},
+		{Routes: []string{""}},
+		{Hosts: []string{"shop.example.test"}, PathPrefixes: []string{"  "}},
+	} {
+		if err := scope.Validate(); err == nil {
+			t.Fatalf("scope %+v validated", scope)
+		}
+		engine := NewEngine()
+		if err := engine.Load([]Rule{{Name: "Blank", Expression: "true", Scope: scope}}); err == nil {
+			t.Fatalf("rule with scope %+v compiled", scope)
+		}
+	}
+	if err := (Scope{Hosts: []string{" shop.example.test ", ""}}).Validate(); err != nil {
+		t.Fatalf("scope with one usable host: %v", err)
+	}
+}
+
+func TestScopeIndexKeepsEvaluationOrder(t *testing.T) {
+	var x scopeIndex
+	scopes := []Scope{
+		{Hosts: []string{"a.test"}},
+		{},
+		{PathPrefixes: []string{"/a"}},
+		{Routes: []string{"r"}},
+		{Hosts: []string{"*.test", "a.test"}},
+	}
+	items := make([]compiledRule, len(scopes))
+	for i, scope := range scopes {
+		items[i].scope = scope
+		x.add(i, scope)
+	}
+	got := x.lookup(items, "a.test", "r", "/a/b")
+	if fmt.Sprint(got) != "[0 1 2 3 4]" {
+		t.Fatalf("lookup = %v", got)
+	}
+	if got := x.lookup(items, "b.test", "", "/"); fmt.Sprint(got) != "[1 4]" {
+		t.Fatalf("lookup = %v", got)
+	}
+}
+
+func BenchmarkEvaluateManyTenants(b *testing.B) {
+	rules := []Rule{{Name: "global", Expression: `Path == "/wp-login.php"`}}
+	for i := 0; i < 500; i++ {
+		host := fmt.Sprintf("tenant%d.example.test", i)
+		rules = append(rules,
+			Rule{Name: host + " admin", Expression: `Path startsWith "/admin"`, Scope: Scope{Hosts: []string{host}}},
+			Rule{Name: host + " sqli", Expression: `detectSQLi(RawQuery)`, Scope: Scope{Hosts: []string{host}}},
+		)
+	}
+	engine := NewEngine()
+	if err := engine.Load(rules); err != nil {
+		b.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/products?id=42", nil)
+	req.Host = "tenant250.example.test"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.Evaluate(req, Options{})
+	}
+}
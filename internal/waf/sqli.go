@@ -0,0 +1,55 @@
+package waf
+
+import (
+	"regexp"
+	"strings"
+)
+
+// sqliComment matches inline comments, including MySQL's executable
+// /*!50000 ... */ form whose body is kept because MySQL runs it.
+var sqliComment = regexp.MustCompile(`/\*!?\d*|\*/`)
+
+// sqliSignatures are the token patterns detectSQLi looks for once input has
+// been decoded, lowercased and stripped of comment obfuscation. Each targets
+// a construct that is rare in ordinary text but central to an injection.
+var sqliSignatures = []*regexp.Regexp{
+	// UNION-based extraction.
+	regexp.MustCompile(`\bunion(\s+(all|distinct))?\s+select\b`),
+	// Boolean tautologies after breaking out of a quoted literal.
+	regexp.MustCompile(`['"\x60)]\s*(or|and|\|\||&&|xor)\s*['"\x60(]?[\w.]*['"\x60]?\s*(=|<>|!=|<|>|\blike\b|\bis\b)`),
+	// Numeric tautologies such as "or 1=1".
+	regexp.MustCompile(`\b(or|and|xor)\s+\(?\d+\)?\s*(=|<>|!=|<|>)\s*\(?\d+\b`),
+	regexp.MustCompile(`\bor\s+(true|not\s+false)\b`),
+	// Breaking out of a literal and commenting out the rest of the query.
+	regexp.MustCompile(`['"\x60]\s*\)*\s*(--(\s|$)|;)|['\x60]\s*\)*\s*#`),
+	// Stacked queries.
+	regexp.MustCompile(`;\s*(drop|delete|insert|update|shutdown|exec|execute|declare|create|alter|truncate)\b`),
+	// Time-based blind probes.
+	regexp.MustCompile(`\b(sleep|benchmark|pg_sleep)\s*\(`),
+	regexp.MustCompile(`\bwaitfor\s+delay\b`),
+	// Schema discovery and file access.
+	regexp.MustCompile(`\binformation_schema\b|\bsysobjects\b|\bpg_catalog\b|@@version\b`),
+	regexp.MustCompile(`\bload_file\s*\(|\binto\s+(out|dump)file\b|\bxp_cmdshell\b`),
+	// Error-based extraction.
+	regexp.MustCompile(`\b(extractvalue|updatexml)\s*\(`),
+}
+
+// detectSQLi is a libinjection-style heuristic: it normalizes the value the
+// way a database parser would see it and then looks for injection
+// signatures. It favours precision over recall; pair it with specific rules
+// for known payloads.
+func detectSQLi(value string) bool {
+	if value == "" {
+		return false
+	}
+	normalized := strings.ToLower(urlDecodeAll(value))
+	normalized = strings.ReplaceAll(normalized, "\x00", "")
+	normalized = sqliComment.ReplaceAllString(normalized, " ")
+	normalized = strings.Join(strings.Fields(normalized), " ")
+	for _, signature := range sqliSignatures {
+		if signature.MatchString(normalized) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,44 +1,214 @@
 package waf
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
 	"github.com/expr-lang/expr/vm"
 	"github.com/rs/zerolog/log"
+
+	"netgoat.xyz/agent/internal/clientip"
+	"netgoat.xyz/agent/internal/geoip"
+	"netgoat.xyz/agent/internal/lists"
+	"netgoat.xyz/agent/internal/normalize"
+	"netgoat.xyz/agent/internal/tlsfp"
 )
 
 // WAFContext defines the variables exposed to the rule engine.
 type WAFContext struct {
-	IP       string
+	// IP is the client address resolved across trusted proxies.
+	IP string
+	// PeerIP is the direct socket peer, which is a proxy when the request
+	// arrived through one.
+	PeerIP string
+	// IPChain is the verified forwarding chain from IP to PeerIP. Addresses
+	// the client claimed before its own are left out, since they can be forged.
+	IPChain  []string
 	Host     string
 	Method   string
 	Path     string
 	Query    map[string][]string
 	RawQuery string
 	Headers  map[string][]string
+	// URI is the raw request target (path and query) as sent by the client.
+	URI string
+	// Args holds query parameters merged with URL-encoded form fields.
+	Args map[string][]string
+	// Body is at most MaxBodyBytes of the request body. It is only read when
+	// a loaded rule references Body or Args.
+	Body string
+	// Cookies maps each cookie name to its first value.
+	Cookies       map[string]string
+	UserAgent     string
+	ContentLength int64
+	// Scheme is "https" for TLS connections and "http" otherwise.
+	Scheme string
+	// Protocol is the HTTP version, such as "HTTP/1.1" or "HTTP/2.0".
+	Protocol string
+	// RouteKey identifies the matched route, or is empty when none matched.
+	RouteKey string
+	// Username is the authenticated user, or empty for anonymous requests.
+	Username string
+	// EncodingFlags lists ambiguities resolved while canonicalizing the URL,
+	// using the normalize.Flag* names (for example "multiple-encoding").
+	EncodingFlags []string
+	// Country is the client's ISO 3166-1 alpha-2 country code, City its
+	// English city name, and ASN and ASOrg its autonomous system, all from
+	// the local GeoIP databases. They are empty or zero when unknown.
+	Country string
+	City    string
+	ASN     int
+	ASOrg   string
+	// JA3 and JA4 fingerprint the TLS ClientHello of the connection; both
+	// are empty for plain HTTP.
+	JA3 string
+	JA4 string
 }
 
+// MaxBodyBytes bounds how much of a request body the WAF inspects. Larger
+// bodies are evaluated on this prefix and forwarded unchanged.
+const MaxBodyBytes = 64 << 10
+
+// Rule actions. SCORE rules only contribute to the anomaly score; BLOCK rules
+// short-circuit unless the caller enables scoring mode. TARPIT rules block
+// even in scoring mode, and ask for the response to be tarpitted.
+const (
+	ActionAllow  = "ALLOW"
+	ActionBlock  = "BLOCK"
+	ActionScore  = "SCORE"
+	ActionTarpit = "TARPIT"
+)
+
+const (
+	// DefaultRuleScore mirrors the OWASP CRS "critical" severity weight.
+	DefaultRuleScore = 5
+	// DefaultInboundThreshold blocks on a single critical match, as CRS does
+	// at paranoia level 1.
+	DefaultInboundThreshold = 5
+	// DefaultCategory is used for scoring rules that do not name a category.
+	DefaultCategory = "generic"
+	// AnomalyRuleName is reported when the accumulated score blocks a request.
+	AnomalyRuleName = "Inbound Anomaly Score Exceeded"
+	// AmbiguousEncodingRuleName is reported for URLs without a canonical form.
+	AmbiguousEncodingRuleName = "Block Ambiguous Encoding"
+)
+
 type compiledRule struct {
-	name    string
-	action  string
-	program *vm.Program
+	name     string
+	action   string
+	score    int
+	category string
+	shadow   bool
+	scope    Scope
+	program  *vm.Program
+	stats    *ruleCounters
+}
+
+// Options carries per-request evaluation settings resolved by the caller.
+type Options struct {
+	// Scoring makes BLOCK rules add their weight to the anomaly score instead
+	// of blocking on the first match.
+	Scoring bool
+	// InboundThreshold is the total score at which the request is blocked.
+	// Zero selects DefaultInboundThreshold.
+	InboundThreshold int
+	DebugLogs        bool
+	// RouteKey and Username are resolved earlier in the pipeline and exposed
+	// to rules unchanged.
+	RouteKey string
+	Username string
+	// EncodingFlags are ambiguities found when the request was canonicalized
+	// before its URL was rewritten.
+	EncodingFlags []string
+	// Client is the trusted-proxy resolution for the request. When it is
+	// empty, the direct peer address is used for IP, PeerIP and IPChain.
+	Client clientip.Result
+	// Geo is the GeoIP enrichment of the client address.
+	Geo geoip.Info
+}
+
+// Match describes a rule that contributed to a request's anomaly score.
+type Match struct {
+	Rule     string
+	Category string
+	Score    int
+}
+
+// Decision is the outcome of evaluating the rule set against one request.
+type Decision struct {
+	Blocked bool
+	// Tarpit is set when a TARPIT rule blocked the request.
+	Tarpit bool
+	// Rule names the rule that decided the request. Scoring blocks report
+	// AnomalyRuleName.
+	Rule       string
+	Score      int
+	Threshold  int
+	Categories map[string]int
+	Matches    []Match
+	// ShadowMatches names shadow rules that matched. They never affect the
+	// outcome.
+	ShadowMatches []string
+}
+
+// ContributingRules returns the names of rules that added to the score.
+func (d Decision) ContributingRules() []string {
+	names := make([]string, 0, len(d.Matches))
+	for _, match := range d.Matches {
+		names = append(names, match.Rule)
+	}
+	return names
 }
 
 type compiledRules struct {
-	items []compiledRule
+	items     []compiledRule
+	index     scopeIndex
+	needsBody bool
+	hasShadow bool
 }
 
 // Engine evaluates an immutable, precompiled rule set. Reload builds a full
 // replacement before publishing it, so requests never observe partial updates.
 type Engine struct {
 	rules atomic.Pointer[compiledRules]
+	lists atomic.Pointer[lists.Store]
+
+	// counters are keyed by rule name so statistics survive reloads of an
+	// unchanged rule. Only Load touches the map.
+	countersMu sync.Mutex
+	counters   map[string]*ruleCounters
+}
+
+// ruleCounters accumulate per-rule statistics without locking.
+type ruleCounters struct {
+	evaluations atomic.Uint64
+	matches     atomic.Uint64
+	errors      atomic.Uint64
+	nanos       atomic.Uint64
+}
+
+// RuleStats are the cumulative evaluation statistics of one loaded rule.
+type RuleStats struct {
+	Rule           string
+	Action         string
+	Shadow         bool
+	Evaluations    uint64
+	Matches        uint64
+	Errors         uint64
+	EvaluationTime time.Duration
 }
 
 func NewEngine() *Engine {
@@ -47,97 +217,432 @@ func NewEngine() *Engine {
 	return engine
 }
 
+// Rule is an uncompiled rule definition, in evaluation order.
+type Rule struct {
+	Name       string
+	Expression string
+	Action     string
+	Score      int
+	Category   string
+	// Shadow rules are evaluated and counted but never enforced, so a rule
+	// can be observed on live traffic before it is promoted.
+	Shadow bool
+	// Scope limits the requests the rule is evaluated for. Requests only
+	// evaluate global rules and the rules scoped to them.
+	Scope Scope
+}
+
 // Reload compiles all database rules and atomically swaps them into service.
 // The previous rule set remains active if any rule cannot be loaded.
 func (e *Engine) Reload(db *sql.DB) error {
-	rows, err := db.Query("SELECT name, expression, action FROM waf_rules ORDER BY priority DESC, id ASC")
+	rows, err := db.Query(`SELECT name, expression, action, COALESCE(score, 0), COALESCE(category, ''), COALESCE(shadow, 0), COALESCE(scope, '')
+		FROM waf_rules ORDER BY priority DESC, id ASC`)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
-	next := &compiledRules{}
+	var rules []Rule
 	for rows.Next() {
-		var name, expression, action string
-		if err := rows.Scan(&name, &expression, &action); err != nil {
+		var (
+			rule  Rule
+			scope string
+		)
+		if err := rows.Scan(&rule.Name, &rule.Expression, &rule.Action, &rule.Score, &rule.Category, &rule.Shadow, &scope); err != nil {
 			return err
 		}
-		program, err := compileExpression(expression)
-		if err != nil {
-			return fmt.Errorf("compile WAF rule %q: %w", name, err)
+		if scope != "" {
+			if err := json.Unmarshal([]byte(scope), &rule.Scope); err != nil {
+				return fmt.Errorf("decode scope of WAF rule %q: %w", rule.Name, err)
+			}
 		}
-		next.items = append(next.items, compiledRule{
-			name:    name,
-			action:  strings.ToUpper(strings.TrimSpace(action)),
-			program: program,
-		})
+		rules = append(rules, rule)
 	}
 	if err := rows.Err(); err != nil {
 		return err
 	}
+	return e.Load(rules)
+}
+
+// Load compiles rules, which must already be in evaluation order, and
+// atomically swaps them into service. Nothing changes if any rule fails.
+// Statistics carry over for rules whose name is unchanged.
+func (e *Engine) Load(rules []Rule) error {
+	next := &compiledRules{}
+	e.countersMu.Lock()
+	defer e.countersMu.Unlock()
+	counters := make(map[string]*ruleCounters, len(rules))
+	for _, rule := range rules {
+		program, err := compileExpression(rule.Expression, &e.lists)
+		if err != nil {
+			return fmt.Errorf("compile WAF rule %q: %w", rule.Name, err)
+		}
+		if referencesBody(program) {
+			next.needsBody = true
+		}
+		score := rule.Score
+		if score <= 0 {
+			score = DefaultRuleScore
+		}
+		stats := counters[rule.Name]
+		if stats == nil {
+			stats = e.counters[rule.Name]
+		}
+		if stats == nil {
+			stats = &ruleCounters{}
+		}
+		counters[rule.Name] = stats
+		next.hasShadow = next.hasShadow || rule.Shadow
+		scope, err := rule.Scope.normalized()
+		if err != nil {
+			return fmt.Errorf("compile WAF rule %q: %w", rule.Name, err)
+		}
+		next.index.add(len(next.items), scope)
+		next.items = append(next.items, compiledRule{
+			name:     rule.Name,
+			action:   strings.ToUpper(strings.TrimSpace(rule.Action)),
+			score:    score,
+			category: ifEmpty(strings.ToLower(strings.TrimSpace(rule.Category)), DefaultCategory),
+			shadow:   rule.Shadow,
+			scope:    scope,
+			program:  program,
+			stats:    stats,
+		})
+	}
+	e.counters = counters
 	e.rules.Store(next)
 	return nil
 }
 
+// RuleStats returns the statistics of every loaded rule in evaluation order.
+// Rules after a deciding match are not evaluated and so are not counted,
+// except shadow rules, which run on every request.
+func (e *Engine) RuleStats() []RuleStats {
+	rules := e.rules.Load()
+	stats := make([]RuleStats, 0, len(rules.items))
+	for _, rule := range rules.items {
+		stats = append(stats, RuleStats{
+			Rule:           rule.name,
+			Action:         ifEmpty(rule.action, ActionBlock),
+			Shadow:         rule.shadow,
+			Evaluations:    rule.stats.evaluations.Load(),
+			Matches:        rule.stats.matches.Load(),
+			Errors:         rule.stats.errors.Load(),
+			EvaluationTime: time.Duration(rule.stats.nanos.Load()),
+		})
+	}
+	return stats
+}
+
 // ValidateExpression verifies that a rule is a boolean WAF expression.
 func ValidateExpression(expression string) error {
-	_, err := compileExpression(expression)
+	_, err := compileExpression(expression, nil)
 	return err
 }
 
-func compileExpression(expression string) (*vm.Program, error) {
-	return expr.Compile(expression, expr.Env(WAFContext{}), expr.AsBool())
+// SetLists replaces the named lists consulted by inList and "in list(...)"
+// with a private set of non-expiring entries. Entries may be IP addresses,
+// CIDR prefixes, ASNs or plain strings.
+func (e *Engine) SetLists(values map[string][]string) {
+	store := lists.NewStore()
+	store.Load(lists.FromStrings(values))
+	e.lists.Store(store)
+}
+
+// UseLists makes rules consult a shared list store, typically the one
+// reloaded from the database. Compiled rules see updates to the store on
+// their next evaluation.
+func (e *Engine) UseLists(store *lists.Store) {
+	e.lists.Store(store)
+}
+
+func compileExpression(expression string, store *atomic.Pointer[lists.Store]) (*vm.Program, error) {
+	options := append([]expr.Option{expr.Env(WAFContext{}), expr.AsBool()}, functionOptions(store)...)
+	return expr.Compile(expression, options...)
+}
+
+// bodyVisitor records whether an expression reads request body fields, so
+// the body is only buffered when some rule needs it.
+type bodyVisitor struct {
+	found bool
+}
+
+func (v *bodyVisitor) Visit(node *ast.Node) {
+	if ident, ok := (*node).(*ast.IdentifierNode); ok && (ident.Value == "Body" || ident.Value == "Args") {
+		v.found = true
+	}
+}
+
+func referencesBody(program *vm.Program) bool {
+	node := program.Node()
+	visitor := &bodyVisitor{}
+	ast.Walk(&node, visitor)
+	return visitor.found
 }
 
 // Check evaluates the current precompiled rule set for a request.
 func (e *Engine) Check(r *http.Request, debugLogs bool) (bool, string) {
-	if e == nil || r == nil {
-		return false, ""
-	}
-	decodedQuery, err := url.QueryUnescape(r.URL.RawQuery)
-	if err != nil {
-		log.Warn().Err(err).Msg("Blocked request due to malformed URL encoding")
-		return true, "Block Malformed Encoding"
-	}
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	if ip == "" {
-		ip = r.RemoteAddr
+	decision := e.Evaluate(r, Options{DebugLogs: debugLogs})
+	return decision.Blocked, decision.Rule
+}
+
+// Evaluate runs every applicable rule and returns the full decision. ALLOW
+// and TARPIT rules end evaluation immediately. In blocking mode the first
+// BLOCK match ends evaluation and SCORE matches never block; otherwise
+// matches accumulate per category and the request is blocked once the total
+// reaches the inbound threshold. Shadow rules are still evaluated after a
+// decision but only reported in ShadowMatches.
+func (e *Engine) Evaluate(r *http.Request, opts Options) Decision {
+	return e.evaluate(r, opts, true)
+}
+
+// evaluate implements Evaluate; record controls whether rule statistics are
+// updated, so dry runs against the live engine leave them untouched.
+func (e *Engine) evaluate(r *http.Request, opts Options, record bool) Decision {
+	threshold := opts.InboundThreshold
+	if threshold <= 0 {
+		threshold = DefaultInboundThreshold
 	}
-	env := WAFContext{
-		IP:       ip,
-		Host:     normalizedHost(r.Host),
-		Method:   r.Method,
-		Path:     r.URL.Path,
-		Query:    r.URL.Query(),
-		RawQuery: decodedQuery,
-		Headers:  r.Header,
+	decision := Decision{Threshold: threshold}
+	if e == nil || r == nil {
+		return decision
 	}
-
 	rules := e.rules.Load()
 	if rules == nil {
-		return false, ""
+		rules = &compiledRules{}
 	}
-	for _, rule := range rules.items {
-		output, err := expr.Run(rule.program, env)
+	env, rejected := requestContext(r, opts, rules.needsBody)
+	if rejected != "" {
+		decision.Blocked = true
+		decision.Rule = rejected
+		return decision
+	}
+	decided := false
+	for _, index := range rules.index.lookup(rules.items, env.Host, env.RouteKey, env.Path) {
+		rule := rules.items[index]
+		if decided && !rule.shadow {
+			if !rules.hasShadow {
+				break
+			}
+			continue
+		}
+		matched, err := rule.run(env, record)
 		if err != nil {
 			log.Error().Err(err).Str("rule", rule.name).Msg("Error running WAF rule")
 			continue
 		}
-		matched, _ := output.(bool)
-		if debugLogs {
-			log.Debug().Str("rule", rule.name).Bool("matched", matched).Msg("WAF rule evaluation")
+		if opts.DebugLogs {
+			log.Debug().Str("rule", rule.name).Bool("matched", matched).Bool("shadow", rule.shadow).Msg("WAF rule evaluation")
 		}
 		if !matched {
 			continue
 		}
+		if rule.shadow {
+			decision.ShadowMatches = append(decision.ShadowMatches, rule.name)
+			continue
+		}
 		switch rule.action {
-		case "ALLOW":
-			return false, rule.name
-		case "", "BLOCK":
-			return true, rule.name
+		case ActionAllow:
+			decision.Rule = rule.name
+			decided = true
+		case ActionTarpit:
+			decision.Blocked = true
+			decision.Tarpit = true
+			decision.Rule = rule.name
+			decided = true
+		case "", ActionBlock:
+			if !opts.Scoring {
+				decision.Blocked = true
+				decision.Rule = rule.name
+				decided = true
+				continue
+			}
+			decision.add(rule)
+		case ActionScore:
+			decision.add(rule)
+		}
+	}
+	// SCORE matches are still reported in blocking mode, but only scoring
+	// mode blocks on their total.
+	if opts.Scoring && !decided && decision.Score >= threshold {
+		decision.Blocked = true
+		decision.Rule = AnomalyRuleName
+	}
+	return decision
+}
+
+// run evaluates the rule against env, updating its statistics when record is
+// set.
+func (rule compiledRule) run(env WAFContext, record bool) (bool, error) {
+	var started time.Time
+	if record {
+		started = time.Now()
+	}
+	output, err := expr.Run(rule.program, env)
+	matched, _ := output.(bool)
+	if record {
+		rule.stats.evaluations.Add(1)
+		rule.stats.nanos.Add(uint64(time.Since(started)))
+		if err != nil {
+			rule.stats.errors.Add(1)
+		} else if matched {
+			rule.stats.matches.Add(1)
+		}
+	}
+	return matched && err == nil, err
+}
+
+// requestContext builds the rule environment for r. It returns the name of a
+// built-in rule instead when the URL cannot be evaluated safely.
+func requestContext(r *http.Request, opts Options, needsBody bool) (WAFContext, string) {
+	if _, err := url.QueryUnescape(r.URL.RawQuery); err != nil {
+		log.Warn().Err(err).Msg("Blocked request due to malformed URL encoding")
+		return WAFContext{}, "Block Malformed Encoding"
+	}
+	// Requests are normally canonicalized before the WAF runs; direct
+	// callers get the same canonical form here. Flags found earlier are
+	// passed through Options.
+	flags := append([]string(nil), opts.EncodingFlags...)
+	canonical, ok := normalize.FromRequest(r)
+	if !ok {
+		var err error
+		canonical, err = normalize.URL(r.URL.EscapedPath(), r.URL.RawQuery)
+		if err != nil {
+			log.Warn().Err(err).Msg("Blocked request due to ambiguous URL encoding")
+			return WAFContext{}, AmbiguousEncodingRuleName
 		}
 	}
-	return false, ""
+	flags = mergeFlags(flags, canonical.Flags)
+	client := opts.Client
+	if client.ClientIP == "" {
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip == "" {
+			ip = r.RemoteAddr
+		}
+		client = clientip.Result{ClientIP: ip, PeerIP: ip, Chain: []string{ip}}
+	}
+	query := r.URL.Query()
+	env := WAFContext{
+		IP:       client.ClientIP,
+		PeerIP:   client.PeerIP,
+		IPChain:  client.Chain,
+		Host:     normalizedHost(r.Host),
+		Method:   r.Method,
+		Path:     canonical.Path,
+		Query:    query,
+		RawQuery: canonical.Query,
+		Headers:  r.Header,
+		URI:      rawRequestURI(r),
+		Args:     query,
+
+		Cookies:       requestCookies(r),
+		UserAgent:     r.UserAgent(),
+		ContentLength: r.ContentLength,
+		Scheme:        "http",
+		Protocol:      r.Proto,
+		RouteKey:      opts.RouteKey,
+		Username:      opts.Username,
+		EncodingFlags: flags,
+		Country:       opts.Geo.Country,
+		City:          opts.Geo.City,
+		ASN:           int(opts.Geo.ASN),
+		ASOrg:         opts.Geo.ASOrg,
+	}
+	if fp := tlsfp.FromRequest(r); !fp.IsZero() {
+		env.JA3, env.JA4 = fp.JA3, fp.JA4
+	}
+	if r.TLS != nil {
+		env.Scheme = "https"
+	}
+	if needsBody {
+		env.Body, env.Args = inspectBody(r, query)
+	}
+	return env, ""
+}
+
+// inspectBody reads up to MaxBodyBytes of the body and restores it so the
+// upstream still receives the full stream. URL-encoded form fields are merged
+// into a copy of the query parameters.
+func inspectBody(r *http.Request, query url.Values) (string, url.Values) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", query
+	}
+	prefix, err := io.ReadAll(io.LimitReader(r.Body, MaxBodyBytes))
+	r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(prefix), r.Body), Closer: r.Body}
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read request body for WAF inspection")
+	}
+	body := string(prefix)
+
+	contentType := strings.ToLower(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		return body, query
+	}
+	form, err := url.ParseQuery(body)
+	if err != nil && len(form) == 0 {
+		return body, query
+	}
+	args := make(url.Values, len(query)+len(form))
+	for name, values := range query {
+		args[name] = append([]string(nil), values...)
+	}
+	for name, values := range form {
+		args[name] = append(args[name], values...)
+	}
+	return body, args
+}
+
+// rawRequestURI returns the request target as the client sent it, before
+// canonicalization rewrote the URL.
+func rawRequestURI(r *http.Request) string {
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+func mergeFlags(flags, more []string) []string {
+	for _, flag := range more {
+		if !slices.Contains(flags, flag) {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+func requestCookies(r *http.Request) map[string]string {
+	cookies := r.Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(cookies))
+	for _, cookie := range cookies {
+		if _, exists := values[cookie.Name]; !exists {
+			values[cookie.Name] = cookie.Value
+		}
+	}
+	return values
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (d *Decision) add(rule compiledRule) {
+	if d.Categories == nil {
+		d.Categories = make(map[string]int)
+	}
+	d.Score += rule.score
+	d.Categories[rule.category] += rule.score
+	d.Matches = append(d.Matches, Match{Rule: rule.name, Category: rule.category, Score: rule.score})
+}
+
+func ifEmpty(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
 }
 
 func normalizedHost(hostport string) string {
@@ -2,10 +2,15 @@ package waf
 
 import (
 	"database/sql"
+	"io"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"netgoat.xyz/agent/internal/clientip"
 )
 
 // setuptestDB creates an in-memory SQLite database and seeds it with mock rules for testing.
@@ -22,7 +27,11 @@ func setupTestDB(t *testing.T) *sql.DB {
 		name TEXT NOT NULL,
 		expression TEXT NOT NULL,
 		action TEXT NOT NULL DEFAULT 'BLOCK',
-		priority INTEGER DEFAULT 0
+		priority INTEGER DEFAULT 0,
+		score INTEGER NOT NULL DEFAULT 0,
+		category TEXT NOT NULL DEFAULT '',
+		shadow INTEGER NOT NULL DEFAULT 0,
+		scope TEXT NOT NULL DEFAULT ''
 	);`)
 	if err != nil {
 		t.Fatalf("Failed to create waf_rules table: %v", err)
@@ -161,6 +170,79 @@ func TestEngineReloadsRulesAtomicallyAndHonorsAllow(t *testing.T) {
 	}
 }
 
+func TestEngineScoringModeAccumulatesToThreshold(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	if _, err := db.Exec(`DELETE FROM waf_rules`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO waf_rules (name, expression, action, priority, score, category) VALUES
+		('allow health', 'Path == "/health"', 'ALLOW', 100, 0, ''),
+		('sql keyword', 'RawQuery contains "select"', 'SCORE', 50, 3, 'SQLi'),
+		('sql comment', 'RawQuery contains "--"', 'BLOCK', 40, 4, 'sqli'),
+		('script tag', 'RawQuery contains "<script"', 'BLOCK', 30, 0, 'xss')`); err != nil {
+		t.Fatal(err)
+	}
+	engine := NewEngine()
+	if err := engine.Reload(db); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	scoring := Options{Scoring: true, InboundThreshold: 8}
+
+	below := engine.Evaluate(httptest.NewRequest("GET", "/?q=select+1--", nil), scoring)
+	if below.Blocked || below.Score != 7 || below.Categories["sqli"] != 7 {
+		t.Fatalf("below threshold decision = %+v", below)
+	}
+	if got := below.ContributingRules(); len(got) != 2 || got[0] != "sql keyword" || got[1] != "sql comment" {
+		t.Fatalf("ContributingRules = %v", got)
+	}
+
+	above := engine.Evaluate(httptest.NewRequest("GET", "/?q=select+1--<script>", nil), scoring)
+	if !above.Blocked || above.Rule != AnomalyRuleName || above.Score != 7+DefaultRuleScore {
+		t.Fatalf("above threshold decision = %+v", above)
+	}
+	if above.Categories["xss"] != DefaultRuleScore {
+		t.Fatalf("xss category score = %d, want %d", above.Categories["xss"], DefaultRuleScore)
+	}
+
+	blocking := engine.Evaluate(httptest.NewRequest("GET", "/?q=select+1--", nil), Options{InboundThreshold: 8})
+	if !blocking.Blocked || blocking.Rule != "sql comment" {
+		t.Fatalf("blocking mode should stop at the first BLOCK rule: %+v", blocking)
+	}
+
+	scored := engine.Evaluate(httptest.NewRequest("GET", "/?q=select+select", nil), Options{InboundThreshold: 3})
+	if scored.Blocked || scored.Score != 3 || scored.Categories["sqli"] != 3 {
+		t.Fatalf("blocking mode should report but not block on SCORE matches: %+v", scored)
+	}
+
+	health := engine.Evaluate(httptest.NewRequest("GET", "/health?q=select--<script>", nil), scoring)
+	if health.Blocked || health.Rule != "allow health" || health.Score != 0 {
+		t.Fatalf("ALLOW rule should short-circuit scoring: %+v", health)
+	}
+}
+
+func TestTarpitRulesBlockInBothModes(t *testing.T) {
+	engine := NewEngine()
+	if err := engine.Load([]Rule{
+		{Name: "scanner", Expression: `UserAgent contains "zgrab"`, Action: ActionTarpit},
+		{Name: "sql comment", Expression: `RawQuery contains "--"`, Action: ActionBlock},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []Options{{}, {Scoring: true, InboundThreshold: 100}} {
+		req := httptest.NewRequest("GET", "/?q=1--", nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0 zgrab/0.x")
+		decision := engine.Evaluate(req, opts)
+		if !decision.Blocked || !decision.Tarpit || decision.Rule != "scanner" || decision.Score != 0 {
+			t.Fatalf("scoring=%v: decision = %+v", opts.Scoring, decision)
+		}
+	}
+	plain := engine.Evaluate(httptest.NewRequest("GET", "/?q=1--", nil), Options{})
+	if !plain.Blocked || plain.Tarpit {
+		t.Fatalf("BLOCK rule decision = %+v", plain)
+	}
+}
+
 func TestNormalizedHost(t *testing.T) {
 	for input, want := range map[string]string{
 		"API.Example.Test.:8443": "api.example.test",
@@ -172,3 +254,161 @@ func TestNormalizedHost(t *testing.T) {
 		}
 	}
 }
+
+func TestEvaluateInspectsBodyOnlyWhenReferencedAndRestoresIt(t *testing.T) {
+	engine := NewEngine()
+	if err := engine.Load([]Rule{{Name: "path", Expression: `Path == "/x"`, Action: ActionBlock}}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("payload"))
+	engine.Evaluate(req, Options{})
+	if _, ok := req.Body.(readCloser); ok {
+		t.Fatal("body was buffered although no rule references it")
+	}
+
+	if err := engine.Load([]Rule{{Name: "form", Expression: `"drop" in Args["cmd"] || Body contains "<!ENTITY"`, Action: ActionBlock}}); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("POST", "/upload?id=1", strings.NewReader("cmd=drop&x=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if decision := engine.Evaluate(req, Options{}); !decision.Blocked {
+		t.Fatalf("form field was not inspected: %+v", decision)
+	}
+	forwarded, err := io.ReadAll(req.Body)
+	if err != nil || string(forwarded) != "cmd=drop&x=1" {
+		t.Fatalf("forwarded body = %q, %v", forwarded, err)
+	}
+	if req.URL.Query().Get("cmd") != "" {
+		t.Fatal("form fields leaked into the request URL")
+	}
+}
+
+func TestURLDecodeHelperKeepsInvalidEscapes(t *testing.T) {
+	for input, want := range map[string]string{
+		"a%20b+c": "a b c",
+		"100%":    "100%",
+		"%zz%41":  "%zzA",
+	} {
+		if got := urlDecode(input); got != want {
+			t.Errorf("urlDecode(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestEvaluateUsesTrustedProxyResolvedClient(t *testing.T) {
+	engine := NewEngine()
+	if err := engine.Load([]Rule{
+		{Name: "blocked client", Expression: `cidr(IP, "198.51.100.0/24")`, Action: ActionBlock},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := clientip.New([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	behindProxy := httptest.NewRequest("GET", "/", nil)
+	behindProxy.RemoteAddr = "10.0.0.2:443"
+	behindProxy.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if decision := engine.Evaluate(behindProxy, Options{Client: resolver.Resolve(behindProxy)}); !decision.Blocked || decision.Rule != "blocked client" {
+		t.Fatalf("trusted chain decision = %+v, want the forwarded client to be blocked", decision)
+	}
+	if decision := engine.Evaluate(behindProxy, Options{}); decision.Blocked {
+		t.Fatalf("without a resolved client the proxy address is used: %+v", decision)
+	}
+
+	spoofed := httptest.NewRequest("GET", "/", nil)
+	spoofed.RemoteAddr = "203.0.113.5:5555"
+	spoofed.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if decision := engine.Evaluate(spoofed, Options{Client: resolver.Resolve(spoofed)}); decision.Blocked {
+		t.Fatalf("untrusted peer must not be able to claim a forwarded IP: %+v", decision)
+	}
+
+	viaLB := httptest.NewRequest("GET", "/", nil)
+	viaLB.RemoteAddr = "10.0.0.2:443"
+	viaLB.Header.Set("X-Forwarded-For", "198.51.100.9")
+	if decision := engine.Evaluate(viaLB, Options{Client: resolver.Resolve(viaLB)}); decision.Rule != "blocked client" {
+		t.Fatalf("via lb decision = %+v", decision)
+	}
+	if err := engine.Load([]Rule{{Name: "via lb", Expression: `PeerIP == "10.0.0.2" && IPChain == ["198.51.100.9", "10.0.0.2"]`, Action: ActionBlock}}); err != nil {
+		t.Fatal(err)
+	}
+	if decision := engine.Evaluate(viaLB, Options{Client: resolver.Resolve(viaLB)}); decision.Rule != "via lb" {
+		t.Fatalf("PeerIP/IPChain not exposed: %+v", decision)
+	}
+}
+
+func TestCanonicalPathClosesAdminBypasses(t *testing.T) {
+	engine := NewEngine()
+	if err := engine.Load([]Rule{
+		{Name: "Block Admin", Expression: `lower(Path) startsWith "/admin"`, Action: ActionBlock},
+		{Name: "Block Path Traversal", Expression: `"traversal" in EncodingFlags`, Action: ActionBlock},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for target, rule := range map[string]string{
+		"/ADMIN":                "Block Admin",
+		"/%2561dmin":            "Block Admin",
+		"//admin/users":         "Block Admin",
+		`/static\admin`:         "",
+		"/static/../css":        "Block Path Traversal",
+		"/a%00":                 AmbiguousEncodingRuleName,
+		"/%c0%ae%c0%ae/passwd":  AmbiguousEncodingRuleName,
+		"/administrators-guide": "Block Admin",
+		"/docs/admin":           "",
+	} {
+		decision := engine.Evaluate(httptest.NewRequest("GET", target, nil), Options{})
+		if decision.Blocked != (rule != "") || decision.Rule != rule {
+			t.Errorf("%s: decision = %+v, want rule %q", target, decision, rule)
+		}
+	}
+}
+
+func TestShadowRulesAreCountedButNeverEnforced(t *testing.T) {
+	engine := NewEngine()
+	rules := []Rule{
+		{Name: "Shadow Admin", Expression: `Path startsWith "/admin"`, Action: ActionBlock, Shadow: true},
+		{Name: "Block Debug", Expression: `Path == "/debug"`, Action: ActionBlock},
+		{Name: "Shadow Everything", Expression: `true`, Action: ActionBlock, Shadow: true},
+		{Name: "Broken", Expression: `Query["id"][0] == "1"`, Action: ActionBlock},
+	}
+	if err := engine.Load(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := engine.Evaluate(httptest.NewRequest("GET", "/admin", nil), Options{})
+	if admin.Blocked || !slices.Equal(admin.ShadowMatches, []string{"Shadow Admin", "Shadow Everything"}) {
+		t.Fatalf("admin decision = %+v", admin)
+	}
+	// Shadow rules after the deciding rule still run; enforced ones do not.
+	debug := engine.Evaluate(httptest.NewRequest("GET", "/debug", nil), Options{})
+	if !debug.Blocked || debug.Rule != "Block Debug" || !slices.Equal(debug.ShadowMatches, []string{"Shadow Everything"}) {
+		t.Fatalf("debug decision = %+v", debug)
+	}
+
+	stats := engine.RuleStats()
+	want := []struct {
+		evaluations, matches, errors uint64
+	}{{2, 1, 0}, {2, 1, 0}, {2, 2, 0}, {1, 0, 1}}
+	for i, rule := range stats {
+		if rule.Evaluations != want[i].evaluations || rule.Matches != want[i].matches || rule.Errors != want[i].errors {
+			t.Fatalf("stats[%d] = %+v, want %+v", i, rule, want[i])
+		}
+	}
+	if !stats[0].Shadow || stats[1].Shadow || stats[0].EvaluationTime <= 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	// Promoting a rule keeps its history; dry runs do not add to it.
+	rules[0].Shadow = false
+	if err := engine.Load(rules); err != nil {
+		t.Fatal(err)
+	}
+	DryRun(engine, engine, []Sample{{ID: "a", URL: "/admin"}}, Options{}, 0)
+	if promoted := engine.RuleStats()[0]; promoted.Shadow || promoted.Evaluations != 2 || promoted.Matches != 1 {
+		t.Fatalf("promoted stats = %+v", promoted)
+	}
+	if !engine.Evaluate(httptest.NewRequest("GET", "/admin", nil), Options{}).Blocked {
+		t.Fatal("promoted rule should block")
+	}
+}
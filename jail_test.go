@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"netgoat.xyz/agent/internal/config"
+	"netgoat.xyz/agent/internal/honeypot"
+	"netgoat.xyz/agent/internal/jail"
+)
+
+func TestJailBansAdminAPI(t *testing.T) {
+	jails, err := jail.New(nil, jail.DefaultRules(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := jailBansHandler(&config.Config{}, nil, jails)
+	call := func(method, target, body string, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := call(http.MethodGet, jailBansPath, "", "192.0.2.10:1234"); rec.Code != http.StatusForbidden {
+		t.Fatalf("remote GET status = %d, want 403", rec.Code)
+	}
+	if rec := call(http.MethodPost, jailBansPath, `{"ip": "203.0.113.5", "reason": "scraper", "duration_seconds": 60}`, "127.0.0.1:1234"); rec.Code != http.StatusCreated {
+		t.Fatalf("POST status = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := call(http.MethodPost, jailBansPath, `{"ip": "nope"}`, "127.0.0.1:1234"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid POST status = %d", rec.Code)
+	}
+
+	rec := call(http.MethodGet, jailBansPath, "", "127.0.0.1:1234")
+	var listed struct{ Bans []jail.Ban }
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Bans) != 1 || listed.Bans[0].IP != "203.0.113.5" || listed.Bans[0].Jail != jail.ManualJail {
+		t.Fatalf("bans = %+v", listed.Bans)
+	}
+
+	if rec := call(http.MethodDelete, jailBansPath+"?ip=203.0.113.5", "", "[::1]:1234"); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE status = %d", rec.Code)
+	}
+	if rec := call(http.MethodDelete, jailBansPath+"?ip=203.0.113.5", "", "[::1]:1234"); rec.Code != http.StatusNotFound {
+		t.Fatalf("second DELETE status = %d, want 404", rec.Code)
+	}
+	if _, banned := jails.Banned("203.0.113.5"); banned {
+		t.Fatal("ban was not lifted")
+	}
+}
+
+func TestJailRulesFromConfig(t *testing.T) {
+	cfg := &config.Config{}
+	if got := jailRules(cfg); len(got) != len(jail.DefaultRules()) {
+		t.Fatalf("default rules = %d", len(got))
+	}
+	cfg.Jails.Rules = []config.JailRule{{Name: "scanners", Events: []string{"not-found", "waf"}, MaxHits: 10, WindowSeconds: 30}}
+	rules := jailRules(cfg)
+	if len(rules) != 1 || rules[0].MaxHits != 10 || rules[0].Window != 30*time.Second || rules[0].BanTime != time.Hour {
+		t.Fatalf("rules = %+v", rules)
+	}
+}
+
+func TestWriteBannedSetsRetryAfter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeBanned(rec, jail.Ban{IP: "192.0.2.1", Jail: "waf", ExpiresAt: time.Now().Add(90 * time.Second)})
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("status = %d, Retry-After = %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestHoneypotTrapsFromConfig(t *testing.T) {
+	cfg := &config.Config{}
+	traps, err := honeypotTraps(cfg)
+	if err != nil || len(traps) != len(honeypot.DefaultTraps()) {
+		t.Fatalf("default traps = %d, %v", len(traps), err)
+	}
+
+	cfg.Honeypots.Traps = []config.HoneypotTrap{
+		{Name: "wp", Paths: []string{"**/wp-login.php"}, Response: "wp-login", Status: http.StatusUnauthorized, BanSeconds: 60},
+		{Name: "custom", Paths: []string{"/backup.sql"}, Body: "-- dump", Tarpit: true},
+	}
+	traps, err = honeypotTraps(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traps[0].Body != honeypot.Responses["wp-login"].Body || traps[0].Status != http.StatusUnauthorized || traps[0].BanFor != time.Minute {
+		t.Fatalf("wp trap = %+v", traps[0])
+	}
+	if traps[1].Body != "-- dump" || !traps[1].Tarpit {
+		t.Fatalf("custom trap = %+v", traps[1])
+	}
+
+	cfg.Honeypots.Traps = []config.HoneypotTrap{{Name: "x", Paths: []string{"/x"}, Response: "nope"}}
+	if _, err := honeypotTraps(cfg); err == nil {
+		t.Fatal("unknown response accepted")
+	}
+}
+
+func TestHoneypotHitBansUnlessIgnored(t *testing.T) {
+	rules := []jail.Rule{{Name: "scanners", Events: []string{jail.EventHoneypot}, MaxHits: 3, Window: time.Minute, BanTime: time.Hour}}
+	jails, err := jail.New(nil, rules, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordHoneypotHit(jails, honeypot.Event{Trap: "wp", ClientIP: "203.0.113.9", BanFor: time.Hour})
+	if ban, banned := jails.Banned("203.0.113.9"); !banned || ban.Jail != "honeypot" {
+		t.Fatalf("ban = %+v, %v", ban, banned)
+	}
+	recordHoneypotHit(jails, honeypot.Event{Trap: "wp", ClientIP: "10.1.2.3", BanFor: time.Hour})
+	if _, banned := jails.Banned("10.1.2.3"); banned {
+		t.Fatal("ignored client was banned")
+	}
+	recordHoneypotHit(jails, honeypot.Event{Trap: "env", ClientIP: "198.51.100.4"})
+	if _, banned := jails.Banned("198.51.100.4"); banned {
+		t.Fatal("a single hit on a trap without ban_seconds should not ban")
+	}
+	recordHoneypotHit(nil, honeypot.Event{Trap: "wp", ClientIP: "203.0.113.10", BanFor: time.Hour})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"netgoat.xyz/agent/internal/config"
+	"netgoat.xyz/agent/internal/database"
+	"netgoat.xyz/agent/internal/lists"
+	"netgoat.xyz/agent/internal/streaming"
+	"netgoat.xyz/agent/internal/waf"
+)
+
+func TestListsRoundTripThroughDatabase(t *testing.T) {
+	db, err := database.Init(":memory:")
+	if err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	defer db.Close()
+
+	expired := time.Now().Add(-time.Minute)
+	later := time.Now().Add(time.Hour)
+	snapshot := &streaming.ConfigSnapshot{
+		ListsConfigured: true,
+		Lists: map[string]streaming.ListData{
+			"corp": {Description: "office egress", Entries: []streaming.ListEntryData{
+				{Value: "10.0.0.0/8"},
+				{Value: "AS64500", Comment: "backup ISP"},
+			}},
+			"banned": {Entries: []streaming.ListEntryData{
+				{Value: "203.0.113.9", ExpiresAt: &later},
+				{Value: "203.0.113.10", ExpiresAt: &expired},
+			}},
+			"empty": {},
+		},
+		WAFRulesConfigured: true,
+		WAFRules: map[string]streaming.WAFRuleData{
+			"banned": {Name: "banned", Expression: `IP in list("banned")`, Action: "BLOCK"},
+		},
+	}
+	if err := applySnapshotToDB(db, snapshot); err != nil {
+		t.Fatalf("applySnapshotToDB: %v", err)
+	}
+	store := lists.NewStore()
+	if err := store.Reload(db); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	set := store.Set()
+	if !set.Contains("corp", "10.4.5.6") || !set.Contains("corp", "AS64500") || !set.Has("empty") {
+		t.Fatal("stored lists were not loaded")
+	}
+	if !set.Contains("banned", "203.0.113.9") || set.Contains("banned", "203.0.113.10") {
+		t.Fatal("expired entries should not be stored")
+	}
+
+	engine := waf.NewEngine()
+	engine.UseLists(store)
+	if err := engine.Reload(db); err != nil {
+		t.Fatalf("engine.Reload: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+	if blocked, _ := engine.Check(req, false); !blocked {
+		t.Fatal(`IP in list("banned") should block a listed client`)
+	}
+
+	// A snapshot without lists leaves them alone; an explicit empty set
+	// removes them.
+	if err := applySnapshotToDB(db, &streaming.ConfigSnapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(db); err != nil || !store.Set().Has("corp") {
+		t.Fatalf("lists should survive a snapshot without lists: %v", err)
+	}
+	if err := applySnapshotToDB(db, &streaming.ConfigSnapshot{ListsConfigured: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(db); err != nil || store.Set().Has("corp") {
+		t.Fatalf("lists should be removed by an empty configured set: %v", err)
+	}
+}
+
+func TestRouteListPolicies(t *testing.T) {
+	db, err := database.Init(":memory:")
+	if err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	defer db.Close()
+
+	cfg := &config.Config{}
+	cfg.WAF.Lists = map[string][]string{
+		"office":  {"198.51.100.0/24"},
+		"blocked": {"198.51.100.66"},
+	}
+	cfg.Routes = map[string]config.Route{
+		"admin.example.test": {Target: "http://127.0.0.1:9001", AllowLists: []string{"office"}, DenyLists: []string{"blocked"}},
+		"www.example.test":   {Target: "http://127.0.0.1:9002", DenyLists: []string{"blocked"}},
+	}
+	if err := applySnapshotToDB(db, localConfigSnapshot(cfg)); err != nil {
+		t.Fatalf("applySnapshotToDB: %v", err)
+	}
+	resolver := database.NewRouteResolver()
+	if err := resolver.Reload(db); err != nil {
+		t.Fatal(err)
+	}
+	store := lists.NewStore()
+	if err := store.Reload(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		host, ip string
+		want     string
+	}{
+		{"admin.example.test", "198.51.100.7", ""},
+		{"admin.example.test", "198.51.100.66", "blocked"},
+		{"admin.example.test", "192.0.2.1", "allow"},
+		{"www.example.test", "192.0.2.1", ""},
+		{"www.example.test", "198.51.100.66", "blocked"},
+	} {
+		match, err := resolver.Resolve(tc.host, "/")
+		if err != nil {
+			t.Fatalf("Resolve(%s): %v", tc.host, err)
+		}
+		list, denied := routeListPolicy(store.Set(), match, tc.ip)
+		if denied != (tc.want != "") || list != tc.want {
+			t.Fatalf("%s from %s: list = %q denied = %v, want %q", tc.host, tc.ip, list, denied, tc.want)
+		}
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
@@ -17,8 +20,10 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -33,14 +38,21 @@ import (
 	"netgoat.xyz/agent/internal/config"
 	"netgoat.xyz/agent/internal/database"
 	"netgoat.xyz/agent/internal/debugoverlay"
+	"netgoat.xyz/agent/internal/geoip"
 	"netgoat.xyz/agent/internal/health"
 	"netgoat.xyz/agent/internal/honeypot"
+	"netgoat.xyz/agent/internal/jail"
 	"netgoat.xyz/agent/internal/koda2"
 	"netgoat.xyz/agent/internal/koda_waf"
+	"netgoat.xyz/agent/internal/lists"
 	"netgoat.xyz/agent/internal/metrics"
 	"netgoat.xyz/agent/internal/modeldl"
+	"netgoat.xyz/agent/internal/normalize"
+	"netgoat.xyz/agent/internal/ratelimit"
+	"netgoat.xyz/agent/internal/seclang"
 	"netgoat.xyz/agent/internal/streaming"
 	"netgoat.xyz/agent/internal/telemetry"
+	"netgoat.xyz/agent/internal/tlsfp"
 	"netgoat.xyz/agent/internal/traffic"
 	"netgoat.xyz/agent/internal/waf"
 )
@@ -51,6 +63,11 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "waf-test" {
+		// Rule evaluation logs are noise in a report; keep only real errors.
+		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+		os.Exit(runWAFTestCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
 	setupLogger("agent")
 
 	loadEnvFromFile(".env")
@@ -98,9 +115,9 @@ func main() {
 
 	log.Info().Msg("Applying initial configuration from snapshot")
 	localSnap := localConfigSnapshot(cfg)
-	if localSnap.RoutesConfigured {
+	if localSnap.RoutesConfigured || localSnap.WAFRulesConfigured || localSnap.ListsConfigured || localSnap.RateLimitPoliciesConfigured {
 		if err := applySnapshotToDB(db, localSnap); err != nil {
-			log.Error().Err(err).Msg("Failed to apply local routes")
+			log.Error().Err(err).Msg("Failed to apply local routes and rules")
 		}
 	}
 	initialSnap := streamMgr.GetSnapshot()
@@ -114,10 +131,19 @@ func main() {
 	if err := routeResolver.Reload(db); err != nil {
 		log.Fatal().Err(err).Msg("Failed to load initial route snapshot")
 	}
+	listStore := lists.NewStore()
+	if err := listStore.Reload(db); err != nil {
+		log.Error().Err(err).Msg("Failed to load initial lists")
+	}
 	wafEngine := waf.NewEngine()
+	wafEngine.UseLists(listStore)
 	if err := wafEngine.Reload(db); err != nil {
 		log.Error().Err(err).Msg("Failed to compile initial WAF rules")
 	}
+	rateLimitPolicies := ratelimit.NewStore()
+	if err := rateLimitPolicies.Reload(db); err != nil {
+		log.Error().Err(err).Msg("Failed to load initial rate limit policies")
+	}
 
 	if backupEvery := cfg.DatabaseBackupIntervalSeconds(); backupEvery > 0 {
 		startDatabaseBackupLoop(db, standbyPath, time.Duration(backupEvery)*time.Second)
@@ -163,9 +189,36 @@ func main() {
 		log.Info().Msg("No API_STREAM_URL configured, running in offline mode with local configuration")
 	}
 
-	go applyConfigUpdates(db, streamMgr, healthWorker, healthChecksEnabled, localSnap, wafEngine, routeResolver)
+	challengeStore := challenge.NewStore()
+	challengeMode := strings.ToLower(ifEmpty(strings.TrimSpace(cfg.Challenge.Mode), "interactive"))
+	switch challenge.Mode(challengeMode) {
+	case challenge.ModeInteractive, challenge.ModePoW, challenge.ModeManaged, challenge.ModeAccessible:
+	default:
+		log.Warn().Str("mode", cfg.Challenge.Mode).Msg("Unknown challenge mode; using interactive challenges")
+		challengeMode = "interactive"
+	}
+	challengeKeys, err := challengeKeyring(cfg.Challenge.Keys)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid challenge keys")
+	}
+	if cfg.Challenge.Stateless && challengeKeys == nil {
+		log.Warn().Msg("Stateless challenges without shared keys only verify on this agent until restart")
+	}
+	pipeline, err := challenge.NewPipeline(cfg.Challenge.Scoring.Weights, reputationLookup(listStore, cfg.Challenge.Scoring.ReputationLists))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid challenge scoring")
+	}
+	challengeStore.SetPipeline(pipeline)
+	challengeStore.SetThresholds(challengeThresholds(cfg.Challenge.Thresholds))
+	challengeStore.SetMode(challenge.Mode(challengeMode))
+	challengeStore.SetStateless(cfg.Challenge.Stateless)
+	challengeStore.SetClearance(challenge.NewClearance(challengeKeys, time.Duration(cfg.Challenge.ClearanceSeconds)*time.Second))
+	log.Info().Str("mode", challengeMode).Bool("stateless", cfg.Challenge.Stateless).Strs("keys", challengeStore.Clearance().Keys().IDs()).Dur("clearance", challengeStore.Clearance().TTL()).Msg("Challenge system initialized")
+
+	go applyConfigUpdates(db, streamMgr, healthWorker, healthChecksEnabled, localSnap, wafEngine, routeResolver, listStore, rateLimitPolicies, challengeStore)
 
 	pages := buildErrorPageStore(cfg)
+	go pages.Watch(context.Background(), time.Duration(ifZeroInt(cfg.ErrorPages.ReloadIntervalSeconds, 5))*time.Second)
 
 	var cacheStore *cache.Store
 	if cfg.Cache.Enabled {
@@ -179,12 +232,53 @@ func main() {
 		rateLimiter = traffic.NewRateLimiter(cfg.RateLimit.RequestsPerMinute, cfg.RateLimit.Burst)
 		log.Info().Int("requests_per_minute", ifZeroInt(cfg.RateLimit.RequestsPerMinute, 60)).Int("burst", ifZeroInt(cfg.RateLimit.Burst, cfg.RateLimit.RequestsPerMinute)).Str("key", ifEmpty(cfg.RateLimit.Key, "ip")).Msg("Rate limiting enabled")
 	}
+	if cfg.RateLimit.Cluster.Enabled {
+		cluster, err := ratelimit.NewCluster(ratelimit.ClusterConfig{
+			Node:     cfg.RateLimit.Cluster.Node,
+			Peers:    cfg.RateLimit.Cluster.Peers,
+			Secret:   cfg.RateLimit.Cluster.Secret,
+			Interval: time.Duration(ifZeroInt(cfg.RateLimit.Cluster.SyncIntervalMs, 1000)) * time.Millisecond,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid rate limit cluster")
+		}
+		if rateLimiter != nil {
+			cluster.Track("global", rateLimiter)
+		}
+		rateLimitPolicies.UseCluster(cluster)
+		http.Handle(ratelimit.GossipPath, cluster)
+		go cluster.Run(context.Background())
+		log.Info().Strs("peers", cfg.RateLimit.Cluster.Peers).Int("sync_interval_ms", ifZeroInt(cfg.RateLimit.Cluster.SyncIntervalMs, 1000)).Msg("Cluster-wide rate limiting enabled")
+	}
 
 	var requestQueue *traffic.Queue
 	if cfg.RequestQueue.Enabled {
 		timeout := time.Duration(ifZeroInt(cfg.RequestQueue.TimeoutSeconds, 5)) * time.Second
-		requestQueue = traffic.NewQueue(cfg.RequestQueue.MaxConcurrent, cfg.RequestQueue.MaxQueued, timeout)
-		log.Info().Int("max_concurrent", ifZeroInt(cfg.RequestQueue.MaxConcurrent, 1)).Int("max_queued", cfg.RequestQueue.MaxQueued).Dur("timeout", timeout).Msg("Request queue enabled")
+		classes := make([]traffic.QueueClass, 0, len(cfg.RequestQueue.Classes))
+		for _, class := range cfg.RequestQueue.Classes {
+			classes = append(classes, traffic.QueueClass{Name: class.Name, Weight: class.Weight})
+		}
+		requestQueue = traffic.NewPriorityQueue(traffic.QueueConfig{
+			MaxConcurrent:      cfg.RequestQueue.MaxConcurrent,
+			MaxQueued:          cfg.RequestQueue.MaxQueued,
+			MaxQueuedPerClient: cfg.RequestQueue.MaxQueuedPerClient,
+			Timeout:            timeout,
+			Classes:            classes,
+		})
+		log.Info().Int("max_concurrent", ifZeroInt(cfg.RequestQueue.MaxConcurrent, 1)).Int("max_queued", cfg.RequestQueue.MaxQueued).Int("max_queued_per_client", ifZeroInt(cfg.RequestQueue.MaxQueuedPerClient, max(cfg.RequestQueue.MaxQueued/10, 1))).Int("classes", len(classes)).Dur("timeout", timeout).Msg("Request queue enabled")
+	}
+
+	var adaptiveLimiters *traffic.AdaptiveLimiters
+	if cfg.AdaptiveConcurrency.Enabled {
+		adaptiveLimiters = traffic.NewAdaptiveLimiters(traffic.AdaptiveConfig{
+			InitialLimit: cfg.AdaptiveConcurrency.InitialLimit,
+			MinLimit:     cfg.AdaptiveConcurrency.MinLimit,
+			MaxLimit:     cfg.AdaptiveConcurrency.MaxLimit,
+			Tolerance:    cfg.AdaptiveConcurrency.Tolerance,
+			Smoothing:    cfg.AdaptiveConcurrency.Smoothing,
+			Backoff:      cfg.AdaptiveConcurrency.Backoff,
+		})
+		log.Info().Int("initial_limit", ifZeroInt(cfg.AdaptiveConcurrency.InitialLimit, 20)).Int("min_limit", ifZeroInt(cfg.AdaptiveConcurrency.MinLimit, 1)).Int("max_limit", ifZeroInt(cfg.AdaptiveConcurrency.MaxLimit, 1000)).Msg("Adaptive concurrency limiting enabled")
 	}
 
 	var bandwidthLimiter *traffic.BandwidthLimiter
@@ -193,6 +287,13 @@ func main() {
 		log.Info().Int("bytes_per_second", ifZeroInt(cfg.Bandwidth.BytesPerSecond, 1<<20)).Int("burst_bytes", ifZeroInt(cfg.Bandwidth.BurstBytes, cfg.Bandwidth.BytesPerSecond)).Str("key", ifEmpty(cfg.Bandwidth.Key, "ip")).Msg("Bandwidth limiting enabled")
 	}
 
+	tarpit := traffic.NewTarpit(traffic.TarpitConfig{
+		BytesPerSecond: cfg.Tarpit.BytesPerSecond,
+		MaxPerIP:       cfg.Tarpit.MaxPerIP,
+		MaxConnections: cfg.Tarpit.MaxConnections,
+		MaxDuration:    time.Duration(cfg.Tarpit.MaxSeconds) * time.Second,
+	})
+
 	var metricsRecorder *metrics.Recorder
 	if cfg.Metrics.Enabled {
 		metricsRecorder = metrics.NewRecorder()
@@ -202,6 +303,17 @@ func main() {
 		}
 		http.HandleFunc(metricsPath, metricsRecorder.ServeJSON)
 		http.HandleFunc(metricsPath+".prom", metricsRecorder.ServePrometheus)
+		metricsRecorder.SetWAFRuleStats(func() []metrics.WAFRuleStats {
+			return wafRuleMetrics(wafEngine.RuleStats())
+		})
+		metricsRecorder.SetTarpitStats(func() metrics.TarpitStats {
+			return tarpitMetrics(tarpit.Stats())
+		})
+		if adaptiveLimiters != nil {
+			metricsRecorder.SetConcurrencyStats(func() []metrics.ConcurrencyStats {
+				return concurrencyMetrics(adaptiveLimiters.Stats())
+			})
+		}
 		log.Info().Str("path", metricsPath).Str("prometheus_path", metricsPath+".prom").Msg("Metrics endpoint enabled")
 	}
 
@@ -296,8 +408,56 @@ func main() {
 		}
 	}
 
-	challengeStore := challenge.NewStore()
-	log.Info().Msg("Challenge system initialized")
+	var jails *jail.Manager
+	if cfg.Jails.Enabled {
+		rules := jailRules(cfg)
+		manager, err := jail.New(db, rules, cfg.Jails.IgnoreIPs)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid jail configuration")
+		}
+		jails = manager
+		go pruneJailBans(jails, time.Minute)
+		http.HandleFunc(jailBansPath, jailBansHandler(cfg, db, jails))
+		log.Info().Int("jails", len(rules)).Int("active_bans", len(jails.Bans())).Msg("Jails enabled")
+	}
+
+	var honeypots *honeypot.Engine
+	var canaries *honeypot.Ledger
+	if cfg.Honeypot {
+		traps, err := honeypotTraps(cfg)
+		if err == nil {
+			honeypots, err = honeypot.New(traps, []byte(cfg.Honeypots.CanarySecret), cfg.Honeypots.BodySampleBytes)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid honeypot configuration")
+		}
+		retention := time.Duration(ifZeroInt(cfg.Honeypots.CanaryRetentionDays, 90)) * 24 * time.Hour
+		canaries, err = honeypot.NewLedger(db, retention)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load honeypot canaries")
+		}
+		go pruneCanaries(canaries, time.Hour)
+		honeypots.OnHit(func(event honeypot.Event) {
+			if err := canaries.Record(event); err != nil {
+				log.Error().Err(err).Str("trap", event.Trap).Msg("Failed to record honeypot canaries")
+			}
+			recordHoneypotHit(jails, event)
+		})
+		honeypots.UseTarpit(tarpit)
+		log.Info().Int("traps", len(traps)).Msg("Honeypots enabled")
+	}
+
+	var geoResolver *geoip.Resolver
+	if len(cfg.GeoIP.Databases) > 0 {
+		resolver, err := geoip.NewResolver(cfg.GeoIP.Databases)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open GeoIP databases")
+		}
+		geoResolver = resolver
+		reloadEvery := time.Duration(ifZeroInt(cfg.GeoIP.ReloadIntervalSeconds, 60)) * time.Second
+		go geoResolver.Watch(context.Background(), reloadEvery)
+		log.Info().Strs("databases", cfg.GeoIP.Databases).Dur("reload_interval", reloadEvery).Msg("GeoIP enrichment enabled")
+	}
 
 	telemetryClient := telemetry.NewClient(telemetry.Config{
 		Enabled:   cfg.Telemetry.Enabled,
@@ -335,8 +495,9 @@ func main() {
 	telemetryClient.Start()
 	defer telemetryClient.Stop()
 
-	http.HandleFunc("/__netgoat/verify", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
+	http.HandleFunc(challenge.VerifyPath, func(w http.ResponseWriter, r *http.Request) {
+		alternative := r.Method == http.MethodGet && r.URL.Query().Get("alternative") == "accessible"
+		if r.Method != "POST" && !alternative {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
@@ -350,15 +511,21 @@ func main() {
 				binding = zeroTrustChallengeBinding(ip, result)
 			}
 		}
+		if alternative {
+			writeAccessibleChallenge(w, r, pages, challengeStore, challengeID, binding, ip)
+			return
+		}
 
 		verified := challengeStore.Verify(challengeID, answer, binding)
 		if !verified && binding != ip {
 			// Non-authentication error challenges remain bound to the client IP.
+			binding = ip
 			verified = challengeStore.Verify(challengeID, answer, ip)
 		}
 		if verified {
 			log.Info().Str("ip", ip).Str("challenge_id", challengeID).Msg("Challenge verified successfully")
-			redirectTo := safeLocalRedirect(r.Header.Get("Referer"), r.Host)
+			setClearanceCookie(w, r, challengeStore.Clearance(), binding)
+			redirectTo := safeLocalRedirect(ifEmpty(r.FormValue("return_to"), r.Header.Get("Referer")), r.Host)
 			http.Redirect(w, r, redirectTo, http.StatusFound)
 		} else {
 			log.Warn().Str("ip", ip).Str("challenge_id", challengeID).Msg("Challenge verification failed")
@@ -366,8 +533,33 @@ func main() {
 		}
 	})
 
+	http.HandleFunc(wafDryRunPath, wafDryRunHandler(cfg, db, wafEngine, listStore))
+
 	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
-		auth.HandleLogin(w, r, db)
+		clientIP := getClientIP(r)
+		if ban, banned := jails.Banned(clientIP); banned {
+			recordBlocked(metricsRecorder, "jail:"+ban.Jail)
+			writeBanned(w, ban)
+			return
+		}
+		decision := checkRateLimitPolicies(rateLimitPolicies, metricsRecorder, jails, r, ratelimit.Identity{ClientIP: clientIP})
+		if !decision.Allowed {
+			traffic.SetRateLimitHeaders(w.Header(), decision.Quotas)
+			writeError(w, pages, challengeStore, r, http.StatusTooManyRequests, "Too Many Requests")
+			return
+		}
+		if cfg.RateLimit.Headers {
+			traffic.SetRateLimitHeaders(w.Header(), decision.Quotas)
+		}
+		if jails == nil {
+			auth.HandleLogin(w, r, db)
+			return
+		}
+		statusWriter := metrics.WrapResponseWriter(w)
+		auth.HandleLogin(statusWriter, r, db)
+		if statusWriter.Status() == http.StatusUnauthorized {
+			recordJailEvent(jails, clientIP, jail.EventLoginFailure)
+		}
 	})
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -380,18 +572,56 @@ func main() {
 				metricsRecorder.RecordResponse(metricWriter.Status(), metricWriter.BytesWritten(), time.Since(startTime))
 			}()
 		}
+
+		// Banned clients are refused before any other work is done for them.
+		clientIP := getClientIP(r)
+		if ban, banned := jails.Banned(clientIP); banned {
+			recordBlocked(metricsRecorder, "jail:"+ban.Jail)
+			log.Debug().Str("ip", clientIP).Str("jail", ban.Jail).Msg("Request from banned client refused")
+			if jails.Tarpits(ban) {
+				var release func()
+				w, release = holdTarpit(tarpit, w, r, clientIP)
+				defer release()
+			}
+			writeBanned(w, ban)
+			return
+		}
+		if jails != nil {
+			statusWriter := metrics.WrapResponseWriter(w)
+			w = statusWriter
+			defer func() {
+				if statusWriter.Status() == http.StatusNotFound {
+					recordJailEvent(jails, clientIP, jail.EventNotFound)
+				}
+			}()
+		}
 		if bandwidthLimiter != nil {
 			key := rateLimitKey(r, cfg.Bandwidth.Key)
 			r.Body = traffic.WrapReadCloser(r.Body, bandwidthLimiter, key+":in", r.Context())
 			w = traffic.WrapResponseWriter(w, bandwidthLimiter, key+":out", r.Context())
 		}
 
+		for _, sighting := range canaries.Find(r) {
+			recordCanaryUse(metricsRecorder, r, clientIP, sighting)
+		}
+
+		// Every later decision and the route lookup use the canonical path,
+		// while the upstream gets the path as the client escaped it. URLs
+		// without an unambiguous form are refused.
+		r, canonicalURL, err := normalize.Request(r)
+		if err != nil {
+			recordBlocked(metricsRecorder, "ambiguous-encoding")
+			log.Warn().Err(err).Str("ip", getClientIP(r)).Str("host", r.Host).Msg("Rejected request with ambiguous URL encoding")
+			writeError(w, pages, challengeStore, r, http.StatusBadRequest, "Bad Request")
+			return
+		}
+
 		analysisInfo := &debugoverlay.AnalysisInfo{
-			RequestID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+			RequestID:        newRequestID(),
 			Timestamp:        startTime,
 			ClientIP:         getClientIP(r),
 			Host:             r.Host,
-			Path:             r.URL.Path,
+			Path:             canonicalURL.Path,
 			Method:           r.Method,
 			RequestAllowed:   true,
 			AIEnabled:        detector != nil,
@@ -401,7 +631,10 @@ func main() {
 			Koda2Enabled:     koda2Detector != nil,
 			Koda2Threshold:   ifZero(cfg.Koda2.Threshold, 0.7),
 		}
+		suspicion := &suspicionState{analysis: analysisInfo}
+		r = withSuspicionState(r, suspicion)
 
+		var username string
 		if cfg.Auth.Enabled {
 			authResult := auth.Check(r, db)
 			if !authResult.Authenticated {
@@ -413,44 +646,65 @@ func main() {
 				return
 			}
 			challengeBinding := zeroTrustChallengeBinding(getClientIP(r), authResult)
-			if auth.RequireZeroTrustChallenge(authResult, database.IsZeroTrustEnabled(db), challengeStore.IsVerified(challengeBinding)) {
+			zeroTrustVerified := challengeStore.IsVerified(challengeBinding) || hasClearance(r, challengeStore.Clearance(), challengeBinding)
+			if auth.RequireZeroTrustChallenge(authResult, database.IsZeroTrustEnabled(db), zeroTrustVerified) {
 				analysisInfo.RequestAllowed = false
 				analysisInfo.BlockReason = "zero-trust verification required"
 				recordBlocked(metricsRecorder, "zero-trust")
 				log.Info().Str("user", authResult.Username).Str("ip", getClientIP(r)).Msg("Zero-trust challenge required")
-				writeZeroTrustChallenge(w, challengeStore, r, challengeBinding)
+				writeZeroTrustChallenge(w, pages, challengeStore, r, challengeBinding)
 				return
 			}
+			username = authResult.Username
+		}
+
+		if honeypots.Check(w, r, clientIP) {
+			analysisInfo.RequestAllowed = false
+			analysisInfo.BlockReason = "honeypot"
+			recordBlocked(metricsRecorder, "honeypot")
+			return
 		}
 
-		if cfg.Honeypot {
-			if honeypot.Check(w, r) {
-				log.Warn().Str("ip", r.RemoteAddr).Str("path", r.URL.Path).Msg("Honeypot triggered")
+		var rateQuotas []traffic.RateLimitQuota
+		if rateLimiter != nil {
+			key := rateLimitKey(r, cfg.RateLimit.Key)
+			status := rateLimiter.Take(key)
+			suspicion.rateUsage = rateLimiter.Usage(key)
+			rateQuotas = append(rateQuotas, traffic.RateLimitQuota{Name: "global", RateLimitStatus: status})
+			if !status.Allowed {
+				analysisInfo.RequestAllowed = false
+				analysisInfo.BlockReason = "rate limit exceeded"
+				recordBlocked(metricsRecorder, "rate-limit")
+				recordJailEvent(jails, clientIP, jail.EventRateLimit)
+				log.Warn().Str("ip", getClientIP(r)).Str("host", r.Host).Str("path", r.URL.Path).Dur("retry_after", status.RetryAfter).Msg("Request rate limited")
+				traffic.SetRateLimitHeaders(w.Header(), rateQuotas)
+				writeError(w, pages, challengeStore, r, http.StatusTooManyRequests, "Too Many Requests")
 				return
 			}
 		}
 
-		if rateLimiter != nil && !rateLimiter.Allow(rateLimitKey(r, cfg.RateLimit.Key)) {
-			analysisInfo.RequestAllowed = false
-			analysisInfo.BlockReason = "rate limit exceeded"
-			recordBlocked(metricsRecorder, "rate-limit")
-			log.Warn().Str("ip", getClientIP(r)).Str("host", r.Host).Str("path", r.URL.Path).Msg("Request rate limited")
-			writeError(w, pages, challengeStore, r, http.StatusTooManyRequests, "Too Many Requests")
-			return
+		host := r.Host
+		if idx := strings.LastIndex(host, ":"); idx > 0 {
+			host = host[:idx]
 		}
+		log.Debug().Str("host", host).Str("method", r.Method).Str("path", r.URL.Path).Msg("Processing request")
 
+		// The route is resolved before the detectors and the WAF so the queue
+		// can class by it and per-route scoring thresholds apply; unrouted
+		// requests are still screened before the 404.
+		routeMatch, err := routeResolver.Resolve(host, canonicalURL.Path)
+
+		client := clientAddressResolver.Resolve(r)
+
+		// The queue admits requests before the detectors and the WAF run, so
+		// the expensive stages only see as many requests as it lets through.
+		// Classes that need WAF categories are settled once the WAF has run.
+		queueClass := ""
 		if requestQueue != nil {
-			release, err := requestQueue.Acquire(r.Context())
-			if err != nil {
-				analysisInfo.RequestAllowed = false
-				analysisInfo.BlockReason = "request queue full"
-				status := http.StatusServiceUnavailable
-				if errors.Is(err, traffic.ErrQueueFull) {
-					status = http.StatusTooManyRequests
-				}
-				recordBlocked(metricsRecorder, "request-queue")
-				log.Warn().Err(err).Str("ip", getClientIP(r)).Str("host", r.Host).Str("path", r.URL.Path).Msg("Request rejected by queue")
-				writeError(w, pages, challengeStore, r, status, http.StatusText(status))
+			queueClass = requestQueueClass(cfg.RequestQueue.Classes, r, routeMatch.RouteKey, username, nil)
+			release, qerr := requestQueue.AcquireClass(r.Context(), queueClass, client.ClientIP)
+			if qerr != nil {
+				rejectQueuedRequest(w, pages, challengeStore, r, metricsRecorder, analysisInfo, qerr, queueClass, client.ClientIP)
 				return
 			}
 			defer release()
@@ -558,26 +812,96 @@ func main() {
 			}
 		}
 
+		geo := geoResolver.Lookup(client.ClientIP)
+		fingerprint := tlsfp.FromRequest(r)
+		analysisInfo.Country, analysisInfo.City = geo.Country, geo.City
+		analysisInfo.ASN, analysisInfo.ASOrg = geo.ASN, geo.ASOrg
+		policyIdentity := ratelimit.Identity{ClientIP: client.ClientIP, User: username}
+		if err == nil {
+			policyIdentity.RouteKey = routeMatch.RouteKey
+		}
+		policyDecision := checkRateLimitPolicies(rateLimitPolicies, metricsRecorder, jails, r, policyIdentity)
+		suspicion.rateUsage = max(suspicion.rateUsage, policyDecision.Usage)
+		rateQuotas = append(rateQuotas, policyDecision.Quotas...)
+		if !policyDecision.Allowed {
+			analysisInfo.RequestAllowed = false
+			analysisInfo.BlockReason = "rate limit policy: " + policyDecision.Policy
+			traffic.SetRateLimitHeaders(w.Header(), rateQuotas)
+			writeError(w, pages, challengeStore, r, http.StatusTooManyRequests, "Too Many Requests")
+			return
+		}
+		if cfg.RateLimit.Headers {
+			traffic.SetRateLimitHeaders(w.Header(), rateQuotas)
+		}
+		if err == nil {
+			suspicion.thresholds = challengeThresholds(routeMatch.ChallengeThresholds)
+			if list, denied := routeListPolicy(listStore.Set(), routeMatch, client.ClientIP); denied {
+				analysisInfo.RequestAllowed = false
+				analysisInfo.BlockReason = "route list policy: " + list
+				recordBlocked(metricsRecorder, "list:"+list)
+				log.Warn().Str("list", list).Str("route", routeMatch.RouteKey).Str("ip", client.ClientIP).Str("host", r.Host).Msg("Request blocked by route list policy")
+				writeError(w, pages, challengeStore, r, http.StatusForbidden, "Forbidden")
+				return
+			}
+			if country, denied := routeCountryPolicy(routeMatch, geo.Country); denied {
+				analysisInfo.RequestAllowed = false
+				analysisInfo.BlockReason = "route country policy: " + country
+				recordBlocked(metricsRecorder, "country:"+country)
+				log.Warn().Str("country", country).Uint32("asn", geo.ASN).Str("route", routeMatch.RouteKey).Str("ip", client.ClientIP).Str("host", r.Host).Msg("Request blocked by route country policy")
+				writeError(w, pages, challengeStore, r, http.StatusForbidden, "Forbidden")
+				return
+			}
+		}
+
 		analysisInfo.WAFChecked = true
-		block, ruleName := wafEngine.Check(r, cfg.DebugLogs)
-		if block {
+		wafOptions := waf.Options{
+			Scoring:          cfg.WAFScoringEnabled(),
+			InboundThreshold: cfg.WAF.InboundThreshold,
+			DebugLogs:        cfg.DebugLogs,
+			Username:         username,
+			Client:           client,
+			EncodingFlags:    canonicalURL.Flags,
+			Geo:              geo,
+		}
+		if err == nil {
+			wafOptions.RouteKey = routeMatch.RouteKey
+			if routeMatch.WAFInboundThreshold > 0 {
+				wafOptions.InboundThreshold = routeMatch.WAFInboundThreshold
+			}
+		}
+		wafDecision := wafEngine.Evaluate(r, wafOptions)
+		analysisInfo.WAFScore = wafDecision.Score
+		analysisInfo.WAFScoreThreshold = wafDecision.Threshold
+		analysisInfo.WAFScoreCategories = wafDecision.Categories
+		analysisInfo.WAFContributingRules = wafDecision.ContributingRules()
+		analysisInfo.WAFShadowRules = wafDecision.ShadowMatches
+		if metricsRecorder != nil && wafDecision.Score > 0 {
+			metricsRecorder.RecordWAFScore(wafDecision.Score, analysisInfo.WAFContributingRules)
+		}
+		if len(wafDecision.ShadowMatches) > 0 {
+			log.Info().Strs("shadow_rules", wafDecision.ShadowMatches).Bool("blocked", wafDecision.Blocked).Str("ip", wafOptions.Client.ClientIP).Str("host", r.Host).Str("path", r.URL.Path).Msg("WAF shadow rules matched")
+		}
+		if wafDecision.Blocked {
+			ruleName := wafDecision.Rule
 			analysisInfo.WAFBlocked = true
 			analysisInfo.WAFRuleName = ruleName
 			analysisInfo.RequestAllowed = false
 			analysisInfo.BlockReason = fmt.Sprintf("WAF rule triggered: %s", ruleName)
+			if ruleName == waf.AnomalyRuleName {
+				analysisInfo.BlockReason = fmt.Sprintf("WAF anomaly score %d reached threshold %d", wafDecision.Score, wafDecision.Threshold)
+			}
 			recordBlocked(metricsRecorder, "waf:"+ruleName)
-			log.Warn().Str("rule", ruleName).Str("ip", r.RemoteAddr).Str("host", r.Host).Msg("Request blocked by WAF")
+			recordJailEvent(jails, clientIP, jail.EventWAF)
+			log.Warn().Str("rule", ruleName).Int("score", wafDecision.Score).Strs("contributing_rules", analysisInfo.WAFContributingRules).Str("ip", wafOptions.Client.ClientIP).Str("peer", wafOptions.Client.PeerIP).Str("country", geo.Country).Uint32("asn", geo.ASN).Str("ja4", fingerprint.JA4).Bool("tarpit", wafDecision.Tarpit).Str("host", r.Host).Msg("Request blocked by WAF")
+			if wafDecision.Tarpit {
+				var release func()
+				w, release = holdTarpit(tarpit, w, r, clientIP)
+				defer release()
+			}
 			writeError(w, pages, challengeStore, r, http.StatusForbidden, "Forbidden")
 			return
 		}
 
-		host := r.Host
-		if idx := strings.LastIndex(host, ":"); idx > 0 {
-			host = host[:idx]
-		}
-		log.Debug().Str("host", host).Str("method", r.Method).Str("path", r.URL.Path).Msg("Processing request")
-
-		routeMatch, err := routeResolver.Resolve(host, r.URL.Path)
 		if err != nil {
 			log.Warn().Err(err).Str("host", host).Str("path", r.URL.Path).Msg("No route found for domain or path")
 			writeError(w, pages, challengeStore, r, http.StatusNotFound, "No route found")
@@ -589,15 +913,25 @@ func main() {
 			return
 		}
 
+		// A request whose WAF categories put it in a lower class keeps its
+		// slot, but the slot is charged to that class.
+		if requestQueue != nil {
+			requestQueue.Reclassify(queueClass, requestQueueClass(cfg.RequestQueue.Classes, r, routeMatch.RouteKey, username, wafDecision.Categories))
+		}
+
 		targetURLs := make([]string, 0, len(routeMatch.Targets))
 		for _, t := range routeMatch.Targets {
 			targetURLs = append(targetURLs, t.URL)
 		}
 		primaryTarget := targetURLs[0]
 
-		log.Info().Str("host", host).Str("path", r.URL.Path).Str("target", primaryTarget).Int("targets", len(targetURLs)).Str("method", r.Method).Msg("Route resolved")
+		log.Info().Str("host", host).Str("path", r.URL.Path).Str("target", primaryTarget).Int("targets", len(targetURLs)).Str("method", r.Method).Str("country", geo.Country).Uint32("asn", geo.ASN).Str("ja4", fingerprint.JA4).Msg("Route resolved")
 
 		analysisInfo.TargetURL = primaryTarget
+		if cfg.DebugOverlay {
+			// Allowed requests are scored too so the overlay shows near misses.
+			scoreSuspicion(challengeStore, r)
+		}
 
 		if r.Header.Get("Upgrade") == "websocket" {
 			log.Info().Str("client", r.RemoteAddr).Str("host", host).Msg("WebSocket upgrade detected")
@@ -630,8 +964,31 @@ func main() {
 			}
 		}
 
+		var (
+			proxyErr       error
+			upstreamStatus int
+			upstreamRTT    time.Duration
+		)
+		proxyStart := time.Now()
+		if limiter := adaptiveLimiters.Get(routeMatch.RouteKey); limiter != nil {
+			release, ok := limiter.Acquire()
+			if !ok {
+				analysisInfo.RequestAllowed = false
+				analysisInfo.BlockReason = "upstream concurrency limit reached"
+				recordBlocked(metricsRecorder, "adaptive-concurrency")
+				log.Warn().Str("route", routeMatch.RouteKey).Int("limit", limiter.Limit()).Str("ip", getClientIP(r)).Str("host", r.Host).Str("path", r.URL.Path).Msg("Request shed by adaptive concurrency limit")
+				w.Header().Set("Retry-After", "1")
+				writeError(w, pages, challengeStore, r, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+				return
+			}
+			defer func() {
+				release(upstreamRTT, adaptiveOutcome(r.Context(), upstreamStatus, proxyErr))
+			}()
+		}
+
 		prepareForwardingHeaders(r, getClientIP(r))
-		if err := proxyHandler.Serve(w, r, routeMatch.RouteKey, targetURLs, func(res *http.Response) error {
+		if proxyErr = proxyHandler.Serve(w, r, routeMatch.RouteKey, targetURLs, func(res *http.Response) error {
+			upstreamStatus, upstreamRTT = res.StatusCode, time.Since(proxyStart)
 			if cfg.DebugOverlay && shouldInjectOverlay(res) {
 				body, err := io.ReadAll(res.Body)
 				if err != nil {
@@ -671,15 +1028,15 @@ func main() {
 			}
 
 			return nil
-		}); err != nil {
+		}); proxyErr != nil {
 			status := http.StatusBadGateway
-			if isTimeoutErr(err) {
+			if isTimeoutErr(proxyErr) {
 				status = http.StatusGatewayTimeout
 			}
 			if metricsRecorder != nil {
-				metricsRecorder.RecordProxyError(err)
+				metricsRecorder.RecordProxyError(proxyErr)
 			}
-			log.Error().Err(err).Int("status", status).Str("host", host).Str("path", r.URL.Path).Msg("Failed to proxy request to upstream")
+			log.Error().Err(proxyErr).Int("status", status).Str("host", host).Str("path", r.URL.Path).Msg("Failed to proxy request to upstream")
 			writeError(w, pages, challengeStore, r, status, http.StatusText(status))
 		}
 	})
@@ -703,8 +1060,15 @@ func main() {
 			port = ":8443"
 		}
 		server.Addr = port
+		listener, err := net.Listen("tcp", port)
+		if err != nil {
+			log.Fatal().Err(err).Str("port", port).Msg("Failed to listen")
+		}
+		// The listener records each ClientHello so requests carry their
+		// JA3/JA4 fingerprints.
+		server.ConnContext = tlsfp.ConnContext
 		log.Info().Str("port", port).Msg("Reverse proxy listening (HTTPS)")
-		serveErr = server.ListenAndServeTLS(cfg.SSL.CertFile, cfg.SSL.KeyFile)
+		serveErr = server.ServeTLS(tlsfp.NewListener(listener), cfg.SSL.CertFile, cfg.SSL.KeyFile)
 	} else {
 		port := ":8080"
 		server.Addr = port
@@ -735,7 +1099,7 @@ func metricsEndpointPath(configured string) (string, bool) {
 		return fallback, false
 	}
 	switch path {
-	case "/", "/login", "/__netgoat/verify":
+	case "/", "/login", challenge.VerifyPath, wafDryRunPath:
 		return fallback, false
 	}
 	for _, char := range path {
@@ -796,18 +1160,30 @@ func logLevelColor(level string) string {
 	}
 }
 
+// errorPageStore holds the page templates for errors and challenges. Each
+// configured file is layered over the built-in pages (see
+// challenge.ParseTemplates) and re-read when it changes.
 type errorPageStore struct {
-	def    []byte
-	byHost map[string][]byte
-	byPath map[string][]byte
+	def    *pageFile
+	byHost map[string]*pageFile
+	byPath map[string]*pageFile
+}
+
+// pageFile is a template file and its last good parse. Only the store's
+// watcher reloads it after startup.
+type pageFile struct {
+	path      string
+	modTime   time.Time
+	size      int64
+	templates atomic.Pointer[challenge.Templates]
 }
 
 func buildErrorPageStore(cfg *config.Config) *errorPageStore {
-	s := &errorPageStore{byHost: map[string][]byte{}, byPath: map[string][]byte{}}
+	s := &errorPageStore{byHost: map[string]*pageFile{}, byPath: map[string]*pageFile{}}
 	if cfg.CustomErrorPage != "" {
-		if b, err := os.ReadFile(cfg.CustomErrorPage); err == nil {
-			s.def = b
-			log.Info().Str("path", cfg.CustomErrorPage).Int("bytes", len(b)).Msg("Loaded default error page")
+		s.def = &pageFile{path: cfg.CustomErrorPage}
+		if _, err := s.def.reload(); err == nil {
+			log.Info().Str("path", cfg.CustomErrorPage).Int64("bytes", s.def.size).Msg("Loaded default error page")
 		} else if !errors.Is(err, fs.ErrNotExist) {
 			log.Warn().Err(err).Str("path", cfg.CustomErrorPage).Msg("Failed to read default error page")
 		}
@@ -816,8 +1192,9 @@ func buildErrorPageStore(cfg *config.Config) *errorPageStore {
 		if p == "" {
 			continue
 		}
-		if b, err := os.ReadFile(p); err == nil {
-			s.byHost[strings.ToLower(host)] = b
+		file := &pageFile{path: p}
+		s.byHost[strings.ToLower(host)] = file
+		if _, err := file.reload(); err == nil {
 			log.Info().Str("host", host).Str("path", p).Msg("Loaded host error page")
 		} else {
 			log.Warn().Err(err).Str("host", host).Str("path", p).Msg("Failed to read host error page")
@@ -827,8 +1204,9 @@ func buildErrorPageStore(cfg *config.Config) *errorPageStore {
 		if p == "" {
 			continue
 		}
-		if b, err := os.ReadFile(p); err == nil {
-			s.byPath[prefix] = b
+		file := &pageFile{path: p}
+		s.byPath[prefix] = file
+		if _, err := file.reload(); err == nil {
 			log.Info().Str("prefix", prefix).Str("path", p).Msg("Loaded path error page")
 		} else {
 			log.Warn().Err(err).Str("prefix", prefix).Str("path", p).Msg("Failed to read path error page")
@@ -837,66 +1215,353 @@ func buildErrorPageStore(cfg *config.Config) *errorPageStore {
 	return s
 }
 
-func (s *errorPageStore) pick(r *http.Request) []byte {
-	if s == nil {
-		return nil
+func (f *pageFile) reload() (bool, error) {
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	if f.templates.Load() != nil && stat.ModTime().Equal(f.modTime) && stat.Size() == f.size {
+		return false, nil
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	templates, err := challenge.ParseTemplates(string(b))
+	if err != nil {
+		return false, err
+	}
+	f.templates.Store(templates)
+	f.modTime, f.size = stat.ModTime(), stat.Size()
+	return true, nil
+}
+
+func (s *errorPageStore) files() []*pageFile {
+	var files []*pageFile
+	if s.def != nil {
+		files = append(files, s.def)
+	}
+	for _, f := range s.byHost {
+		files = append(files, f)
+	}
+	for _, f := range s.byPath {
+		files = append(files, f)
+	}
+	return files
+}
+
+// Reload re-reads template files whose size or modification time changed.
+// A file that is missing or fails to parse keeps serving its previous
+// templates.
+func (s *errorPageStore) Reload() {
+	for _, f := range s.files() {
+		reloaded, err := f.reload()
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Warn().Err(err).Str("path", f.path).Msg("Failed to reload error page template; keeping the previous copy")
+			}
+			continue
+		}
+		if reloaded {
+			log.Info().Str("path", f.path).Msg("Error page template reloaded")
+		}
+	}
+}
+
+// Watch calls Reload every interval until ctx is done.
+func (s *errorPageStore) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 || len(s.files()) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Reload()
+		}
 	}
-	if b, ok := s.byHost[strings.ToLower(r.Host)]; ok && len(b) > 0 {
-		return b
+}
+
+// pick returns the templates for a request: the longest matching path
+// prefix, then the host, then the default file, then the built-in pages.
+func (s *errorPageStore) pick(r *http.Request) *challenge.Templates {
+	if s == nil {
+		return challenge.DefaultTemplates()
 	}
 	bestLen := -1
-	var chosen []byte
-	for prefix, b := range s.byPath {
-		if strings.HasPrefix(r.URL.Path, prefix) {
-			if l := len(prefix); l > bestLen && len(b) > 0 {
-				bestLen = l
-				chosen = b
+	var chosen *challenge.Templates
+	for prefix, f := range s.byPath {
+		if strings.HasPrefix(normalize.CanonicalPath(r), prefix) {
+			if t := f.templates.Load(); t != nil && len(prefix) > bestLen {
+				bestLen = len(prefix)
+				chosen = t
 			}
 		}
 	}
 	if chosen != nil {
 		return chosen
 	}
-	return s.def
+	if f, ok := s.byHost[strings.ToLower(r.Host)]; ok {
+		if t := f.templates.Load(); t != nil {
+			return t
+		}
+	}
+	if s.def != nil {
+		if t := s.def.templates.Load(); t != nil {
+			return t
+		}
+	}
+	return challenge.DefaultTemplates()
 }
 
 func writeError(w http.ResponseWriter, pages *errorPageStore, store *challenge.Store, r *http.Request, status int, fallback string) {
 	ip := getClientIP(r)
 	userAgent := r.UserAgent()
+	page := newErrorPage(r, nil, status, fallback)
 
-	if store.IsVerified(ip) {
-		if p := pages.pick(r); len(p) > 0 && isHTML(p) {
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.WriteHeader(status)
-			_, _ = w.Write(p)
-			return
+	if !store.IsVerified(ip) && !hasClearance(r, store.Clearance(), ip) {
+		breakdown, challengeType := scoreSuspicion(store, r)
+
+		log.Info().Str("request_id", page.RequestID).Str("ip", ip).Str("user_agent", userAgent).Int("suspicion", breakdown.Total).Interface("suspicion_signals", breakdown.Points()).Str("challenge_type", string(challengeType)).Msg("Generating dynamic error page")
+
+		if challengeType != challenge.ChallengeNone {
+			page.Challenge = store.Create(ip, userAgent, breakdown.Total, challengeType)
 		}
-		http.Error(w, fallback, status)
+	}
+	writePage(w, r, pages, page)
+}
+
+// newErrorPage fills in a page with the request ID and block reason from
+// the request's analysis. Requests rejected before the handler built one
+// get a fresh ID.
+func newErrorPage(r *http.Request, ch *challenge.Challenge, status int, message string) challenge.Page {
+	page := challenge.NewPage(ch, status, message)
+	page.ClientIP = getClientIP(r)
+	if state, _ := r.Context().Value(suspicionStateKey{}).(*suspicionState); state != nil {
+		page.RequestID = state.analysis.RequestID
+		page.BlockReason = state.analysis.BlockReason
+	}
+	if page.RequestID == "" {
+		page.RequestID = newRequestID()
+	}
+	return page
+}
+
+// writePage sends problem details to clients that prefer JSON and renders
+// the request's page template for everyone else.
+func writePage(w http.ResponseWriter, r *http.Request, pages *errorPageStore, page challenge.Page) {
+	w.Header().Set("X-Request-Id", page.RequestID)
+	w.Header().Add("Vary", "Accept")
+	if format := negotiateErrorFormat(r.Header.Get("Accept")); format != "text/html" {
+		w.Header().Set("Content-Type", format)
+		w.WriteHeader(page.Status)
+		_ = json.NewEncoder(w).Encode(page.Problem())
 		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(page.Status)
+	if err := pages.pick(r).Render(w, page); err != nil {
+		log.Warn().Err(err).Str("request_id", page.RequestID).Msg("Error page template failed; serving the built-in page")
+		_ = challenge.DefaultTemplates().Render(w, page)
+	}
+}
+
+// negotiateErrorFormat picks text/html, application/problem+json or
+// application/json by the Accept header's quality values. HTML wins ties,
+// so browsers and clients sending */* get a page.
+func negotiateErrorFormat(accept string) string {
+	best, bestQ := "text/html", acceptQuality(accept, "text/html")
+	for _, format := range []string{"application/problem+json", "application/json"} {
+		if q := acceptQuality(accept, format); q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// acceptQuality is the quality an Accept header gives a media type, from
+// its most specific matching range; 0 when nothing matches. An empty header
+// accepts everything.
+func acceptQuality(accept, mediaType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		rangeType := strings.ToLower(strings.TrimSpace(params[0]))
+		var level int
+		switch rangeType {
+		case mediaType:
+			level = 2
+		case major + "/*":
+			level = 1
+		case "*/*":
+			level = 0
+		default:
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = min(max(parsed, 0), 1)
+				}
+			}
+		}
+		if level > specificity {
+			quality, specificity = q, level
+		}
+	}
+	return quality
+}
+
+// newRequestID returns a random ID that error pages show as a support
+// reference and logs record next to the request.
+func newRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// suspicionState is what the request handler has learned that the suspicion
+// pipeline uses: the analysis so far, the client's rate-limit usage and the
+// route's challenge thresholds. Requests rejected before the handler built
+// it are scored from the request alone.
+type suspicionState struct {
+	analysis   *debugoverlay.AnalysisInfo
+	rateUsage  float64
+	thresholds challenge.Thresholds
+}
+
+type suspicionStateKey struct{}
+
+func withSuspicionState(r *http.Request, state *suspicionState) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), suspicionStateKey{}, state))
+}
+
+// scoreSuspicion runs the store's pipeline on r, records the breakdown in
+// the request's analysis and picks the challenge.
+func scoreSuspicion(store *challenge.Store, r *http.Request) (challenge.Breakdown, challenge.ChallengeType) {
+	signals := challenge.Signals{
+		IP:          getClientIP(r),
+		UserAgent:   r.UserAgent(),
+		Header:      r.Header,
+		Fingerprint: tlsfp.FromRequest(r),
+	}
+	state, _ := r.Context().Value(suspicionStateKey{}).(*suspicionState)
+	var thresholds challenge.Thresholds
+	if state != nil {
+		signals.RateUsage = state.rateUsage
+		signals.Classifiers = classifierScores(state.analysis)
+		thresholds = state.thresholds
+	}
+	breakdown := store.Pipeline().Score(signals)
+	challengeType := store.ChallengeWith(breakdown.Total, thresholds)
+	if state != nil {
+		state.analysis.Suspicion = breakdown.Total
+		state.analysis.SuspicionSignals = breakdown.Points()
+		state.analysis.ChallengeType = string(challengeType)
+	}
+	return breakdown, challengeType
+}
 
-	suspicion := challenge.CalculateSuspicion(userAgent, ip)
-	challengeType := challenge.DetermineChallengeType(suspicion)
+// classifierScores collects the risk scores, from 0 to 1, of the models and
+// the WAF anomaly score that already ran on a request.
+func classifierScores(info *debugoverlay.AnalysisInfo) map[string]float64 {
+	scores := make(map[string]float64)
+	if info.KodaWafChecked && info.KodaWafError == "" {
+		scores["koda_waf"] = info.KodaWafScore
+	}
+	if info.AIChecked && info.AIError == "" {
+		scores["goatai"] = info.AIScore
+	}
+	if info.Koda2Checked && info.Koda2Error == "" {
+		scores["koda_2"] = info.Koda2Score
+	}
+	if info.WAFChecked && info.WAFScoreThreshold > 0 {
+		scores["waf"] = min(float64(info.WAFScore)/float64(info.WAFScoreThreshold), 1)
+	}
+	return scores
+}
 
-	log.Info().Str("ip", ip).Str("user_agent", userAgent).Int("suspicion", suspicion).Str("challenge_type", string(challengeType)).Msg("Generating dynamic error page")
+// reputationLookup reports which of the named lists contain an IP, for the
+// reputation signal; nil when no lists are named.
+func reputationLookup(store *lists.Store, names []string) func(ip string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	return func(ip string) []string {
+		set := store.Set()
+		var found []string
+		for _, name := range names {
+			if set.Contains(name, ip) {
+				found = append(found, name)
+			}
+		}
+		return found
+	}
+}
 
-	var ch *challenge.Challenge
-	if challengeType != challenge.ChallengeNone {
-		ch = store.Create(ip, userAgent, suspicion, challengeType)
+// challengeThresholds reads [text, click, slider] thresholds; missing or
+// zero entries are left for the next level to fill in.
+func challengeThresholds(values []int) challenge.Thresholds {
+	var t challenge.Thresholds
+	for i, target := range []*int{&t.Text, &t.Click, &t.Slider} {
+		if i < len(values) {
+			*target = values[i]
+		}
 	}
+	return t
+}
 
-	dynamicHTML := challenge.RenderDynamicErrorPage(ch, status, fallback)
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(status)
-	_, _ = w.Write([]byte(dynamicHTML))
+// setClearanceCookie gives a client that solved a challenge a signed cookie
+// so later checks for the same binding skip the challenge without
+// server-side state, on this agent or any other sharing its keys.
+func setClearanceCookie(w http.ResponseWriter, r *http.Request, clearance *challenge.Clearance, binding string) {
+	token, expires := clearance.Issue(binding, r.UserAgent())
+	http.SetCookie(w, &http.Cookie{
+		Name:     challenge.ClearanceCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func hasClearance(r *http.Request, clearance *challenge.Clearance, binding string) bool {
+	cookie, err := r.Cookie(challenge.ClearanceCookie)
+	return err == nil && clearance.Valid(cookie.Value, binding, r.UserAgent())
 }
 
-func writeZeroTrustChallenge(w http.ResponseWriter, store *challenge.Store, r *http.Request, binding string) {
+func writeZeroTrustChallenge(w http.ResponseWriter, pages *errorPageStore, store *challenge.Store, r *http.Request, binding string) {
 	ch := store.Create(binding, r.UserAgent(), 50, challenge.ChallengeText)
-	html := challenge.RenderDynamicErrorPage(ch, http.StatusForbidden, "Zero-trust verification required")
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusForbidden)
-	_, _ = w.Write([]byte(html))
+	writePage(w, r, pages, newErrorPage(r, ch, http.StatusForbidden, "Zero-trust verification required"))
+}
+
+// writeAccessibleChallenge swaps a pending challenge for the accessible
+// one. Error challenges are bound to the client IP even for signed-in
+// users, as in the verify handler.
+func writeAccessibleChallenge(w http.ResponseWriter, r *http.Request, pages *errorPageStore, store *challenge.Store, id, binding, ip string) {
+	ch, ok := store.Accessible(id, binding)
+	if !ok && binding != ip {
+		ch, ok = store.Accessible(id, ip)
+	}
+	if !ok {
+		writePage(w, r, pages, newErrorPage(r, nil, http.StatusGone, "This challenge has expired. Go back and reload the page."))
+		return
+	}
+	page := newErrorPage(r, ch, http.StatusForbidden, "Verification required")
+	if page.ReturnTo = safeLocalRedirect(r.Header.Get("Referer"), r.Host); strings.HasPrefix(page.ReturnTo, challenge.VerifyPath) {
+		page.ReturnTo = "/"
+	}
+	writePage(w, r, pages, page)
 }
 
 func zeroTrustChallengeBinding(ip string, result *auth.AuthResult) string {
@@ -906,11 +1571,6 @@ func zeroTrustChallengeBinding(ip string, result *auth.AuthResult) string {
 	return ip + "|user:" + strconv.Itoa(result.UserID)
 }
 
-func isHTML(b []byte) bool {
-	trimmed := strings.TrimSpace(strings.ToLower(string(b)))
-	return strings.HasPrefix(trimmed, "<") && (strings.Contains(trimmed, "<html") || strings.Contains(trimmed, "<body"))
-}
-
 func ifEmpty(v, def string) string {
 	if v == "" {
 		return def
@@ -924,6 +1584,14 @@ func ifZero(f, def float64) float64 {
 	return f
 }
 
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, ",")
+}
+
 func ifZeroInt(v int, def int) int {
 	if v == 0 {
 		return def
@@ -982,7 +1650,7 @@ func rateLimitKey(r *http.Request, keyMode string) string {
 	case "host":
 		return r.Host
 	case "route":
-		return r.Host + "|" + r.URL.Path
+		return r.Host + "|" + normalize.CanonicalPath(r)
 	case "global":
 		return "global"
 	default:
@@ -990,28 +1658,215 @@ func rateLimitKey(r *http.Request, keyMode string) string {
 	}
 }
 
-func recordBlocked(rec *metrics.Recorder, reason string) {
-	if rec != nil {
-		rec.RecordBlocked(reason)
+func wafRuleMetrics(stats []waf.RuleStats) []metrics.WAFRuleStats {
+	out := make([]metrics.WAFRuleStats, 0, len(stats))
+	for _, rule := range stats {
+		out = append(out, metrics.WAFRuleStats{
+			Rule:                  rule.Rule,
+			Action:                rule.Action,
+			Shadow:                rule.Shadow,
+			Evaluations:           rule.Evaluations,
+			Matches:               rule.Matches,
+			Errors:                rule.Errors,
+			EvaluationTimeSeconds: rule.EvaluationTime.Seconds(),
+		})
 	}
+	return out
 }
 
-func newStableProxyTransport() *http.Transport {
-	dialer := &net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 30 * time.Second,
+func tarpitMetrics(stats traffic.TarpitStats) metrics.TarpitStats {
+	return metrics.TarpitStats{
+		Active:       stats.Active,
+		Held:         stats.Held,
+		Rejected:     stats.Rejected,
+		BytesWritten: stats.Bytes,
+		HeldSeconds:  stats.Duration.Seconds(),
 	}
-	return &http.Transport{
-		Proxy:                 http.ProxyFromEnvironment,
-		DialContext:           dialer.DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          200,
-		MaxIdleConnsPerHost:   50,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		ResponseHeaderTimeout: 30 * time.Second,
-		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+}
+
+func concurrencyMetrics(stats []traffic.AdaptiveStats) []metrics.ConcurrencyStats {
+	out := make([]metrics.ConcurrencyStats, 0, len(stats))
+	for _, limit := range stats {
+		out = append(out, metrics.ConcurrencyStats{
+			Route:              limit.Key,
+			Limit:              limit.Limit,
+			InFlight:           limit.InFlight,
+			Shed:               limit.Shed,
+			Dropped:            limit.Dropped,
+			RTTSeconds:         limit.RTT.Seconds(),
+			BaselineRTTSeconds: limit.Baseline.Seconds(),
+		})
+	}
+	return out
+}
+
+// adaptiveOutcome tells the adaptive concurrency limiter how a proxied
+// request went. Failures and overload statuses back the limit off; a
+// request the client abandoned says nothing about the upstream.
+func adaptiveOutcome(ctx context.Context, status int, err error) traffic.Outcome {
+	switch {
+	case ctx.Err() != nil:
+		return traffic.OutcomeIgnored
+	case err != nil:
+		return traffic.OutcomeDropped
+	}
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return traffic.OutcomeDropped
+	}
+	return traffic.OutcomeSuccess
+}
+
+// rejectQueuedRequest answers a request the queue refused: 429 when the
+// backlog or the client's share of it is full, 503 when it was shed or timed
+// out waiting.
+func rejectQueuedRequest(w http.ResponseWriter, pages *errorPageStore, challengeStore *challenge.Store, r *http.Request, recorder *metrics.Recorder, analysisInfo *debugoverlay.AnalysisInfo, err error, class, clientIP string) {
+	analysisInfo.RequestAllowed = false
+	analysisInfo.BlockReason = "request queue full"
+	status := http.StatusServiceUnavailable
+	if errors.Is(err, traffic.ErrQueueFull) {
+		status = http.StatusTooManyRequests
+	}
+	recordBlocked(recorder, "request-queue")
+	log.Warn().Err(err).Str("class", ifEmpty(class, traffic.DefaultQueueClass)).Str("ip", clientIP).Str("host", r.Host).Str("path", r.URL.Path).Msg("Request rejected by queue")
+	writeError(w, pages, challengeStore, r, status, http.StatusText(status))
+}
+
+// requestQueueClass names the first of classes whose conditions all match
+// the request, or the first class without conditions when none does. It
+// returns "" when there is neither, which the queue takes as its default.
+func requestQueueClass(classes []config.RequestQueueClass, r *http.Request, routeKey, username string, wafCategories map[string]int) string {
+	fallback := ""
+	for _, class := range classes {
+		if len(class.Routes) == 0 && len(class.PathPrefixes) == 0 && !class.Authenticated && len(class.WAFCategories) == 0 && len(class.Headers) == 0 {
+			if fallback == "" {
+				fallback = class.Name
+			}
+			continue
+		}
+		if len(class.Routes) > 0 && !slices.Contains(class.Routes, routeKey) {
+			continue
+		}
+		if len(class.PathPrefixes) > 0 && !slices.ContainsFunc(class.PathPrefixes, func(prefix string) bool {
+			return strings.HasPrefix(normalize.CanonicalPath(r), prefix)
+		}) {
+			continue
+		}
+		if class.Authenticated && username == "" {
+			continue
+		}
+		if len(class.WAFCategories) > 0 && !slices.ContainsFunc(class.WAFCategories, func(category string) bool {
+			_, ok := wafCategories[strings.ToLower(category)]
+			return ok
+		}) {
+			continue
+		}
+		if !headersMatch(r.Header, class.Headers) {
+			continue
+		}
+		return class.Name
+	}
+	return fallback
+}
+
+// headersMatch reports whether h has every header in want, with the given
+// value or, for an empty value, any value.
+func headersMatch(h http.Header, want map[string]string) bool {
+	for name, value := range want {
+		got, ok := h[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "" && !slices.Contains(got, value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// routeListPolicy applies a route's deny and allow lists to the client IP.
+// A client in any deny list is rejected; when allow lists are set, a client
+// must appear in at least one of them. It returns the list that decided a
+// rejection, or "allow" when no allow list matched.
+func routeListPolicy(set *lists.Set, match *database.RouteMatch, ip string) (string, bool) {
+	if match == nil || (len(match.DenyLists) == 0 && len(match.AllowLists) == 0) {
+		return "", false
+	}
+	for _, name := range match.DenyLists {
+		if set.Contains(name, ip) {
+			return name, true
+		}
+	}
+	if len(match.AllowLists) == 0 {
+		return "", false
+	}
+	for _, name := range match.AllowLists {
+		if set.Contains(name, ip) {
+			return "", false
+		}
+	}
+	return "allow", true
+}
+
+// routeCountryPolicy applies a route's deny and allow countries to the
+// client's GeoIP country. Clients of unknown country are rejected only when
+// allow countries are set. It returns the rejected country code, or "unknown".
+func routeCountryPolicy(match *database.RouteMatch, country string) (string, bool) {
+	if match == nil || (len(match.DenyCountries) == 0 && len(match.AllowCountries) == 0) {
+		return "", false
+	}
+	if country != "" && slices.Contains(match.DenyCountries, country) {
+		return country, true
+	}
+	if len(match.AllowCountries) == 0 || (country != "" && slices.Contains(match.AllowCountries, country)) {
+		return "", false
+	}
+	return ifEmpty(country, "unknown"), true
+}
+
+// checkRateLimitPolicies takes a token from every rate limit policy matching
+// r, and records and logs the request when a policy refuses it.
+func checkRateLimitPolicies(store *ratelimit.Store, rec *metrics.Recorder, jails *jail.Manager, r *http.Request, id ratelimit.Identity) ratelimit.Decision {
+	decision := store.Allow(r, id)
+	if !decision.Allowed {
+		recordBlocked(rec, "rate-limit:"+decision.Policy)
+		recordJailEvent(jails, id.ClientIP, jail.EventRateLimit)
+		log.Warn().Str("policy", decision.Policy).Str("limit", decision.Limit.String()).Str("ip", id.ClientIP).Str("user", id.User).Str("route", id.RouteKey).
+			Str("method", r.Method).Str("host", r.Host).Str("path", r.URL.Path).Dur("retry_after", retryAfter(decision.Quotas)).Msg("Request rate limited by policy")
+	}
+	return decision
+}
+
+// retryAfter returns the longest wait of any quota that refused a request.
+func retryAfter(quotas []traffic.RateLimitQuota) time.Duration {
+	var wait time.Duration
+	for _, quota := range quotas {
+		if !quota.Allowed {
+			wait = max(wait, quota.RetryAfter)
+		}
+	}
+	return wait
+}
+
+func recordBlocked(rec *metrics.Recorder, reason string) {
+	if rec != nil {
+		rec.RecordBlocked(reason)
+	}
+}
+
+func newStableProxyTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          200,
+		MaxIdleConnsPerHost:   50,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
 	}
 }
 
@@ -1097,27 +1952,41 @@ type domainPollState struct {
 }
 
 type domainsResponse struct {
-	Domains          []domainRecord            `json:"domains"`
-	WAFRules         []wafRuleRecord           `json:"waf_rules"`
-	ZeroTrustEnabled *bool                     `json:"zero_trust_enabled"`
-	AgentConfig      streaming.AgentConfigData `json:"agent_config"`
+	Domains           []domainRecord                           `json:"domains"`
+	WAFRules          []wafRuleRecord                          `json:"waf_rules"`
+	Lists             map[string]streaming.ListData            `json:"lists"`
+	RateLimitPolicies map[string]streaming.RateLimitPolicyData `json:"rate_limit_policies"`
+	ZeroTrustEnabled  *bool                                    `json:"zero_trust_enabled"`
+	AgentConfig       streaming.AgentConfigData                `json:"agent_config"`
 }
 
 type domainRecord struct {
-	Domain         string            `json:"domain"`
-	TargetURL      string            `json:"target_url"`
-	TargetURLs     []string          `json:"target_urls"`
-	CertificatePEM string            `json:"certificate_pem"`
-	PrivateKeyPEM  string            `json:"private_key_pem"`
-	Active         any               `json:"active"`
-	Subdomains     []subdomainRecord `json:"subdomains"`
+	Domain              string            `json:"domain"`
+	TargetURL           string            `json:"target_url"`
+	TargetURLs          []string          `json:"target_urls"`
+	CertificatePEM      string            `json:"certificate_pem"`
+	PrivateKeyPEM       string            `json:"private_key_pem"`
+	Active              any               `json:"active"`
+	WAFInboundThreshold int               `json:"waf_inbound_threshold"`
+	AllowLists          []string          `json:"allow_lists"`
+	DenyLists           []string          `json:"deny_lists"`
+	AllowCountries      []string          `json:"allow_countries"`
+	DenyCountries       []string          `json:"deny_countries"`
+	ChallengeThresholds []int             `json:"challenge_thresholds"`
+	Subdomains          []subdomainRecord `json:"subdomains"`
 }
 
 type subdomainRecord struct {
-	FullDomain string   `json:"full_domain"`
-	TargetURL  string   `json:"target_url"`
-	TargetURLs []string `json:"target_urls"`
-	Active     any      `json:"active"`
+	FullDomain          string   `json:"full_domain"`
+	TargetURL           string   `json:"target_url"`
+	TargetURLs          []string `json:"target_urls"`
+	Active              any      `json:"active"`
+	WAFInboundThreshold int      `json:"waf_inbound_threshold"`
+	AllowLists          []string `json:"allow_lists"`
+	DenyLists           []string `json:"deny_lists"`
+	AllowCountries      []string `json:"allow_countries"`
+	DenyCountries       []string `json:"deny_countries"`
+	ChallengeThresholds []int    `json:"challenge_thresholds"`
 }
 
 type wafRuleRecord struct {
@@ -1126,8 +1995,13 @@ type wafRuleRecord struct {
 	Expression    string   `json:"expression"`
 	Action        string   `json:"action"`
 	Priority      int      `json:"priority"`
+	Score         int      `json:"score"`
+	Category      string   `json:"category"`
+	Shadow        bool     `json:"shadow"`
 	ProxyConfigID string   `json:"proxy_config_id"`
 	Hosts         []string `json:"hosts"`
+	Routes        []string `json:"routes"`
+	PathPrefixes  []string `json:"path_prefixes"`
 }
 
 func streamSettingsFromConfig(cfg *config.Config) streamPollSettings {
@@ -1258,13 +2132,17 @@ func pollDomains(ctx context.Context, mgr *streaming.Manager, domainsURL, apiKey
 
 func snapshotFromDomainsResponse(payload domainsResponse) streaming.ConfigSnapshot {
 	snapshot := streaming.ConfigSnapshot{
-		Routes:             make(map[string]streaming.RouteData),
-		RoutesConfigured:   payload.Domains != nil,
-		WAFRules:           make(map[string]streaming.WAFRuleData),
-		WAFRulesConfigured: payload.WAFRules != nil,
-		Users:              []streaming.UserData{},
-		UserDomains:        []streaming.UserDomainData{},
-		AgentConfig:        payload.AgentConfig,
+		Routes:                      make(map[string]streaming.RouteData),
+		RoutesConfigured:            payload.Domains != nil,
+		WAFRules:                    make(map[string]streaming.WAFRuleData),
+		WAFRulesConfigured:          payload.WAFRules != nil,
+		Lists:                       payload.Lists,
+		ListsConfigured:             payload.Lists != nil,
+		RateLimitPolicies:           payload.RateLimitPolicies,
+		RateLimitPoliciesConfigured: payload.RateLimitPolicies != nil,
+		Users:                       []streaming.UserData{},
+		UserDomains:                 []streaming.UserDomainData{},
+		AgentConfig:                 payload.AgentConfig,
 	}
 	if payload.ZeroTrustEnabled != nil {
 		snapshot.ZeroTrustEnabled = *payload.ZeroTrustEnabled
@@ -1274,11 +2152,17 @@ func snapshotFromDomainsResponse(payload domainsResponse) streaming.ConfigSnapsh
 	for _, domain := range payload.Domains {
 		if apiRecordActive(domain.Active) && strings.TrimSpace(domain.Domain) != "" {
 			snapshot.Routes[domain.Domain] = streaming.RouteData{
-				Type:           "domain",
-				Target:         domain.TargetURL,
-				Targets:        routeTargetsFromAPI(domain.TargetURL, domain.TargetURLs),
-				CertificatePEM: domain.CertificatePEM,
-				PrivateKeyPEM:  domain.PrivateKeyPEM,
+				Type:                "domain",
+				Target:              domain.TargetURL,
+				Targets:             routeTargetsFromAPI(domain.TargetURL, domain.TargetURLs),
+				CertificatePEM:      domain.CertificatePEM,
+				PrivateKeyPEM:       domain.PrivateKeyPEM,
+				WAFInboundThreshold: domain.WAFInboundThreshold,
+				AllowLists:          domain.AllowLists,
+				DenyLists:           domain.DenyLists,
+				AllowCountries:      domain.AllowCountries,
+				DenyCountries:       domain.DenyCountries,
+				ChallengeThresholds: domain.ChallengeThresholds,
 			}
 		}
 		for _, subdomain := range domain.Subdomains {
@@ -1286,9 +2170,15 @@ func snapshotFromDomainsResponse(payload domainsResponse) streaming.ConfigSnapsh
 				continue
 			}
 			snapshot.Routes[subdomain.FullDomain] = streaming.RouteData{
-				Type:    "domain",
-				Target:  subdomain.TargetURL,
-				Targets: routeTargetsFromAPI(subdomain.TargetURL, subdomain.TargetURLs),
+				Type:                "domain",
+				Target:              subdomain.TargetURL,
+				Targets:             routeTargetsFromAPI(subdomain.TargetURL, subdomain.TargetURLs),
+				WAFInboundThreshold: subdomain.WAFInboundThreshold,
+				AllowLists:          subdomain.AllowLists,
+				DenyLists:           subdomain.DenyLists,
+				AllowCountries:      subdomain.AllowCountries,
+				DenyCountries:       subdomain.DenyCountries,
+				ChallengeThresholds: subdomain.ChallengeThresholds,
 			}
 		}
 	}
@@ -1299,12 +2189,13 @@ func snapshotFromDomainsResponse(payload domainsResponse) streaming.ConfigSnapsh
 		if name == "" || strings.TrimSpace(rule.Expression) == "" {
 			continue
 		}
-		if rule.ProxyConfigID != "" && len(rule.Hosts) == 0 {
+		hosts := normalizedRuleHosts(rule.Hosts)
+		if (rule.ProxyConfigID != "" || len(rule.Hosts) > 0) && len(hosts) == 0 {
 			// Older or inconsistent control planes did not publish enough data to
-			// enforce a route scope. Skipping is safer than broadening to global.
+			// enforce a route scope, or only blank hosts. Skipping is safer than
+			// broadening to global.
 			continue
 		}
-		expression, hosts := scopedWAFExpression(rule.Expression, rule.Hosts)
 		if len(hosts) > 0 {
 			name += " [" + strings.Join(hosts, ",") + "]"
 		}
@@ -1319,17 +2210,27 @@ func snapshotFromDomainsResponse(payload domainsResponse) streaming.ConfigSnapsh
 			}
 			key = ifEmpty(strings.TrimSpace(rule.ID), name) + "#" + strconv.Itoa(suffix)
 		}
+		var scope *streaming.WAFRuleScope
+		if len(hosts) > 0 || len(rule.Routes) > 0 || len(rule.PathPrefixes) > 0 {
+			scope = &streaming.WAFRuleScope{Hosts: hosts, Routes: rule.Routes, PathPrefixes: rule.PathPrefixes}
+		}
 		snapshot.WAFRules[key] = streaming.WAFRuleData{
 			Name:       name,
-			Expression: expression,
+			Expression: rule.Expression,
 			Action:     ifEmpty(rule.Action, "BLOCK"),
 			Priority:   rule.Priority,
+			Score:      rule.Score,
+			Category:   rule.Category,
+			Shadow:     rule.Shadow,
+			Scope:      scope,
 		}
 	}
 	return snapshot
 }
 
-func scopedWAFExpression(expression string, rawHosts []string) (string, []string) {
+// normalizedRuleHosts lowercases and deduplicates the hosts a control-plane
+// rule is scoped to.
+func normalizedRuleHosts(rawHosts []string) []string {
 	seen := make(map[string]struct{}, len(rawHosts))
 	hosts := make([]string, 0, len(rawHosts))
 	for _, rawHost := range rawHosts {
@@ -1344,13 +2245,9 @@ func scopedWAFExpression(expression string, rawHosts []string) (string, []string
 		hosts = append(hosts, host)
 	}
 	if len(hosts) == 0 {
-		return expression, nil
-	}
-	conditions := make([]string, len(hosts))
-	for index, host := range hosts {
-		conditions[index] = "Host == " + strconv.Quote(host)
+		return nil
 	}
-	return "(" + strings.Join(conditions, " || ") + ") && (" + expression + ")", hosts
+	return hosts
 }
 
 func apiRecordActive(value any) bool {
@@ -1429,35 +2326,637 @@ func localConfigSnapshot(cfg *config.Config) *streaming.ConfigSnapshot {
 			continue
 		}
 		snapshot.Routes[key] = streaming.RouteData{
-			Type:           ifEmpty(strings.ToLower(strings.TrimSpace(route.Type)), "domain"),
-			Targets:        targets,
-			CertificatePEM: route.CertificatePEM,
-			PrivateKeyPEM:  route.PrivateKeyPEM,
+			Type:                ifEmpty(strings.ToLower(strings.TrimSpace(route.Type)), "domain"),
+			Targets:             targets,
+			CertificatePEM:      route.CertificatePEM,
+			PrivateKeyPEM:       route.PrivateKeyPEM,
+			WAFInboundThreshold: route.WAFInboundThreshold,
+			AllowLists:          route.AllowLists,
+			DenyLists:           route.DenyLists,
+			AllowCountries:      route.AllowCountries,
+			DenyCountries:       route.DenyCountries,
+			ChallengeThresholds: route.ChallengeThresholds,
+		}
+	}
+
+	if len(cfg.WAF.Lists) > 0 {
+		snapshot.Lists = make(map[string]streaming.ListData, len(cfg.WAF.Lists))
+		for name, values := range cfg.WAF.Lists {
+			entries := make([]streaming.ListEntryData, 0, len(values))
+			for _, value := range values {
+				entries = append(entries, streaming.ListEntryData{Value: value})
+			}
+			snapshot.Lists[name] = streaming.ListData{Entries: entries}
+		}
+		snapshot.ListsConfigured = true
+	}
+
+	if len(cfg.RateLimit.Policies) > 0 {
+		snapshot.RateLimitPolicies = make(map[string]streaming.RateLimitPolicyData, len(cfg.RateLimit.Policies))
+		for name, policy := range cfg.RateLimit.Policies {
+			limits := make([]streaming.RateLimitData, 0, len(policy.Limits))
+			for _, limit := range policy.Limits {
+				limits = append(limits, streaming.RateLimitData(limit))
+			}
+			snapshot.RateLimitPolicies[name] = streaming.RateLimitPolicyData{
+				Routes:       policy.Routes,
+				PathPrefixes: policy.PathPrefixes,
+				Methods:      policy.Methods,
+				Limits:       limits,
+			}
+		}
+		snapshot.RateLimitPoliciesConfigured = true
+	}
+
+	// SecLang rules replace every other WAF rule, so a set that failed to
+	// load or came out empty leaves the stored rules alone rather than
+	// running without any.
+	if len(cfg.WAF.SecLangFiles) > 0 {
+		rules, err := secLangWAFRules(cfg.WAF.SecLangFiles)
+		if err != nil {
+			log.Error().Err(err).Msg("Keeping the stored WAF rules")
+		} else {
+			snapshot.WAFRules = rules
+			snapshot.WAFRulesConfigured = true
 		}
 	}
 	return snapshot
 }
 
+// secLangWAFRules converts the configured SecLang files into WAF rules.
+// Rules that cannot be translated are logged individually; rule priorities
+// preserve file order because the engine evaluates by priority. It fails
+// when the files cannot be read or yield no rules.
+func secLangWAFRules(patterns []string) (map[string]streaming.WAFRuleData, error) {
+	result, err := seclang.LoadFiles(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("load SecLang rule files: %w", err)
+	}
+	for _, issue := range result.Issues {
+		log.Warn().Str("source", issue.Source).Int("line", issue.Line).Int("rule_id", issue.RuleID).Str("reason", issue.Reason).Msg("Skipping untranslatable SecLang rule")
+	}
+	if len(result.Rules) == 0 {
+		return nil, fmt.Errorf("SecLang rule files yielded no rules (%d skipped)", len(result.Issues))
+	}
+	rules := make(map[string]streaming.WAFRuleData, len(result.Rules))
+	for i, rule := range result.Rules {
+		key := fmt.Sprintf("seclang:%d", rule.ID)
+		if _, exists := rules[key]; exists {
+			log.Warn().Str("source", rule.Source).Int("line", rule.Line).Int("rule_id", rule.ID).Msg("Duplicate SecLang rule id replaces an earlier rule")
+		}
+		rules[key] = streaming.WAFRuleData{
+			Name:       rule.Name,
+			Expression: rule.Expression,
+			Action:     rule.Action,
+			Priority:   len(result.Rules) - i,
+			Score:      rule.Score,
+			Category:   rule.Category,
+		}
+	}
+	log.Info().Int("rules", len(result.Rules)).Int("issues", len(result.Issues)).Msg("Loaded SecLang WAF rules")
+	return rules, nil
+}
+
+// wafDryRunPath is the admin endpoint that evaluates candidate WAF rules
+// against a request corpus without loading them.
+const wafDryRunPath = "/__netgoat/waf/dry-run"
+
+// maxWAFDryRunBodyBytes bounds a dry-run upload, including its corpus.
+const maxWAFDryRunBodyBytes = 16 << 20
+
+// wafRuleInput is a candidate rule in a dry-run rule file or request. Rules
+// are evaluated in the order given.
+type wafRuleInput struct {
+	Name       string    `json:"name"`
+	Expression string    `json:"expression"`
+	Action     string    `json:"action"`
+	Score      int       `json:"score"`
+	Category   string    `json:"category"`
+	Shadow     bool      `json:"shadow"`
+	Scope      waf.Scope `json:"scope"`
+}
+
+// wafDryRunRequest is the body accepted by wafDryRunPath. Corpus holds JSONL
+// samples in the same format the waf-test command reads from a file.
+type wafDryRunRequest struct {
+	Rules   []wafRuleInput `json:"rules"`
+	SecLang string         `json:"seclang"`
+	Corpus  string         `json:"corpus"`
+	Samples int            `json:"samples"`
+}
+
+func (in wafRuleInput) rule() waf.Rule {
+	return waf.Rule{Name: in.Name, Expression: in.Expression, Action: ifEmpty(in.Action, waf.ActionBlock), Score: in.Score, Category: in.Category, Shadow: in.Shadow, Scope: in.Scope}
+}
+
+func secLangCandidateRules(result *seclang.Result) []waf.Rule {
+	rules := make([]waf.Rule, 0, len(result.Rules))
+	for _, rule := range result.Rules {
+		rules = append(rules, waf.Rule{Name: rule.Name, Expression: rule.Expression, Action: rule.Action, Score: rule.Score, Category: rule.Category})
+	}
+	return rules
+}
+
+// newWAFDryRunEngine compiles candidate rules against the given lists.
+func newWAFDryRunEngine(rules []waf.Rule, listStore *lists.Store) (*waf.Engine, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("no candidate WAF rules")
+	}
+	engine := waf.NewEngine()
+	engine.UseLists(listStore)
+	if err := engine.Load(rules); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+func wafDryRunOptions(cfg *config.Config) waf.Options {
+	return waf.Options{Scoring: cfg.WAFScoringEnabled(), InboundThreshold: cfg.WAF.InboundThreshold}
+}
+
+// wafDryRunHandler serves wafDryRunPath. The active rule set is only read.
+// With authentication enabled it requires a signed-in local user; otherwise
+// it only answers loopback peers.
+func wafDryRunHandler(cfg *config.Config, db *sql.DB, active *waf.Engine, listStore *lists.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !adminRequestAllowed(cfg, db, r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var payload wafDryRunRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWAFDryRunBodyBytes))
+		if err := decoder.Decode(&payload); err != nil {
+			http.Error(w, "Invalid dry-run request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rules := make([]waf.Rule, 0, len(payload.Rules))
+		for _, input := range payload.Rules {
+			rules = append(rules, input.rule())
+		}
+		var issues []string
+		if strings.TrimSpace(payload.SecLang) != "" {
+			result, err := seclang.Parse(strings.NewReader(payload.SecLang), "request")
+			if err != nil {
+				http.Error(w, "Invalid SecLang rules: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			rules = append(rules, secLangCandidateRules(result)...)
+			for _, issue := range result.Issues {
+				issues = append(issues, issue.String())
+			}
+		}
+		candidate, err := newWAFDryRunEngine(rules, listStore)
+		if err != nil {
+			http.Error(w, "Invalid WAF rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		samples, err := waf.ReadSamples(strings.NewReader(payload.Corpus))
+		if err != nil {
+			http.Error(w, "Invalid corpus: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report := waf.DryRun(candidate, active, samples, wafDryRunOptions(cfg), payload.Samples)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			waf.DryRunReport
+			SecLangIssues []string `json:"seclang_issues,omitempty"`
+		}{report, issues})
+	}
+}
+
+// jailBansPath lists (GET), adds (POST) and lifts (DELETE ?ip=) bans.
+const jailBansPath = "/__netgoat/jail/bans"
+
+type jailBanRequest struct {
+	IP              string `json:"ip"`
+	Jail            string `json:"jail"`
+	Reason          string `json:"reason"`
+	DurationSeconds int    `json:"duration_seconds"`
+}
+
+// jailRules converts the configured jails, falling back to the defaults.
+func jailRules(cfg *config.Config) []jail.Rule {
+	if len(cfg.Jails.Rules) == 0 {
+		return jail.DefaultRules()
+	}
+	rules := make([]jail.Rule, 0, len(cfg.Jails.Rules))
+	for _, rule := range cfg.Jails.Rules {
+		rules = append(rules, jail.Rule{
+			Name:    rule.Name,
+			Events:  rule.Events,
+			MaxHits: ifZeroInt(rule.MaxHits, 5),
+			Window:  time.Duration(ifZeroInt(rule.WindowSeconds, 60)) * time.Second,
+			BanTime: time.Duration(ifZeroInt(rule.BanSeconds, 3600)) * time.Second,
+			Tarpit:  rule.Tarpit,
+		})
+	}
+	return rules
+}
+
+// honeypotTraps builds the configured trap catalogue, or the built-in one.
+func honeypotTraps(cfg *config.Config) ([]honeypot.Trap, error) {
+	if len(cfg.Honeypots.Traps) == 0 {
+		return honeypot.DefaultTraps(), nil
+	}
+	traps := make([]honeypot.Trap, 0, len(cfg.Honeypots.Traps))
+	for _, t := range cfg.Honeypots.Traps {
+		response := honeypot.Response{Status: t.Status, ContentType: t.ContentType, Body: t.Body}
+		switch {
+		case t.Response != "":
+			builtin, ok := honeypot.Responses[t.Response]
+			if !ok {
+				return nil, fmt.Errorf("honeypot trap %q: unknown response %q", t.Name, t.Response)
+			}
+			response = honeypot.Response{Status: ifZeroInt(t.Status, builtin.Status), ContentType: builtin.ContentType, Body: builtin.Body}
+		case t.BodyFile != "":
+			body, err := os.ReadFile(t.BodyFile)
+			if err != nil {
+				return nil, fmt.Errorf("honeypot trap %q: %w", t.Name, err)
+			}
+			response.Body = string(body)
+		}
+		traps = append(traps, honeypot.Trap{
+			Name:     t.Name,
+			Paths:    t.Paths,
+			Response: response,
+			BanFor:   time.Duration(t.BanSeconds) * time.Second,
+			Tarpit:   t.Tarpit,
+		})
+	}
+	return traps, nil
+}
+
+// recordHoneypotHit logs a trap hit as a structured event and jails the
+// client, at once when the trap bans.
+func recordHoneypotHit(jails *jail.Manager, event honeypot.Event) {
+	log.Warn().
+		Str("event", "honeypot").
+		Str("trap", event.Trap).
+		Str("ip", event.ClientIP).
+		Str("method", event.Method).
+		Str("host", event.Host).
+		Str("path", event.Path).
+		Str("query", event.Query).
+		Interface("headers", event.Headers).
+		Str("body_sample", event.BodySample).
+		Interface("canaries", event.Canaries).
+		Bool("tarpit", event.Tarpit).
+		Msg("Honeypot triggered")
+	if event.BanFor <= 0 || jails == nil || jails.Ignores(event.ClientIP) {
+		recordJailEvent(jails, event.ClientIP, jail.EventHoneypot)
+		return
+	}
+	ban, err := jails.Ban(event.ClientIP, "honeypot", "honeypot trap "+event.Trap, event.BanFor)
+	if err != nil {
+		log.Error().Err(err).Str("ip", event.ClientIP).Msg("Failed to ban honeypot client")
+		return
+	}
+	log.Warn().Str("ip", ban.IP).Str("jail", ban.Jail).Str("reason", ban.Reason).Time("expires_at", ban.ExpiresAt).Msg("Client banned")
+}
+
+// recordCanaryUse raises a high-severity event for a request presenting a
+// canary the honeypot served, linking it to the scrape the canary came from.
+func recordCanaryUse(metricsRecorder *metrics.Recorder, r *http.Request, ip string, sighting honeypot.Sighting) {
+	scrape := sighting.Scrape
+	if metricsRecorder != nil {
+		metricsRecorder.RecordCanaryUse(scrape.Trap)
+	}
+	log.Error().
+		Str("event", "canary_used").
+		Str("severity", "high").
+		Str("canary", scrape.Label).
+		Str("found_in", sighting.Where).
+		Str("ip", ip).
+		Str("user_agent", r.UserAgent()).
+		Str("host", r.Host).
+		Str("path", r.URL.Path).
+		Str("scraped_by", scrape.ClientIP).
+		Str("scraped_user_agent", scrape.UserAgent).
+		Str("scraped_trap", scrape.Trap).
+		Str("scraped_path", scrape.Host+scrape.Path).
+		Time("first_scraped_at", scrape.FirstSeen).
+		Time("last_scraped_at", scrape.LastSeen).
+		Bool("same_client", scrape.ClientIP == ip).
+		Msg("Leaked honeypot canary used")
+}
+
+func pruneCanaries(canaries *honeypot.Ledger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := canaries.Prune(); err != nil {
+			log.Warn().Err(err).Msg("Failed to prune expired honeypot canaries")
+		}
+	}
+}
+
+// recordJailEvent reports an event to the jails and logs a resulting ban.
+func recordJailEvent(jails *jail.Manager, ip, event string) {
+	if ban, banned := jails.Record(ip, event); banned {
+		log.Warn().Str("ip", ban.IP).Str("jail", ban.Jail).Str("reason", ban.Reason).Time("expires_at", ban.ExpiresAt).Msg("Client banned")
+	}
+}
+
+// holdTarpit sends a response through the tarpit, or at full speed when the
+// tarpit is full. Call release once the response is written.
+func holdTarpit(tarpit *traffic.Tarpit, w http.ResponseWriter, r *http.Request, ip string) (http.ResponseWriter, func()) {
+	held, release, ok := tarpit.Hold(w, r, ip)
+	if !ok {
+		log.Debug().Str("ip", ip).Msg("Tarpit full; answering at full speed")
+	}
+	return held, release
+}
+
+// writeBanned answers a banned client without rendering a challenge: solving
+// one would not lift the ban.
+func writeBanned(w http.ResponseWriter, ban jail.Ban) {
+	retryAfter := int(time.Until(ban.ExpiresAt).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+func pruneJailBans(jails *jail.Manager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := jails.Prune(); err != nil {
+			log.Warn().Err(err).Msg("Failed to prune expired bans")
+		}
+	}
+}
+
+// jailBansHandler serves jailBansPath behind the same gate as the other
+// administration endpoints.
+func jailBansHandler(cfg *config.Config, db *sql.DB, jails *jail.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminRequestAllowed(cfg, db, r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Bans []jail.Ban `json:"bans"`
+			}{jails.Bans()})
+		case http.MethodPost:
+			var payload jailBanRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&payload); err != nil {
+				http.Error(w, "Invalid ban request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			duration := time.Duration(ifZeroInt(payload.DurationSeconds, 3600)) * time.Second
+			ban, err := jails.Ban(payload.IP, payload.Jail, payload.Reason, duration)
+			if err != nil && ban.IP == "" {
+				http.Error(w, "Invalid ban request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Error().Err(err).Str("ip", ban.IP).Msg("Manual ban is enforced but was not persisted")
+			}
+			log.Info().Str("ip", ban.IP).Str("jail", ban.Jail).Time("expires_at", ban.ExpiresAt).Msg("Client banned manually")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(ban)
+		case http.MethodDelete:
+			ip := r.URL.Query().Get("ip")
+			lifted, err := jails.Unban(ip)
+			if errors.Is(err, jail.ErrInvalidIP) {
+				http.Error(w, "Invalid IP address", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Error().Err(err).Str("ip", ip).Msg("Ban lifted in memory but not in the database")
+			}
+			if !lifted {
+				http.Error(w, "No active ban", http.StatusNotFound)
+				return
+			}
+			log.Info().Str("ip", ip).Msg("Ban lifted")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// adminRequestAllowed gates agent administration endpoints.
+func adminRequestAllowed(cfg *config.Config, db *sql.DB, r *http.Request) bool {
+	if cfg.Auth.Enabled {
+		return auth.Check(r, db).Authenticated
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// runWAFTestCommand implements "agent waf-test": it evaluates candidate rule
+// files against a JSONL corpus and compares the result with the rules in the
+// agent's database. It returns the process exit code.
+func runWAFTestCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("waf-test", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var rulePaths multiFlag
+	flags.Var(&rulePaths, "rules", "candidate rule file: a JSON array of rules, or SecLang (repeatable)")
+	corpusPath := flags.String("corpus", "", "JSONL request corpus (\"-\" reads stdin)")
+	configPath := flags.String("config", "config.yml", "agent configuration for WAF mode, lists and database path")
+	dbPath := flags.String("db", "", "database holding the active rules (default from config)")
+	sampleLimit := flags.Int("samples", waf.DefaultSampleLimit, "matching requests listed per rule")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: agent waf-test -rules FILE [-rules FILE...] -corpus FILE [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(rulePaths) == 0 || *corpusPath == "" {
+		flags.Usage()
+		return 2
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		cfg = &config.Config{}
+	}
+	rules, err := loadCandidateWAFRules(rulePaths, stderr)
+	if err != nil {
+		fmt.Fprintln(stderr, "waf-test:", err)
+		return 1
+	}
+	// Lists come from the configuration and are replaced by the stored lists
+	// when the database has them.
+	listStore := lists.NewStore()
+	listStore.Load(lists.FromStrings(cfg.WAF.Lists))
+	candidate, err := newWAFDryRunEngine(rules, listStore)
+	if err != nil {
+		fmt.Fprintln(stderr, "waf-test:", err)
+		return 1
+	}
+	samples, err := readWAFCorpus(*corpusPath)
+	if err != nil {
+		fmt.Fprintln(stderr, "waf-test:", err)
+		return 1
+	}
+
+	var active *waf.Engine
+	activePath := ifEmpty(*dbPath, cfg.DatabasePath())
+	if db, err := database.OpenReadOnly(activePath); err != nil {
+		fmt.Fprintf(stderr, "waf-test: no active rules to compare against: %v\n", err)
+	} else {
+		if err := listStore.Reload(db); err != nil {
+			fmt.Fprintln(stderr, "waf-test: using configured lists:", err)
+		}
+		active = waf.NewEngine()
+		active.UseLists(listStore)
+		err = active.Reload(db)
+		db.Close()
+		if err != nil {
+			fmt.Fprintln(stderr, "waf-test: load active rules:", err)
+			return 1
+		}
+	}
+
+	report := waf.DryRun(candidate, active, samples, wafDryRunOptions(cfg), *sampleLimit)
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		printWAFDryRunReport(stdout, report, active != nil)
+	}
+	return 0
+}
+
+// multiFlag collects a repeatable string flag.
+type multiFlag []string
+
+func (f *multiFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *multiFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func loadCandidateWAFRules(paths []string, stderr io.Writer) ([]waf.Rule, error) {
+	var rules []waf.Rule
+	for _, path := range paths {
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			var inputs []wafRuleInput
+			if err := json.Unmarshal(data, &inputs); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", path, err)
+			}
+			for _, input := range inputs {
+				rules = append(rules, input.rule())
+			}
+			continue
+		}
+		result, err := seclang.LoadFiles([]string{path})
+		if err != nil {
+			return nil, err
+		}
+		for _, issue := range result.Issues {
+			fmt.Fprintln(stderr, "waf-test: skipped:", issue)
+		}
+		rules = append(rules, secLangCandidateRules(result)...)
+	}
+	return rules, nil
+}
+
+func readWAFCorpus(path string) ([]waf.Sample, error) {
+	if path == "-" {
+		return waf.ReadSamples(os.Stdin)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return waf.ReadSamples(file)
+}
+
+func printWAFDryRunReport(w io.Writer, report waf.DryRunReport, compared bool) {
+	fmt.Fprintf(w, "%d requests, %d blocked by candidate rules", report.Requests, report.Blocked)
+	if compared {
+		fmt.Fprintf(w, ", %d by active rules (%d newly blocked, %d newly allowed)", report.ActiveBlocked, report.NewlyBlocked, report.NewlyAllowed)
+	}
+	fmt.Fprintln(w)
+	for _, sample := range report.Errors {
+		fmt.Fprintln(w, "  error:", sample)
+	}
+	fmt.Fprintln(w, "\nRule matches:")
+	for _, rule := range report.Rules {
+		fmt.Fprintf(w, "  %6d  %-6s %s", rule.Matches, rule.Action, rule.Name)
+		if len(rule.Samples) > 0 {
+			fmt.Fprintf(w, "  [%s]", strings.Join(rule.Samples, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+	if len(report.Changes) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nChanged decisions:")
+	for _, change := range report.Changes {
+		fmt.Fprintf(w, "  %s: %s -> %s\n", change.RequestID, describeVerdict(change.Active), describeVerdict(change.Candidate))
+	}
+}
+
+func describeVerdict(v waf.Verdict) string {
+	if !v.Blocked {
+		return "allowed"
+	}
+	return "blocked by " + strconv.Quote(v.Rule)
+}
+
 func snapshotHasContent(snapshot *streaming.ConfigSnapshot) bool {
 	if snapshot == nil {
 		return false
 	}
-	return snapshot.Version > 0 || snapshot.RoutesConfigured || snapshot.WAFRulesConfigured || len(snapshot.Routes) > 0 || len(snapshot.WAFRules) > 0 ||
+	return snapshot.Version > 0 || snapshot.RoutesConfigured || snapshot.WAFRulesConfigured || snapshot.ListsConfigured || len(snapshot.Routes) > 0 || len(snapshot.WAFRules) > 0 || len(snapshot.Lists) > 0 ||
+		snapshot.RateLimitPoliciesConfigured || len(snapshot.RateLimitPolicies) > 0 ||
 		len(snapshot.Users) > 0 || len(snapshot.UserDomains) > 0 || !snapshot.AgentConfig.IsZero()
 }
 
 func mergeConfigSnapshots(local, remote *streaming.ConfigSnapshot) *streaming.ConfigSnapshot {
 	merged := &streaming.ConfigSnapshot{
-		Routes:      make(map[string]streaming.RouteData),
-		WAFRules:    make(map[string]streaming.WAFRuleData),
-		Users:       []streaming.UserData{},
-		UserDomains: []streaming.UserDomainData{},
+		Routes:            make(map[string]streaming.RouteData),
+		WAFRules:          make(map[string]streaming.WAFRuleData),
+		Lists:             make(map[string]streaming.ListData),
+		RateLimitPolicies: make(map[string]streaming.RateLimitPolicyData),
+		Users:             []streaming.UserData{},
+		UserDomains:       []streaming.UserDomainData{},
 	}
 	if local != nil {
 		merged.RoutesConfigured = local.RoutesConfigured || len(local.Routes) > 0
 		for key, route := range local.Routes {
 			merged.Routes[key] = route
 		}
+		merged.WAFRulesConfigured = local.WAFRulesConfigured || len(local.WAFRules) > 0
+		for key, rule := range local.WAFRules {
+			merged.WAFRules[key] = rule
+		}
+		merged.ListsConfigured = local.ListsConfigured || len(local.Lists) > 0
+		for name, list := range local.Lists {
+			merged.Lists[name] = list
+		}
+		merged.RateLimitPoliciesConfigured = local.RateLimitPoliciesConfigured || len(local.RateLimitPolicies) > 0
+		for name, policy := range local.RateLimitPolicies {
+			merged.RateLimitPolicies[name] = policy
+		}
 	}
 	if remote == nil {
 		return merged
@@ -1468,10 +2967,18 @@ func mergeConfigSnapshots(local, remote *streaming.ConfigSnapshot) *streaming.Co
 	for key, route := range remote.Routes {
 		merged.Routes[key] = route
 	}
-	merged.WAFRulesConfigured = remote.WAFRulesConfigured || len(remote.WAFRules) > 0
+	merged.WAFRulesConfigured = merged.WAFRulesConfigured || remote.WAFRulesConfigured || len(remote.WAFRules) > 0
 	for key, rule := range remote.WAFRules {
 		merged.WAFRules[key] = rule
 	}
+	merged.ListsConfigured = merged.ListsConfigured || remote.ListsConfigured || len(remote.Lists) > 0
+	for name, list := range remote.Lists {
+		merged.Lists[name] = list
+	}
+	merged.RateLimitPoliciesConfigured = merged.RateLimitPoliciesConfigured || remote.RateLimitPoliciesConfigured || len(remote.RateLimitPolicies) > 0
+	for name, policy := range remote.RateLimitPolicies {
+		merged.RateLimitPolicies[name] = policy
+	}
 	merged.Users = append(merged.Users, remote.Users...)
 	merged.UserDomains = append(merged.UserDomains, remote.UserDomains...)
 	merged.ZeroTrustEnabled = remote.ZeroTrustEnabled
@@ -1653,10 +3160,54 @@ func applyAgentConfigToConfig(cfg *config.Config, agentConfig streaming.AgentCon
 	cfg.Koda2.ScalerPath = agentConfig.Koda2.ScalerPath
 	cfg.Koda2.PythonScript = agentConfig.Koda2.PythonScript
 	cfg.Koda2.FeatureHeader = agentConfig.Koda2.FeatureHeader
+
+	if len(agentConfig.Challenge.Keys) > 0 {
+		cfg.Challenge.Stateless = agentConfig.Challenge.Stateless
+		cfg.Challenge.Keys = make([]config.ChallengeKey, len(agentConfig.Challenge.Keys))
+		for i, key := range agentConfig.Challenge.Keys {
+			cfg.Challenge.Keys[i] = config.ChallengeKey{ID: key.ID, Secret: key.Secret}
+		}
+	}
+}
+
+// challengeKeyring builds the challenge signing keys; no keys yields nil,
+// which selects a random per-process key.
+func challengeKeyring(keys []config.ChallengeKey) (*challenge.Keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	ring := make([]challenge.Key, len(keys))
+	for i, key := range keys {
+		ring[i] = challenge.Key{ID: key.ID, Secret: []byte(key.Secret)}
+	}
+	return challenge.NewKeyring(ring...)
+}
+
+// rotateChallengeKeys installs challenge keys pushed by the control plane.
+// Snapshots without keys keep the current ones; stateless mode is fixed at
+// startup because switching it would strand outstanding challenges.
+func rotateChallengeKeys(store *challenge.Store, update streaming.AgentChallengeConfig) {
+	if store == nil || len(update.Keys) == 0 {
+		return
+	}
+	keys := make([]config.ChallengeKey, len(update.Keys))
+	for i, key := range update.Keys {
+		keys[i] = config.ChallengeKey{ID: key.ID, Secret: key.Secret}
+	}
+	ring, err := challengeKeyring(keys)
+	if err != nil {
+		log.Error().Err(err).Msg("Rejected challenge keys from control plane; keeping current keys")
+		return
+	}
+	previous := store.Clearance().Keys().IDs()
+	store.SetKeyring(ring)
+	if !slices.Equal(ring.IDs(), previous) {
+		log.Info().Strs("keys", ring.IDs()).Msg("Challenge keys rotated")
+	}
 }
 
 // applyConfigUpdates subscribes to config changes and applies them to the database.
-func applyConfigUpdates(db *sql.DB, mgr *streaming.Manager, healthWorker *health.Worker, healthChecksEnabled bool, local *streaming.ConfigSnapshot, wafEngine *waf.Engine, routeResolver *database.RouteResolver) {
+func applyConfigUpdates(db *sql.DB, mgr *streaming.Manager, healthWorker *health.Worker, healthChecksEnabled bool, local *streaming.ConfigSnapshot, wafEngine *waf.Engine, routeResolver *database.RouteResolver, listStore *lists.Store, rateLimitPolicies *ratelimit.Store, challengeStore *challenge.Store) {
 	ch := mgr.Subscribe()
 	log.Info().Msg("Config update subscriber started")
 
@@ -1673,9 +3224,16 @@ func applyConfigUpdates(db *sql.DB, mgr *streaming.Manager, healthWorker *health
 			log.Error().Err(err).Int64("version", snap.Version).Msg("Failed to reload route snapshot; retaining last known-good routes")
 			continue
 		}
+		if err := listStore.Reload(db); err != nil {
+			log.Error().Err(err).Int64("version", snap.Version).Msg("Failed to reload lists; retaining last known-good lists")
+		}
 		if err := wafEngine.Reload(db); err != nil {
 			log.Error().Err(err).Int64("version", snap.Version).Msg("Failed to reload WAF rules")
 		}
+		if err := rateLimitPolicies.Reload(db); err != nil {
+			log.Error().Err(err).Int64("version", snap.Version).Msg("Failed to reload rate limit policies; retaining last known-good policies")
+		}
+		rotateChallengeKeys(challengeStore, snap.AgentConfig.Challenge)
 		if healthChecksEnabled {
 			syncHealthTargets(db, healthWorker)
 		}
@@ -1769,9 +3327,12 @@ func applySnapshotToDB(db *sql.DB, snap *streaming.ConfigSnapshot) error {
 		}
 		primaryTarget := targets[0].URL
 		if _, err := tx.Exec(
-			`INSERT INTO routes (route_type, domain, path_prefix, target_url, certificate_pem, private_key_pem, active) VALUES (?, ?, ?, ?, ?, ?, 1)
-			 ON CONFLICT(route_type, domain, path_prefix) DO UPDATE SET target_url=excluded.target_url, certificate_pem=excluded.certificate_pem, private_key_pem=excluded.private_key_pem, active=1, updated_at=CURRENT_TIMESTAMP`,
-			routeType, domainVal, pathVal, primaryTarget, route.CertificatePEM, route.PrivateKeyPEM); err != nil {
+			`INSERT INTO routes (route_type, domain, path_prefix, target_url, certificate_pem, private_key_pem, waf_inbound_threshold, allow_lists, deny_lists, allow_countries, deny_countries, challenge_thresholds, active) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+			 ON CONFLICT(route_type, domain, path_prefix) DO UPDATE SET target_url=excluded.target_url, certificate_pem=excluded.certificate_pem, private_key_pem=excluded.private_key_pem, waf_inbound_threshold=excluded.waf_inbound_threshold, allow_lists=excluded.allow_lists, deny_lists=excluded.deny_lists, allow_countries=excluded.allow_countries, deny_countries=excluded.deny_countries, challenge_thresholds=excluded.challenge_thresholds, active=1, updated_at=CURRENT_TIMESTAMP`,
+			routeType, domainVal, pathVal, primaryTarget, route.CertificatePEM, route.PrivateKeyPEM, route.WAFInboundThreshold,
+			strings.Join(route.AllowLists, ","), strings.Join(route.DenyLists, ","),
+			strings.Join(route.AllowCountries, ","), strings.Join(route.DenyCountries, ","),
+			joinInts(route.ChallengeThresholds)); err != nil {
 			return fmt.Errorf("upsert route %q: %w", routeKey, err)
 		}
 
@@ -1809,13 +3370,33 @@ func applySnapshotToDB(db *sql.DB, snap *streaming.ConfigSnapshot) error {
 		if err := waf.ValidateExpression(rule.Expression); err != nil {
 			return fmt.Errorf("validate WAF rule %q: %w", name, err)
 		}
-		if _, err := tx.Exec(`INSERT INTO waf_rules (name, expression, action, priority) VALUES (?, ?, ?, ?)`,
-			name, rule.Expression, ifEmpty(strings.ToUpper(strings.TrimSpace(rule.Action)), "BLOCK"), rule.Priority); err != nil {
+		scope := ""
+		if rule.Scope != nil {
+			if err := waf.Scope(*rule.Scope).Validate(); err != nil {
+				return fmt.Errorf("validate WAF rule %q: %w", name, err)
+			}
+			encoded, err := json.Marshal(rule.Scope)
+			if err != nil {
+				return fmt.Errorf("encode scope of WAF rule %q: %w", name, err)
+			}
+			scope = string(encoded)
+		}
+		if _, err := tx.Exec(`INSERT INTO waf_rules (name, expression, action, priority, score, category, shadow, scope) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			name, rule.Expression, ifEmpty(strings.ToUpper(strings.TrimSpace(rule.Action)), "BLOCK"), rule.Priority, rule.Score, rule.Category, rule.Shadow, scope); err != nil {
 			return fmt.Errorf("insert WAF rule %q: %w", name, err)
 		}
 		rulesApplied++
 	}
 
+	listEntriesApplied, err := applyListsToTx(tx, snap)
+	if err != nil {
+		return err
+	}
+	policiesApplied, err := applyRateLimitPoliciesToTx(tx, snap)
+	if err != nil {
+		return err
+	}
+
 	usersApplied := 0
 	for _, user := range snap.Users {
 		if _, err := tx.Exec(
@@ -1853,12 +3434,99 @@ func applySnapshotToDB(db *sql.DB, snap *streaming.ConfigSnapshot) error {
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("commit snapshot: %w", err)
 	}
-	log.Info().Int("routes_applied", routesApplied).Int("rules_applied", rulesApplied).
-		Int("users_applied", usersApplied).Int("user_domains_applied", userDomainsApplied).
+	log.Info().Int("routes_applied", routesApplied).Int("rules_applied", rulesApplied).Int("list_entries_applied", listEntriesApplied).
+		Int("rate_limit_policies_applied", policiesApplied).Int("users_applied", usersApplied).Int("user_domains_applied", userDomainsApplied).
 		Int64("version", snap.Version).Msg("Snapshot applied atomically")
 	return nil
 }
 
+// applyListsToTx replaces every stored list with the snapshot's lists when
+// the snapshot carries them. Entries that expired before the snapshot was
+// applied are not stored.
+func applyListsToTx(tx *sql.Tx, snap *streaming.ConfigSnapshot) (int, error) {
+	if !snap.ListsConfigured && len(snap.Lists) == 0 {
+		return 0, nil
+	}
+	if _, err := tx.Exec(`DELETE FROM list_entries`); err != nil {
+		return 0, fmt.Errorf("clear list entries: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM lists`); err != nil {
+		return 0, fmt.Errorf("clear lists: %w", err)
+	}
+	insertEntry, err := tx.Prepare(`INSERT INTO list_entries (list_name, value, expires_at, comment) VALUES (?, ?, ?, ?)
+		ON CONFLICT(list_name, value) DO UPDATE SET expires_at=excluded.expires_at, comment=excluded.comment`)
+	if err != nil {
+		return 0, fmt.Errorf("prepare list entry insert: %w", err)
+	}
+	defer insertEntry.Close()
+
+	now := time.Now()
+	applied := 0
+	for name, list := range snap.Lists {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return 0, errors.New("list name cannot be empty")
+		}
+		if _, err := tx.Exec(`INSERT INTO lists (name, description) VALUES (?, ?)`, name, list.Description); err != nil {
+			return 0, fmt.Errorf("insert list %q: %w", name, err)
+		}
+		for _, entry := range list.Entries {
+			value := strings.TrimSpace(entry.Value)
+			if value == "" {
+				continue
+			}
+			var expiresAt any
+			if entry.ExpiresAt != nil {
+				if !entry.ExpiresAt.After(now) {
+					continue
+				}
+				expiresAt = entry.ExpiresAt.Unix()
+			}
+			if _, err := insertEntry.Exec(name, value, expiresAt, entry.Comment); err != nil {
+				return 0, fmt.Errorf("insert entry %q into list %q: %w", value, name, err)
+			}
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// applyRateLimitPoliciesToTx replaces every stored rate limit policy with
+// the snapshot's policies when the snapshot carries them.
+func applyRateLimitPoliciesToTx(tx *sql.Tx, snap *streaming.ConfigSnapshot) (int, error) {
+	if !snap.RateLimitPoliciesConfigured && len(snap.RateLimitPolicies) == 0 {
+		return 0, nil
+	}
+	if _, err := tx.Exec(`DELETE FROM rate_limit_policies`); err != nil {
+		return 0, fmt.Errorf("clear rate limit policies: %w", err)
+	}
+	applied := 0
+	for name, data := range snap.RateLimitPolicies {
+		policy := rateLimitPolicy(strings.TrimSpace(name), data)
+		if err := policy.Validate(); err != nil {
+			return 0, err
+		}
+		limits, err := json.Marshal(policy.Limits)
+		if err != nil {
+			return 0, fmt.Errorf("encode limits of rate limit policy %q: %w", policy.Name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO rate_limit_policies (name, routes, path_prefixes, methods, limits) VALUES (?, ?, ?, ?, ?)`,
+			policy.Name, strings.Join(policy.Routes, ","), strings.Join(policy.PathPrefixes, ","), strings.Join(policy.Methods, ","), string(limits)); err != nil {
+			return 0, fmt.Errorf("insert rate limit policy %q: %w", policy.Name, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+func rateLimitPolicy(name string, data streaming.RateLimitPolicyData) ratelimit.Policy {
+	policy := ratelimit.Policy{Name: name, Routes: data.Routes, PathPrefixes: data.PathPrefixes, Methods: data.Methods}
+	for _, limit := range data.Limits {
+		policy.Limits = append(policy.Limits, ratelimit.Limit(limit))
+	}
+	return policy
+}
+
 func normalizedRouteTargets(targets []streaming.RouteTarget) ([]database.RouteTarget, error) {
 	seen := make(map[string]struct{}, len(targets))
 	normalized := make([]database.RouteTarget, 0, len(targets))
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -12,12 +14,17 @@ import (
 	"time"
 
 	"netgoat.xyz/agent/internal/auth"
+	"netgoat.xyz/agent/internal/balancer"
 	"netgoat.xyz/agent/internal/cache"
 
 	"netgoat.xyz/agent/internal/challenge"
 	"netgoat.xyz/agent/internal/config"
 	"netgoat.xyz/agent/internal/database"
+	"netgoat.xyz/agent/internal/debugoverlay"
+	"netgoat.xyz/agent/internal/health"
+	"netgoat.xyz/agent/internal/normalize"
 	"netgoat.xyz/agent/internal/streaming"
+	"netgoat.xyz/agent/internal/traffic"
 )
 
 func TestProxyErrorHandlerReturnsBadGatewayOnConnectRefused(t *testing.T) {
@@ -54,6 +61,36 @@ func TestProxyErrorHandlerReturnsBadGatewayOnConnectRefused(t *testing.T) {
 	}
 }
 
+func TestProxyForwardsPathAsEscapedByClient(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Path", r.URL.EscapedPath())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+	proxy := balancer.NewProxyHandler(balancer.New(health.NewWorker(time.Minute, time.Second, "/")), newStableProxyTransport())
+
+	for _, tc := range []struct{ path, canonical string }{
+		{"/a%2Fb", "/a/b"},
+		{"/files/100%2525off", "/files/100%off"},
+		{"/docs/50%25", "/docs/50%"},
+	} {
+		req, result, err := normalize.Request(httptest.NewRequest(http.MethodGet, "http://app.example.com"+tc.path, nil))
+		if err != nil {
+			t.Fatalf("normalize %s: %v", tc.path, err)
+		}
+		if result.Path != tc.canonical || normalize.CanonicalPath(req) != tc.canonical {
+			t.Fatalf("%s: canonical path %q, want %q", tc.path, result.Path, tc.canonical)
+		}
+		rr := httptest.NewRecorder()
+		if err := proxy.Serve(rr, req, "domain:app.example.com", []string{up.URL}, nil); err != nil {
+			t.Fatalf("proxy %s: %v", tc.path, err)
+		}
+		if got := rr.Header().Get("X-Seen-Path"); got != tc.path {
+			t.Fatalf("upstream saw %q, want %q", got, tc.path)
+		}
+	}
+}
+
 func TestDirectorSetsForwardedHeaders(t *testing.T) {
 	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Seen-XFF", r.Header.Get("X-Forwarded-For"))
@@ -306,3 +343,122 @@ func TestEmptyRecoverySnapshotHasNoContent(t *testing.T) {
 		t.Fatal("zero-value snapshot should not override local state")
 	}
 }
+
+func TestAdaptiveOutcomeClassifiesProxiedRequests(t *testing.T) {
+	ctx := context.Background()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	for _, tc := range []struct {
+		ctx    context.Context
+		status int
+		err    error
+		want   traffic.Outcome
+	}{
+		{ctx, http.StatusOK, nil, traffic.OutcomeSuccess},
+		{ctx, http.StatusNotFound, nil, traffic.OutcomeSuccess},
+		{ctx, http.StatusServiceUnavailable, nil, traffic.OutcomeDropped},
+		{ctx, http.StatusTooManyRequests, nil, traffic.OutcomeDropped},
+		{ctx, 0, errors.New("connection refused"), traffic.OutcomeDropped},
+		{canceled, 0, context.Canceled, traffic.OutcomeIgnored},
+	} {
+		if got := adaptiveOutcome(tc.ctx, tc.status, tc.err); got != tc.want {
+			t.Errorf("adaptiveOutcome(%d, %v) = %d, want %d", tc.status, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRequestQueueClassPicksFirstMatchingClass(t *testing.T) {
+	classes := []config.RequestQueueClass{
+		{Name: "checkout", PathPrefixes: []string{"/checkout", "/login"}},
+		{Name: "members", Authenticated: true},
+		{Name: "normal"},
+		{Name: "bots", WAFCategories: []string{"Scanner"}},
+		{Name: "search", Routes: []string{"path:/search"}, Headers: map[string]string{"X-Requested-With": ""}},
+	}
+	for _, tc := range []struct {
+		path, route, user string
+		categories        map[string]int
+		header            bool
+		want              string
+	}{
+		{path: "/login", want: "checkout"},
+		{path: "/account", user: "alice", want: "members"},
+		{path: "/", want: "normal"},
+		{path: "/", categories: map[string]int{"scanner": 5}, want: "bots"},
+		{path: "/search", route: "path:/search", header: true, want: "search"},
+		{path: "/search", route: "path:/search", want: "normal"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.header {
+			r.Header.Set("X-Requested-With", "XMLHttpRequest")
+		}
+		if got := requestQueueClass(classes, r, tc.route, tc.user, tc.categories); got != tc.want {
+			t.Errorf("%s as %q: class %q, want %q", tc.path, tc.user, got, tc.want)
+		}
+	}
+	if got := requestQueueClass(classes[:1], httptest.NewRequest(http.MethodGet, "/", nil), "", "", nil); got != "" {
+		t.Fatalf("unmatched request without a fallback class: %q", got)
+	}
+}
+
+func TestRejectQueuedRequestTellsFullFromShed(t *testing.T) {
+	pages := &errorPageStore{}
+	store := challenge.NewStore()
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{traffic.ErrQueueFull, http.StatusTooManyRequests},
+		{traffic.ErrQueueShed, http.StatusServiceUnavailable},
+		{traffic.ErrQueueWait, http.StatusServiceUnavailable},
+	} {
+		info := &debugoverlay.AnalysisInfo{RequestAllowed: true}
+		rr := httptest.NewRecorder()
+		rejectQueuedRequest(rr, pages, store, httptest.NewRequest(http.MethodGet, "/", nil), nil, info, tc.err, "bulk", "192.0.2.1")
+		if rr.Code != tc.want || info.RequestAllowed {
+			t.Fatalf("%v: status %d, allowed %v; want %d and refused", tc.err, rr.Code, info.RequestAllowed, tc.want)
+		}
+	}
+}
+
+func TestWriteErrorSkipsChallengeWithClearanceCookie(t *testing.T) {
+	pages := &errorPageStore{}
+	store := challenge.NewStore()
+	store.SetProofOfWork(true)
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "203.0.113.10:12345"
+		req.Header.Set("User-Agent", "python-requests/2.31")
+		return req
+	}
+	rr := httptest.NewRecorder()
+	writeError(rr, pages, store, newRequest(), http.StatusForbidden, "Forbidden")
+	if !strings.Contains(rr.Body.String(), "Checking your browser") {
+		t.Fatal("suspicious client should get the proof-of-work challenge")
+	}
+
+	issued := httptest.NewRecorder()
+	setClearanceCookie(issued, newRequest(), store.Clearance(), "203.0.113.10")
+	cookies := issued.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].Name != challenge.ClearanceCookie {
+		t.Fatalf("cookies = %+v", cookies)
+	}
+
+	cleared := newRequest()
+	cleared.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	writeError(rr, pages, store, cleared, http.StatusForbidden, "Forbidden")
+	if rr.Code != http.StatusForbidden || strings.Contains(rr.Body.String(), "Checking your browser") {
+		t.Fatalf("cleared client got status %d with a challenge", rr.Code)
+	}
+
+	moved := newRequest()
+	moved.RemoteAddr = "198.51.100.1:999"
+	moved.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	writeError(rr, pages, store, moved, http.StatusForbidden, "Forbidden")
+	if !strings.Contains(rr.Body.String(), "Checking your browser") {
+		t.Fatal("clearance must not follow the cookie to another address")
+	}
+}
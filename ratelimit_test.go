@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"netgoat.xyz/agent/internal/config"
+	"netgoat.xyz/agent/internal/database"
+	"netgoat.xyz/agent/internal/ratelimit"
+	"netgoat.xyz/agent/internal/streaming"
+)
+
+func TestRateLimitPoliciesRoundTripThroughDatabase(t *testing.T) {
+	db, err := database.Init(":memory:")
+	if err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	defer db.Close()
+
+	cfg := &config.Config{}
+	cfg.RateLimit.Policies = map[string]config.RateLimitPolicy{
+		"login": {PathPrefixes: []string{"/login"}, Methods: []string{"POST"}, Limits: []config.RateLimitLimit{
+			{Requests: 1, PeriodSeconds: 60},
+		}},
+		"static": {PathPrefixes: []string{"/assets/"}, Limits: []config.RateLimitLimit{
+			{Requests: 1000, PeriodSeconds: 1},
+		}},
+	}
+	var payload domainsResponse
+	if err := json.Unmarshal([]byte(`{"rate_limit_policies":{"static":{"path_prefixes":["/assets/"],"limits":[
+		{"requests":2,"period_seconds":1},
+		{"requests":100,"period_seconds":3600,"key":["api_key"]}
+	]}}}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+	remote := snapshotFromDomainsResponse(payload)
+	if err := applySnapshotToDB(db, mergeConfigSnapshots(localConfigSnapshot(cfg), &remote)); err != nil {
+		t.Fatalf("applySnapshotToDB: %v", err)
+	}
+	store := ratelimit.NewStore()
+	if err := store.Reload(db); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if store.Set().Len() != 2 {
+		t.Fatalf("loaded %d policies", store.Set().Len())
+	}
+
+	id := ratelimit.Identity{ClientIP: "192.0.2.1"}
+	login := httptest.NewRequest(http.MethodPost, "/login", nil)
+	if !store.Allow(login, id).Allowed || store.Allow(login, id).Allowed {
+		t.Fatal("login should allow one attempt a minute")
+	}
+	asset := httptest.NewRequest(http.MethodGet, "/assets/app.js", nil)
+	store.Allow(asset, id)
+	store.Allow(asset, id)
+	if d := store.Allow(asset, id); d.Allowed || d.Policy != "static" {
+		t.Fatalf("streamed static policy should replace the local one: %+v", d)
+	}
+
+	invalid := &streaming.ConfigSnapshot{RateLimitPolicies: map[string]streaming.RateLimitPolicyData{
+		"broken": {Limits: []streaming.RateLimitData{{Requests: 1, Key: []string{"ip"}}}},
+	}}
+	if err := applySnapshotToDB(db, invalid); err == nil {
+		t.Fatal("a policy without a period should be rejected")
+	}
+	if err := applySnapshotToDB(db, &streaming.ConfigSnapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(db); err != nil || store.Set().Len() != 2 {
+		t.Fatalf("policies should survive a snapshot without them: %v", err)
+	}
+	if err := applySnapshotToDB(db, &streaming.ConfigSnapshot{RateLimitPoliciesConfigured: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(db); err != nil || store.Set().Len() != 0 {
+		t.Fatalf("policies should be removed by an empty configured set: %v", err)
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"netgoat.xyz/agent/internal/config"
 	"netgoat.xyz/agent/internal/database"
 	"netgoat.xyz/agent/internal/streaming"
 )
@@ -116,3 +119,71 @@ func TestMergeConfigSnapshotsKeepsLocalFallbacks(t *testing.T) {
 		t.Fatalf("remote route did not override local fallback: %q", got)
 	}
 }
+
+func TestLocalSecLangRulesMergeWithRemoteRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crs.conf")
+	rules := `SecRule ARGS "@rx (?i)union\s+select" "id:942100,phase:2,block,t:urlDecode,tag:'attack-sqli',severity:'CRITICAL'"
+SecRule REQUEST_BODY "@detectXSS" "id:941100,phase:2,block"
+`
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	cfg.WAF.SecLangFiles = []string{path}
+
+	local := localConfigSnapshot(cfg)
+	if !local.WAFRulesConfigured || len(local.WAFRules) != 1 {
+		t.Fatalf("local WAF rules = %+v", local.WAFRules)
+	}
+	rule := local.WAFRules["seclang:942100"]
+	if rule.Action != "SCORE" || rule.Score != 5 || rule.Category != "sqli" {
+		t.Fatalf("converted rule = %+v", rule)
+	}
+
+	remote := &streaming.ConfigSnapshot{WAFRulesConfigured: true, WAFRules: map[string]streaming.WAFRuleData{
+		"remote": {Name: "remote", Expression: `Path == "/blocked"`, Action: "BLOCK"},
+	}}
+	merged := mergeConfigSnapshots(local, remote)
+	if len(merged.WAFRules) != 2 || !merged.WAFRulesConfigured {
+		t.Fatalf("merged WAF rules = %+v", merged.WAFRules)
+	}
+	if merged := mergeConfigSnapshots(local, nil); len(merged.WAFRules) != 1 {
+		t.Fatalf("local-only merge WAF rules = %+v", merged.WAFRules)
+	}
+}
+
+func TestUnusableSecLangFilesKeepTheStoredRules(t *testing.T) {
+	dir := t.TempDir()
+	unsupported := filepath.Join(dir, "unsupported.conf")
+	if err := os.WriteFile(unsupported, []byte("SecRule REQUEST_HEADERS \"@geoLookup\" \"id:1,phase:1,block\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, patterns := range [][]string{
+		{filepath.Join(dir, "missing-*.conf")},
+		{unsupported},
+		{filepath.Join(dir, "[")},
+	} {
+		db, err := database.Init(":memory:")
+		if err != nil {
+			t.Fatalf("database.Init: %v", err)
+		}
+		var seeded int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM waf_rules`).Scan(&seeded); err != nil || seeded == 0 {
+			t.Fatalf("seeded rules = %d (%v)", seeded, err)
+		}
+		cfg := &config.Config{}
+		cfg.WAF.SecLangFiles = patterns
+		local := localConfigSnapshot(cfg)
+		if local.WAFRulesConfigured || len(local.WAFRules) != 0 {
+			t.Fatalf("%v: local WAF rules = %+v", patterns, local.WAFRules)
+		}
+		if err := applySnapshotToDB(db, local); err != nil {
+			t.Fatalf("applySnapshotToDB: %v", err)
+		}
+		var kept int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM waf_rules`).Scan(&kept); err != nil || kept != seeded {
+			t.Fatalf("%v: %d of %d stored rules kept (%v)", patterns, kept, seeded, err)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"netgoat.xyz/agent/internal/challenge"
+	"netgoat.xyz/agent/internal/config"
+	"netgoat.xyz/agent/internal/database"
+	"netgoat.xyz/agent/internal/debugoverlay"
+	"netgoat.xyz/agent/internal/lists"
+)
+
+func TestRouteChallengeThresholdsRoundTrip(t *testing.T) {
+	db, err := database.Init(":memory:")
+	if err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	defer db.Close()
+
+	cfg := &config.Config{}
+	cfg.Routes = map[string]config.Route{
+		"login.example.test": {Target: "http://127.0.0.1:9001", ChallengeThresholds: []int{10, 0, 50}},
+		"www.example.test":   {Target: "http://127.0.0.1:9002"},
+	}
+	if err := applySnapshotToDB(db, localConfigSnapshot(cfg)); err != nil {
+		t.Fatalf("applySnapshotToDB: %v", err)
+	}
+	resolver := database.NewRouteResolver()
+	if err := resolver.Reload(db); err != nil {
+		t.Fatal(err)
+	}
+
+	login, _ := resolver.Resolve("login.example.test", "/")
+	if got := challengeThresholds(login.ChallengeThresholds); got != (challenge.Thresholds{Text: 10, Slider: 50}) {
+		t.Fatalf("login thresholds = %+v", got)
+	}
+	www, _ := resolver.Resolve("www.example.test", "/")
+	if got := challengeThresholds(www.ChallengeThresholds); got != (challenge.Thresholds{}) {
+		t.Fatalf("www thresholds = %+v", got)
+	}
+}
+
+func TestScoreSuspicionUsesRequestStateAndRecordsBreakdown(t *testing.T) {
+	listStore := lists.NewStore()
+	listStore.Load(lists.FromStrings(map[string][]string{"tor-exits": {"203.0.113.0/24"}}))
+	pipeline, err := challenge.NewPipeline(nil, reputationLookup(listStore, []string{"tor-exits"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := challenge.NewStore()
+	store.SetPipeline(pipeline)
+
+	analysis := &debugoverlay.AnalysisInfo{Koda2Checked: true, Koda2Score: 0.4}
+	state := &suspicionState{analysis: analysis, rateUsage: 1, thresholds: challenge.Thresholds{Text: 90, Click: 95, Slider: 101}}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0")
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Accept-Language", "de")
+
+	breakdown, challengeType := scoreSuspicion(store, withSuspicionState(req, state))
+	// rate 100 at 0.3, classifiers 40 at 0.5 and reputation 100 at 0.5; the
+	// route never asks for the slider.
+	if breakdown.Total != 30+20+50 || challengeType != challenge.ChallengeClick {
+		t.Fatalf("score = %d (%v), challenge = %s", breakdown.Total, breakdown.Points(), challengeType)
+	}
+	if analysis.Suspicion != breakdown.Total || analysis.SuspicionSignals["reputation"] != 50 || analysis.ChallengeType != "click" {
+		t.Fatalf("analysis = %d %v %s", analysis.Suspicion, analysis.SuspicionSignals, analysis.ChallengeType)
+	}
+
+	// Without request state only the request itself is scored.
+	breakdown, challengeType = scoreSuspicion(store, req)
+	if breakdown.Total != 50 || challengeType != challenge.ChallengeText {
+		t.Fatalf("stateless score = %d (%v), challenge = %s", breakdown.Total, breakdown.Points(), challengeType)
+	}
+}
+
+func TestWriteErrorChallengesByPipelineScore(t *testing.T) {
+	store := challenge.NewStore()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "198.51.100.20:999"
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0")
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	state := &suspicionState{analysis: &debugoverlay.AnalysisInfo{}, rateUsage: 0.9}
+	rr := httptest.NewRecorder()
+	writeError(rr, &errorPageStore{}, store, withSuspicionState(req, state), http.StatusTooManyRequests, "Too Many Requests")
+	// A browser near its rate limit without Accept-Language: 27 + 10 points.
+	if state.analysis.Suspicion != 37 || !strings.Contains(rr.Body.String(), "challenge_id") {
+		t.Fatalf("suspicion = %d; want a text challenge", state.analysis.Suspicion)
+	}
+}
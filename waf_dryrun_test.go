@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"netgoat.xyz/agent/internal/config"
+	"netgoat.xyz/agent/internal/database"
+	"netgoat.xyz/agent/internal/lists"
+	"netgoat.xyz/agent/internal/waf"
+)
+
+const dryRunCorpus = `{"request_id": "home", "url": "/"}
+{"request_id": "admin", "url": "/admin"}
+{"request_id": "api", "url": "/api/items"}
+`
+
+func TestWAFDryRunEndpointReportsWithoutChangingActiveRules(t *testing.T) {
+	active := waf.NewEngine()
+	if err := active.Load([]waf.Rule{{Name: "Block Admin", Expression: `Path startsWith "/admin"`, Action: waf.ActionBlock}}); err != nil {
+		t.Fatal(err)
+	}
+	handler := wafDryRunHandler(&config.Config{}, nil, active, lists.NewStore())
+
+	body, _ := json.Marshal(wafDryRunRequest{
+		Rules:  []wafRuleInput{{Name: "Block API", Expression: `Path startsWith "/api"`}},
+		Corpus: dryRunCorpus,
+	})
+	req := httptest.NewRequest(http.MethodPost, wafDryRunPath, bytes.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:4000"
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var report waf.DryRunReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 3 || report.Rules[0].Matches != 1 || report.NewlyBlocked != 1 || report.NewlyAllowed != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	if blocked, rule := active.Check(httptest.NewRequest("GET", "/admin", nil), false); !blocked || rule != "Block Admin" {
+		t.Fatal("dry run changed the active rules")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, wafDryRunPath, bytes.NewReader(body))
+	req.RemoteAddr = "203.0.113.5:4000"
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("remote status = %d, want 403", rec.Code)
+	}
+
+	body, _ = json.Marshal(wafDryRunRequest{Rules: []wafRuleInput{{Name: "broken", Expression: `Path +`}}, Corpus: dryRunCorpus})
+	req = httptest.NewRequest(http.MethodPost, wafDryRunPath, bytes.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:4000"
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid rule status = %d, want 400", rec.Code)
+	}
+}
+
+func TestWAFTestCommandComparesAgainstDatabaseRules(t *testing.T) {
+	t.Setenv("NETGOAT_BOOTSTRAP_USERNAME", "")
+	t.Setenv("NETGOAT_BOOTSTRAP_PASSWORD", "")
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "proxy.db")
+	db, err := database.Init(dbPath)
+	if err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	db.Close()
+
+	rulesPath := filepath.Join(dir, "rules.conf")
+	corpusPath := filepath.Join(dir, "corpus.jsonl")
+	writeFile(t, rulesPath, `SecRule REQUEST_URI "@beginsWith /api" "id:1001,phase:1,deny,msg:'API'"`+"\n")
+	writeFile(t, corpusPath, dryRunCorpus)
+
+	var stdout, stderr bytes.Buffer
+	code := runWAFTestCommand([]string{"-rules", rulesPath, "-corpus", corpusPath, "-db", dbPath, "-config", filepath.Join(dir, "missing.yml")}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit code = %d, stderr: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	for _, want := range []string{
+		"3 requests, 1 blocked by candidate rules, 1 by active rules (1 newly blocked, 1 newly allowed)",
+		"SecRule 1001: API  [api]",
+		`admin: blocked by "Block Admin" -> allowed`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output missing %q:\n%s", want, out)
+		}
+	}
+
+	if code := runWAFTestCommand([]string{"-corpus", corpusPath}, &stdout, &stderr); code != 2 {
+		t.Fatalf("missing -rules exit code = %d, want 2", code)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"net/http/httptest"
+	"slices"
 	"strings"
 	"testing"
 
+	"netgoat.xyz/agent/internal/database"
+	"netgoat.xyz/agent/internal/streaming"
 	"netgoat.xyz/agent/internal/waf"
 )
 
@@ -12,27 +16,82 @@ func TestSnapshotScopesWAFRulesAndKeepsDuplicateNames(t *testing.T) {
 		{ID: "one", Name: "block admin", Expression: `Path == "/admin"`, Hosts: []string{"API.Example.Test."}, ProxyConfigID: "proxy-one"},
 		{ID: "two", Name: "block admin", Expression: `Path == "/admin"`, Hosts: []string{"www.example.test"}, ProxyConfigID: "proxy-two"},
 		{ID: "stale", Name: "stale", Expression: "true", ProxyConfigID: "missing"},
+		{ID: "blank", Name: "blank hosts", Expression: "true", Hosts: []string{" "}, ProxyConfigID: "proxy-three"},
+		{ID: "unbound", Name: "blank hosts without proxy", Expression: "true", Hosts: []string{" ", "."}},
 	}}
 	snapshot := snapshotFromDomainsResponse(payload)
 	if len(snapshot.WAFRules) != 2 {
 		t.Fatalf("WAF rule count = %d, want 2", len(snapshot.WAFRules))
 	}
 	for _, rule := range snapshot.WAFRules {
-		if !strings.Contains(rule.Expression, "Host ==") || !strings.Contains(rule.Name, "[") {
+		if rule.Expression != `Path == "/admin"` || rule.Scope == nil || len(rule.Scope.Hosts) != 1 || !strings.Contains(rule.Name, "[") {
 			t.Fatalf("rule was not scoped: %+v", rule)
 		}
-		if err := waf.ValidateExpression(rule.Expression); err != nil {
-			t.Fatalf("scoped expression is invalid: %v", err)
+	}
+	if hosts := snapshot.WAFRules["one"].Scope.Hosts; !slices.Equal(hosts, []string{"api.example.test"}) {
+		t.Fatalf("hosts = %#v", hosts)
+	}
+}
+
+func TestNormalizedRuleHostsDeduplicates(t *testing.T) {
+	hosts := normalizedRuleHosts([]string{"api.example.test", "API.EXAMPLE.TEST", `odd\"host`, " "})
+	if !slices.Equal(hosts, []string{"api.example.test", `odd\"host`}) {
+		t.Fatalf("hosts = %#v", hosts)
+	}
+	if normalizedRuleHosts([]string{""}) != nil {
+		t.Fatal("empty host list should be nil")
+	}
+}
+
+func TestScopedRulesRoundTripThroughDatabase(t *testing.T) {
+	db, err := database.Init(":memory:")
+	if err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	defer db.Close()
+	snapshot := &streaming.ConfigSnapshot{WAFRulesConfigured: true, WAFRules: map[string]streaming.WAFRuleData{
+		"tenant": {Name: "Tenant Admin", Expression: `Path startsWith "/admin"`, Action: "BLOCK", Priority: 2, Scope: &streaming.WAFRuleScope{Hosts: []string{"shop.example.test"}}},
+		"api":    {Name: "API Writes", Expression: `Method == "DELETE"`, Action: "BLOCK", Priority: 1, Scope: &streaming.WAFRuleScope{PathPrefixes: []string{"/api/"}}},
+	}}
+	if err := applySnapshotToDB(db, snapshot); err != nil {
+		t.Fatalf("applySnapshotToDB: %v", err)
+	}
+	engine := waf.NewEngine()
+	if err := engine.Reload(db); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	for _, tc := range []struct {
+		method, target, host string
+		blocked              bool
+	}{
+		{"GET", "/admin", "shop.example.test", true},
+		{"GET", "/admin", "other.example.test", false},
+		{"DELETE", "/api/items/1", "other.example.test", true},
+		{"DELETE", "/items/1", "other.example.test", false},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		req.Host = tc.host
+		if blocked, _ := engine.Check(req, false); blocked != tc.blocked {
+			t.Fatalf("%s %s%s blocked = %v, want %v", tc.method, tc.host, tc.target, blocked, tc.blocked)
 		}
 	}
 }
 
-func TestScopedWAFExpressionEscapesAndDeduplicatesHosts(t *testing.T) {
-	expression, hosts := scopedWAFExpression("Method == `GET`", []string{"api.example.test", "API.EXAMPLE.TEST", `odd\"host`})
-	if len(hosts) != 2 || !strings.Contains(expression, `odd\\\"host`) {
-		t.Fatalf("expression/hosts = %q / %#v", expression, hosts)
+func TestBlankRuleScopesAreNotStored(t *testing.T) {
+	db, err := database.Init(":memory:")
+	if err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	defer db.Close()
+	snapshot := &streaming.ConfigSnapshot{WAFRulesConfigured: true, WAFRules: map[string]streaming.WAFRuleData{
+		"blank": {Name: "Blank Routes", Expression: "true", Action: "BLOCK", Scope: &streaming.WAFRuleScope{Routes: []string{" "}}},
+	}}
+	if err := applySnapshotToDB(db, snapshot); err == nil || !strings.Contains(err.Error(), "Blank Routes") {
+		t.Fatalf("applySnapshotToDB = %v, want the blank scope rejected", err)
 	}
-	if err := waf.ValidateExpression(expression); err != nil {
-		t.Fatalf("scoped expression is invalid: %v", err)
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM waf_rules WHERE name = 'Blank Routes'`).Scan(&count); err != nil || count != 0 {
+		t.Fatalf("stored the blank-scoped rule %d times (%v)", count, err)
 	}
 }